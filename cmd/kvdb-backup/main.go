@@ -0,0 +1,156 @@
+// Command kvdb-backup takes backups of a running kvdb-server through its
+// admin endpoint, and restores them into a data directory.
+//
+//	kvdb-backup backup -addr http://localhost:6060 -token T -dir ./backups [-full] [-keep N]
+//	kvdb-backup restore -dir ./backups -data ./data [-encryption-key-file F]
+//	kvdb-backup list -dir ./backups
+//
+// With -config, restore opens the data directory with the badger options of
+// the server's config file.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/maolonglong/kvdb/internal/backup"
+	"github.com/maolonglong/kvdb/internal/config"
+	"github.com/maolonglong/kvdb/internal/kv"
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+)
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		log.Fatal("usage: kvdb-backup backup|restore|list [flags]")
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	dirPath := fs.String("dir", "./backups", "backup directory")
+	var err error
+	switch os.Args[1] {
+	case "backup":
+		addr := fs.String("addr", "http://localhost:6060", "admin address of the server")
+		token := fs.String("token", os.Getenv("KVDB_ADMIN_TOKEN"), "admin token of the server")
+		full := fs.Bool("full", false, "take a full backup")
+		keep := fs.Int("keep", 0, "number of full backups to keep, 0 keeps all of them")
+		_ = fs.Parse(os.Args[2:])
+		err = runBackup(*dirPath, *addr, *token, *full, *keep)
+	case "restore":
+		configFile := fs.String("config", "", "config file of kvdb-server")
+		data := fs.String("data", "",
+			"empty data directory to restore into, ./data or the dir of -config by default")
+		keyFile := fs.String("encryption-key-file", "", "master key to encrypt the data with")
+		_ = fs.Parse(os.Args[2:])
+		err = runRestore(*dirPath, *configFile, *data, *keyFile)
+	case "list":
+		_ = fs.Parse(os.Args[2:])
+		err = runList(*dirPath)
+	default:
+		log.Fatalf("unknown command %q", os.Args[1])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runBackup(dirPath, addr, token string, full bool, keep int) error {
+	dir, err := backup.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	e, err := dir.Backup(func(w io.Writer, since uint64) (uint64, error) {
+		return fetchBackup(w, addr, token, since)
+	}, full)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s version=%d size=%d\n", e.File, e.Version, e.Size)
+	if keep > 0 {
+		return dir.Prune(keep)
+	}
+	return nil
+}
+
+func fetchBackup(w io.Writer, addr, token string, since uint64) (uint64, error) {
+	u := addr + "/admin/backup?" + url.Values{
+		"since": {strconv.FormatUint(since, 10)},
+	}.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("backup: unexpected status %s", resp.Status)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return 0, err
+	}
+	// The trailer is only sent once the backup is complete.
+	version := resp.Trailer.Get("Kvdb-Backup-Version")
+	if version == "" {
+		return 0, errors.New("backup: incomplete backup")
+	}
+	return strconv.ParseUint(version, 10, 64)
+}
+
+func runRestore(dirPath, configFile, dataPath, keyFile string) error {
+	opts := badgerstore.DefaultOptions("./data")
+	if configFile != "" {
+		if err := config.Load(configFile, &config.Config{Badger: opts}); err != nil {
+			return err
+		}
+	}
+	if dataPath != "" {
+		opts.Dir = dataPath
+	}
+	if keyFile != "" {
+		opts.EncryptionKey = nil
+		opts.EncryptionKeyFile = keyFile
+	}
+	if entries, err := os.ReadDir(opts.Dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("restore: %s is not empty", opts.Dir)
+	}
+	dir, err := backup.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	store, err := badgerstore.New(opts)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return dir.Restore(store.(kv.BackupStore).Load)
+}
+
+func runList(dirPath string) error {
+	dir, err := backup.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	m, err := dir.Manifest()
+	if err != nil {
+		return err
+	}
+	for _, e := range m.Backups {
+		kind := "incr"
+		if e.Full {
+			kind = "full"
+		}
+		fmt.Printf("%s %s version=%d since=%d size=%d\n", e.File, kind, e.Version, e.Since, e.Size)
+	}
+	return nil
+}
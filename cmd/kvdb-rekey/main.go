@@ -0,0 +1,53 @@
+// Command kvdb-rekey encrypts a data directory under a new master key, while
+// kvdb-server is stopped. An empty key file means plain text, to enable or
+// disable encryption.
+//
+//	kvdb-rekey -data ./data -old-key-file old.key -new-key-file new.key
+//
+// With -config, the data directory is rewritten with the badger options of
+// the server's config file, whose key file is the old key by default.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/maolonglong/kvdb/internal/config"
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+)
+
+func main() {
+	log.SetFlags(0)
+	configFile := flag.String("config", "", "config file of kvdb-server")
+	data := flag.String("data", "", "data directory, ./data or the dir of -config by default")
+	oldKeyFile := flag.String("old-key-file", "", "current master key, empty for plain text")
+	newKeyFile := flag.String("new-key-file", "", "new master key, empty for plain text")
+	flag.Parse()
+
+	opts := badgerstore.DefaultOptions("./data")
+	if *configFile != "" {
+		if err := config.Load(*configFile, &config.Config{Badger: opts}); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *data != "" {
+		opts.Dir = *data
+	}
+	if *oldKeyFile != "" {
+		opts.EncryptionKey = nil
+		opts.EncryptionKeyFile = *oldKeyFile
+	}
+	if opts.EncryptionKeyFile == "" && *newKeyFile == "" {
+		log.Fatal("rekey: at least one of -old-key-file and -new-key-file is required")
+	}
+	var newKey []byte
+	if *newKeyFile != "" {
+		var err error
+		if newKey, err = badgerstore.ReadEncryptionKey(*newKeyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := badgerstore.Rekey(opts, newKey); err != nil {
+		log.Fatal(err)
+	}
+}
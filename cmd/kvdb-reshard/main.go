@@ -0,0 +1,75 @@
+// Command kvdb-reshard copies a data directory into a new one with another
+// number of shards, while kvdb-server is stopped. The source may be an
+// unsharded directory, and the versions and TTLs of the keys are kept.
+//
+//	kvdb-reshard -from ./data -to ./data.new -shards 8 [-encryption-key-file F]
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+	"github.com/maolonglong/kvdb/internal/kv/shard"
+)
+
+func main() {
+	log.SetFlags(0)
+	from := flag.String("from", "./data", "data directory to reshard")
+	to := flag.String("to", "", "new data directory, must be empty")
+	n := flag.Int("shards", 0, "number of shards of the new directory")
+	keyFile := flag.String(
+		"encryption-key-file",
+		"",
+		"master key of the data, the new directory is encrypted with it too",
+	)
+	flag.Parse()
+
+	if *to == "" || *n < 1 {
+		log.Fatal("reshard: -to and a positive -shards are required")
+	}
+	if err := run(*from, *to, *n, *keyFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(from, to string, n int, keyFile string) error {
+	// Opening a missing directory would create it.
+	if _, err := os.Stat(from); err != nil {
+		return err
+	}
+	if entries, err := os.ReadDir(to); err == nil && len(entries) > 0 {
+		return fmt.Errorf("reshard: %s is not empty", to)
+	}
+	open := func(dir string) (kv.Store, error) {
+		opts := badgerstore.DefaultOptions(dir)
+		opts.EncryptionKeyFile = keyFile
+		return badgerstore.New(opts)
+	}
+
+	src, err := shard.Open(from, 0, open)
+	if errors.Is(err, shard.ErrNotSharded) {
+		var s kv.Store
+		if s, err = open(from); err == nil {
+			src, err = shard.New([]kv.Store{s})
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := shard.Open(to, n, open)
+	if err != nil {
+		return err
+	}
+	if err := shard.Reshard(src, dst); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
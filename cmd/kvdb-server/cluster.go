@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/maolonglong/kvdb/internal/cluster"
+	"github.com/maolonglong/kvdb/internal/core"
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/kv/shard"
+	"github.com/maolonglong/kvdb/internal/raft"
+)
+
+var (
+	clusterID = flag.String(
+		"cluster-id",
+		os.Getenv("KVDB_CLUSTER_ID"),
+		"ID of the member, to run as part of a Raft cluster",
+	)
+	clusterPeerURL = flag.String(
+		"cluster-peer-url",
+		os.Getenv("KVDB_CLUSTER_PEER_URL"),
+		"URL of the admin listener of the member, for the RPCs of its peers",
+	)
+	clusterClientURL = flag.String(
+		"cluster-client-url",
+		os.Getenv("KVDB_CLUSTER_CLIENT_URL"),
+		"URL of the member that clients are redirected to when it leads",
+	)
+	clusterDir       = flag.String("cluster-dir", "./raft", "directory of the Raft log")
+	clusterBootstrap = flag.Bool(
+		"cluster-bootstrap",
+		false,
+		"create a cluster of this single member, the others join it through the admin API",
+	)
+)
+
+// newClusterStore replicates local in the cluster of the member
+// -cluster-id.
+func newClusterStore(local kv.Store) *cluster.Store {
+	if *storeType != "badger" {
+		log.Fatal("main: a cluster member must use the badger store")
+	}
+	if _, ok := local.(*shard.Store); ok {
+		// The writes of an entry are applied with its index in a single
+		// transaction.
+		log.Fatal("main: a cluster member cannot be sharded")
+	}
+	if *adminToken == "" {
+		log.Fatal("main: -admin-token is required with -cluster-id, it authenticates the peers")
+	}
+	if *clusterPeerURL == "" || *clusterClientURL == "" {
+		log.Fatal("main: -cluster-peer-url and -cluster-client-url are required with -cluster-id")
+	}
+	storage, err := raft.OpenFileStorage(*clusterDir)
+	if err != nil {
+		log.Fatalf("main: %v", err)
+	}
+	cs, err := cluster.New(local, &cluster.Options{
+		Member: raft.Member{
+			ID:        *clusterID,
+			PeerURL:   *clusterPeerURL,
+			ClientURL: *clusterClientURL,
+		},
+		Storage:   storage,
+		Transport: cluster.NewHTTPTransport(*adminToken),
+		Bootstrap: *clusterBootstrap,
+		OnLeader:  core.PurgeCaches,
+	})
+	if err != nil {
+		log.Fatalf("main: %v", err)
+	}
+	return cs
+}
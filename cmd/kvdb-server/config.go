@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/maolonglong/kvdb/internal/config"
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+)
+
+var (
+	configFile = flag.String(
+		"config",
+		os.Getenv("KVDB_CONFIG"),
+		"TOML or JSON config file, its [badger] table holds the badger options",
+	)
+
+	badgerOpts = badgerstore.DefaultOptions("./data")
+
+	// Flags of badgerOpts, also registered on the command line. Each can be
+	// set by the KVDB_<NAME> environment variable too, see loadBadgerOptions.
+	badgerFlags = flag.NewFlagSet("badger", flag.ContinueOnError)
+)
+
+func init() {
+	o := badgerOpts
+	badgerFlags.StringVar(&o.Dir, "data-dir", o.Dir, "directory of the badger store")
+	badgerFlags.Var(&o.MemTableSize, "badger-memtable-size", "size of a memtable")
+	badgerFlags.Var(&o.BlockCacheSize, "badger-block-cache-size", "size of the block cache")
+	badgerFlags.Var(&o.IndexCacheSize, "badger-index-cache-size", "size of the index cache")
+	badgerFlags.StringVar(
+		&o.Compression,
+		"badger-compression",
+		o.Compression,
+		"compression of the tables, none, snappy or zstd",
+	)
+	badgerFlags.IntVar(
+		&o.CompressionLevel,
+		"badger-compression-level",
+		o.CompressionLevel,
+		"zstd compression level, from 1 to 22",
+	)
+	badgerFlags.BoolVar(&o.SyncWrites, "badger-sync-writes", o.SyncWrites, "fsync every write")
+	badgerFlags.Var(
+		&o.ValueThreshold,
+		"badger-value-threshold",
+		"values larger than this are stored in the value log",
+	)
+	badgerFlags.Var(&o.GCInterval, "badger-gc-interval", "interval of value log GC")
+	badgerFlags.Float64Var(
+		&o.GCDiscardRatio,
+		"badger-gc-discard-ratio",
+		o.GCDiscardRatio,
+		"value log files with this ratio of stale data are rewritten",
+	)
+	badgerFlags.StringVar(
+		&o.EncryptionKeyFile,
+		"encryption-key-file",
+		o.EncryptionKeyFile,
+		"file of the master key encrypting the data, hex or raw, see also KVDB_ENCRYPTION_KEY",
+	)
+	badgerFlags.Var(
+		&o.EncryptionKeyRotation,
+		"encryption-key-rotation",
+		"interval after which a new data key is used",
+	)
+	badgerFlags.IntVar(
+		&o.NumVersionsToKeep,
+		"badger-num-versions",
+		o.NumVersionsToKeep,
+		"maximum number of versions kept per key, truncating bucket histories, 0 keeps them all",
+	)
+	badgerFlags.VisitAll(func(f *flag.Flag) {
+		flag.Var(f.Value, f.Name, f.Usage)
+	})
+}
+
+// loadBadgerOptions returns the badger options, from the defaults overridden
+// by the config file, then the environment and then the command line.
+func loadBadgerOptions() (*badgerstore.Options, error) {
+	// The flags were parsed into badgerOpts, set them again once the
+	// other sources are applied.
+	set := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if badgerFlags.Lookup(f.Name) != nil {
+			set[f.Name] = f.Value.String()
+		}
+	})
+	*badgerOpts = *badgerstore.DefaultOptions("./data")
+
+	if *configFile != "" {
+		if err := config.Load(*configFile, &config.Config{Badger: badgerOpts}); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	badgerFlags.VisitAll(func(f *flag.Flag) {
+		name := "KVDB_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(name); ok && err == nil {
+			if err = f.Value.Set(v); err != nil {
+				err = fmt.Errorf("config: invalid %s: %w", name, err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The key itself has no flag, so that it does not show in the process
+	// list.
+	if v, ok := os.LookupEnv("KVDB_ENCRYPTION_KEY"); ok {
+		key, err := badgerstore.ParseEncryptionKey([]byte(v))
+		if err != nil {
+			return nil, fmt.Errorf("config: invalid KVDB_ENCRYPTION_KEY: %w", err)
+		}
+		badgerOpts.EncryptionKey = key
+		badgerOpts.EncryptionKeyFile = ""
+	}
+
+	for name, v := range set {
+		if err := badgerFlags.Set(name, v); err != nil {
+			return nil, err
+		}
+	}
+	if err := badgerOpts.Validate(); err != nil {
+		return nil, err
+	}
+	return badgerOpts, nil
+}
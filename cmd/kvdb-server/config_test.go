@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+)
+
+func TestLoadBadgerOptions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kvdb.toml")
+	err := os.WriteFile(path, []byte(`
+[badger]
+dir = "/file"
+memtable_size = "32MiB"
+compression = "snappy"
+gc_interval = "1m"
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*configFile = path
+	defer func() { *configFile = "" }()
+	t.Setenv("KVDB_BADGER_COMPRESSION", "none")
+	t.Setenv("KVDB_BADGER_GC_INTERVAL", "2m")
+	t.Setenv("KVDB_BADGER_GC_DISCARD_RATIO", "0.5")
+	// Parsed from the command line.
+	if err := flag.Set("badger-gc-interval", "3m"); err != nil {
+		t.Fatal(err)
+	}
+	if err := flag.Set("data-dir", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := loadBadgerOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := badgerstore.DefaultOptions(dir)
+	want.MemTableSize = 32 << 20                            // File.
+	want.Compression = "none"                               // Environment over file.
+	want.GCDiscardRatio = 0.5                               // Environment.
+	want.GCInterval = badgerstore.Duration(3 * time.Minute) // Flag over both.
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("loadBadgerOptions =\n%+v\nwant\n%+v", *opts, *want)
+	}
+
+	// Invalid options are rejected once all sources are applied.
+	t.Setenv("KVDB_BADGER_GC_DISCARD_RATIO", "1")
+	if _, err := loadBadgerOptions(); err == nil {
+		t.Error("loadBadgerOptions accepted gc_discard_ratio 1")
+	}
+	t.Setenv("KVDB_BADGER_GC_DISCARD_RATIO", "x")
+	if _, err := loadBadgerOptions(); err == nil {
+		t.Error("loadBadgerOptions accepted an invalid environment variable")
+	}
+}
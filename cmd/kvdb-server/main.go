@@ -1,30 +1,206 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"log/slog"
 	gohttp "net/http"
 	_ "net/http/pprof"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/ory/graceful"
 	"github.com/samber/lo"
 
+	"github.com/maolonglong/kvdb/internal/backup"
+	"github.com/maolonglong/kvdb/internal/cluster"
+	"github.com/maolonglong/kvdb/internal/core"
 	"github.com/maolonglong/kvdb/internal/http"
-	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+	"github.com/maolonglong/kvdb/internal/replica"
+)
+
+var (
+	addr      = flag.String("addr", "localhost:8080", "address of the data listener")
+	adminAddr = flag.String(
+		"admin-addr",
+		"localhost:6060",
+		"address of the private listener of pprof and the admin endpoints",
+	)
+
+	storeType = flag.String(
+		"store",
+		"badger",
+		"storage engine, badger or memory for throwaway instances",
+	)
+
+	adminToken = flag.String(
+		"admin-token",
+		os.Getenv("KVDB_ADMIN_TOKEN"),
+		"bearer token of the admin endpoints, they are disabled if empty",
+	)
+	reapInterval = flag.Duration(
+		"reap-interval",
+		time.Hour,
+		"interval of expired bucket deletion",
+	)
+	bucketCacheSize = flag.Int(
+		"bucket-cache-size",
+		core.DefaultBucketCacheSize,
+		"number of buckets whose options are cached, 0 disables the cache",
+	)
+	valueCacheSize = flag.Int64(
+		"value-cache-size",
+		64<<20,
+		"bytes of values cached for the buckets caching them, 0 disables the cache; "+
+			"cluster members do not cache values",
+	)
+	valueCacheMaxValueSize = flag.Int(
+		"value-cache-max-value-size",
+		64<<10,
+		"size in bytes of the largest cached value",
+	)
+
+	backupDir      = flag.String("backup-dir", "./backups", "directory of scheduled backups")
+	backupInterval = flag.Duration(
+		"backup-interval",
+		0,
+		"interval of scheduled backups, 0 disables them",
+	)
+	backupFullEvery = flag.Int(
+		"backup-full-every",
+		24,
+		"take a full backup every N scheduled backups",
+	)
+	backupKeep = flag.Int(
+		"backup-keep",
+		7,
+		"number of full backups to keep, 0 keeps all of them",
+	)
+
+	replicateFrom = flag.String(
+		"replicate-from",
+		os.Getenv("KVDB_REPLICATE_FROM"),
+		"admin address of the primary, to run as its read-only replica",
+	)
+	replicaToken = flag.String(
+		"replica-token",
+		os.Getenv("KVDB_REPLICA_TOKEN"),
+		"admin token of the primary",
+	)
+	primaryURL = flag.String(
+		"primary-url",
+		os.Getenv("KVDB_PRIMARY_URL"),
+		"URL of the primary that a replica redirects writes to",
+	)
+	replicaState = flag.String(
+		"replica-state",
+		"./replica.json",
+		"file recording the replicated version",
+	)
+	replicaInterval = flag.Duration(
+		"replica-interval",
+		time.Second,
+		"interval between polls of the primary",
+	)
 )
 
 func main() {
-	store := lo.Must(badgerstore.New("./data"))
+	flag.Parse()
+	core.SetBucketCacheSize(*bucketCacheSize)
+	// A cache hit would skip the read index of cluster transactions, and
+	// could serve a stale value from a member that lost its leadership.
+	if *valueCacheSize > 0 && *clusterID == "" {
+		err := core.SetValueCache(&core.ValueCacheOptions{
+			Size:         *valueCacheSize,
+			MaxValueSize: *valueCacheMaxValueSize,
+		})
+		if err != nil {
+			log.Fatalf("main: %v", err)
+		}
+	}
+
+	var local kv.Store
+	switch *storeType {
+	case "badger":
+		opts, err := loadBadgerOptions()
+		if err != nil {
+			log.Fatalf("main: %v", err)
+		}
+		if local, err = openBadger(opts); err != nil {
+			log.Fatalf("main: %v", err)
+		}
+	case "memory":
+		local = memory.New()
+	default:
+		log.Fatalf("main: unknown store %q", *storeType)
+	}
+	store := local
+	if *clusterID != "" {
+		store = newClusterStore(local)
+	}
 	defer store.Close()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := &http.Options{}
+	if cs, ok := store.(*cluster.Store); ok {
+		opts.Cluster = cs
+	}
+	if *replicateFrom != "" {
+		if opts.Cluster != nil {
+			log.Fatal("main: a cluster member cannot replicate from a primary")
+		}
+		if *primaryURL == "" {
+			log.Fatal("main: -primary-url is required with -replicate-from")
+		}
+		bs, ok := local.(kv.BackupStore)
+		if !ok {
+			log.Fatalf("main: %s store does not support replication", storeName(local))
+		}
+		rep, err := replica.New(bs, &replica.Options{
+			Primary:   strings.TrimSuffix(*replicateFrom, "/"),
+			Token:     *replicaToken,
+			StatePath: *replicaState,
+			Interval:  *replicaInterval,
+		})
+		if err != nil {
+			log.Fatalf("main: %v", err)
+		}
+		go rep.Run(ctx)
+		opts.Primary = strings.TrimSuffix(*primaryURL, "/")
+		opts.Replica = rep
+	} else {
+		// Replicas get the deletions of their primary.
+		go core.RunReaper(ctx, store, *reapInterval)
+	}
+	if *backupInterval > 0 {
+		dir := lo.Must(backup.Open(*backupDir))
+		// Members of a cluster back up their local copy.
+		bs, ok := local.(kv.BackupStore)
+		if !ok {
+			log.Fatalf("main: %s store does not support backups", storeName(local))
+		}
+		go backup.Schedule(ctx, dir, bs.Backup, &backup.ScheduleOptions{
+			Interval:  *backupInterval,
+			FullEvery: *backupFullEvery,
+			Keep:      *backupKeep,
+		})
+	}
+
+	// The admin endpoints share the private listener of pprof.
+	gohttp.Handle("/admin/", http.NewAdminHandler(store, *adminToken, opts))
+	gohttp.Handle("/metrics", http.NewMetricsHandler(local))
 	go func() {
-		log.Println(gohttp.ListenAndServe("localhost:6060", nil))
+		log.Println(gohttp.ListenAndServe(*adminAddr, nil))
 	}()
 
 	server := graceful.WithDefaults(&gohttp.Server{
-		Addr:    "localhost:8080",
-		Handler: http.NewHandler(store),
+		Addr:    *addr,
+		Handler: http.NewHandler(store, opts),
 	})
 
 	slog.Info("main: Starting the server")
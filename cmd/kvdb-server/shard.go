@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+	"github.com/maolonglong/kvdb/internal/kv/shard"
+)
+
+var shards = flag.Int(
+	"shards",
+	0,
+	"number of badger shards created in an empty data directory, see kvdb-reshard; "+
+		"sharded stores cannot be backed up or replicated",
+)
+
+// openBadger opens the badger store of opts, sharded if its directory is or
+// -shards is set. Each shard gets the options, caches included.
+func openBadger(opts *badgerstore.Options) (kv.Store, error) {
+	s, err := shard.Open(opts.Dir, *shards, func(dir string) (kv.Store, error) {
+		o := *opts
+		o.Dir = dir
+		return badgerstore.New(&o)
+	})
+	if errors.Is(err, shard.ErrNotSharded) && *shards == 0 {
+		return badgerstore.New(opts)
+	}
+	return s, err
+}
+
+// storeName describes the store in errors.
+func storeName(s kv.Store) string {
+	if _, ok := s.(*shard.Store); ok {
+		return "sharded " + *storeType
+	}
+	return *storeType
+}
@@ -0,0 +1,287 @@
+// Package backup manages a directory of full and incremental backups of a
+// kv.BackupStore, described by a manifest.
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const ManifestFile = "manifest.json"
+
+var ErrNoBackup = errors.New("backup: no full backup")
+
+// Func writes the versions newer than since and returns the version of the
+// backup, see kv.BackupStore.Backup.
+type Func func(w io.Writer, since uint64) (uint64, error)
+
+type Entry struct {
+	File string `json:"file"`
+	Full bool   `json:"full"`
+
+	// Version of the previous backup for incremental backups, 0 for full
+	// backups. An incremental backup following an empty backup is also
+	// since 0.
+	Since   uint64 `json:"since"`
+	Version uint64 `json:"version"`
+
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// UnmarshalJSON reads the entries of manifests written before Full, whose
+// full backups were the ones since 0.
+func (e *Entry) UnmarshalJSON(b []byte) error {
+	type entry Entry
+	v := struct {
+		*entry
+		Full *bool `json:"full"`
+	}{entry: (*entry)(e)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Full != nil {
+		e.Full = *v.Full
+	} else {
+		e.Full = e.Since == 0
+	}
+	return nil
+}
+
+type Manifest struct {
+	Backups []*Entry `json:"backups"`
+}
+
+// Dir is a directory of backups. Its methods are safe for concurrent use
+// within a process, but the directory must not be shared by processes
+// writing to it at the same time.
+type Dir struct {
+	mu   sync.Mutex
+	path string
+}
+
+func Open(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+	return &Dir{path: path}, nil
+}
+
+func (d *Dir) Manifest() (*Manifest, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.readManifest()
+}
+
+// Backup writes a new backup with fn. It is incremental from the latest
+// backup unless full is set or there is no backup yet.
+func (d *Dir) Backup(fn Func, full bool) (*Entry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	m, err := d.readManifest()
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{
+		Full:      full || len(m.Backups) == 0,
+		CreatedAt: time.Now().UTC(),
+	}
+	kind := "full"
+	if !e.Full {
+		e.Since = m.Backups[len(m.Backups)-1].Version
+		kind = "incr"
+	}
+	e.File = fmt.Sprintf("%s-%s.bak", e.CreatedAt.Format("20060102T150405.000000000Z"), kind)
+
+	tmp, err := os.CreateTemp(d.path, e.File+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if e.Version, err = fn(tmp, e.Since); err != nil {
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, err
+	}
+	fi, err := tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	e.Size = fi.Size()
+	if err := os.Rename(tmp.Name(), filepath.Join(d.path, e.File)); err != nil {
+		return nil, err
+	}
+
+	m.Backups = append(m.Backups, e)
+	if err := d.writeManifest(m); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Restore calls load with the latest full backup, then with each of the
+// incremental backups taken after it.
+func (d *Dir) Restore(load func(r io.Reader) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	m, err := d.readManifest()
+	if err != nil {
+		return err
+	}
+	start := -1
+	for i, e := range m.Backups {
+		if e.Full {
+			start = i
+		}
+	}
+	if start < 0 {
+		return ErrNoBackup
+	}
+	for _, e := range m.Backups[start:] {
+		if err := d.load(e, load); err != nil {
+			return fmt.Errorf("backup: load %s: %w", e.File, err)
+		}
+	}
+	return nil
+}
+
+func (d *Dir) load(e *Entry, load func(r io.Reader) error) error {
+	f, err := os.Open(filepath.Join(d.path, e.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return load(f)
+}
+
+// Prune removes the backups older than the keep latest full backups.
+func (d *Dir) Prune(keep int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	m, err := d.readManifest()
+	if err != nil {
+		return err
+	}
+	start := 0
+	fulls := 0
+	for i := len(m.Backups) - 1; i >= 0; i-- {
+		if m.Backups[i].Full {
+			fulls++
+			if fulls == keep {
+				start = i
+				break
+			}
+		}
+	}
+	if fulls < keep || start == 0 {
+		return nil
+	}
+
+	removed := m.Backups[:start]
+	m.Backups = m.Backups[start:]
+	// Update the manifest first, so that it never lists a missing file.
+	if err := d.writeManifest(m); err != nil {
+		return err
+	}
+	for _, e := range removed {
+		if err := os.Remove(filepath.Join(d.path, e.File)); err != nil &&
+			!errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dir) readManifest() (*Manifest, error) {
+	m := &Manifest{}
+	b, err := os.ReadFile(filepath.Join(d.path, ManifestFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return m, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (d *Dir) writeManifest(m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(d.path, ManifestFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(d.path, ManifestFile))
+}
+
+type ScheduleOptions struct {
+	Interval time.Duration
+
+	// Take a full backup every FullEvery backups, the others are
+	// incremental.
+	FullEvery int
+
+	// Number of full backups to keep, with their incremental backups. 0
+	// keeps all of them.
+	Keep int
+}
+
+// Schedule takes a backup every opts.Interval until ctx is done.
+func Schedule(ctx context.Context, d *Dir, fn Func, opts *ScheduleOptions) {
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m, err := d.Manifest()
+		if err != nil {
+			slog.Error("backup: Failed to read manifest", "err", err)
+			continue
+		}
+		// Count the backups since the latest full one.
+		n := 0
+		for i := len(m.Backups) - 1; i >= 0; i-- {
+			n++
+			if m.Backups[i].Full {
+				break
+			}
+		}
+		full := len(m.Backups) == 0 || n >= opts.FullEvery
+
+		e, err := d.Backup(fn, full)
+		if err != nil {
+			slog.Error("backup: Failed to backup", "full", full, "err", err)
+			continue
+		}
+		slog.Info("backup: Backup done", "file", e.File, "version", e.Version, "size", e.Size)
+
+		if opts.Keep > 0 {
+			if err := d.Prune(opts.Keep); err != nil {
+				slog.Error("backup: Failed to prune backups", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package backup_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/backup"
+)
+
+// store is a fake kv.BackupStore whose backups hold their number, and whose
+// version is set by the test.
+type store struct {
+	version uint64
+	n       int
+}
+
+func (s *store) backup(w io.Writer, since uint64) (uint64, error) {
+	s.n++
+	_, err := io.WriteString(w, string(rune('0'+s.n)))
+	return s.version, err
+}
+
+// take takes a backup per element of fulls, the versions are bumped before
+// each one unless empty is set.
+func take(t *testing.T, d *backup.Dir, s *store, fulls []bool, empty bool) {
+	t.Helper()
+	for _, full := range fulls {
+		if !empty {
+			s.version++
+		}
+		if _, err := d.Backup(s.backup, full); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func kinds(m *backup.Manifest) string {
+	var s string
+	for _, e := range m.Backups {
+		if e.Full {
+			s += "F"
+		} else {
+			s += "I"
+		}
+	}
+	return s
+}
+
+func TestManifest(t *testing.T) {
+	tests := []struct {
+		name      string
+		fulls     []bool
+		empty     bool
+		wantKinds string
+		wantSince []uint64
+	}{
+		{"first is full", []bool{false, false}, false, "FI", []uint64{0, 1}},
+		{"full", []bool{false, true, false}, false, "FFI", []uint64{0, 0, 2}},
+		// The backups of an empty store are all at version 0.
+		{"after empty", []bool{false, false, false}, true, "FII", []uint64{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir()
+			d, err := backup.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			take(t, d, &store{}, tt.fulls, tt.empty)
+
+			// Read the manifest back from a new Dir.
+			d, err = backup.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := d.Manifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := kinds(m); got != tt.wantKinds {
+				t.Errorf("kinds = %q, want %q", got, tt.wantKinds)
+			}
+			var since []uint64
+			for _, e := range m.Backups {
+				since = append(since, e.Since)
+				fi, err := os.Stat(filepath.Join(path, e.File))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Size() != e.Size {
+					t.Errorf("size of %s = %d, manifest %d", e.File, fi.Size(), e.Size)
+				}
+			}
+			if !slices.Equal(since, tt.wantSince) {
+				t.Errorf("since = %v, want %v", since, tt.wantSince)
+			}
+		})
+	}
+}
+
+func TestManifestWithoutFull(t *testing.T) {
+	path := t.TempDir()
+	manifest := `{"backups": [
+		{"file": "a.bak", "since": 0, "version": 1},
+		{"file": "b.bak", "since": 1, "version": 2}
+	]}`
+	err := os.WriteFile(filepath.Join(path, backup.ManifestFile), []byte(manifest), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := backup.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := d.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := kinds(m); got != "FI" {
+		t.Errorf("kinds = %q, want %q", got, "FI")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tests := []struct {
+		name    string
+		fulls   []bool
+		empty   bool
+		want    string
+		wantErr error
+	}{
+		{"none", nil, false, "", backup.ErrNoBackup},
+		{"full", []bool{true}, false, "1", nil},
+		{"incrementals", []bool{true, false, false}, false, "123", nil},
+		{"latest full", []bool{true, false, true, false}, false, "34", nil},
+		{"after empty", []bool{true, false}, true, "12", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := backup.Open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			take(t, d, &store{}, tt.fulls, tt.empty)
+
+			var got string
+			err = d.Restore(func(r io.Reader) error {
+				b, err := io.ReadAll(r)
+				got += string(b)
+				return err
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Restore = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("loaded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name  string
+		fulls []bool
+		keep  int
+		want  string
+	}{
+		{"nothing to prune", []bool{true, false, true}, 2, "FIF"},
+		{"too few fulls", []bool{true, false}, 3, "FI"},
+		{"incrementals", []bool{true, false, true, false, false}, 1, "FII"},
+		{"fulls", []bool{true, true, true, false}, 2, "FFI"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir()
+			d, err := backup.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			take(t, d, &store{}, tt.fulls, false)
+
+			if err := d.Prune(tt.keep); err != nil {
+				t.Fatal(err)
+			}
+			m, err := d.Manifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := kinds(m); got != tt.want {
+				t.Errorf("kinds = %q, want %q", got, tt.want)
+			}
+			// Only the manifest and the backups it lists are left.
+			files, err := filepath.Glob(filepath.Join(path, "*.bak"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(m.Backups) {
+				t.Errorf("%d backup files, want %d", len(files), len(m.Backups))
+			}
+		})
+	}
+}
+
+func TestScheduleFullEvery(t *testing.T) {
+	tests := []struct {
+		fullEvery int
+		want      string
+	}{
+		{0, "FFFF"},
+		{1, "FFFF"},
+		{2, "FIFIF"},
+		{3, "FIIFIIF"},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.fullEvery), func(t *testing.T) {
+			d, err := backup.Open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s := &store{}
+			fn := func(w io.Writer, since uint64) (uint64, error) {
+				if err := ctx.Err(); err != nil {
+					// The ticker may still fire once.
+					return 0, err
+				}
+				s.version++
+				if s.n+1 == len(tt.want) {
+					cancel()
+				}
+				return s.backup(w, since)
+			}
+			backup.Schedule(ctx, d, fn, &backup.ScheduleOptions{
+				Interval:  time.Millisecond,
+				FullEvery: tt.fullEvery,
+			})
+
+			m, err := d.Manifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := kinds(m); got != tt.want {
+				t.Errorf("kinds = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+// Package cluster implements a kv.Store replicated by Raft. The writes of a
+// transaction are proposed to the log on Commit, and every member applies
+// the committed ones to its local store.
+//
+// Only the leader serves transactions, they fail with kv.ErrNotLeader on
+// other members. Reads are linearizable: a transaction starts once the
+// leader confirmed it still leads, and applied every write committed before.
+// Like the other stores, transactions do not detect conflicts.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/raft"
+)
+
+// Maximum size of the writes proposed at once by a write batch.
+const _maxBatchSize = 1 << 20
+
+var ErrDiscarded = errors.New("cluster: transaction has been discarded")
+
+var _ kv.Store = (*Store)(nil)
+
+type Options struct {
+	// The member running the store.
+	Member raft.Member
+
+	Storage   raft.Storage
+	Transport raft.Transport
+	Raft      *raft.Options
+
+	// Create a cluster of this single member, unless it already has a log.
+	Bootstrap bool
+
+	// Maximum time to wait for the leader to confirm a read or commit a
+	// write.
+	Timeout time.Duration
+
+	// OnLeader is called when the member starts to lead a term, before
+	// IsLeader reports it, to drop the state cached from the local store
+	// while others led.
+	OnLeader func()
+}
+
+type Store struct {
+	local kv.Store
+	node  *raft.Node
+	opts  *Options
+
+	// Last term IsLeader reported, OnLeader is called under mu.
+	term atomic.Uint64
+	mu   sync.Mutex
+}
+
+// New replicates local, which must only be written through the returned
+// store. The store owns local and opts.Storage, Close closes them.
+func New(local kv.Store, opts *Options) (*Store, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	node, err := raft.New(
+		opts.Member.ID,
+		&machine{store: local},
+		opts.Storage,
+		opts.Transport,
+		opts.Raft,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Bootstrap {
+		err := node.Bootstrap([]raft.Member{opts.Member})
+		if err != nil && !errors.Is(err, raft.ErrAlreadyBootstrap) {
+			node.Stop()
+			return nil, err
+		}
+	}
+	return &Store{
+		local: local,
+		node:  node,
+		opts:  opts,
+	}, nil
+}
+
+// Node returns the Raft node of the store, for the RPCs of its peers and
+// membership changes.
+func (s *Store) Node() *raft.Node {
+	return s.node
+}
+
+// Leader returns the leader of the cluster, if known.
+func (s *Store) Leader() (*raft.Member, bool) {
+	return s.node.Leader()
+}
+
+// IsLeader tells whether the store serves transactions.
+func (s *Store) IsLeader() bool {
+	term, ok := s.node.Leading()
+	if !ok {
+		return false
+	}
+	if s.term.Load() != term {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.term.Load() != term {
+			if s.opts.OnLeader != nil {
+				s.opts.OnLeader()
+			}
+			s.term.Store(term)
+		}
+	}
+	return true
+}
+
+func (s *Store) Close() error {
+	s.node.Stop()
+	return errors.Join(s.opts.Storage.Close(), s.local.Close())
+}
+
+// NewTransaction waits for the leader to apply the writes committed so far,
+// a transaction failing to do so fails on first use.
+func (s *Store) NewTransaction(update bool) kv.Txn {
+	txn := &txn{s: s, update: update}
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+	if err := s.node.ReadIndex(ctx); err != nil {
+		txn.err = convertErr(err)
+		return txn
+	}
+	txn.inner = s.local.NewTransaction(update)
+	return txn
+}
+
+func (s *Store) NewWriteBatch() kv.WriteBatch {
+	return &writeBatch{s: s}
+}
+
+func (s *Store) propose(data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+	return convertErr(s.node.Propose(ctx, data))
+}
+
+// convertErr wraps the errors of a node that is not, or no longer, the
+// leader into kv.ErrNotLeader.
+func convertErr(err error) error {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+		return fmt.Errorf("%w: %w", kv.ErrNotLeader, err)
+	}
+	return err
+}
+
+// txn runs in a transaction of the local store, its writes are recorded to
+// be proposed on Commit. err is set once the transaction is unusable.
+type txn struct {
+	s      *Store
+	update bool
+	inner  kv.Txn
+	err    error
+	ops    []byte
+}
+
+func (txn *txn) record(o *op) {
+	txn.ops = appendOp(txn.ops, o)
+}
+
+func (txn *txn) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if txn.err != nil {
+		return nil, txn.err
+	}
+	return txn.inner.Get(ctx, key)
+}
+
+func (txn *txn) Has(ctx context.Context, key []byte) (bool, error) {
+	if txn.err != nil {
+		return false, txn.err
+	}
+	return txn.inner.Has(ctx, key)
+}
+
+func (txn *txn) TTL(ctx context.Context, key []byte) (time.Duration, error) {
+	if txn.err != nil {
+		return 0, txn.err
+	}
+	return txn.inner.TTL(ctx, key)
+}
+
+func (txn *txn) Set(ctx context.Context, key, val []byte, opts *kv.SetOptions) error {
+	if txn.err != nil {
+		return txn.err
+	}
+	if err := txn.inner.Set(ctx, key, val, opts); err != nil {
+		return err
+	}
+	o := &op{typ: opSet, key: key, val: val}
+	if opts != nil {
+		o.expiresAt = expiresAt(opts)
+		o.keepVersions = opts.KeepVersions
+	}
+	txn.record(o)
+	return nil
+}
+
+func (txn *txn) Delete(ctx context.Context, key []byte) error {
+	if txn.err != nil {
+		return txn.err
+	}
+	if err := txn.inner.Delete(ctx, key); err != nil {
+		return err
+	}
+	txn.record(&op{typ: opDelete, key: key})
+	return nil
+}
+
+func (txn *txn) Incr(
+	ctx context.Context,
+	key []byte,
+	increment int64,
+	opts *kv.IncrOptions[int64],
+) (int64, error) {
+	if txn.err != nil {
+		return 0, txn.err
+	}
+	num, err := txn.inner.Incr(ctx, key, increment, opts)
+	if err != nil {
+		return num, err
+	}
+	return num, txn.recordIncr(ctx, key, opts != nil && opts.KeepVersions)
+}
+
+func (txn *txn) IncrFloat(
+	ctx context.Context,
+	key []byte,
+	increment float64,
+	opts *kv.IncrOptions[float64],
+) (float64, error) {
+	if txn.err != nil {
+		return 0, txn.err
+	}
+	num, err := txn.inner.IncrFloat(ctx, key, increment, opts)
+	if err != nil {
+		return num, err
+	}
+	return num, txn.recordIncr(ctx, key, opts != nil && opts.KeepVersions)
+}
+
+// recordIncr records the result of an increment as a set, so that members
+// apply the same value.
+func (txn *txn) recordIncr(ctx context.Context, key []byte, keepVersions bool) error {
+	val, err := txn.inner.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	ttl, err := txn.inner.TTL(ctx, key)
+	if err != nil {
+		return err
+	}
+	txn.record(&op{
+		typ:          opSet,
+		key:          key,
+		val:          val,
+		expiresAt:    expiresAt(&kv.SetOptions{TTL: ttl}),
+		keepVersions: keepVersions,
+	})
+	return nil
+}
+
+func (txn *txn) Iterate(
+	ctx context.Context,
+	opts *kv.IterOptions,
+	fn func(key, val []byte) error,
+) error {
+	if txn.err != nil {
+		return txn.err
+	}
+	return txn.inner.Iterate(ctx, opts, func(key, val []byte) error {
+		if string(key) == string(_appliedKey) {
+			return nil
+		}
+		return fn(key, val)
+	})
+}
+
+func (txn *txn) Commit() error {
+	if txn.err != nil {
+		return txn.err
+	}
+	// The writes are applied by the state machine, once committed.
+	txn.inner.Discard()
+	txn.inner = nil
+	txn.err = ErrDiscarded
+	if !txn.update || len(txn.ops) == 0 {
+		return nil
+	}
+	return txn.s.propose(txn.ops)
+}
+
+func (txn *txn) Discard() {
+	if txn.inner != nil {
+		txn.inner.Discard()
+	}
+	if txn.err == nil {
+		txn.err = ErrDiscarded
+	}
+	txn.ops = nil
+}
+
+// writeBatch proposes its writes in entries of up to _maxBatchSize.
+type writeBatch struct {
+	s   *Store
+	ops []byte
+}
+
+func (wb *writeBatch) Set(key, val []byte, opts *kv.SetOptions) error {
+	o := &op{typ: opSet, key: key, val: val}
+	if opts != nil {
+		o.expiresAt = expiresAt(opts)
+		o.keepVersions = opts.KeepVersions
+	}
+	return wb.add(o)
+}
+
+func (wb *writeBatch) Delete(key []byte) error {
+	return wb.add(&op{typ: opDelete, key: key})
+}
+
+func (wb *writeBatch) add(o *op) error {
+	wb.ops = appendOp(wb.ops, o)
+	if len(wb.ops) < _maxBatchSize {
+		return nil
+	}
+	return wb.Flush()
+}
+
+func (wb *writeBatch) Flush() error {
+	if len(wb.ops) == 0 {
+		return nil
+	}
+	ops := wb.ops
+	wb.ops = nil
+	return wb.s.propose(ops)
+}
+
+func (wb *writeBatch) Cancel() {
+	wb.ops = nil
+}
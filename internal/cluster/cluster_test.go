@@ -0,0 +1,173 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/kv/kvtest"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+	"github.com/maolonglong/kvdb/internal/raft"
+)
+
+var _raftOpts = &raft.Options{
+	HeartbeatInterval: 20 * time.Millisecond,
+	ElectionTimeout:   200 * time.Millisecond,
+	MaxAppendEntries:  64,
+	SnapshotThreshold: 1 << 20,
+	TrailingLogs:      64,
+}
+
+// testCluster runs members in process, over memory stores.
+type testCluster struct {
+	t         *testing.T
+	transport *raft.MemoryTransport
+	stores    map[string]*Store
+}
+
+func newTestCluster(t *testing.T, n int) *testCluster {
+	c := &testCluster{
+		t:         t,
+		transport: raft.NewMemoryTransport(),
+		stores:    make(map[string]*Store),
+	}
+	ctx := context.Background()
+	for i := range n {
+		id := fmt.Sprintf("n%d", i+1)
+		s, err := New(memory.New(), &Options{
+			Member:    raft.Member{ID: id},
+			Storage:   raft.NewMemoryStorage(),
+			Transport: c.transport,
+			Raft:      _raftOpts,
+			Bootstrap: i == 0,
+			Timeout:   5 * time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.transport.Register(s.Node())
+		c.stores[id] = s
+		if i > 0 {
+			if err := c.leader().Node().AddMember(ctx, raft.Member{ID: id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return c
+}
+
+func (c *testCluster) close() error {
+	var errs []error
+	for _, s := range c.stores {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (c *testCluster) leader(except ...*Store) *Store {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+	next:
+		for _, s := range c.stores {
+			for _, e := range except {
+				if s == e {
+					continue next
+				}
+			}
+			if s.IsLeader() {
+				return s
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.t.Fatal("no leader")
+	return nil
+}
+
+// leaderStore is the leader of a cluster, closing it closes the cluster.
+type leaderStore struct {
+	*Store
+	c *testCluster
+}
+
+func (s *leaderStore) Close() error {
+	return s.c.close()
+}
+
+func TestStore(t *testing.T) {
+	kvtest.Run(t, func(t *testing.T) kv.Store {
+		c := newTestCluster(t, 3)
+		return &leaderStore{Store: c.leader(), c: c}
+	})
+}
+
+func TestFollowers(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+	ctx := context.Background()
+	leader := c.leader()
+
+	err := kv.WithTxn(leader, true, func(txn kv.Txn) error {
+		if err := txn.Set(ctx, []byte("k"), []byte("v"), nil); err != nil {
+			return err
+		}
+		_, err := txn.Incr(ctx, []byte("n"), 2, nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, s := range c.stores {
+		if s == leader {
+			continue
+		}
+		// Followers do not serve transactions...
+		err := kv.WithTxn(s, false, func(txn kv.Txn) error {
+			_, err := txn.Get(ctx, []byte("k"))
+			return err
+		})
+		if !errors.Is(err, kv.ErrNotLeader) {
+			t.Fatalf("Get on follower %s = %v, want ErrNotLeader", id, err)
+		}
+
+		// ...but apply the writes to their local store.
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var k, n []byte
+			err := kv.WithTxn(s.local, false, func(txn kv.Txn) error {
+				var err error
+				if k, err = txn.Get(ctx, []byte("k")); err != nil {
+					return err
+				}
+				n, err = txn.Get(ctx, []byte("n"))
+				return err
+			})
+			if err == nil && string(k) == "v" && string(n) == "2" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("follower %s has k = %q, n = %q, %v", id, k, n, err)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// A new leader has the writes of the previous one.
+	c.transport.Disconnect(leader.opts.Member.ID)
+	newLeader := c.leader(leader)
+	err = kv.WithTxn(newLeader, false, func(txn kv.Txn) error {
+		val, err := txn.Get(ctx, []byte("k"))
+		if err == nil && string(val) != "v" {
+			err = fmt.Errorf("Get(k) = %q, want v", val)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,294 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/raft"
+)
+
+var errInvalidOp = errors.New("cluster: invalid op")
+
+// Index of the last applied entry, stored along with the data. Core keys
+// start with a bucket name, which never holds a NUL byte.
+var _appliedKey = []byte("\x00raft:applied")
+
+type opType byte
+
+const (
+	_ opType = iota
+	opSet
+	opDelete
+)
+
+// op is a write of a transaction or a write batch, the data of a log entry
+// is a sequence of them.
+type op struct {
+	typ opType
+	key []byte
+	val []byte
+	// Unix milliseconds, the TTL would depend on when the op is applied.
+	expiresAt    int64
+	keepVersions bool
+}
+
+func appendOp(buf []byte, o *op) []byte {
+	buf = append(buf, byte(o.typ))
+	buf = binary.AppendUvarint(buf, uint64(len(o.key)))
+	buf = append(buf, o.key...)
+	if o.typ == opDelete {
+		return buf
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(o.val)))
+	buf = append(buf, o.val...)
+	buf = binary.AppendVarint(buf, o.expiresAt)
+	if o.keepVersions {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+func readOp(r *bufio.Reader) (*op, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	o := &op{typ: opType(typ)}
+	if o.key, err = readBytes(r); err != nil {
+		return nil, err
+	}
+	switch o.typ {
+	case opDelete:
+		return o, nil
+	case opSet:
+	default:
+		return nil, errInvalidOp
+	}
+	if o.val, err = readBytes(r); err != nil {
+		return nil, err
+	}
+	if o.expiresAt, err = binary.ReadVarint(r); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	keep, err := r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	o.keepVersions = keep == 1
+	return o, nil
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if n > 1<<30 {
+		return nil, errInvalidOp
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func expiresAt(opts *kv.SetOptions) int64 {
+	switch {
+	case !opts.ExpiresAt.IsZero():
+		return opts.ExpiresAt.UnixMilli()
+	case opts.TTL > 0:
+		return time.Now().Add(opts.TTL).UnixMilli()
+	}
+	return 0
+}
+
+// machine applies the committed entries to the local store.
+type machine struct {
+	store kv.Store
+}
+
+var _ raft.StateMachine = (*machine)(nil)
+
+func (m *machine) Applied() (uint64, error) {
+	var index uint64
+	err := kv.WithTxn(m.store, false, func(txn kv.Txn) error {
+		var err error
+		index, err = applied(txn)
+		return err
+	})
+	return index, err
+}
+
+func applied(txn kv.Txn) (uint64, error) {
+	val, err := txn.Get(context.Background(), _appliedKey)
+	if err != nil {
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("cluster: invalid applied index %x", val)
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+func (m *machine) Apply(e *raft.Entry) error {
+	ctx := context.Background()
+	return kv.WithTxn(m.store, true, func(txn kv.Txn) error {
+		r := bufio.NewReader(bytes.NewReader(e.Data))
+		for {
+			o, err := readOp(r)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return fmt.Errorf("cluster: entry %d: %w", e.Index, err)
+			}
+			if err := applyOp(ctx, txn, o); err != nil {
+				return err
+			}
+		}
+		return txn.Set(ctx, _appliedKey, binary.BigEndian.AppendUint64(nil, e.Index), nil)
+	})
+}
+
+func applyOp(ctx context.Context, txn kv.Txn, o *op) error {
+	if o.typ == opDelete {
+		return txn.Delete(ctx, o.key)
+	}
+	opts := &kv.SetOptions{KeepVersions: o.keepVersions}
+	if o.expiresAt != 0 {
+		opts.ExpiresAt = time.UnixMilli(o.expiresAt)
+		if !opts.ExpiresAt.After(time.Now()) {
+			return txn.Delete(ctx, o.key)
+		}
+	}
+	return txn.Set(ctx, o.key, o.val, opts)
+}
+
+// Snapshot reads from a transaction of the local store, the applied index
+// is consistent with the data.
+func (m *machine) Snapshot() (raft.Snapshot, error) {
+	txn := m.store.NewTransaction(false)
+	index, err := applied(txn)
+	if err != nil {
+		txn.Discard()
+		return nil, err
+	}
+	return &snapshot{txn: txn, index: index}, nil
+}
+
+// Restore replaces the content of the local store. The superseded versions
+// of keys are not part of a snapshot.
+func (m *machine) Restore(r io.Reader, index uint64) error {
+	ctx := context.Background()
+	wb := m.store.NewWriteBatch()
+	defer wb.Cancel()
+	err := kv.WithTxn(m.store, false, func(txn kv.Txn) error {
+		return txn.Iterate(ctx, &kv.IterOptions{KeysOnly: true}, func(k, _ []byte) error {
+			return wb.Delete(k)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	wb = m.store.NewWriteBatch()
+	defer wb.Cancel()
+	br := bufio.NewReader(r)
+	for {
+		o, err := readOp(br)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		if o.typ != opSet {
+			return errInvalidOp
+		}
+		if o.expiresAt == 0 {
+			err = wb.Set(o.key, o.val, nil)
+		} else if at := time.UnixMilli(o.expiresAt); at.After(time.Now()) {
+			err = wb.Set(o.key, o.val, &kv.SetOptions{ExpiresAt: at})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	return kv.WithTxn(m.store, true, func(txn kv.Txn) error {
+		return txn.Set(ctx, _appliedKey, binary.BigEndian.AppendUint64(nil, index), nil)
+	})
+}
+
+func (m *machine) Sync() error {
+	if s, ok := m.store.(kv.SyncStore); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+type snapshot struct {
+	txn   kv.Txn
+	index uint64
+}
+
+func (s *snapshot) Index() uint64 {
+	return s.index
+}
+
+// WriteTo writes every key as an opSet.
+func (s *snapshot) WriteTo(w io.Writer) (int64, error) {
+	ctx := context.Background()
+	bw := bufio.NewWriter(w)
+	var (
+		n   int64
+		buf []byte
+	)
+	err := s.txn.Iterate(ctx, &kv.IterOptions{}, func(k, v []byte) error {
+		if bytes.Equal(k, _appliedKey) {
+			return nil
+		}
+		ttl, err := s.txn.TTL(ctx, k)
+		if err != nil {
+			return err
+		}
+		buf = appendOp(
+			buf[:0],
+			&op{typ: opSet, key: k, val: v, expiresAt: expiresAt(&kv.SetOptions{TTL: ttl})},
+		)
+		written, err := bw.Write(buf)
+		n += int64(written)
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+func (s *snapshot) Close() {
+	s.txn.Discard()
+}
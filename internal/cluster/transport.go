@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/maolonglong/kvdb/internal/raft"
+)
+
+// Paths of the RPCs under the peer URL of a member, served by the admin
+// handler.
+const (
+	PathVote     = "/admin/raft/vote"
+	PathAppend   = "/admin/raft/append"
+	PathSnapshot = "/admin/raft/snapshot"
+
+	// Header of snapshot requests holding the JSON encoded request, the
+	// body is the snapshot.
+	HeaderSnapshot = "Kvdb-Raft-Snapshot"
+)
+
+// HTTPTransport sends the RPCs as JSON over HTTP, authenticated with the
+// admin token shared by the members.
+type HTTPTransport struct {
+	client *http.Client
+	token  string
+}
+
+var _ raft.Transport = (*HTTPTransport)(nil)
+
+func NewHTTPTransport(token string) *HTTPTransport {
+	return &HTTPTransport{
+		client: &http.Client{},
+		token:  token,
+	}
+}
+
+func (t *HTTPTransport) RequestVote(
+	ctx context.Context,
+	to *raft.Member,
+	req *raft.VoteRequest,
+) (*raft.VoteResponse, error) {
+	var resp raft.VoteResponse
+	return &resp, t.call(ctx, to, PathVote, req, &resp)
+}
+
+func (t *HTTPTransport) AppendEntries(
+	ctx context.Context,
+	to *raft.Member,
+	req *raft.AppendRequest,
+) (*raft.AppendResponse, error) {
+	var resp raft.AppendResponse
+	return &resp, t.call(ctx, to, PathAppend, req, &resp)
+}
+
+func (t *HTTPTransport) InstallSnapshot(
+	ctx context.Context,
+	to *raft.Member,
+	req *raft.SnapshotRequest,
+	data io.Reader,
+) (*raft.SnapshotResponse, error) {
+	header, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := t.newRequest(ctx, to, PathSnapshot, data)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set(HeaderSnapshot, string(header))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	var resp raft.SnapshotResponse
+	return &resp, t.do(r, &resp)
+}
+
+func (t *HTTPTransport) call(
+	ctx context.Context,
+	to *raft.Member,
+	path string,
+	req, resp any,
+) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := t.newRequest(ctx, to, path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	return t.do(r, resp)
+}
+
+func (t *HTTPTransport) newRequest(
+	ctx context.Context,
+	to *raft.Member,
+	path string,
+	body io.Reader,
+) (*http.Request, error) {
+	u := strings.TrimSuffix(to.PeerURL, "/") + path
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, u, body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return r, nil
+}
+
+func (t *HTTPTransport) do(r *http.Request, resp any) error {
+	res, err := t.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("cluster: %s: %s: %s", r.URL, res.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
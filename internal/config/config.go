@@ -0,0 +1,47 @@
+// Package config decodes the config files of the kvdb commands.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+)
+
+// Config is a TOML or JSON config file.
+type Config struct {
+	Badger *badgerstore.Options `toml:"badger" json:"badger"`
+}
+
+// Load decodes the file at path into cfg, by its extension. Unknown keys are
+// rejected so that typos do not go unnoticed.
+func Load(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+		return nil
+	}
+
+	md, err := toml.NewDecoder(f).Decode(cfg)
+	if err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("config: %s: unknown key %s", path, undecoded[0])
+	}
+	return nil
+}
@@ -3,13 +3,18 @@ package core
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"io"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/jaevor/go-nanoid"
 	"github.com/samber/lo"
+	"github.com/spf13/cast"
 	lua "github.com/yuin/gopher-lua"
 
 	"github.com/maolonglong/kvdb/internal/kv"
@@ -21,8 +26,14 @@ const _bucketNameLen = 21
 
 const (
 	_markBucketOpts = ":opts"
+	_markAccessTime = ":atime"
 	_markKeyValue   = ":kv:"
 	_markScripts    = ":scripts:"
+	_markHash       = ":hash:"
+	_markZMember    = ":zmember:"
+	_markZScore     = ":zscore:"
+	_markSet        = ":set:"
+	_markIndex      = ":idx:"
 )
 
 var idgen = lo.Must(nanoid.Standard(_bucketNameLen))
@@ -33,6 +44,13 @@ const (
 	_ OpType = iota
 	OpTypeSet
 	OpTypeDelete
+	OpTypeHSet
+	OpTypeHDelete
+	OpTypeHIncrBy
+	OpTypeSAdd
+	OpTypeSRem
+	OpTypeIncr
+	OpTypeIncrFloat
 )
 
 type Operation struct {
@@ -50,6 +68,18 @@ type OpDelete struct {
 	Key []byte
 }
 
+type OpIncr struct {
+	Key       []byte
+	Increment int64
+	Options   *kv.IncrOptions[int64]
+}
+
+type OpIncrFloat struct {
+	Key       []byte
+	Increment float64
+	Options   *kv.IncrOptions[float64]
+}
+
 type BucketOptions struct {
 	// TODO: To implement authorization, I am not sure how to do authorization
 	// properly when there is a script, because the script can access all keys by default.
@@ -68,15 +98,44 @@ type BucketOptions struct {
 
 	// Keys not updated expire after this duration.
 	DefaultTTL time.Duration
+
+	// The bucket is deleted this long after its creation.
+	TTL time.Duration `json:",omitempty"`
+
+	// The bucket is deleted when it has not been accessed for this long.
+	InactivityTTL time.Duration `json:",omitempty"`
+
+	// Set by NewBucket.
+	CreatedAt time.Time
+
+	// Keep this many versions of each key, see Bucket.History.
+	HistoryVersions int `json:",omitempty"`
+
+	// Keep the versions of each key written in this duration.
+	HistoryDuration time.Duration `json:",omitempty"`
+
+	// Secondary indexes on JSON values.
+	Indexes []*Index `json:",omitempty"`
+
+	// Writes are durable before they are acknowledged, unless a request
+	// opts out, see WithSync.
+	SyncWrites bool `json:",omitempty"`
+
+	// Cache the values read by Get, see SetValueCache.
+	CacheValues bool `json:",omitempty"`
 }
 
 type Bucket struct {
 	store kv.Store
 	opts  *BucketOptions
 	name  string
+
+	// Last recorded access, see Touch.
+	atime time.Time
 }
 
 func NewBucket(ctx context.Context, store kv.Store, opts *BucketOptions) (*Bucket, error) {
+	opts.CreatedAt = time.Now().UTC()
 	b := &Bucket{
 		store: store,
 		opts:  opts,
@@ -92,8 +151,26 @@ func NewBucket(ctx context.Context, store kv.Store, opts *BucketOptions) (*Bucke
 	return b, nil
 }
 
-// TODO: LUR
+// LoadBucket returns ErrBucketExpired for expired buckets not deleted yet.
+// Buckets are cached, unknown names included, see SetBucketCacheSize.
 func LoadBucket(ctx context.Context, store kv.Store, name string) (*Bucket, error) {
+	b, err := loadCachedBucket(ctx, store, name)
+	if err != nil {
+		return nil, err
+	}
+	if b.expired(time.Now()) {
+		return nil, ErrBucketExpired
+	}
+	for _, idx := range b.opts.Indexes {
+		if !idx.Ready && !readOnly(ctx) {
+			// Resume a backfill interrupted by a restart.
+			b.startBackfill(idx.Name)
+		}
+	}
+	return b, nil
+}
+
+func loadBucket(ctx context.Context, store kv.Store, name string) (*Bucket, error) {
 	b := &Bucket{
 		store: store,
 		name:  name,
@@ -109,36 +186,50 @@ func (b *Bucket) Name() string {
 	return b.name
 }
 
+// IsSecretKey reports whether key is the bucket's SecretKey, which is never
+// the case for buckets without one.
+func (b *Bucket) IsSecretKey(key string) bool {
+	return b.opts.SecretKey != "" &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(b.opts.SecretKey)) == 1
+}
+
 func (b *Bucket) Set(ctx context.Context, key, val []byte, ttl time.Duration) error {
-	uKey := b.udataKey(key, _markKeyValue)
-	opts := &kv.SetOptions{
-		TTL: b.opts.DefaultTTL,
-	}
-	if ttl > 0 {
-		opts.TTL = ttl
-	}
-	return kv.WithTxn(b.store, true, func(txn any) error {
-		return b.store.Set(ctx, txn, uKey, val, opts)
+	opts := b.setOptions(ttl)
+	return b.update(ctx, func(txn kv.Txn) error {
+		return b.setKV(ctx, txn, key, val, opts)
 	})
 }
 
+// Incr adds increment to the integer value of key. A zero opts.TTL falls back
+// to the bucket's DefaultTTL.
 func (b *Bucket) Incr(
 	ctx context.Context,
 	key []byte,
 	increment int64,
-	ttl time.Duration,
+	opts *kv.IncrOptions[int64],
 ) (int64, error) {
-	uKey := b.udataKey(key, _markKeyValue)
-	opts := &kv.SetOptions{
-		TTL: b.opts.DefaultTTL,
-	}
-	if ttl > 0 {
-		opts.TTL = ttl
-	}
+	opts = incrOptions(b, opts)
 	var num int64
-	err := kv.WithTxn(b.store, true, func(txn any) error {
+	err := b.update(ctx, func(txn kv.Txn) error {
 		var err error
-		num, err = b.store.Incr(ctx, txn, uKey, increment, opts)
+		num, err = b.incrKV(ctx, txn, key, increment, opts)
+		return err
+	})
+	return num, err
+}
+
+// IncrFloat is like Incr for floating-point values.
+func (b *Bucket) IncrFloat(
+	ctx context.Context,
+	key []byte,
+	increment float64,
+	opts *kv.IncrOptions[float64],
+) (float64, error) {
+	opts = incrOptions(b, opts)
+	var num float64
+	err := b.update(ctx, func(txn kv.Txn) error {
+		var err error
+		num, err = b.incrFloatKV(ctx, txn, key, increment, opts)
 		return err
 	})
 	return num, err
@@ -146,19 +237,35 @@ func (b *Bucket) Incr(
 
 func (b *Bucket) Get(ctx context.Context, key []byte) ([]byte, error) {
 	uKey := b.udataKey(key, _markKeyValue)
+	if c := b.valueCache(ctx); c != nil {
+		return c.get(ctx, uKey, func(ctx context.Context) ([]byte, time.Duration, error) {
+			var (
+				val []byte
+				ttl time.Duration
+			)
+			err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+				var err error
+				if val, err = txn.Get(ctx, uKey); err != nil {
+					return err
+				}
+				ttl, err = txn.TTL(ctx, uKey)
+				return err
+			})
+			return val, ttl, err
+		})
+	}
 	var val []byte
-	err := kv.WithTxn(b.store, false, func(txn any) error {
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
 		var err error
-		val, err = b.store.Get(ctx, txn, uKey)
+		val, err = txn.Get(ctx, uKey)
 		return err
 	})
 	return val, err
 }
 
 func (b *Bucket) Delete(ctx context.Context, key []byte) error {
-	uKey := b.udataKey(key, _markKeyValue)
-	return kv.WithTxn(b.store, true, func(txn any) error {
-		return b.store.Delete(ctx, txn, uKey)
+	return b.update(ctx, func(txn kv.Txn) error {
+		return b.deleteKV(ctx, txn, key)
 	})
 }
 
@@ -166,25 +273,54 @@ func (b *Bucket) ApplyTxn(ctx context.Context, ops []*Operation) error {
 	if len(ops) == 0 {
 		return nil
 	}
-	return kv.WithTxn(b.store, true, func(txn any) error {
+	return b.update(ctx, func(txn kv.Txn) error {
 		for _, op := range ops {
 			switch op.Type {
 			case OpTypeSet:
 				d := op.Data.(*OpSet)
-				uKey := b.udataKey(d.Key, _markKeyValue)
-				opts := &kv.SetOptions{
-					TTL: b.opts.DefaultTTL,
-				}
-				if d.TTL > 0 {
-					opts.TTL = d.TTL
-				}
-				if err := b.store.Set(ctx, txn, uKey, d.Value, opts); err != nil {
+				if err := b.setKV(ctx, txn, d.Key, d.Value, b.setOptions(d.TTL)); err != nil {
 					return err
 				}
 			case OpTypeDelete:
 				d := op.Data.(*OpDelete)
-				uKey := b.udataKey(d.Key, _markKeyValue)
-				if err := b.store.Delete(ctx, txn, uKey); err != nil {
+				if err := b.deleteKV(ctx, txn, d.Key); err != nil {
+					return err
+				}
+			case OpTypeIncr:
+				d := op.Data.(*OpIncr)
+				opts := incrOptions(b, d.Options)
+				if _, err := b.incrKV(ctx, txn, d.Key, d.Increment, opts); err != nil {
+					return err
+				}
+			case OpTypeIncrFloat:
+				d := op.Data.(*OpIncrFloat)
+				opts := incrOptions(b, d.Options)
+				if _, err := b.incrFloatKV(ctx, txn, d.Key, d.Increment, opts); err != nil {
+					return err
+				}
+			case OpTypeHSet:
+				d := op.Data.(*OpHSet)
+				if err := b.hset(ctx, txn, d.Key, d.Field, d.Value); err != nil {
+					return err
+				}
+			case OpTypeHDelete:
+				d := op.Data.(*OpHDelete)
+				if _, err := b.hdel(ctx, txn, d.Key, d.Field); err != nil {
+					return err
+				}
+			case OpTypeHIncrBy:
+				d := op.Data.(*OpHIncrBy)
+				if _, err := b.hincrby(ctx, txn, d.Key, d.Field, d.Increment); err != nil {
+					return err
+				}
+			case OpTypeSAdd:
+				d := op.Data.(*OpSAdd)
+				if _, err := b.sadd(ctx, txn, d.Key, d.Member); err != nil {
+					return err
+				}
+			case OpTypeSRem:
+				d := op.Data.(*OpSRem)
+				if _, err := b.srem(ctx, txn, d.Key, d.Member); err != nil {
 					return err
 				}
 			default:
@@ -196,8 +332,8 @@ func (b *Bucket) ApplyTxn(ctx context.Context, ops []*Operation) error {
 
 func (b *Bucket) StoreScript(ctx context.Context, name, content []byte) error {
 	key := b.udataKey(name, _markScripts)
-	return kv.WithTxn(b.store, true, func(txn any) error {
-		return b.store.Set(ctx, txn, key, content, nil)
+	return b.update(ctx, func(txn kv.Txn) error {
+		return txn.Set(ctx, key, content, nil)
 	})
 }
 
@@ -220,71 +356,154 @@ func (b *Bucket) DoScript(
 	buf := pool.GetByteBuffer()
 	defer pool.PutByteBuffer(buf)
 
-	txn := b.store.NewTransaction(true)
-	defer b.store.Discard(txn)
+	// The keys are locked like in update, the script is run again when one
+	// is used by another transaction.
+	locker := newKeyLocker()
+	defer locker.release()
+	var res scriptResult
+	for {
+		buf.Reset()
+		l.Pop(l.GetTop())
+		res, err = b.runScript(ctx, r, name, script, l, buf, locker)
+		if !locker.retry() {
+			break
+		}
+	}
+	locker.release()
+	if err != nil {
+		return err
+	}
+	if res.redirect != nil {
+		url := res.redirect.RawGetString("url").(lua.LString)
+		code := res.redirect.RawGetString("code").(lua.LNumber)
+		http.Redirect(w, r, string(url), int(code))
+		return nil
+	}
+	if res.prune != nil {
+		res.prune(ctx)
+		if err := b.sync(ctx); err != nil {
+			return err
+		}
+	}
 
-	mod := mkLua(buf, r, b, txn, l)
-	l.SetGlobal("kvdb", mod)
+	if header, ok := res.mod.RawGetString("header").(*lua.LTable); ok {
+		header.ForEach(func(l1, l2 lua.LValue) {
+			k, ok := l1.(lua.LString)
+			v, ok2 := l2.(lua.LString)
+			if ok && ok2 {
+				w.Header().Set(string(k), string(v))
+			}
+		})
+	}
+	if res.exitCode > 0 {
+		w.WriteHeader(res.exitCode)
+	} else if code, ok := res.mod.RawGetString("status").(lua.LNumber); ok {
+		w.WriteHeader(int(code))
+	}
+
+	_, _ = buf.WriteTo(w)
+	return nil
+}
+
+// scriptResult is the outcome of a script run.
+type scriptResult struct {
+	mod      *lua.LTable
+	exitCode int
+	// Payload of kvdb.redirect, if called.
+	redirect *lua.LTable
+	// Set once the writes of the script are committed.
+	prune func(ctx context.Context)
+}
 
-	var exitCode int
-	if err := l.DoString(bytesconv.BytesToString(script)); err != nil {
+func (b *Bucket) runScript(
+	ctx context.Context,
+	r *http.Request,
+	name, script []byte,
+	l *lua.LState,
+	w io.Writer,
+	locker *keyLocker,
+) (scriptResult, error) {
+	update := !readOnly(ctx)
+	var txn kv.Txn
+	if update {
+		txn = locker.newTransaction(b.store)
+	} else {
+		txn = b.store.NewTransaction(false)
+	}
+	txn, invalidate := b.trackWrites(ctx, txn)
+	defer invalidate()
+	defer txn.Discard()
+	txn, prune := b.trackHistory(txn)
+	var ro *readOnlyTxn
+	if !update {
+		ro = &readOnlyTxn{Txn: txn}
+		txn = ro
+	}
+
+	res := scriptResult{mod: mkLua(w, r, b, txn, l)}
+	l.SetGlobal("kvdb", res.mod)
+
+	start := time.Now()
+	err := l.DoString(bytesconv.BytesToString(script))
+	_luaDuration.Observe(time.Since(start).Seconds())
+	if ro != nil && ro.rejected {
+		// Even if the script recovered, its output assumed the write.
+		return res, kv.ErrReadOnlyTxn
+	}
+	if locker.failed {
+		// Same as above, the script is run again.
+		return res, errLockBusy
+	}
+	if err != nil {
+		failed := func() error {
+			slog.WarnContext(ctx, "core: Script failed",
+				"bucket", b.name,
+				"script", string(name),
+				"request_id", RequestID(ctx),
+				"err", err,
+			)
+			return err
+		}
 		var luaErr *lua.ApiError
 		if !errors.As(err, &luaErr) {
-			return err
+			return res, failed()
 		}
 		tb, ok := luaErr.Object.(*lua.LTable)
 		if !ok {
-			return err
+			return res, failed()
 		}
 		reason, ok := tb.RawGetString(_kvdbExitReason).(lua.LString)
 		if !ok {
-			return err
+			return res, failed()
 		}
 
 		switch reason {
 		case "redirect":
-			tb := tb.RawGetString(_kvdbExitPayload).(*lua.LTable)
-			url := tb.RawGetString("url").(lua.LString)
-			code := tb.RawGetString("code").(lua.LNumber)
-			http.Redirect(w, r, string(url), int(code))
-			return nil
+			res.redirect = tb.RawGetString(_kvdbExitPayload).(*lua.LTable)
 		case "exit":
 			code := tb.RawGetString(_kvdbExitPayload).(lua.LNumber)
-			exitCode = int(code)
+			res.exitCode = int(code)
 		default:
-			return err
-		}
-	} else {
-		if err := b.store.Commit(txn); err != nil {
-			return err
+			return res, failed()
 		}
+		return res, nil
 	}
 
-	if header, ok := mod.RawGetString("header").(*lua.LTable); ok {
-		header.ForEach(func(l1, l2 lua.LValue) {
-			k, ok := l1.(lua.LString)
-			v, ok2 := l2.(lua.LString)
-			if ok && ok2 {
-				w.Header().Set(string(k), string(v))
-			}
-		})
+	if err := txn.Commit(); err != nil {
+		return res, err
 	}
-	if exitCode > 0 {
-		w.WriteHeader(exitCode)
-	} else if code, ok := mod.RawGetString("status").(lua.LNumber); ok {
-		w.WriteHeader(int(code))
+	if update {
+		res.prune = prune
 	}
-
-	_, _ = buf.WriteTo(w)
-	return nil
+	return res, nil
 }
 
 func (b *Bucket) loadScript(ctx context.Context, name []byte) ([]byte, error) {
 	key := b.udataKey(name, _markScripts)
 	var val []byte
-	err := kv.WithTxn(b.store, false, func(txn any) error {
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
 		var err error
-		val, err = b.store.Get(ctx, txn, key)
+		val, err = txn.Get(ctx, key)
 		return err
 	})
 	return val, err
@@ -296,8 +515,9 @@ func (b *Bucket) storeOpts(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	return kv.WithTxn(b.store, true, func(txn any) error {
-		return b.store.Set(ctx, txn, key, val, nil)
+	defer _buckets.invalidate(b.name)
+	return b.update(ctx, func(txn kv.Txn) error {
+		return txn.Set(ctx, key, val, nil)
 	})
 }
 
@@ -313,16 +533,71 @@ func (b *Bucket) udataKey(origin []byte, mark string) []byte {
 	return bytes.Clone(buf.Bytes())
 }
 
+// compositeKey builds a key for data types that store one badger key per
+// element, e.g. hash fields.
+func (b *Bucket) compositeKey(mark string, key, sub []byte) []byte {
+	buf := pool.GetByteBuffer()
+	defer pool.PutByteBuffer(buf)
+
+	// <bucket_name><mark><len(key)><key><sub>
+	_, _ = buf.WriteString(b.name)
+	_, _ = buf.WriteString(mark)
+	buf.B = binary.BigEndian.AppendUint32(buf.B, uint32(len(key)))
+	_, _ = buf.Write(key)
+	_, _ = buf.Write(sub)
+
+	return bytes.Clone(buf.Bytes())
+}
+
+func (b *Bucket) setOptions(ttl time.Duration) *kv.SetOptions {
+	opts := &kv.SetOptions{
+		TTL: b.opts.DefaultTTL,
+	}
+	if ttl > 0 {
+		opts.TTL = ttl
+	}
+	return opts
+}
+
+// incrOptions returns a copy of opts with the bucket's DefaultTTL applied.
+func incrOptions[T int64 | float64](b *Bucket, opts *kv.IncrOptions[T]) *kv.IncrOptions[T] {
+	o := &kv.IncrOptions[T]{}
+	if opts != nil {
+		*o = *opts
+	}
+	if o.TTL <= 0 {
+		o.TTL = b.opts.DefaultTTL
+	}
+	return o
+}
+
 func (b *Bucket) loadOpts(ctx context.Context) error {
 	key := bytesconv.StringToBytes(b.name + _markBucketOpts)
-	var val []byte
-	err := kv.WithTxn(b.store, false, func(txn any) error {
+	var val, atime []byte
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
 		var err error
-		val, err = b.store.Get(ctx, txn, key)
+		if val, err = txn.Get(ctx, key); err != nil {
+			return err
+		}
+		atime, err = txn.Get(ctx, []byte(b.name+_markAccessTime))
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			return nil
+		}
 		return err
 	})
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(val, b.opts)
+	if atime != nil {
+		b.atime = time.Unix(cast.ToInt64(string(atime)), 0)
+	}
+	opts := &BucketOptions{}
+	if err := json.Unmarshal(val, opts); err != nil {
+		return err
+	}
+	if err := compileIndexes(opts); err != nil {
+		return err
+	}
+	b.opts = opts
+	return nil
 }
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+// Default number of buckets cached by LoadBucket, see SetBucketCacheSize.
+const DefaultBucketCacheSize = 10000
+
+var _buckets = newBucketCache(DefaultBucketCacheSize)
+
+// CacheStats are the counters of a cache, Entries is only known for the
+// bucket cache.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries,omitempty"`
+	Size      int    `json:"size"`
+}
+
+// SetBucketCacheSize bounds the number of buckets, known or not, cached by
+// LoadBucket. 0 disables the cache.
+func SetBucketCacheSize(n int) {
+	_buckets.resize(n)
+}
+
+func BucketCacheStats() *CacheStats {
+	return _buckets.stats()
+}
+
+// bucketCache is an LRU cache of the buckets loaded from a store, nil for
+// unknown names. Every invalidation bumps gen, so that a bucket loaded
+// before is not added afterwards.
+type bucketCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List // Most recently used first.
+	items map[string]*list.Element
+	gen   uint64
+
+	hits, misses, evictions atomic.Uint64
+}
+
+type cachedBucket struct {
+	store kv.Store
+	name  string
+	b     *Bucket
+}
+
+func newBucketCache(size int) *bucketCache {
+	return &bucketCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the entry of name, or nil and the generation to add it with.
+func (c *bucketCache) get(store kv.Store, name string) (*cachedBucket, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[name]; ok {
+		if e := el.Value.(*cachedBucket); e.store == store {
+			c.ll.MoveToFront(el)
+			c.hits.Add(1)
+			return e, 0
+		}
+	}
+	c.misses.Add(1)
+	return nil, c.gen
+}
+
+func (c *bucketCache) add(gen uint64, e *cachedBucket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen || c.size == 0 {
+		return
+	}
+	if el, ok := c.items[e.name]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[e.name] = c.ll.PushFront(e)
+	c.evict()
+}
+
+func (c *bucketCache) evict() {
+	for c.ll.Len() > c.size {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*cachedBucket).name)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *bucketCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if el, ok := c.items[name]; ok {
+		c.ll.Remove(el)
+		delete(c.items, name)
+	}
+}
+
+func (c *bucketCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.ll.Init()
+	clear(c.items)
+}
+
+func (c *bucketCache) resize(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = n
+	c.evict()
+}
+
+func (c *bucketCache) stats() *CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   c.ll.Len(),
+		Size:      c.size,
+	}
+}
+
+// loadCachedBucket returns a copy of the cached bucket, which the caller may
+// modify, loading it on a miss.
+func loadCachedBucket(ctx context.Context, store kv.Store, name string) (*Bucket, error) {
+	if readOnly(ctx) {
+		// The buckets of a replica are written by its primary.
+		return loadBucket(ctx, store, name)
+	}
+	e, gen := _buckets.get(store, name)
+	if e == nil {
+		b, err := loadBucket(ctx, store, name)
+		if err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+			return nil, err
+		}
+		e = &cachedBucket{store: store, name: name, b: b}
+		_buckets.add(gen, e)
+	}
+	if e.b == nil {
+		return nil, kv.ErrKeyNotFound
+	}
+	b := *e.b
+	return &b, nil
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+// cached reports whether the cache holds an entry for name in store.
+func cached(s kv.Store, name string) bool {
+	e, _ := _buckets.get(s, name)
+	return e != nil
+}
+
+func TestBucketCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	s := memory.New()
+	b, err := NewBucket(ctx, s, &BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func() *Bucket {
+		t.Helper()
+		got, err := LoadBucket(ctx, s, b.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached(s, b.name) {
+			t.Fatal("bucket not cached")
+		}
+		return got
+	}
+	load()
+
+	err = b.updateOpts(ctx, func(opts *BucketOptions) error {
+		opts.DefaultTTL = time.Hour
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached(s, b.name) {
+		t.Error("bucket cached after updateOpts")
+	}
+	if got := load().opts.DefaultTTL; got != time.Hour {
+		t.Errorf("DefaultTTL after updateOpts = %v, want 1h", got)
+	}
+
+	b.opts.DefaultTTL = time.Minute
+	if err := b.storeOpts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if cached(s, b.name) {
+		t.Error("bucket cached after storeOpts")
+	}
+	if got := load().opts.DefaultTTL; got != time.Minute {
+		t.Errorf("DefaultTTL after storeOpts = %v, want 1m", got)
+	}
+
+	if err := b.Drop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadBucket(ctx, s, b.name); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Fatalf("LoadBucket after Drop error = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestBucketCacheNegative(t *testing.T) {
+	ctx := context.Background()
+	s := memory.New()
+	const name = "cachedmissingbucket1"
+	if _, err := LoadBucket(ctx, s, name); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Fatalf("LoadBucket error = %v, want ErrKeyNotFound", err)
+	}
+	if !cached(s, name) {
+		t.Fatal("unknown bucket not cached")
+	}
+
+	saved := idgen
+	idgen = func() string { return name }
+	t.Cleanup(func() { idgen = saved })
+	if _, err := NewBucket(ctx, s, &BucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadBucket(ctx, s, name); err != nil {
+		t.Fatalf("LoadBucket after NewBucket: %v", err)
+	}
+}
+
+func TestBucketCacheRace(t *testing.T) {
+	ctx := context.Background()
+	s := memory.New()
+	b, err := NewBucket(ctx, s, &BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A load reads the options, which are then updated before it adds them
+	// to the cache.
+	e, gen := _buckets.get(s, b.name)
+	if e != nil {
+		t.Fatal("bucket cached before being loaded")
+	}
+	stale, err := loadBucket(ctx, s, b.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.updateOpts(ctx, func(opts *BucketOptions) error {
+		opts.DefaultTTL = time.Hour
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_buckets.add(gen, &cachedBucket{store: s, name: b.name, b: stale})
+	if cached(s, b.name) {
+		t.Fatal("bucket loaded before an invalidation was cached")
+	}
+
+	got, err := LoadBucket(ctx, s, b.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.opts.DefaultTTL != time.Hour {
+		t.Errorf("DefaultTTL = %v, want 1h", got.opts.DefaultTTL)
+	}
+}
@@ -0,0 +1,42 @@
+package core
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// Clone creates a new bucket with opts and copies the elements of b whose
+// key starts with prefix, with their TTL, from a consistent snapshot.
+// Scripts are always copied. Indexes are not, they can be created on the
+// clone. The new bucket is dropped if the copy fails.
+func (b *Bucket) Clone(ctx context.Context, opts *BucketOptions, prefix string) (*Bucket, error) {
+	nb, err := NewBucket(ctx, b.store, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	im := nb.newImporter(ctx, &ImportOptions{PreserveTTL: true})
+	err = b.Export(ctx, func(rec *Record) error {
+		if rec.Type != RecordTypeScript && !strings.HasPrefix(rec.Key, prefix) {
+			return nil
+		}
+		return im.add(ctx, rec)
+	})
+	if err == nil {
+		err = im.finish(ctx)
+	}
+	im.close()
+	if err != nil {
+		// The batch may have been flushed in part. Drop even if ctx is
+		// canceled, which may be why the copy failed.
+		if err := nb.Drop(context.WithoutCancel(ctx)); err != nil {
+			slog.WarnContext(ctx, "core: Failed to drop a failed clone",
+				"bucket", nb.name,
+				"err", err,
+			)
+		}
+		return nil, err
+	}
+	return nb, nil
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+func TestCloneFailure(t *testing.T) {
+	ctx := context.Background()
+	s := memory.New()
+	b, err := NewBucket(ctx, s, &BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set(ctx, []byte("k"), []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := b.Clone(canceled, &BucketOptions{}, ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Clone error = %v, want context.Canceled", err)
+	}
+	// The clone has been dropped.
+	err = kv.WithTxn(s, false, func(txn kv.Txn) error {
+		return txn.Iterate(ctx, &kv.IterOptions{KeysOnly: true}, func(k, _ []byte) error {
+			if !strings.HasPrefix(string(k), b.name) {
+				t.Errorf("key %q left by a failed clone", k)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
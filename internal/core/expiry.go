@@ -0,0 +1,227 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+)
+
+var ErrBucketExpired = errors.New("core: bucket expired")
+
+// The last access time of a bucket is written at most once per
+// _accessResolution by a process.
+const _accessResolution = time.Minute
+
+// Bucket name -> time of the last write of its access time.
+var _accessed sync.Map
+
+type BucketInfo struct {
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastAccess time.Time  `json:"last_access"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+
+	// Number of stored entries and their total size in bytes, including
+	// internal ones.
+	Entries int64 `json:"entries"`
+	Size    int64 `json:"size"`
+}
+
+// ListBuckets calls fn with the name of every bucket having data, which
+// includes the leftovers of buckets whose deletion was interrupted.
+func ListBuckets(ctx context.Context, store kv.Store, fn func(name string) error) error {
+	var seek []byte
+	for {
+		var name string
+		err := kv.WithTxn(store, false, func(txn kv.Txn) error {
+			return txn.Iterate(ctx, &kv.IterOptions{
+				Seek:     seek,
+				KeysOnly: true,
+			}, func(k, _ []byte) error {
+				if len(k) > _bucketNameLen && k[_bucketNameLen] == ':' {
+					name = string(k[:_bucketNameLen])
+					return kv.ErrStopIteration
+				}
+				seek = append(k, 0)
+				return nil
+			})
+		})
+		if err != nil || name == "" {
+			return err
+		}
+		if err := fn(name); err != nil {
+			return err
+		}
+		// Skip the other keys of the bucket, ';' follows ':'.
+		seek = []byte(name + ";")
+	}
+}
+
+// ReapBuckets deletes the expired buckets and the leftovers of deleted ones,
+// and returns the number of buckets deleted.
+func ReapBuckets(ctx context.Context, store kv.Store) (int, error) {
+	var names []string
+	err := ListBuckets(ctx, store, func(name string) error {
+		b, err := loadBucket(ctx, store, name)
+		switch {
+		case errors.Is(err, kv.ErrKeyNotFound):
+		case err != nil:
+			return err
+		case !b.expired(time.Now()):
+			return nil
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, name := range names {
+		b := &Bucket{store: store, name: name, opts: &BucketOptions{}}
+		if err := b.Drop(ctx); err != nil {
+			return i, err
+		}
+	}
+	return len(names), nil
+}
+
+// DropBucket drops the bucket name, expired or not, without recording an
+// access to it.
+func DropBucket(ctx context.Context, store kv.Store, name string) error {
+	b, err := loadBucket(ctx, store, name)
+	if err != nil {
+		return err
+	}
+	return b.Drop(ctx)
+}
+
+// RunReaper calls ReapBuckets every interval until ctx is done.
+func RunReaper(ctx context.Context, store kv.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := ReapBuckets(ctx, store)
+		if errors.Is(err, kv.ErrNotLeader) {
+			// The leader reaps the buckets of a cluster.
+			continue
+		}
+		if err != nil {
+			slog.Error("core: Failed to reap buckets", "err", err)
+		}
+		if n > 0 {
+			slog.Info("core: Reaped buckets", "count", n)
+		}
+	}
+}
+
+// Touch records an access to the bucket, which postpones its expiry for
+// inactivity.
+func (b *Bucket) Touch(ctx context.Context) error {
+	if readOnly(ctx) {
+		// Replicas get the access times of their primary.
+		return nil
+	}
+	now := time.Now()
+	if last, ok := _accessed.Load(b.name); ok && now.Sub(last.(time.Time)) < _accessResolution {
+		return nil
+	}
+	_accessed.Store(b.name, now)
+
+	key := bytesconv.StringToBytes(b.name + _markAccessTime)
+	val := strconv.AppendInt(nil, now.Unix(), 10)
+	err := kv.WithTxn(b.store, true, func(txn kv.Txn) error {
+		return txn.Set(ctx, key, val, nil)
+	})
+	if err != nil {
+		return err
+	}
+	b.atime = now
+	return nil
+}
+
+// Drop deletes the bucket and all of its data.
+func (b *Bucket) Drop(ctx context.Context) error {
+	if readOnly(ctx) {
+		return kv.ErrReadOnlyTxn
+	}
+	// Delete the options first, so that the bucket cannot be loaded anymore.
+	key := bytesconv.StringToBytes(b.name + _markBucketOpts)
+	err := kv.WithTxn(b.store, true, func(txn kv.Txn) error {
+		return txn.Delete(ctx, key)
+	})
+	_buckets.invalidate(b.name)
+	if err != nil {
+		return err
+	}
+	_accessed.Delete(b.name)
+	return b.deletePrefix(ctx, []byte(b.name+":"))
+}
+
+func (b *Bucket) Info(ctx context.Context) (*BucketInfo, error) {
+	info := &BucketInfo{
+		Name:       b.name,
+		CreatedAt:  b.opts.CreatedAt,
+		LastAccess: b.lastAccess(),
+	}
+	if t, ok := b.expiresAt(); ok {
+		info.ExpiresAt = &t
+	}
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		return txn.Iterate(ctx, &kv.IterOptions{
+			Prefix: []byte(b.name + ":"),
+		}, func(k, v []byte) error {
+			info.Entries++
+			info.Size += int64(len(k) + len(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (b *Bucket) lastAccess() time.Time {
+	t := b.opts.CreatedAt
+	if b.atime.After(t) {
+		t = b.atime
+	}
+	// A cached bucket misses the accesses recorded since it was loaded.
+	if last, ok := _accessed.Load(b.name); ok && last.(time.Time).After(t) {
+		t = last.(time.Time)
+	}
+	return t
+}
+
+// expiresAt returns when the bucket expires given its last access.
+func (b *Bucket) expiresAt() (time.Time, bool) {
+	var (
+		t  time.Time
+		ok bool
+	)
+	if b.opts.TTL > 0 && !b.opts.CreatedAt.IsZero() {
+		t, ok = b.opts.CreatedAt.Add(b.opts.TTL), true
+	}
+	if b.opts.InactivityTTL > 0 {
+		if it := b.lastAccess().Add(b.opts.InactivityTTL); !ok || it.Before(t) {
+			t, ok = it, true
+		}
+	}
+	return t, ok
+}
+
+func (b *Bucket) expired(now time.Time) bool {
+	t, ok := b.expiresAt()
+	return ok && !now.Before(t)
+}
@@ -0,0 +1,43 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+func TestDropExpiredBucket(t *testing.T) {
+	ctx := context.Background()
+	s := memory.New()
+	b, err := NewBucket(ctx, s, &BucketOptions{TTL: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set(ctx, []byte("k"), []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := LoadBucket(ctx, s, b.name); !errors.Is(err, ErrBucketExpired) {
+		t.Fatalf("LoadBucket error = %v, want ErrBucketExpired", err)
+	}
+
+	if err := DropBucket(ctx, s, b.name); err != nil {
+		t.Fatal(err)
+	}
+	err = kv.WithTxn(s, false, func(txn kv.Txn) error {
+		return txn.Iterate(ctx, &kv.IterOptions{KeysOnly: true}, func(k, _ []byte) error {
+			t.Errorf("key %q left after DropBucket", k)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DropBucket(ctx, s, b.name); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("DropBucket of a dropped bucket: error = %v, want ErrKeyNotFound", err)
+	}
+}
@@ -0,0 +1,349 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+)
+
+var ErrInvalidRecord = errors.New("core: invalid record")
+
+type RecordType string
+
+const (
+	RecordTypeKV     RecordType = "kv"
+	RecordTypeHash   RecordType = "hash"
+	RecordTypeZSet   RecordType = "zset"
+	RecordTypeSet    RecordType = "set"
+	RecordTypeScript RecordType = "script"
+)
+
+// Record is an element of a bucket in an export. Key is the key, or the name
+// of a script, Field is set for hashes and Member for sorted sets and sets.
+type Record struct {
+	Type   RecordType `json:"type"`
+	Key    string     `json:"key"`
+	Field  string     `json:"field,omitempty"`
+	Member string     `json:"member,omitempty"`
+	Score  float64    `json:"score,omitempty"`
+	Value  []byte     `json:"value,omitempty"`
+
+	// Remaining time to live in seconds, 0 if the element does not expire.
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+type ImportOptions struct {
+	// Replace existing elements, they are skipped otherwise. This includes
+	// the elements imported earlier by the same import: with Overwrite the
+	// last record of an element wins, without it the first one.
+	Overwrite bool
+
+	// Use the TTL of the records instead of the bucket's DefaultTTL.
+	PreserveTTL bool
+}
+
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// Export calls fn for every element of the bucket from a consistent
+// snapshot. Index entries are not exported, they are derived from the values.
+func (b *Bucket) Export(ctx context.Context, fn func(rec *Record) error) error {
+	return kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		kvPrefix := b.udataKey(nil, _markKeyValue)
+		err := b.exportPrefix(ctx, txn, kvPrefix, func(k, v []byte) (*Record, error) {
+			return &Record{
+				Type:  RecordTypeKV,
+				Key:   string(k[len(kvPrefix):]),
+				Value: v,
+			}, nil
+		}, fn)
+		if err != nil {
+			return err
+		}
+
+		err = b.exportComposite(ctx, txn, _markHash, func(key, sub, v []byte) (*Record, error) {
+			return &Record{
+				Type:  RecordTypeHash,
+				Key:   string(key),
+				Field: string(sub),
+				Value: v,
+			}, nil
+		}, fn)
+		if err != nil {
+			return err
+		}
+
+		err = b.exportComposite(ctx, txn, _markZMember, func(key, sub, v []byte) (*Record, error) {
+			if len(v) != 8 {
+				return nil, kv.ErrInvalidNum
+			}
+			return &Record{
+				Type:   RecordTypeZSet,
+				Key:    string(key),
+				Member: string(sub),
+				Score:  math.Float64frombits(binary.BigEndian.Uint64(v)),
+			}, nil
+		}, fn)
+		if err != nil {
+			return err
+		}
+
+		err = b.exportComposite(ctx, txn, _markSet, func(key, sub, _ []byte) (*Record, error) {
+			return &Record{
+				Type:   RecordTypeSet,
+				Key:    string(key),
+				Member: string(sub),
+			}, nil
+		}, fn)
+		if err != nil {
+			return err
+		}
+
+		scriptsPrefix := b.udataKey(nil, _markScripts)
+		return b.exportPrefix(ctx, txn, scriptsPrefix, func(k, v []byte) (*Record, error) {
+			return &Record{
+				Type:  RecordTypeScript,
+				Key:   string(k[len(scriptsPrefix):]),
+				Value: v,
+			}, nil
+		}, fn)
+	})
+}
+
+// exportPrefix turns the keys with prefix into records, adding their TTL.
+func (b *Bucket) exportPrefix(
+	ctx context.Context,
+	txn kv.Txn,
+	prefix []byte,
+	record func(k, v []byte) (*Record, error),
+	fn func(rec *Record) error,
+) error {
+	return txn.Iterate(ctx, &kv.IterOptions{
+		Prefix: prefix,
+	}, func(k, v []byte) error {
+		rec, err := record(k, v)
+		if err != nil {
+			return err
+		}
+		ttl, err := txn.TTL(ctx, k)
+		if err != nil {
+			return err
+		}
+		// Round up, a key about to expire must not become persistent.
+		rec.TTL = int64((ttl + time.Second - 1) / time.Second)
+		return fn(rec)
+	})
+}
+
+func (b *Bucket) exportComposite(
+	ctx context.Context,
+	txn kv.Txn,
+	mark string,
+	record func(key, sub, v []byte) (*Record, error),
+	fn func(rec *Record) error,
+) error {
+	prefix := b.udataKey(nil, mark)
+	return b.exportPrefix(ctx, txn, prefix, func(k, v []byte) (*Record, error) {
+		key, sub, ok := splitCompositeKey(k[len(prefix):])
+		if !ok {
+			return nil, ErrInvalidRecord
+		}
+		return record(key, sub, v)
+	}, fn)
+}
+
+// Import writes the records returned by next until it returns io.EOF. The
+// writes go through a kv.WriteBatch, so an import is not atomic and is not
+// limited by the size of a transaction. Indexes covering imported keys are
+// rebuilt in the background.
+func (b *Bucket) Import(
+	ctx context.Context,
+	next func() (*Record, error),
+	opts *ImportOptions,
+) (*ImportResult, error) {
+	if readOnly(ctx) {
+		return nil, kv.ErrReadOnlyTxn
+	}
+	im := b.newImporter(ctx, opts)
+	defer im.close()
+	for {
+		rec, err := next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return im.res, err
+		}
+		if err := im.add(ctx, rec); err != nil {
+			return im.res, err
+		}
+	}
+	return im.res, im.finish(ctx)
+}
+
+type importer struct {
+	b    *Bucket
+	opts *ImportOptions
+	res  *ImportResult
+
+	// Existing elements are looked up in a snapshot taken before the import.
+	txn kv.Txn
+	wb  kv.WriteBatch
+	// Invalidates the cached values written by wb.
+	invalidate func()
+
+	reindex map[string]struct{}
+	// Scores written by this import, for members imported twice.
+	scores map[string]float64
+	// Elements written by this import, which exist for later records
+	// without Overwrite.
+	imported map[string]struct{}
+}
+
+func (b *Bucket) newImporter(ctx context.Context, opts *ImportOptions) *importer {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	wb, invalidate := b.trackBatch(ctx, b.store.NewWriteBatch())
+	return &importer{
+		b:          b,
+		opts:       opts,
+		res:        &ImportResult{},
+		txn:        b.store.NewTransaction(false),
+		wb:         wb,
+		invalidate: invalidate,
+		reindex:    make(map[string]struct{}),
+		scores:     make(map[string]float64),
+		imported:   make(map[string]struct{}),
+	}
+}
+
+func (im *importer) add(ctx context.Context, rec *Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := im.b
+
+	key := bytesconv.StringToBytes(rec.Key)
+	if len(key) == 0 {
+		return ErrInvalidRecord
+	}
+	setOpts := b.setOptions(0)
+	if im.opts.PreserveTTL {
+		setOpts = &kv.SetOptions{TTL: time.Duration(rec.TTL) * time.Second}
+	}
+
+	var uKey []byte
+	switch rec.Type {
+	case RecordTypeKV:
+		uKey = b.udataKey(key, _markKeyValue)
+	case RecordTypeHash:
+		uKey = b.compositeKey(_markHash, key, bytesconv.StringToBytes(rec.Field))
+	case RecordTypeZSet:
+		if math.IsNaN(rec.Score) {
+			return ErrInvalidRecord
+		}
+		uKey = b.compositeKey(_markZMember, key, bytesconv.StringToBytes(rec.Member))
+		// Both keys of the member expire at the same time, see zadd.
+		if setOpts.TTL > 0 {
+			setOpts.ExpiresAt = time.Now().Add(setOpts.TTL)
+		}
+	case RecordTypeSet:
+		uKey = b.compositeKey(_markSet, key, bytesconv.StringToBytes(rec.Member))
+	case RecordTypeScript:
+		uKey = b.udataKey(key, _markScripts)
+		setOpts = nil
+	default:
+		return ErrInvalidRecord
+	}
+
+	exists, err := im.txn.Has(ctx, uKey)
+	if err != nil {
+		return err
+	}
+	if !im.opts.Overwrite {
+		if _, ok := im.imported[string(uKey)]; exists || ok {
+			im.res.Skipped++
+			return nil
+		}
+		im.imported[string(uKey)] = struct{}{}
+	}
+
+	val := rec.Value
+	switch rec.Type {
+	case RecordTypeKV:
+		for _, idx := range b.indexesFor(key) {
+			im.reindex[idx.Name] = struct{}{}
+		}
+		setOpts.KeepVersions = b.keepsHistory()
+	case RecordTypeZSet:
+		member := bytesconv.StringToBytes(rec.Member)
+		prev, ok := im.scores[string(uKey)]
+		if !ok && exists {
+			if prev, err = b.zscore(ctx, im.txn, key, member); err != nil {
+				return err
+			}
+			ok = true
+		}
+		if ok {
+			if err := im.wb.Delete(b.zscoreKey(key, member, prev)); err != nil {
+				return err
+			}
+		}
+		im.scores[string(uKey)] = rec.Score
+		if err := im.wb.Set(b.zscoreKey(key, member, rec.Score), nil, setOpts); err != nil {
+			return err
+		}
+		val = binary.BigEndian.AppendUint64(nil, math.Float64bits(rec.Score))
+	case RecordTypeSet:
+		val = nil
+	}
+	if err := im.wb.Set(uKey, val, setOpts); err != nil {
+		return err
+	}
+	im.res.Imported++
+	return nil
+}
+
+func (im *importer) finish(ctx context.Context) error {
+	if err := im.wb.Flush(); err != nil {
+		return err
+	}
+	if err := im.b.sync(ctx); err != nil {
+		return err
+	}
+	for name := range im.reindex {
+		if err := im.b.rebuildIndex(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) close() {
+	im.wb.Cancel()
+	im.invalidate()
+	im.txn.Discard()
+}
+
+// splitCompositeKey is the inverse of compositeKey, sub is what follows the
+// bucket name and the mark.
+func splitCompositeKey(sub []byte) ([]byte, []byte, bool) {
+	if len(sub) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(sub)
+	sub = sub[4:]
+	if uint64(len(sub)) < uint64(n) {
+		return nil, nil, false
+	}
+	return sub[:n], sub[n:], true
+}
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+func importRecords(b *Bucket, recs []*Record, opts *ImportOptions) (*ImportResult, error) {
+	return b.Import(context.Background(), func() (*Record, error) {
+		if len(recs) == 0 {
+			return nil, io.EOF
+		}
+		rec := recs[0]
+		recs = recs[1:]
+		return rec, nil
+	}, opts)
+}
+
+func TestImportDuplicates(t *testing.T) {
+	ctx := context.Background()
+	recs := []*Record{
+		{Type: RecordTypeKV, Key: "k", Value: []byte("1")},
+		{Type: RecordTypeZSet, Key: "z", Member: "m", Score: 1},
+		{Type: RecordTypeKV, Key: "k", Value: []byte("2")},
+		{Type: RecordTypeZSet, Key: "z", Member: "m", Score: 2},
+	}
+	for _, tt := range []struct {
+		overwrite bool
+		want      string
+		score     float64
+		res       ImportResult
+	}{
+		{overwrite: false, want: "1", score: 1, res: ImportResult{Imported: 2, Skipped: 2}},
+		{overwrite: true, want: "2", score: 2, res: ImportResult{Imported: 4}},
+	} {
+		b, err := NewBucket(ctx, memory.New(), &BucketOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := importRecords(b, recs, &ImportOptions{Overwrite: tt.overwrite})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *res != tt.res {
+			t.Errorf("overwrite %v: result = %+v, want %+v", tt.overwrite, *res, tt.res)
+		}
+		if val, err := b.Get(ctx, []byte("k")); err != nil || string(val) != tt.want {
+			t.Errorf("overwrite %v: Get = %q, %v, want %q", tt.overwrite, val, err, tt.want)
+		}
+		ms, err := b.ZRange(ctx, []byte("z"), 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ms) != 1 || ms[0].Score != tt.score {
+			t.Errorf("overwrite %v: ZRange = %v, want m with score %v",
+				tt.overwrite, ms, tt.score)
+		}
+	}
+}
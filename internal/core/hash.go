@@ -0,0 +1,213 @@
+package core
+
+import (
+	"context"
+	"errors"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+)
+
+type OpHSet struct {
+	Key   []byte
+	Field []byte
+	Value []byte
+}
+
+type OpHDelete struct {
+	Key   []byte
+	Field []byte
+}
+
+type OpHIncrBy struct {
+	Key       []byte
+	Field     []byte
+	Increment int64
+}
+
+func (b *Bucket) HSet(ctx context.Context, key, field, val []byte) error {
+	return b.update(ctx, func(txn kv.Txn) error {
+		return b.hset(ctx, txn, key, field, val)
+	})
+}
+
+func (b *Bucket) HGet(ctx context.Context, key, field []byte) ([]byte, error) {
+	var val []byte
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		var err error
+		val, err = txn.Get(ctx, b.compositeKey(_markHash, key, field))
+		return err
+	})
+	return val, err
+}
+
+// HDel removes the given fields and returns the number of fields that existed.
+func (b *Bucket) HDel(ctx context.Context, key []byte, fields ...[]byte) (int, error) {
+	var n int
+	err := b.update(ctx, func(txn kv.Txn) error {
+		var err error
+		n, err = b.hdel(ctx, txn, key, fields...)
+		return err
+	})
+	return n, err
+}
+
+func (b *Bucket) HGetAll(ctx context.Context, key []byte) (map[string][]byte, error) {
+	var m map[string][]byte
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		var err error
+		m, err = b.hgetall(ctx, txn, key)
+		return err
+	})
+	return m, err
+}
+
+func (b *Bucket) HIncrBy(ctx context.Context, key, field []byte, increment int64) (int64, error) {
+	var num int64
+	err := b.update(ctx, func(txn kv.Txn) error {
+		var err error
+		num, err = b.hincrby(ctx, txn, key, field, increment)
+		return err
+	})
+	return num, err
+}
+
+func (b *Bucket) hset(ctx context.Context, txn kv.Txn, key, field, val []byte) error {
+	uKey := b.compositeKey(_markHash, key, field)
+	return txn.Set(ctx, uKey, val, b.setOptions(0))
+}
+
+func (b *Bucket) hdel(ctx context.Context, txn kv.Txn, key []byte, fields ...[]byte) (int, error) {
+	var n int
+	for _, field := range fields {
+		uKey := b.compositeKey(_markHash, key, field)
+		ok, err := txn.Has(ctx, uKey)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		if err := txn.Delete(ctx, uKey); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (b *Bucket) hgetall(ctx context.Context, txn kv.Txn, key []byte) (map[string][]byte, error) {
+	prefix := b.compositeKey(_markHash, key, nil)
+	m := make(map[string][]byte)
+	err := txn.Iterate(ctx, &kv.IterOptions{
+		Prefix: prefix,
+	}, func(k, v []byte) error {
+		m[string(k[len(prefix):])] = v
+		return nil
+	})
+	return m, err
+}
+
+func (b *Bucket) hincrby(
+	ctx context.Context,
+	txn kv.Txn,
+	key, field []byte,
+	increment int64,
+) (int64, error) {
+	uKey := b.compositeKey(_markHash, key, field)
+	return txn.Incr(ctx, uKey, increment, incrOptions[int64](b, nil))
+}
+
+func mkLuaHash(ctx context.Context, b *Bucket, txn kv.Txn, l *lua.LState) *lua.LTable {
+	fns := map[string]lua.LGFunction{
+		"set": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			field := l.CheckString(2)
+			val := l.CheckString(3)
+			if err := b.hset(
+				ctx,
+				txn,
+				bytesconv.StringToBytes(key),
+				bytesconv.StringToBytes(field),
+				bytesconv.StringToBytes(val),
+			); err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+			}
+			return 0
+		},
+		"get": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			field := l.CheckString(2)
+			uKey := b.compositeKey(
+				_markHash,
+				bytesconv.StringToBytes(key),
+				bytesconv.StringToBytes(field),
+			)
+			val, err := txn.Get(ctx, uKey)
+			if err != nil {
+				if errors.Is(err, kv.ErrKeyNotFound) {
+					l.Push(lua.LNil)
+					return 1
+				}
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(lua.LString(val))
+			return 1
+		},
+		"del": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			fields := make([][]byte, 0, l.GetTop()-1)
+			for i := 2; i <= l.GetTop(); i++ {
+				fields = append(fields, bytesconv.StringToBytes(l.CheckString(i)))
+			}
+			n, err := b.hdel(ctx, txn, bytesconv.StringToBytes(key), fields...)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(lua.LNumber(n))
+			return 1
+		},
+		"getall": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			m, err := b.hgetall(ctx, txn, bytesconv.StringToBytes(key))
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			tb := l.NewTable()
+			for k, v := range m {
+				tb.RawSetString(k, lua.LString(v))
+			}
+			l.Push(tb)
+			return 1
+		},
+		"incrby": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			field := l.CheckString(2)
+			increment := l.CheckInt64(3)
+			num, err := b.hincrby(
+				ctx,
+				txn,
+				bytesconv.StringToBytes(key),
+				bytesconv.StringToBytes(field),
+				increment,
+			)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(lua.LNumber(num))
+			return 1
+		},
+	}
+
+	mod := l.NewTable()
+	for name, f := range fns {
+		mod.RawSetString(name, l.NewFunction(f))
+	}
+	return mod
+}
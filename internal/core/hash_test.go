@@ -0,0 +1,90 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"math"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+func TestHash(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewBucket(ctx, memory.New(), &BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("h")
+	hgetall := func() map[string]string {
+		t.Helper()
+		m, err := b.HGetAll(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string, len(m))
+		for k, v := range m {
+			got[k] = string(v)
+		}
+		return got
+	}
+
+	for _, f := range []string{"a", "b", "c"} {
+		if err := b.HSet(ctx, key, []byte(f), []byte(f+f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another key sharing the prefix of key.
+	if err := b.HSet(ctx, []byte("hh"), []byte("a"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := b.HGet(ctx, key, []byte("b")); err != nil || string(val) != "bb" {
+		t.Errorf("HGet = %q, %v, want %q", val, err, "bb")
+	}
+	if _, err := b.HGet(ctx, key, []byte("z")); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("HGet of a missing field = %v, want ErrKeyNotFound", err)
+	}
+	want := map[string]string{"a": "aa", "b": "bb", "c": "cc"}
+	if got := hgetall(); !maps.Equal(got, want) {
+		t.Errorf("HGetAll = %v, want %v", got, want)
+	}
+
+	if n, err := b.HDel(ctx, key, []byte("a"), []byte("z"), []byte("a")); err != nil || n != 1 {
+		t.Errorf("HDel = %d, %v, want 1", n, err)
+	}
+
+	for _, tt := range []struct {
+		field     string
+		increment int64
+		want      int64
+		wantErr   error
+	}{
+		{"n", 5, 5, nil},
+		{"n", -7, -2, nil},
+		{"b", 1, 0, kv.ErrInvalidNum},
+		{"n", math.MinInt64, 0, kv.ErrOutOfRange},
+	} {
+		got, err := b.HIncrBy(ctx, key, []byte(tt.field), tt.increment)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("HIncrBy(%q, %d) = %d, %v, want %d, %v",
+				tt.field, tt.increment, got, err, tt.want, tt.wantErr)
+		}
+	}
+	// A failed increment leaves the field unchanged.
+	if val, err := b.HGet(ctx, key, []byte("n")); err != nil || string(val) != "-2" {
+		t.Errorf("HGet = %q, %v, want %q", val, err, "-2")
+	}
+
+	// Deleting the last fields deletes the hash.
+	if n, err := b.HDel(ctx, key, []byte("b"), []byte("c"), []byte("n")); err != nil || n != 3 {
+		t.Errorf("HDel = %d, %v, want 3", n, err)
+	}
+	if got := hgetall(); len(got) != 0 {
+		t.Errorf("HGetAll = %v, want empty", got)
+	}
+	if val, err := b.HGet(ctx, []byte("hh"), []byte("a")); err != nil || string(val) != "x" {
+		t.Errorf("HGet of another key = %q, %v, want %q", val, err, "x")
+	}
+}
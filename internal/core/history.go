@@ -0,0 +1,165 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+var ErrHistoryNotSupported = errors.New("core: store does not keep history")
+
+// History calls fn for every retained version of key, newest first. A
+// delete or expiry ends the history of a key.
+func (b *Bucket) History(ctx context.Context, key []byte, fn func(v *kv.Version) error) error {
+	vs, ok := b.store.(kv.VersionedStore)
+	if !ok || !b.keepsHistory() {
+		return ErrHistoryNotSupported
+	}
+	retained := b.retention(time.Now())
+	return vs.Versions(ctx, b.udataKey(key, _markKeyValue), func(v *kv.Version) error {
+		if !retained(v.Version) {
+			return kv.ErrStopIteration
+		}
+		return fn(v)
+	})
+}
+
+// GetAt returns the value of key as of at, ErrKeyNotFound is returned when
+// the key did not exist then or its version is no longer retained.
+func (b *Bucket) GetAt(ctx context.Context, key []byte, at time.Time) ([]byte, error) {
+	ts := uint64(at.UnixNano())
+	var (
+		val   []byte
+		found bool
+	)
+	err := b.History(ctx, key, func(v *kv.Version) error {
+		if v.Version > ts {
+			return nil
+		}
+		if !v.Deleted && (v.ExpiresAt == 0 || v.ExpiresAt > uint64(at.Unix())) {
+			val, found = v.Value, true
+		}
+		return kv.ErrStopIteration
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, kv.ErrKeyNotFound
+	}
+	return val, nil
+}
+
+func (b *Bucket) keepsHistory() bool {
+	return b.opts.HistoryVersions > 0 || b.opts.HistoryDuration > 0
+}
+
+// retention returns a func reporting whether a version is within the bucket's
+// history settings, it must be called with the versions of a key newest
+// first. Besides the versions written in the last HistoryDuration, the version
+// that was current when it started is kept too.
+func (b *Bucket) retention(now time.Time) func(ts uint64) bool {
+	cutoff := uint64(now.Add(-b.opts.HistoryDuration).UnixNano())
+	var (
+		i     int
+		newer uint64
+	)
+	return func(ts uint64) bool {
+		ok := i == 0 || i < b.opts.HistoryVersions ||
+			b.opts.HistoryDuration > 0 && newer >= cutoff
+		i++
+		newer = ts
+		return ok
+	}
+}
+
+// trackHistory wraps txn to record the keys written with KeepVersions, the
+// returned function prunes their history and must be called once txn is
+// committed.
+func (b *Bucket) trackHistory(txn kv.Txn) (kv.Txn, func(ctx context.Context)) {
+	if !b.keepsHistory() {
+		return txn, func(context.Context) {}
+	}
+	t := &historyTxn{Txn: txn, keys: make(map[string]struct{})}
+	return t, func(ctx context.Context) {
+		for key := range t.keys {
+			// The write is committed, a version left behind is only
+			// reclaimed by the next write of the key.
+			if err := b.pruneHistory(ctx, []byte(key)); err != nil {
+				slog.WarnContext(ctx, "core: Failed to prune history",
+					"bucket", b.name,
+					"err", err,
+				)
+			}
+		}
+	}
+}
+
+type historyTxn struct {
+	kv.Txn
+	keys map[string]struct{}
+}
+
+func (txn *historyTxn) Set(ctx context.Context, key, val []byte, opts *kv.SetOptions) error {
+	if opts != nil && opts.KeepVersions {
+		txn.keys[string(key)] = struct{}{}
+	}
+	return txn.Txn.Set(ctx, key, val, opts)
+}
+
+func (txn *historyTxn) Incr(
+	ctx context.Context,
+	key []byte,
+	increment int64,
+	opts *kv.IncrOptions[int64],
+) (int64, error) {
+	if opts != nil && opts.KeepVersions {
+		txn.keys[string(key)] = struct{}{}
+	}
+	return txn.Txn.Incr(ctx, key, increment, opts)
+}
+
+func (txn *historyTxn) IncrFloat(
+	ctx context.Context,
+	key []byte,
+	increment float64,
+	opts *kv.IncrOptions[float64],
+) (float64, error) {
+	if opts != nil && opts.KeepVersions {
+		txn.keys[string(key)] = struct{}{}
+	}
+	return txn.Txn.IncrFloat(ctx, key, increment, opts)
+}
+
+// pruneHistory lets the store reclaim the versions of uKey that fall out of
+// the history. It runs once the write of a new version is committed, as the
+// store rewrites the oldest retained version apart from that write.
+//
+// Replicas only load the versions committed since their last poll, so they
+// never see that rewrite and keep the pruned versions. History applies the
+// retention itself, reads from a replica are the same as from its primary.
+func (b *Bucket) pruneHistory(ctx context.Context, uKey []byte) error {
+	vs, ok := b.store.(kv.VersionedStore)
+	if !ok {
+		return nil
+	}
+	retained := b.retention(time.Now())
+
+	var oldest uint64
+	dropped := false
+	err := vs.Versions(ctx, uKey, func(v *kv.Version) error {
+		if !retained(v.Version) {
+			dropped = true
+			return kv.ErrStopIteration
+		}
+		oldest = v.Version
+		return nil
+	})
+	if err != nil || !dropped || oldest == 0 {
+		return err
+	}
+	return vs.DiscardVersionsBefore(ctx, uKey, oldest)
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+func newHistoryBucket(t *testing.T, opts *BucketOptions) *Bucket {
+	t.Helper()
+	s, err := badgerstore.New(badgerstore.DefaultOptions(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	b, err := NewBucket(context.Background(), s, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func history(t *testing.T, b *Bucket, key string) []string {
+	t.Helper()
+	var vals []string
+	err := b.History(context.Background(), []byte(key), func(v *kv.Version) error {
+		if v.Deleted {
+			vals = append(vals, "<deleted>")
+		} else {
+			vals = append(vals, string(v.Value))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vals
+}
+
+func TestHistoryVersions(t *testing.T) {
+	ctx := context.Background()
+	b := newHistoryBucket(t, &BucketOptions{HistoryVersions: 2})
+	for _, v := range []string{"1", "2", "3"} {
+		if err := b.Set(ctx, []byte("k"), []byte(v), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.Incr(ctx, []byte("k"), 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := history(t, b, "k"), []string{"4", "3"}; !slices.Equal(got, want) {
+		t.Errorf("History = %q, want %q", got, want)
+	}
+
+	// An aborted write prunes nothing.
+	errAbort := errors.New("abort")
+	err := b.update(ctx, func(txn kv.Txn) error {
+		if err := b.setKV(ctx, txn, []byte("k"), []byte("5"), b.setOptions(0)); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("update error = %v", err)
+	}
+	if got, want := history(t, b, "k"), []string{"4", "3"}; !slices.Equal(got, want) {
+		t.Errorf("History after an aborted write = %q, want %q", got, want)
+	}
+
+	// The versions out of the history have been discarded by the store.
+	var n int
+	err = b.store.(kv.VersionedStore).Versions(ctx, b.udataKey([]byte("k"), _markKeyValue),
+		func(*kv.Version) error {
+			n++
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("store kept %d versions, want 2", n)
+	}
+
+	if err := b.Delete(ctx, []byte("k")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := history(t, b, "k"), []string{"<deleted>"}; !slices.Equal(got, want) {
+		t.Errorf("History after Delete = %q, want %q", got, want)
+	}
+}
+
+func TestHistoryDuration(t *testing.T) {
+	ctx := context.Background()
+	b := newHistoryBucket(t, &BucketOptions{HistoryDuration: 100 * time.Millisecond})
+	for _, v := range []string{"0", "1"} {
+		if err := b.Set(ctx, []byte("k"), []byte(v), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, v := range []string{"2", "3"} {
+		if err := b.Set(ctx, []byte("k"), []byte(v), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "1" was current when the window started.
+	if got, want := history(t, b, "k"), []string{"3", "2", "1"}; !slices.Equal(got, want) {
+		t.Errorf("History = %q, want %q", got, want)
+	}
+}
+
+func TestGetAt(t *testing.T) {
+	ctx := context.Background()
+	b := newHistoryBucket(t, &BucketOptions{HistoryVersions: 10})
+	// The time before the writes, then after each of them.
+	ats := []time.Time{time.Now()}
+	for _, v := range []string{"a", "", "c"} {
+		if err := b.Set(ctx, []byte("k"), []byte(v), 0); err != nil {
+			t.Fatal(err)
+		}
+		ats = append(ats, time.Now())
+	}
+
+	for i, want := range []string{"", "a", "", "c"} {
+		got, err := b.GetAt(ctx, []byte("k"), ats[i])
+		if i == 0 {
+			if !errors.Is(err, kv.ErrKeyNotFound) {
+				t.Errorf("GetAt before the writes: error = %v, want ErrKeyNotFound", err)
+			}
+			continue
+		}
+		if err != nil || string(got) != want {
+			t.Errorf("GetAt %d = %q, %v, want %q", i, got, err, want)
+		}
+	}
+
+	// A delete ends the history.
+	if err := b.Delete(ctx, []byte("k")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetAt(ctx, []byte("k"), ats[3]); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("GetAt after Delete: error = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestHistoryNotSupported(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewBucket(ctx, memory.New(), &BucketOptions{HistoryVersions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetAt(ctx, []byte("k"), time.Now()); !errors.Is(err, ErrHistoryNotSupported) {
+		t.Errorf("GetAt error = %v, want ErrHistoryNotSupported", err)
+	}
+}
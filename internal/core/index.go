@@ -0,0 +1,690 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/jsondoc"
+)
+
+// A secondary index maps the value at Path of every JSON document stored
+// under Prefix to the document's key:
+//
+//	<bucket_name>:idx:<len(name)><name><sortable value><key> -> ""
+//
+// Entries are maintained in the same transaction as the write of the
+// document. Documents that are not JSON, or that have no indexable value at
+// Path, are not indexed.
+
+const _backfillBatchSize = 1000
+
+var (
+	ErrIndexExists   = errors.New("core: index already exists")
+	ErrIndexNotFound = errors.New("core: index not found")
+	ErrIndexNotReady = errors.New("core: index is being built")
+)
+
+// Indexes that are currently being backfilled, keyed by bucket and index name.
+var _backfills sync.Map
+
+type Index struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	Path   string `json:"path"`
+
+	// False until all documents that existed when the index was created have
+	// been indexed.
+	Ready bool `json:"ready"`
+
+	// Parsed Path, set by compileIndexes.
+	path jsondoc.Path
+}
+
+type IndexBound struct {
+	Value     any
+	Exclusive bool
+}
+
+// IndexQuery selects the entries between Lower and Upper, a nil bound is
+// unbounded. A Limit <= 0 means no limit.
+type IndexQuery struct {
+	Lower *IndexBound
+	Upper *IndexBound
+	Limit int
+}
+
+// CreateIndex defines a new index and starts indexing the existing documents
+// in the background.
+func (b *Bucket) CreateIndex(ctx context.Context, name, prefix, path string) (*Index, error) {
+	p, err := jsondoc.ParsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{
+		Name:   name,
+		Prefix: prefix,
+		Path:   path,
+		path:   p,
+	}
+
+	err = b.updateOpts(ctx, func(opts *BucketOptions) error {
+		for _, i := range opts.Indexes {
+			if i.Name == name {
+				return ErrIndexExists
+			}
+		}
+		opts.Indexes = append(opts.Indexes, idx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.startBackfill(name)
+	return idx, nil
+}
+
+// DropIndex removes the index definition and all of its entries.
+func (b *Bucket) DropIndex(ctx context.Context, name string) error {
+	err := b.updateOpts(ctx, func(opts *BucketOptions) error {
+		for i, idx := range opts.Indexes {
+			if idx.Name == name {
+				opts.Indexes = append(opts.Indexes[:i], opts.Indexes[i+1:]...)
+				return nil
+			}
+		}
+		return ErrIndexNotFound
+	})
+	if err != nil {
+		return err
+	}
+	return b.deletePrefix(ctx, b.compositeKey(_markIndex, []byte(name), nil))
+}
+
+// rebuildIndex drops the entries of an index and indexes the documents again
+// in the background, after writes that did not maintain the index.
+func (b *Bucket) rebuildIndex(ctx context.Context, name string) error {
+	err := b.updateOpts(ctx, func(opts *BucketOptions) error {
+		for _, idx := range opts.Indexes {
+			if idx.Name == name {
+				idx.Ready = false
+				return nil
+			}
+		}
+		return ErrIndexNotFound
+	})
+	if err != nil {
+		return err
+	}
+	if err := b.deletePrefix(ctx, b.compositeKey(_markIndex, []byte(name), nil)); err != nil {
+		return err
+	}
+	b.startBackfill(name)
+	return nil
+}
+
+func (b *Bucket) Indexes() []*Index {
+	return b.opts.Indexes
+}
+
+// QueryIndex calls fn with the key and value of every document matching q,
+// ordered by the indexed value.
+func (b *Bucket) QueryIndex(
+	ctx context.Context,
+	name string,
+	q *IndexQuery,
+	fn func(key, val []byte) error,
+) error {
+	idx := b.index(name)
+	if idx == nil {
+		return ErrIndexNotFound
+	}
+	if !idx.Ready {
+		return ErrIndexNotReady
+	}
+	return kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		return b.scanIndex(ctx, txn, idx, q, fn)
+	})
+}
+
+func (b *Bucket) index(name string) *Index {
+	for _, idx := range b.opts.Indexes {
+		if idx.Name == name {
+			return idx
+		}
+	}
+	return nil
+}
+
+func (b *Bucket) scanIndex(
+	ctx context.Context,
+	txn kv.Txn,
+	idx *Index,
+	q *IndexQuery,
+	fn func(key, val []byte) error,
+) error {
+	var lower, upper []byte
+	if q.Lower != nil {
+		var ok bool
+		if lower, ok = encodeIndexValue(q.Lower.Value); !ok {
+			return fmt.Errorf("%w: unsupported bound", jsondoc.ErrInvalidDocument)
+		}
+	}
+	if q.Upper != nil {
+		var ok bool
+		if upper, ok = encodeIndexValue(q.Upper.Value); !ok {
+			return fmt.Errorf("%w: unsupported bound", jsondoc.ErrInvalidDocument)
+		}
+	}
+
+	prefix := b.compositeKey(_markIndex, []byte(idx.Name), nil)
+	opts := &kv.IterOptions{
+		Prefix:   prefix,
+		KeysOnly: true,
+	}
+	if lower != nil {
+		opts.Seek = append(bytes.Clone(prefix), lower...)
+	}
+
+	n := 0
+	return txn.Iterate(ctx, opts, func(k, _ []byte) error {
+		ev, key := splitIndexEntry(k[len(prefix):])
+		if q.Lower != nil {
+			c := bytes.Compare(ev, lower)
+			if c < 0 || (c == 0 && q.Lower.Exclusive) {
+				return nil
+			}
+		}
+		if q.Upper != nil {
+			c := bytes.Compare(ev, upper)
+			if c > 0 || (c == 0 && q.Upper.Exclusive) {
+				return kv.ErrStopIteration
+			}
+		}
+
+		// Entries of expired documents are left behind, and a backfill may
+		// race with writes, skip the entries that no longer match.
+		val, err := txn.Get(ctx, b.udataKey(key, _markKeyValue))
+		if err != nil {
+			if errors.Is(err, kv.ErrKeyNotFound) {
+				return nil
+			}
+			return err
+		}
+		doc, err := jsondoc.Decode(val)
+		if err != nil || !bytes.Equal(b.indexEntry(idx, key, doc), k) {
+			return nil
+		}
+		if err := fn(key, val); err != nil {
+			return err
+		}
+		n++
+		if q.Limit > 0 && n >= q.Limit {
+			return kv.ErrStopIteration
+		}
+		return nil
+	})
+}
+
+// indexesFor returns the indexes covering key.
+func (b *Bucket) indexesFor(key []byte) []*Index {
+	var idxs []*Index
+	for _, idx := range b.opts.Indexes {
+		if bytes.HasPrefix(key, []byte(idx.Prefix)) {
+			idxs = append(idxs, idx)
+		}
+	}
+	return idxs
+}
+
+// setKV writes a key-value and keeps the indexes covering key up to date.
+func (b *Bucket) setKV(
+	ctx context.Context,
+	txn kv.Txn,
+	key, val []byte,
+	opts *kv.SetOptions,
+) error {
+	uKey := b.udataKey(key, _markKeyValue)
+	if idxs := b.indexesFor(key); len(idxs) > 0 {
+		old, err := b.getOld(ctx, txn, uKey)
+		if err != nil {
+			return err
+		}
+		if err := b.updateIndexes(ctx, txn, idxs, key, old, val, opts); err != nil {
+			return err
+		}
+	}
+	if b.keepsHistory() {
+		opts = &kv.SetOptions{TTL: opts.TTL, KeepVersions: true}
+	}
+	return txn.Set(ctx, uKey, val, opts)
+}
+
+func (b *Bucket) deleteKV(ctx context.Context, txn kv.Txn, key []byte) error {
+	uKey := b.udataKey(key, _markKeyValue)
+	if idxs := b.indexesFor(key); len(idxs) > 0 {
+		old, err := b.getOld(ctx, txn, uKey)
+		if err != nil {
+			return err
+		}
+		if err := b.updateIndexes(ctx, txn, idxs, key, old, nil, nil); err != nil {
+			return err
+		}
+	}
+	return txn.Delete(ctx, uKey)
+}
+
+func (b *Bucket) incrKV(
+	ctx context.Context,
+	txn kv.Txn,
+	key []byte,
+	increment int64,
+	opts *kv.IncrOptions[int64],
+) (int64, error) {
+	uKey := b.udataKey(key, _markKeyValue)
+	idxs := b.indexesFor(key)
+	var old []byte
+	if len(idxs) > 0 {
+		var err error
+		if old, err = b.getOld(ctx, txn, uKey); err != nil {
+			return 0, err
+		}
+	}
+	if b.keepsHistory() {
+		o := *opts
+		o.KeepVersions = true
+		opts = &o
+	}
+	num, err := txn.Incr(ctx, uKey, increment, opts)
+	if err != nil || len(idxs) == 0 {
+		return num, err
+	}
+	val := []byte(strconv.FormatInt(num, 10))
+	return num, b.updateIndexes(ctx, txn, idxs, key, old, val, &kv.SetOptions{TTL: opts.TTL})
+}
+
+func (b *Bucket) incrFloatKV(
+	ctx context.Context,
+	txn kv.Txn,
+	key []byte,
+	increment float64,
+	opts *kv.IncrOptions[float64],
+) (float64, error) {
+	uKey := b.udataKey(key, _markKeyValue)
+	idxs := b.indexesFor(key)
+	var old []byte
+	if len(idxs) > 0 {
+		var err error
+		if old, err = b.getOld(ctx, txn, uKey); err != nil {
+			return 0, err
+		}
+	}
+	if b.keepsHistory() {
+		o := *opts
+		o.KeepVersions = true
+		opts = &o
+	}
+	num, err := txn.IncrFloat(ctx, uKey, increment, opts)
+	if err != nil || len(idxs) == 0 {
+		return num, err
+	}
+	val := []byte(kv.FormatFloat(num))
+	return num, b.updateIndexes(ctx, txn, idxs, key, old, val, &kv.SetOptions{TTL: opts.TTL})
+}
+
+// getOld returns the current value of uKey, or nil if it does not exist.
+func (b *Bucket) getOld(ctx context.Context, txn kv.Txn, uKey []byte) ([]byte, error) {
+	val, err := txn.Get(ctx, uKey)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, nil
+	}
+	return val, err
+}
+
+// updateIndexes replaces the index entries of old by the entries of val, a
+// nil value has no entries.
+func (b *Bucket) updateIndexes(
+	ctx context.Context,
+	txn kv.Txn,
+	idxs []*Index,
+	key, old, val []byte,
+	opts *kv.SetOptions,
+) error {
+	oldDoc, oldErr := jsondoc.Decode(old)
+	newDoc, newErr := jsondoc.Decode(val)
+	for _, idx := range idxs {
+		var oldEntry, newEntry []byte
+		if old != nil && oldErr == nil {
+			oldEntry = b.indexEntry(idx, key, oldDoc)
+		}
+		if val != nil && newErr == nil {
+			newEntry = b.indexEntry(idx, key, newDoc)
+		}
+		if oldEntry != nil && !bytes.Equal(oldEntry, newEntry) {
+			if err := txn.Delete(ctx, oldEntry); err != nil {
+				return err
+			}
+		}
+		if newEntry != nil {
+			if err := txn.Set(ctx, newEntry, nil, opts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexEntry returns the index key of doc, or nil if doc has no indexable
+// value.
+func (b *Bucket) indexEntry(idx *Index, key []byte, doc any) []byte {
+	if idx.path == nil {
+		return nil
+	}
+	v, err := idx.path.Get(doc)
+	if err != nil {
+		return nil
+	}
+	ev, ok := encodeIndexValue(v)
+	if !ok {
+		return nil
+	}
+	return b.compositeKey(_markIndex, []byte(idx.Name), append(ev, key...))
+}
+
+func (b *Bucket) startBackfill(name string) {
+	id := b.name + "/" + name
+	if _, loaded := _backfills.LoadOrStore(id, struct{}{}); loaded {
+		return
+	}
+	go func() {
+		defer _backfills.Delete(id)
+		// Use a private instance, b may be shared with other goroutines.
+		fb := &Bucket{
+			store: b.store,
+			name:  b.name,
+			opts:  &BucketOptions{},
+		}
+		if err := fb.backfillIndex(context.Background(), name); err != nil {
+			slog.Error(
+				"core: Failed to backfill index",
+				"bucket", b.name,
+				"index", name,
+				"err", err,
+			)
+		}
+	}()
+}
+
+// backfillIndex indexes the existing documents in batches, then marks the
+// index as ready. Writes that happen meanwhile maintain the index themselves.
+func (b *Bucket) backfillIndex(ctx context.Context, name string) error {
+	var idx *Index
+	loadIndex := func() error {
+		if err := b.loadOpts(ctx); err != nil {
+			return err
+		}
+		idx = b.index(name)
+		return nil
+	}
+	if err := loadIndex(); err != nil || idx == nil {
+		return err
+	}
+
+	prefix := b.udataKey([]byte(idx.Prefix), _markKeyValue)
+	kvPrefix := b.udataKey(nil, _markKeyValue)
+	var last []byte
+	for {
+		var uKeys [][]byte
+		err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+			opts := &kv.IterOptions{
+				Prefix:   prefix,
+				KeysOnly: true,
+			}
+			if last != nil {
+				opts.Seek = last
+			}
+			return txn.Iterate(ctx, opts, func(k, _ []byte) error {
+				if bytes.Equal(k, last) {
+					return nil
+				}
+				uKeys = append(uKeys, k)
+				if len(uKeys) >= _backfillBatchSize {
+					return kv.ErrStopIteration
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		var dropped bool
+		err = kv.WithTxn(b.store, true, func(txn kv.Txn) error {
+			// Check the definition in the same transaction, so that the
+			// entries are not written after the index has been dropped.
+			var err error
+			if dropped, err = b.indexDropped(ctx, txn, idx); err != nil || dropped {
+				return err
+			}
+			for _, uKey := range uKeys {
+				// Re-read the value so that the entry matches the latest write.
+				val, err := b.getOld(ctx, txn, uKey)
+				if err != nil {
+					return err
+				}
+				doc, err := jsondoc.Decode(val)
+				if val == nil || err != nil {
+					continue
+				}
+				entry := b.indexEntry(idx, uKey[len(kvPrefix):], doc)
+				if entry == nil {
+					continue
+				}
+				if err := txn.Set(ctx, entry, nil, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || dropped {
+			return err
+		}
+
+		if len(uKeys) < _backfillBatchSize {
+			break
+		}
+		last = uKeys[len(uKeys)-1]
+
+		// Stop if the index has been dropped meanwhile.
+		if err := loadIndex(); err != nil || idx == nil {
+			return err
+		}
+	}
+
+	return b.updateOpts(ctx, func(opts *BucketOptions) error {
+		for _, i := range opts.Indexes {
+			if i.Name == name {
+				i.Ready = true
+			}
+		}
+		return nil
+	})
+}
+
+// indexDropped reports whether idx is no longer defined in the options read
+// by txn.
+func (b *Bucket) indexDropped(ctx context.Context, txn kv.Txn, idx *Index) (bool, error) {
+	val, err := txn.Get(ctx, []byte(b.name+_markBucketOpts))
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	opts := &BucketOptions{}
+	if err := json.Unmarshal(val, opts); err != nil {
+		return false, err
+	}
+	for _, i := range opts.Indexes {
+		if i.Name == idx.Name && i.Prefix == idx.Prefix && i.Path == idx.Path {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// deletePrefix deletes all keys with prefix in batches.
+func (b *Bucket) deletePrefix(ctx context.Context, prefix []byte) error {
+	for {
+		var keys [][]byte
+		err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+			return txn.Iterate(ctx, &kv.IterOptions{
+				Prefix:   prefix,
+				KeysOnly: true,
+			}, func(k, _ []byte) error {
+				keys = append(keys, k)
+				if len(keys) >= _backfillBatchSize {
+					return kv.ErrStopIteration
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		err = kv.WithTxn(b.store, true, func(txn kv.Txn) error {
+			for _, k := range keys {
+				if err := txn.Delete(ctx, k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Type tags of encoded index values, in sort order.
+const (
+	_indexNull byte = iota + 1
+	_indexFalse
+	_indexTrue
+	_indexNumber
+	_indexString
+)
+
+// encodeIndexValue encodes a JSON scalar so that the byte order of the
+// results matches null < false < true < numbers < strings. Objects and
+// arrays are not indexable.
+func encodeIndexValue(v any) ([]byte, bool) {
+	switch v := v.(type) {
+	case nil:
+		return []byte{_indexNull}, true
+	case bool:
+		if v {
+			return []byte{_indexTrue}, true
+		}
+		return []byte{_indexFalse}, true
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return nil, false
+		}
+		return append([]byte{_indexNumber}, encodeScore(f)...), true
+	case float64:
+		return append([]byte{_indexNumber}, encodeScore(v)...), true
+	case string:
+		// 0x00 is escaped as 0x00 0xff and the string is terminated by
+		// 0x00 0x01, so that a string sorts before its extensions.
+		buf := make([]byte, 0, len(v)+3)
+		buf = append(buf, _indexString)
+		for i := 0; i < len(v); i++ {
+			buf = append(buf, v[i])
+			if v[i] == 0 {
+				buf = append(buf, 0xff)
+			}
+		}
+		return append(buf, 0x00, 0x01), true
+	default:
+		return nil, false
+	}
+}
+
+// splitIndexEntry splits the suffix of an index key into the encoded value
+// and the document key.
+func splitIndexEntry(sub []byte) ([]byte, []byte) {
+	if len(sub) == 0 {
+		return nil, nil
+	}
+	n := 1
+	switch sub[0] {
+	case _indexNumber:
+		n = 9
+	case _indexString:
+		for n = 1; n+1 < len(sub); n++ {
+			if sub[n] == 0 {
+				if sub[n+1] == 0x01 {
+					n += 2
+					break
+				}
+				n++
+			}
+		}
+	}
+	n = min(n, len(sub))
+	return sub[:n], sub[n:]
+}
+
+func (b *Bucket) updateOpts(ctx context.Context, fn func(opts *BucketOptions) error) error {
+	key := []byte(b.name + _markBucketOpts)
+	defer _buckets.invalidate(b.name)
+	return b.update(ctx, func(txn kv.Txn) error {
+		val, err := txn.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		opts := &BucketOptions{}
+		if err := json.Unmarshal(val, opts); err != nil {
+			return err
+		}
+		if err := fn(opts); err != nil {
+			return err
+		}
+		val, err = json.Marshal(opts)
+		if err != nil {
+			return err
+		}
+		if err := txn.Set(ctx, key, val, nil); err != nil {
+			return err
+		}
+		if err := compileIndexes(opts); err != nil {
+			return err
+		}
+		b.opts = opts
+		return nil
+	})
+}
+
+// compileIndexes parses the paths of the indexes of opts.
+func compileIndexes(opts *BucketOptions) error {
+	for _, idx := range opts.Indexes {
+		p, err := jsondoc.ParsePath(idx.Path)
+		if err != nil {
+			return err
+		}
+		idx.path = p
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+	"github.com/maolonglong/kvdb/pkg/jsondoc"
+)
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewBucket(ctx, memory.New(), &BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range map[string]string{
+		"u:1": `{"age":30}`,
+		"u:2": `{"age":20}`,
+		"u:3": `{"name":"c"}`,
+		"v:1": `{"age":10}`,
+	} {
+		if err := b.Set(ctx, []byte(key), []byte(val), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.CreateIndex(ctx, "age", "u:", "$.age"); err != nil {
+		t.Fatal(err)
+	}
+	waitIndex(t, b, "age")
+	if err := b.Set(ctx, []byte("u:4"), []byte(`{"age":25}`), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry left behind by a backfill racing with a write of u:1.
+	idx := b.index("age")
+	doc, _ := jsondoc.Decode([]byte(`{"age":40}`))
+	err = kv.WithTxn(b.store, true, func(txn kv.Txn) error {
+		return txn.Set(ctx, b.indexEntry(idx, []byte("u:1"), doc), nil, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err = b.QueryIndex(ctx, "age", &IndexQuery{}, func(key, _ []byte) error {
+		got = append(got, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"u:2", "u:4", "u:1"}; !slices.Equal(got, want) {
+		t.Errorf("QueryIndex = %q, want %q", got, want)
+	}
+}
+
+func TestBackfillDroppedIndex(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewBucket(ctx, memory.New(), &BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set(ctx, []byte("a"), []byte(`{"v":1}`), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.CreateIndex(ctx, "v", "", "$.v"); err != nil {
+		t.Fatal(err)
+	}
+	waitIndex(t, b, "v")
+	if err := b.DropIndex(ctx, "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A backfill that loaded the definition before the drop.
+	fb := &Bucket{store: b.store, name: b.name, opts: &BucketOptions{}}
+	idx := &Index{Name: "v", Path: "$.v"}
+	if err := compileIndexes(&BucketOptions{Indexes: []*Index{idx}}); err != nil {
+		t.Fatal(err)
+	}
+	err = kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		dropped, err := fb.indexDropped(ctx, txn, idx)
+		if err == nil && !dropped {
+			t.Error("indexDropped = false after DropIndex")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.backfillIndex(ctx, "v"); err != nil {
+		t.Fatal(err)
+	}
+	err = kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		return txn.Iterate(ctx, &kv.IterOptions{
+			Prefix: b.compositeKey(_markIndex, []byte("v"), nil),
+		}, func(k, _ []byte) error {
+			t.Errorf("entry %q left after DropIndex", k)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitIndex(t *testing.T, b *Bucket, name string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if err := b.loadOpts(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if idx := b.index(name); idx != nil && idx.Ready {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("index %s not ready", name)
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	luajson "github.com/alicebob/gopher-json"
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+	"github.com/maolonglong/kvdb/pkg/jsondoc"
+)
+
+type PatchType uint8
+
+const (
+	_ PatchType = iota
+	// RFC 6902
+	PatchTypeJSONPatch
+	// RFC 7386
+	PatchTypeMergePatch
+)
+
+// GetJSON decodes the value of key as a JSON document and returns the
+// sub-document at path.
+func (b *Bucket) GetJSON(ctx context.Context, key []byte, path jsondoc.Path) (any, error) {
+	var v any
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		var err error
+		v, err = b.getJSON(ctx, txn, key, path)
+		return err
+	})
+	return v, err
+}
+
+// PatchJSON applies patch to the JSON document stored at key and returns the
+// new document. A missing key is patched as a null document.
+func (b *Bucket) PatchJSON(
+	ctx context.Context,
+	key []byte,
+	typ PatchType,
+	patch []byte,
+	ttl time.Duration,
+) ([]byte, error) {
+	var doc []byte
+	err := b.update(ctx, func(txn kv.Txn) error {
+		var err error
+		doc, err = b.patchJSON(ctx, txn, key, typ, patch, ttl)
+		return err
+	})
+	return doc, err
+}
+
+func (b *Bucket) getJSON(
+	ctx context.Context,
+	txn kv.Txn,
+	key []byte,
+	path jsondoc.Path,
+) (any, error) {
+	val, err := txn.Get(ctx, b.udataKey(key, _markKeyValue))
+	if err != nil {
+		return nil, err
+	}
+	doc, err := jsondoc.Decode(val)
+	if err != nil {
+		return nil, err
+	}
+	return path.Get(doc)
+}
+
+func (b *Bucket) patchJSON(
+	ctx context.Context,
+	txn kv.Txn,
+	key []byte,
+	typ PatchType,
+	patch []byte,
+	ttl time.Duration,
+) ([]byte, error) {
+	uKey := b.udataKey(key, _markKeyValue)
+	val, err := txn.Get(ctx, uKey)
+	if err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, err
+	}
+
+	var doc []byte
+	switch typ {
+	case PatchTypeJSONPatch:
+		doc, err = jsondoc.Patch(val, patch)
+	case PatchTypeMergePatch:
+		doc, err = jsondoc.MergePatch(val, patch)
+	default:
+		err = jsondoc.ErrInvalidPatch
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.setKV(ctx, txn, key, doc, b.setOptions(ttl)); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func mkLuaJSON(ctx context.Context, b *Bucket, txn kv.Txn, l *lua.LState) *lua.LTable {
+	patch := func(typ PatchType) lua.LGFunction {
+		return func(l *lua.LState) int {
+			key := l.CheckString(1)
+			var p []byte
+			switch v := l.CheckAny(2).(type) {
+			case lua.LString:
+				p = bytesconv.StringToBytes(string(v))
+			case *lua.LTable:
+				var err error
+				if p, err = luajson.Encode(v); err != nil {
+					l.ArgError(2, err.Error())
+					return 0
+				}
+			default:
+				l.ArgError(2, "string or table expected")
+				return 0
+			}
+			ttl := time.Duration(l.OptInt(3, 0)) * time.Second
+
+			doc, err := b.patchJSON(ctx, txn, bytesconv.StringToBytes(key), typ, p, ttl)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			v, err := luajson.Decode(l, doc)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(v)
+			return 1
+		}
+	}
+	fns := map[string]lua.LGFunction{
+		"get": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			path, err := jsondoc.ParsePath(l.OptString(2, "$"))
+			if err != nil {
+				l.ArgError(2, err.Error())
+				return 0
+			}
+			v, err := b.getJSON(ctx, txn, bytesconv.StringToBytes(key), path)
+			if err != nil {
+				if errors.Is(err, kv.ErrKeyNotFound) || errors.Is(err, jsondoc.ErrPathNotFound) {
+					l.Push(lua.LNil)
+					return 1
+				}
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(luajson.DecodeValue(l, v))
+			return 1
+		},
+		"patch": patch(PatchTypeJSONPatch),
+		"merge": patch(PatchTypeMergePatch),
+	}
+
+	mod := l.NewTable()
+	for name, f := range fns {
+		mod.RawSetString(name, l.NewFunction(f))
+	}
+	return mod
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+// Number of locks the keys are spread over.
+const _keyLockStripes = 4096
+
+// errLockBusy aborts a write transaction that could not lock a key, it is
+// run again once the key is unlocked.
+var errLockBusy = errors.New("core: key locked by another transaction")
+
+// _keyLocks serializes the write transactions using the same keys, stores
+// do not detect conflicts: two read-modify-writes of a key would otherwise
+// both read the old value, and one of the writes would be lost.
+var _keyLocks struct {
+	mus [_keyLockStripes]sync.Mutex
+	// Value of seq when the locks were last released, guarded by mus.
+	released [_keyLockStripes]uint64
+	seq      atomic.Uint64
+	seed     maphash.Seed
+}
+
+func init() {
+	_keyLocks.seed = maphash.MakeSeed()
+}
+
+// keyLocker holds the locks of the keys used by a write transaction until
+// released. A transaction holding locks does not wait for another one, it
+// fails with errLockBusy instead, and retry waits for the lock before the
+// transaction is run again, so that they cannot deadlock. The transaction
+// also fails when a key it locks was written after it started, as it reads
+// from a snapshot.
+type keyLocker struct {
+	held map[uint64]struct{}
+	// Value of seq when the transaction started.
+	start uint64
+	busy  uint64
+	// Set once a lock could not be taken.
+	failed bool
+}
+
+func newKeyLocker() *keyLocker {
+	return &keyLocker{held: make(map[uint64]struct{})}
+}
+
+func (l *keyLocker) lock(key []byte) error {
+	i := maphash.Bytes(_keyLocks.seed, key) % _keyLockStripes
+	if _, ok := l.held[i]; ok {
+		return nil
+	}
+	mu := &_keyLocks.mus[i]
+	if len(l.held) == 0 {
+		mu.Lock()
+	} else if !mu.TryLock() {
+		l.busy, l.failed = i, true
+		return errLockBusy
+	}
+	l.held[i] = struct{}{}
+	if _keyLocks.released[i] > l.start {
+		// The key may have been written since the transaction started, its
+		// snapshot is stale.
+		l.busy, l.failed = i, true
+		return errLockBusy
+	}
+	return nil
+}
+
+func (l *keyLocker) release() {
+	seq := _keyLocks.seq.Add(1)
+	for i := range l.held {
+		_keyLocks.released[i] = seq
+		_keyLocks.mus[i].Unlock()
+	}
+	clear(l.held)
+}
+
+// retry reports whether the transaction failed to take a lock. The locks are
+// then released, and the busy one is waited for and taken first.
+func (l *keyLocker) retry() bool {
+	if !l.failed {
+		return false
+	}
+	l.release()
+	l.failed = false
+	_keyLocks.mus[l.busy].Lock()
+	l.held[l.busy] = struct{}{}
+	return true
+}
+
+// newTransaction starts a write transaction on s locking the keys it reads or
+// writes. Iterations do not lock the keys they visit.
+func (l *keyLocker) newTransaction(s kv.Store) kv.Txn {
+	l.start = _keyLocks.seq.Load()
+	return &lockedTxn{Txn: s.NewTransaction(true), l: l}
+}
+
+type lockedTxn struct {
+	kv.Txn
+	l *keyLocker
+}
+
+func (txn *lockedTxn) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := txn.l.lock(key); err != nil {
+		return nil, err
+	}
+	return txn.Txn.Get(ctx, key)
+}
+
+func (txn *lockedTxn) Has(ctx context.Context, key []byte) (bool, error) {
+	if err := txn.l.lock(key); err != nil {
+		return false, err
+	}
+	return txn.Txn.Has(ctx, key)
+}
+
+func (txn *lockedTxn) TTL(ctx context.Context, key []byte) (time.Duration, error) {
+	if err := txn.l.lock(key); err != nil {
+		return 0, err
+	}
+	return txn.Txn.TTL(ctx, key)
+}
+
+func (txn *lockedTxn) Set(ctx context.Context, key, val []byte, opts *kv.SetOptions) error {
+	if err := txn.l.lock(key); err != nil {
+		return err
+	}
+	return txn.Txn.Set(ctx, key, val, opts)
+}
+
+func (txn *lockedTxn) Delete(ctx context.Context, key []byte) error {
+	if err := txn.l.lock(key); err != nil {
+		return err
+	}
+	return txn.Txn.Delete(ctx, key)
+}
+
+func (txn *lockedTxn) Incr(
+	ctx context.Context,
+	key []byte,
+	increment int64,
+	opts *kv.IncrOptions[int64],
+) (int64, error) {
+	if err := txn.l.lock(key); err != nil {
+		return 0, err
+	}
+	return txn.Txn.Incr(ctx, key, increment, opts)
+}
+
+func (txn *lockedTxn) IncrFloat(
+	ctx context.Context,
+	key []byte,
+	increment float64,
+	opts *kv.IncrOptions[float64],
+) (float64, error) {
+	if err := txn.l.lock(key); err != nil {
+		return 0, err
+	}
+	return txn.Txn.IncrFloat(ctx, key, increment, opts)
+}
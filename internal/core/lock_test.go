@@ -0,0 +1,51 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+func TestConcurrentBoundedDecr(t *testing.T) {
+	ctx := context.Background()
+	b := newHistoryBucket(t, &BucketOptions{})
+	key := []byte("stock")
+	if err := b.Set(ctx, key, []byte("10"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		ok    atomic.Int64
+		floor int64
+	)
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.Incr(ctx, key, -1, &kv.IncrOptions[int64]{Min: &floor})
+			switch {
+			case err == nil:
+				ok.Add(1)
+			case !errors.Is(err, kv.ErrOutOfRange):
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := ok.Load(); got != 10 {
+		t.Errorf("%d decrements succeeded, want 10", got)
+	}
+	val, err := b.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "0" {
+		t.Errorf("value = %q, want 0", val)
+	}
+}
@@ -19,7 +19,7 @@ const (
 	_kvdbExitPayload = "__kvdb_exit_payload"
 )
 
-func mkLua(w io.Writer, r *http.Request, b *Bucket, txn any, l *lua.LState) *lua.LTable {
+func mkLua(w io.Writer, r *http.Request, b *Bucket, txn kv.Txn, l *lua.LState) *lua.LTable {
 	write := func(newline bool) lua.LGFunction {
 		return func(l *lua.LState) int {
 			msg := l.CheckString(1)
@@ -54,7 +54,7 @@ func mkLua(w io.Writer, r *http.Request, b *Bucket, txn any, l *lua.LState) *lua
 		"get": func(l *lua.LState) int {
 			key := l.CheckString(1)
 			uKey := b.udataKey(bytesconv.StringToBytes(key), _markKeyValue)
-			val, err := b.store.Get(r.Context(), txn, uKey)
+			val, err := txn.Get(r.Context(), uKey)
 			if err != nil {
 				if errors.Is(err, kv.ErrKeyNotFound) {
 					l.Push(lua.LNil)
@@ -68,8 +68,7 @@ func mkLua(w io.Writer, r *http.Request, b *Bucket, txn any, l *lua.LState) *lua
 		},
 		"delete": func(l *lua.LState) int {
 			key := l.CheckString(1)
-			uKey := b.udataKey(bytesconv.StringToBytes(key), _markKeyValue)
-			if err := b.store.Delete(r.Context(), txn, uKey); err != nil {
+			if err := b.deleteKV(r.Context(), txn, bytesconv.StringToBytes(key)); err != nil {
 				l.Error(lua.LString(err.Error()), 1)
 			}
 			return 0
@@ -81,14 +80,14 @@ func mkLua(w io.Writer, r *http.Request, b *Bucket, txn any, l *lua.LState) *lua
 			if l.GetTop() >= 3 {
 				ttl = l.CheckInt(3)
 			}
-			uKey := b.udataKey(bytesconv.StringToBytes(key), _markKeyValue)
-			opts := &kv.SetOptions{
-				TTL: b.opts.DefaultTTL,
-			}
-			if ttl > 0 {
-				opts.TTL = time.Duration(ttl) * time.Second
-			}
-			if err := b.store.Set(r.Context(), txn, uKey, bytesconv.StringToBytes(val), opts); err != nil {
+			opts := b.setOptions(time.Duration(ttl) * time.Second)
+			if err := b.setKV(
+				r.Context(),
+				txn,
+				bytesconv.StringToBytes(key),
+				bytesconv.StringToBytes(val),
+				opts,
+			); err != nil {
 				l.Error(lua.LString(err.Error()), 1)
 				return 0
 			}
@@ -97,18 +96,48 @@ func mkLua(w io.Writer, r *http.Request, b *Bucket, txn any, l *lua.LState) *lua
 		"incr": func(l *lua.LState) int {
 			key := l.CheckString(1)
 			increment := l.CheckInt64(2)
-			var ttl int
+			opts := &kv.IncrOptions[int64]{}
 			if l.GetTop() >= 3 {
-				ttl = l.CheckInt(3)
+				opts.TTL = time.Duration(l.CheckInt(3)) * time.Second
 			}
-			uKey := b.udataKey(bytesconv.StringToBytes(key), _markKeyValue)
-			opts := &kv.SetOptions{
-				TTL: b.opts.DefaultTTL,
+			if l.GetTop() >= 4 {
+				luaIncrOptions(l, l.CheckTable(4), opts, func(n lua.LNumber) int64 {
+					return int64(n)
+				})
+			}
+			num, err := b.incrKV(
+				r.Context(),
+				txn,
+				bytesconv.StringToBytes(key),
+				increment,
+				incrOptions(b, opts),
+			)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
 			}
-			if ttl > 0 {
-				opts.TTL = time.Duration(ttl) * time.Second
+			l.Push(lua.LNumber(num))
+			return 1
+		},
+		"incrbyfloat": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			increment := float64(l.CheckNumber(2))
+			opts := &kv.IncrOptions[float64]{}
+			if l.GetTop() >= 3 {
+				opts.TTL = time.Duration(l.CheckInt(3)) * time.Second
+			}
+			if l.GetTop() >= 4 {
+				luaIncrOptions(l, l.CheckTable(4), opts, func(n lua.LNumber) float64 {
+					return float64(n)
+				})
 			}
-			num, err := b.store.Incr(r.Context(), txn, uKey, increment, opts)
+			num, err := b.incrFloatKV(
+				r.Context(),
+				txn,
+				bytesconv.StringToBytes(key),
+				increment,
+				incrOptions(b, opts),
+			)
 			if err != nil {
 				l.Error(lua.LString(err.Error()), 1)
 				return 0
@@ -134,6 +163,11 @@ func mkLua(w io.Writer, r *http.Request, b *Bucket, txn any, l *lua.LState) *lua
 		"var":    reqVar,
 		"status": lua.LNumber(200),
 		"header": l.NewTable(),
+		"hash":   mkLuaHash(r.Context(), b, txn, l),
+		"zset":   mkLuaZSet(r.Context(), b, txn, l),
+		"sets":   mkLuaSets(r.Context(), b, txn, l),
+		"json":   mkLuaJSON(r.Context(), b, txn, l),
+		"query":  mkLuaQuery(r.Context(), b, txn, l),
 	}
 
 	mod := l.NewTable()
@@ -160,6 +194,34 @@ func urlValuesToLua(l *lua.LState, tb *lua.LTable, m url.Values) {
 	}
 }
 
+// luaIncrOptions reads the "default", "min", "max" and "clamp" fields of tb
+// into opts.
+func luaIncrOptions[T int64 | float64](
+	l *lua.LState,
+	tb *lua.LTable,
+	opts *kv.IncrOptions[T],
+	conv func(lua.LNumber) T,
+) {
+	number := func(name string) *T {
+		switch v := tb.RawGetString(name).(type) {
+		case lua.LNumber:
+			n := conv(v)
+			return &n
+		case *lua.LNilType:
+			return nil
+		default:
+			l.ArgError(4, name+" must be a number")
+			return nil
+		}
+	}
+	if n := number("default"); n != nil {
+		opts.Default = *n
+	}
+	opts.Min = number("min")
+	opts.Max = number("max")
+	opts.Clamp = lua.LVAsBool(tb.RawGetString("clamp"))
+}
+
 func safeExit(l *lua.LState, reason string, payload lua.LValue) {
 	tb := l.NewTable()
 	tb.RawSetString(_kvdbExitReason, lua.LString(reason))
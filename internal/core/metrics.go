@@ -0,0 +1,23 @@
+package core
+
+import (
+	"github.com/maolonglong/kvdb/internal/metrics"
+)
+
+var _luaDuration = metrics.NewHistogramVec(
+	"kvdb_lua_duration_seconds",
+	"Execution time of Lua scripts.",
+	metrics.DefBuckets,
+)
+
+func init() {
+	metrics.Register(metrics.CollectorFunc(func(e *metrics.Encoder) {
+		st := BucketCacheStats()
+		metrics.Cache(e, "bucket", st.Hits, st.Misses)
+		e.Gauge("kvdb_bucket_cache_entries", "Buckets cached.", float64(st.Entries))
+		if _values.Load() != nil {
+			st := ValueCacheStats()
+			metrics.Cache(e, "value", st.Hits, st.Misses)
+		}
+	}))
+}
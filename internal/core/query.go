@@ -0,0 +1,454 @@
+package core
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	luajson "github.com/alicebob/gopher-json"
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/jsondoc"
+)
+
+// Sorted queries keep at most this many matches, see Bucket.Query.
+const _maxSortedMatches = 10000
+
+var (
+	ErrInvalidQuery  = errors.New("core: invalid query")
+	ErrQueryTooLarge = errors.New("core: too many matches to sort")
+)
+
+// Query selects the JSON documents under Prefix matching all conditions of
+// Filter, e.g.
+//
+//	{
+//	  "prefix": "orders/",
+//	  "filter": [
+//	    {"path": "$.status", "op": "eq", "value": "paid"},
+//	    {"path": "$.total", "op": "gt", "value": 100}
+//	  ],
+//	  "sort": [{"path": "$.created_at", "desc": true}],
+//	  "fields": {"total": "$.total"},
+//	  "limit": 20
+//	}
+//
+// Fields, if set, projects every document to an object of the values at the
+// given paths.
+type Query struct {
+	Prefix string            `json:"prefix"`
+	Filter []*Condition      `json:"filter"`
+	Sort   []*SortField      `json:"sort"`
+	Fields map[string]string `json:"fields"`
+	Offset int               `json:"offset"`
+	Limit  int               `json:"limit"`
+
+	fields map[string]jsondoc.Path
+}
+
+// Condition compares the value at Path with Value. Op is one of eq, ne, gt,
+// gte, lt, lte, in (Value is an array) and exists (Value is a boolean).
+// Ordering operators only match values of the same type.
+type Condition struct {
+	Path  string `json:"path"`
+	Op    string `json:"op"`
+	Value any    `json:"value"`
+
+	path jsondoc.Path
+}
+
+type SortField struct {
+	Path string `json:"path"`
+	Desc bool   `json:"desc"`
+
+	path jsondoc.Path
+}
+
+type QueryResult struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+// ParseQuery decodes and validates a JSON query, numbers are kept as
+// json.Number.
+func ParseQuery(data []byte) (*Query, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var q Query
+	if err := dec.Decode(&q); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	if err := q.compile(); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (q *Query) compile() error {
+	var err error
+	for _, c := range q.Filter {
+		switch c.Op {
+		case "eq", "ne", "gt", "gte", "lt", "lte":
+		case "in":
+			if _, ok := c.Value.([]any); !ok {
+				return fmt.Errorf("%w: in expects an array", ErrInvalidQuery)
+			}
+		case "exists":
+			if _, ok := c.Value.(bool); !ok {
+				return fmt.Errorf("%w: exists expects a boolean", ErrInvalidQuery)
+			}
+		default:
+			return fmt.Errorf("%w: unknown op %q", ErrInvalidQuery, c.Op)
+		}
+		if c.path, err = jsondoc.ParsePath(c.Path); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+		}
+	}
+	for _, s := range q.Sort {
+		if s.path, err = jsondoc.ParsePath(s.Path); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+		}
+	}
+	if len(q.Fields) > 0 {
+		q.fields = make(map[string]jsondoc.Path, len(q.Fields))
+		for name, path := range q.Fields {
+			if q.fields[name], err = jsondoc.ParsePath(path); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+			}
+		}
+	}
+	if q.Offset < 0 || q.Limit < 0 {
+		return fmt.Errorf("%w: negative offset or limit", ErrInvalidQuery)
+	}
+	return nil
+}
+
+func (c *Condition) match(doc any) bool {
+	v, err := c.path.Get(doc)
+	found := err == nil
+	switch c.Op {
+	case "exists":
+		return found == c.Value.(bool)
+	case "ne":
+		return !found || !jsondoc.Equal(v, c.Value)
+	}
+	if !found {
+		return false
+	}
+	switch c.Op {
+	case "eq":
+		return jsondoc.Equal(v, c.Value)
+	case "in":
+		for _, e := range c.Value.([]any) {
+			if jsondoc.Equal(v, e) {
+				return true
+			}
+		}
+		return false
+	}
+
+	cmp, ok := compareValues(v, c.Value)
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case "gt":
+		return cmp > 0
+	case "gte":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "lte":
+		return cmp <= 0
+	default:
+		return false
+	}
+}
+
+// compareValues compares two JSON scalars of the same type.
+func compareValues(a, b any) (int, bool) {
+	ea, ok1 := encodeIndexValue(a)
+	eb, ok2 := encodeIndexValue(b)
+	if !ok1 || !ok2 || ea[0] != eb[0] {
+		return 0, false
+	}
+	return bytes.Compare(ea, eb), true
+}
+
+// compareForSort orders missing values first, then by type, then by value.
+func compareForSort(a, b any, aok, bok bool) int {
+	switch {
+	case !aok && !bok:
+		return 0
+	case !aok:
+		return -1
+	case !bok:
+		return 1
+	}
+	ea, ok1 := encodeIndexValue(a)
+	eb, ok2 := encodeIndexValue(b)
+	switch {
+	case !ok1 && !ok2:
+		return 0
+	case !ok1:
+		return 1
+	case !ok2:
+		return -1
+	}
+	return bytes.Compare(ea, eb)
+}
+
+// Query calls fn for every document matching q. Results are streamed unless
+// q has a sort order, in which case the first Offset+Limit matches are
+// buffered. Sorting more than _maxSortedMatches matches, including sorted
+// queries without a limit matching more, fails with ErrQueryTooLarge.
+func (b *Bucket) Query(ctx context.Context, q *Query, fn func(*QueryResult) error) error {
+	if err := q.compile(); err != nil {
+		return err
+	}
+	return kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		return b.query(ctx, txn, q, fn)
+	})
+}
+
+func (b *Bucket) query(
+	ctx context.Context,
+	txn kv.Txn,
+	q *Query,
+	fn func(*QueryResult) error,
+) error {
+	var (
+		sorted  *sortedMatches
+		skipped int
+		emitted int
+	)
+	if len(q.Sort) > 0 {
+		n := _maxSortedMatches
+		if q.Limit > 0 {
+			if q.Offset+q.Limit > n {
+				return ErrQueryTooLarge
+			}
+			n = q.Offset + q.Limit
+		}
+		sorted = &sortedMatches{q: q, n: n}
+	}
+	emit := func(key string, doc any) error {
+		if sorted != nil {
+			return sorted.add(key, doc, q.Limit == 0)
+		}
+		if skipped < q.Offset {
+			skipped++
+			return nil
+		}
+		if err := fn(q.result(key, doc)); err != nil {
+			return err
+		}
+		emitted++
+		if q.Limit > 0 && emitted >= q.Limit {
+			return kv.ErrStopIteration
+		}
+		return nil
+	}
+	visit := func(key, val []byte) error {
+		if !bytes.HasPrefix(key, []byte(q.Prefix)) {
+			return nil
+		}
+		if len(val) == 0 {
+			return nil
+		}
+		doc, err := jsondoc.Decode(val)
+		if err != nil {
+			return nil
+		}
+		for _, c := range q.Filter {
+			if !c.match(doc) {
+				return nil
+			}
+		}
+		return emit(string(key), doc)
+	}
+
+	var err error
+	if idx, iq := b.planQuery(q); idx != nil {
+		err = b.scanIndex(ctx, txn, idx, iq, visit)
+	} else {
+		prefix := b.udataKey(nil, _markKeyValue)
+		err = txn.Iterate(ctx, &kv.IterOptions{
+			Prefix: b.udataKey([]byte(q.Prefix), _markKeyValue),
+		}, func(k, v []byte) error {
+			return visit(k[len(prefix):], v)
+		})
+	}
+	if errors.Is(err, kv.ErrStopIteration) {
+		err = nil
+	}
+	if err != nil || sorted == nil {
+		return err
+	}
+
+	matches := sorted.ms
+	sort.Slice(matches, func(i, j int) bool {
+		return sorted.before(matches[i], matches[j])
+	})
+	for _, m := range matches[min(q.Offset, len(matches)):] {
+		if err := fn(q.result(m.key, m.doc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type match struct {
+	key string
+	doc any
+	seq int // Order of the match, for a stable sort.
+}
+
+// sortedMatches keeps the first n matches in the sort order of q, in a heap
+// with the last one on top.
+type sortedMatches struct {
+	q   *Query
+	n   int
+	seq int
+	ms  []*match
+}
+
+// add adds a match, or fails with ErrQueryTooLarge if full is set and n
+// matches are kept already.
+func (h *sortedMatches) add(key string, doc any, full bool) error {
+	m := &match{key: key, doc: doc, seq: h.seq}
+	h.seq++
+	switch {
+	case len(h.ms) < h.n:
+		heap.Push(h, m)
+	case full:
+		return ErrQueryTooLarge
+	case h.before(m, h.ms[0]):
+		h.ms[0] = m
+		heap.Fix(h, 0)
+	}
+	return nil
+}
+
+func (h *sortedMatches) before(a, b *match) bool {
+	for _, s := range h.q.Sort {
+		av, aerr := s.path.Get(a.doc)
+		bv, berr := s.path.Get(b.doc)
+		c := compareForSort(av, bv, aerr == nil, berr == nil)
+		if s.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return a.seq < b.seq
+}
+
+func (h *sortedMatches) Len() int           { return len(h.ms) }
+func (h *sortedMatches) Less(i, j int) bool { return h.before(h.ms[j], h.ms[i]) }
+func (h *sortedMatches) Swap(i, j int)      { h.ms[i], h.ms[j] = h.ms[j], h.ms[i] }
+func (h *sortedMatches) Push(x any)         { h.ms = append(h.ms, x.(*match)) }
+
+func (h *sortedMatches) Pop() any {
+	m := h.ms[len(h.ms)-1]
+	h.ms = h.ms[:len(h.ms)-1]
+	return m
+}
+
+func (q *Query) result(key string, doc any) *QueryResult {
+	if q.fields == nil {
+		return &QueryResult{Key: key, Value: doc}
+	}
+	obj := make(map[string]any, len(q.fields))
+	for name, path := range q.fields {
+		if v, err := path.Get(doc); err == nil {
+			obj[name] = v
+		}
+	}
+	return &QueryResult{Key: key, Value: obj}
+}
+
+// planQuery picks a ready index covering the prefix of q and the path of one
+// of its conditions, and returns the range to scan. Equality conditions are
+// preferred.
+func (b *Bucket) planQuery(q *Query) (*Index, *IndexQuery) {
+	var (
+		best  *Index
+		bestQ *IndexQuery
+	)
+	for _, idx := range b.opts.Indexes {
+		if !idx.Ready || idx.path == nil {
+			continue
+		}
+		if !bytes.HasPrefix([]byte(q.Prefix), []byte(idx.Prefix)) {
+			continue
+		}
+		iq := &IndexQuery{}
+		eq := false
+		for _, c := range q.Filter {
+			if c.path.String() != idx.path.String() {
+				continue
+			}
+			bound := &IndexBound{Value: c.Value}
+			switch c.Op {
+			case "eq":
+				iq.Lower, iq.Upper, eq = bound, bound, true
+			case "gt", "gte":
+				bound.Exclusive = c.Op == "gt"
+				if !eq {
+					iq.Lower = bound
+				}
+			case "lt", "lte":
+				bound.Exclusive = c.Op == "lt"
+				if !eq {
+					iq.Upper = bound
+				}
+			}
+		}
+		if iq.Lower == nil && iq.Upper == nil {
+			continue
+		}
+		if best == nil || eq {
+			best, bestQ = idx, iq
+		}
+		if eq {
+			break
+		}
+	}
+	return best, bestQ
+}
+
+func mkLuaQuery(ctx context.Context, b *Bucket, txn kv.Txn, l *lua.LState) *lua.LFunction {
+	return l.NewFunction(func(l *lua.LState) int {
+		spec, err := luajson.Encode(l.CheckTable(1))
+		if err != nil {
+			l.ArgError(1, err.Error())
+			return 0
+		}
+		q, err := ParseQuery(spec)
+		if err != nil {
+			l.ArgError(1, err.Error())
+			return 0
+		}
+
+		arr := l.NewTable()
+		if err := b.query(ctx, txn, q, func(res *QueryResult) error {
+			tb := l.NewTable()
+			tb.RawSetString("key", lua.LString(res.Key))
+			tb.RawSetString("value", luajson.DecodeValue(l, res.Value))
+			arr.Append(tb)
+			return nil
+		}); err != nil {
+			l.Error(lua.LString(err.Error()), 1)
+			return 0
+		}
+		l.Push(arr)
+		return 1
+	})
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+func TestQuerySort(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewBucket(ctx, memory.New(), &BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ages 0, 1, 2, 0, 1, ... so that ties are ordered by key.
+	for i := 0; i < 9; i++ {
+		val := fmt.Sprintf(`{"age":%d}`, i%3)
+		if err := b.Set(ctx, []byte(fmt.Sprintf("u:%d", i)), []byte(val), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Set(ctx, []byte("u:x"), []byte(`{}`), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(spec string) ([]string, error) {
+		q, err := ParseQuery([]byte(spec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		err = b.Query(ctx, q, func(res *QueryResult) error {
+			keys = append(keys, res.Key)
+			return nil
+		})
+		return keys, err
+	}
+	for _, tt := range []struct {
+		spec string
+		want []string
+	}{
+		{
+			`{"prefix":"u:","sort":[{"path":"$.age"}]}`,
+			[]string{"u:x", "u:0", "u:3", "u:6", "u:1", "u:4", "u:7", "u:2", "u:5", "u:8"},
+		},
+		{
+			`{"prefix":"u:","sort":[{"path":"$.age","desc":true}],"limit":4}`,
+			[]string{"u:2", "u:5", "u:8", "u:1"},
+		},
+		{
+			`{"prefix":"u:","sort":[{"path":"$.age"}],"offset":2,"limit":3}`,
+			[]string{"u:3", "u:6", "u:1"},
+		},
+		{
+			`{"prefix":"u:","sort":[{"path":"$.age"}],"offset":8,"limit":5}`,
+			[]string{"u:5", "u:8"},
+		},
+	} {
+		got, err := query(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+
+	_, err = query(fmt.Sprintf(`{"sort":[{"path":"$.age"}],"offset":%d,"limit":1}`,
+		_maxSortedMatches))
+	if !errors.Is(err, ErrQueryTooLarge) {
+		t.Errorf("offset past the limit: error = %v, want ErrQueryTooLarge", err)
+	}
+}
+
+func TestQuerySortTooLarge(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewBucket(ctx, memory.New(), &BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.WithTxn(b.store, true, func(txn kv.Txn) error {
+		for i := 0; i <= _maxSortedMatches; i++ {
+			key := b.udataKey([]byte(fmt.Sprintf("%05d", i)), _markKeyValue)
+			if err := txn.Set(ctx, key, []byte(`{"n":1}`), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := ParseQuery([]byte(`{"sort":[{"path":"$.n"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Query(ctx, q, func(*QueryResult) error { return nil })
+	if !errors.Is(err, ErrQueryTooLarge) {
+		t.Errorf("Query error = %v, want ErrQueryTooLarge", err)
+	}
+
+	// A limit keeps the buffer bounded.
+	q, err = ParseQuery([]byte(`{"sort":[{"path":"$.n","desc":true}],"limit":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	err = b.Query(ctx, q, func(res *QueryResult) error {
+		keys = append(keys, res.Key)
+		return nil
+	})
+	if err != nil || !slices.Equal(keys, []string{"00000", "00001"}) {
+		t.Errorf("Query = %q, %v", keys, err)
+	}
+}
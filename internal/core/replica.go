@@ -0,0 +1,64 @@
+package core
+
+import (
+	"context"
+	"errors"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+type readOnlyKey struct{}
+
+// WithReadOnly marks ctx as serving a read-only replica: writes fail with
+// kv.ErrReadOnlyTxn, scripts run in a read-only transaction, and loading
+// or accessing buckets writes nothing.
+func WithReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyKey{}, true)
+}
+
+func readOnly(ctx context.Context) bool {
+	ro, _ := ctx.Value(readOnlyKey{}).(bool)
+	return ro
+}
+
+// readOnlyTxn records whether a script attempted a write, which a replica
+// forwards to its primary.
+type readOnlyTxn struct {
+	kv.Txn
+	rejected bool
+}
+
+func (txn *readOnlyTxn) check(err error) error {
+	if errors.Is(err, kv.ErrReadOnlyTxn) {
+		txn.rejected = true
+	}
+	return err
+}
+
+func (txn *readOnlyTxn) Set(ctx context.Context, key, val []byte, opts *kv.SetOptions) error {
+	return txn.check(txn.Txn.Set(ctx, key, val, opts))
+}
+
+func (txn *readOnlyTxn) Delete(ctx context.Context, key []byte) error {
+	return txn.check(txn.Txn.Delete(ctx, key))
+}
+
+func (txn *readOnlyTxn) Incr(
+	ctx context.Context,
+	key []byte,
+	increment int64,
+	opts *kv.IncrOptions[int64],
+) (int64, error) {
+	num, err := txn.Txn.Incr(ctx, key, increment, opts)
+	return num, txn.check(err)
+}
+
+func (txn *readOnlyTxn) IncrFloat(
+	ctx context.Context,
+	key []byte,
+	increment float64,
+	opts *kv.IncrOptions[float64],
+) (float64, error) {
+	num, err := txn.Txn.IncrFloat(ctx, key, increment, opts)
+	return num, txn.check(err)
+}
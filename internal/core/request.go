@@ -0,0 +1,17 @@
+package core
+
+import "context"
+
+type requestIDKey struct{}
+
+// WithRequestID attaches the ID of the request served with ctx, which the
+// logs of the request include.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID attached by WithRequestID, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
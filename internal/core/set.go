@@ -0,0 +1,342 @@
+package core
+
+import (
+	"context"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+)
+
+type OpSAdd struct {
+	Key    []byte
+	Member []byte
+}
+
+type OpSRem struct {
+	Key    []byte
+	Member []byte
+}
+
+// SAdd adds members to the set and returns the number of members that were
+// not already present.
+func (b *Bucket) SAdd(ctx context.Context, key []byte, members ...[]byte) (int, error) {
+	var n int
+	err := b.update(ctx, func(txn kv.Txn) error {
+		var err error
+		n, err = b.sadd(ctx, txn, key, members...)
+		return err
+	})
+	return n, err
+}
+
+// SRem removes members from the set and returns the number of members that
+// existed.
+func (b *Bucket) SRem(ctx context.Context, key []byte, members ...[]byte) (int, error) {
+	var n int
+	err := b.update(ctx, func(txn kv.Txn) error {
+		var err error
+		n, err = b.srem(ctx, txn, key, members...)
+		return err
+	})
+	return n, err
+}
+
+func (b *Bucket) SIsMember(ctx context.Context, key, member []byte) (bool, error) {
+	var ok bool
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		var err error
+		ok, err = txn.Has(ctx, b.compositeKey(_markSet, key, member))
+		return err
+	})
+	return ok, err
+}
+
+// SMembers calls fn for every member of the set in lexicographical order.
+func (b *Bucket) SMembers(ctx context.Context, key []byte, fn func(member []byte) error) error {
+	return kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		return b.smembers(ctx, txn, key, fn)
+	})
+}
+
+func (b *Bucket) SCard(ctx context.Context, key []byte) (int64, error) {
+	var n int64
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		var err error
+		n, err = b.scard(ctx, txn, key)
+		return err
+	})
+	return n, err
+}
+
+// SUnion calls fn once for every member of any of the sets.
+func (b *Bucket) SUnion(ctx context.Context, keys [][]byte, fn func(member []byte) error) error {
+	return kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		return b.sunion(ctx, txn, keys, fn)
+	})
+}
+
+// SInter calls fn for every member of the first set that is a member of all
+// other sets.
+func (b *Bucket) SInter(ctx context.Context, keys [][]byte, fn func(member []byte) error) error {
+	return kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		return b.sinter(ctx, txn, keys, fn)
+	})
+}
+
+// SDiff calls fn for every member of the first set that is not a member of
+// any other set.
+func (b *Bucket) SDiff(ctx context.Context, keys [][]byte, fn func(member []byte) error) error {
+	return kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		return b.sdiff(ctx, txn, keys, fn)
+	})
+}
+
+func (b *Bucket) sadd(
+	ctx context.Context,
+	txn kv.Txn,
+	key []byte,
+	members ...[]byte,
+) (int, error) {
+	var n int
+	opts := b.setOptions(0)
+	for _, member := range members {
+		uKey := b.compositeKey(_markSet, key, member)
+		ok, err := txn.Has(ctx, uKey)
+		if err != nil {
+			return 0, err
+		}
+		// Set anyway so that the TTL is refreshed.
+		if err := txn.Set(ctx, uKey, nil, opts); err != nil {
+			return 0, err
+		}
+		if !ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (b *Bucket) srem(
+	ctx context.Context,
+	txn kv.Txn,
+	key []byte,
+	members ...[]byte,
+) (int, error) {
+	var n int
+	for _, member := range members {
+		uKey := b.compositeKey(_markSet, key, member)
+		ok, err := txn.Has(ctx, uKey)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		if err := txn.Delete(ctx, uKey); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (b *Bucket) smembers(
+	ctx context.Context,
+	txn kv.Txn,
+	key []byte,
+	fn func(member []byte) error,
+) error {
+	prefix := b.compositeKey(_markSet, key, nil)
+	return txn.Iterate(ctx, &kv.IterOptions{
+		Prefix:   prefix,
+		KeysOnly: true,
+	}, func(k, _ []byte) error {
+		return fn(k[len(prefix):])
+	})
+}
+
+func (b *Bucket) scard(ctx context.Context, txn kv.Txn, key []byte) (int64, error) {
+	var n int64
+	err := b.smembers(ctx, txn, key, func(_ []byte) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// sismemberAny reports whether member is in any of the sets.
+func (b *Bucket) sismemberAny(
+	ctx context.Context,
+	txn kv.Txn,
+	keys [][]byte,
+	member []byte,
+) (bool, error) {
+	for _, key := range keys {
+		ok, err := txn.Has(ctx, b.compositeKey(_markSet, key, member))
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (b *Bucket) sunion(
+	ctx context.Context,
+	txn kv.Txn,
+	keys [][]byte,
+	fn func(member []byte) error,
+) error {
+	for i, key := range keys {
+		// Members already reported by a previous set are skipped, so that
+		// nothing has to be buffered.
+		err := b.smembers(ctx, txn, key, func(member []byte) error {
+			seen, err := b.sismemberAny(ctx, txn, keys[:i], member)
+			if err != nil || seen {
+				return err
+			}
+			return fn(member)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bucket) sinter(
+	ctx context.Context,
+	txn kv.Txn,
+	keys [][]byte,
+	fn func(member []byte) error,
+) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return b.smembers(ctx, txn, keys[0], func(member []byte) error {
+		for _, key := range keys[1:] {
+			ok, err := txn.Has(ctx, b.compositeKey(_markSet, key, member))
+			if err != nil || !ok {
+				return err
+			}
+		}
+		return fn(member)
+	})
+}
+
+func (b *Bucket) sdiff(
+	ctx context.Context,
+	txn kv.Txn,
+	keys [][]byte,
+	fn func(member []byte) error,
+) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return b.smembers(ctx, txn, keys[0], func(member []byte) error {
+		found, err := b.sismemberAny(ctx, txn, keys[1:], member)
+		if err != nil || found {
+			return err
+		}
+		return fn(member)
+	})
+}
+
+func mkLuaSets(ctx context.Context, b *Bucket, txn kv.Txn, l *lua.LState) *lua.LTable {
+	checkBytesArgs := func(l *lua.LState, from int) [][]byte {
+		args := make([][]byte, 0, l.GetTop()-from+1)
+		for i := from; i <= l.GetTop(); i++ {
+			args = append(args, bytesconv.StringToBytes(l.CheckString(i)))
+		}
+		return args
+	}
+	update := func(
+		fn func(ctx context.Context, txn kv.Txn, key []byte, members ...[]byte) (int, error),
+	) lua.LGFunction {
+		return func(l *lua.LState) int {
+			key := l.CheckString(1)
+			n, err := fn(ctx, txn, bytesconv.StringToBytes(key), checkBytesArgs(l, 2)...)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(lua.LNumber(n))
+			return 1
+		}
+	}
+	algebra := func(
+		fn func(
+			ctx context.Context,
+			txn kv.Txn,
+			keys [][]byte,
+			fn func(member []byte) error,
+		) error,
+	) lua.LGFunction {
+		return func(l *lua.LState) int {
+			arr := l.NewTable()
+			if err := fn(ctx, txn, checkBytesArgs(l, 1), func(member []byte) error {
+				arr.Append(lua.LString(member))
+				return nil
+			}); err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(arr)
+			return 1
+		}
+	}
+	fns := map[string]lua.LGFunction{
+		"add": update(b.sadd),
+		"rem": update(b.srem),
+		"ismember": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			member := l.CheckString(2)
+			uKey := b.compositeKey(
+				_markSet,
+				bytesconv.StringToBytes(key),
+				bytesconv.StringToBytes(member),
+			)
+			ok, err := txn.Has(ctx, uKey)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(lua.LBool(ok))
+			return 1
+		},
+		"members": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			arr := l.NewTable()
+			err := b.smembers(ctx, txn, bytesconv.StringToBytes(key), func(member []byte) error {
+				arr.Append(lua.LString(member))
+				return nil
+			})
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(arr)
+			return 1
+		},
+		"card": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			n, err := b.scard(ctx, txn, bytesconv.StringToBytes(key))
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(lua.LNumber(n))
+			return 1
+		},
+		"union": algebra(b.sunion),
+		"inter": algebra(b.sinter),
+		"diff":  algebra(b.sdiff),
+	}
+
+	mod := l.NewTable()
+	for name, f := range fns {
+		mod.RawSetString(name, l.NewFunction(f))
+	}
+	return mod
+}
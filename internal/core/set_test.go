@@ -0,0 +1,191 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+func newSetBucket(t *testing.T, sets map[string][]string) *Bucket {
+	t.Helper()
+	ctx := context.Background()
+	b, err := NewBucket(ctx, memory.New(), &BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, members := range sets {
+		args := make([][]byte, len(members))
+		for i, m := range members {
+			args[i] = []byte(m)
+		}
+		if _, err := b.SAdd(ctx, []byte(key), args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+// collect returns the members fn is called with, joined by commas.
+func collect(t *testing.T, iter func(fn func(member []byte) error) error) string {
+	t.Helper()
+	var ms []string
+	if err := iter(func(member []byte) error {
+		ms = append(ms, string(member))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(ms, ",")
+}
+
+func TestSets(t *testing.T) {
+	ctx := context.Background()
+	b := newSetBucket(t, nil)
+	key := []byte("s")
+	smembers := func() string {
+		return collect(t, func(fn func(member []byte) error) error {
+			return b.SMembers(ctx, key, fn)
+		})
+	}
+
+	if n, err := b.SAdd(ctx, key, []byte("c"), []byte("a"), []byte("c")); err != nil || n != 2 {
+		t.Errorf("SAdd = %d, %v, want 2", n, err)
+	}
+	if n, err := b.SAdd(ctx, key, []byte("a"), []byte("b")); err != nil || n != 1 {
+		t.Errorf("SAdd = %d, %v, want 1", n, err)
+	}
+	if got := smembers(); got != "a,b,c" {
+		t.Errorf("SMembers = %q, want %q", got, "a,b,c")
+	}
+	if n, err := b.SCard(ctx, key); err != nil || n != 3 {
+		t.Errorf("SCard = %d, %v, want 3", n, err)
+	}
+	if ok, err := b.SIsMember(ctx, key, []byte("b")); err != nil || !ok {
+		t.Errorf("SIsMember = %v, %v, want true", ok, err)
+	}
+
+	if n, err := b.SRem(ctx, key, []byte("b"), []byte("z"), []byte("b")); err != nil || n != 1 {
+		t.Errorf("SRem = %d, %v, want 1", n, err)
+	}
+	if got := smembers(); got != "a,c" {
+		t.Errorf("SMembers = %q, want %q", got, "a,c")
+	}
+	if ok, err := b.SIsMember(ctx, key, []byte("b")); err != nil || ok {
+		t.Errorf("SIsMember = %v, %v, want false", ok, err)
+	}
+
+	if n, err := b.SRem(ctx, key, []byte("a"), []byte("c")); err != nil || n != 2 {
+		t.Errorf("SRem = %d, %v, want 2", n, err)
+	}
+	if got := smembers(); got != "" {
+		t.Errorf("SMembers = %q, want empty", got)
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	ctx := context.Background()
+	b := newSetBucket(t, map[string][]string{
+		"s1": {"a", "b", "c"},
+		"s2": {"b", "c", "d"},
+		"s3": {"e"},
+	})
+	// An emptied set.
+	if _, err := b.SRem(ctx, []byte("s3"), []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+
+	type algebra func(ctx context.Context, keys [][]byte, fn func(member []byte) error) error
+	ops := map[string]algebra{"union": b.SUnion, "inter": b.SInter, "diff": b.SDiff}
+	tests := []struct {
+		op   string
+		keys string
+		want string
+	}{
+		{"union", "", ""},
+		{"union", "s1 s2", "a,b,c,d"},
+		{"union", "s2 s1", "b,c,d,a"},
+		{"union", "s1 s1", "a,b,c"},
+		{"union", "s1 s3", "a,b,c"},
+		{"union", "missing s2", "b,c,d"},
+		{"inter", "", ""},
+		{"inter", "s1 s2", "b,c"},
+		{"inter", "s1 s1", "a,b,c"},
+		{"inter", "s1 s3", ""},
+		{"inter", "s1 missing", ""},
+		{"inter", "missing s1", ""},
+		{"diff", "", ""},
+		{"diff", "s1 s2", "a"},
+		{"diff", "s1", "a,b,c"},
+		{"diff", "s1 s1", ""},
+		{"diff", "s1 s3", "a,b,c"},
+		{"diff", "s1 missing", "a,b,c"},
+		{"diff", "missing s1", ""},
+	}
+	for _, tt := range tests {
+		var keys [][]byte
+		for _, k := range strings.Fields(tt.keys) {
+			keys = append(keys, []byte(k))
+		}
+		got := collect(t, func(fn func(member []byte) error) error {
+			return ops[tt.op](ctx, keys, fn)
+		})
+		if got != tt.want {
+			t.Errorf("%s %s = %q, want %q", tt.op, tt.keys, got, tt.want)
+		}
+	}
+
+	// The members are streamed, an error of fn stops the iteration.
+	errStop := errors.New("stop")
+	for name, op := range ops {
+		n := 0
+		err := op(ctx, [][]byte{[]byte("s1"), []byte("s2")}, func([]byte) error {
+			n++
+			return errStop
+		})
+		if !errors.Is(err, errStop) || n != 1 {
+			t.Errorf("%s = %v after %d members, want %v after 1", name, err, n, errStop)
+		}
+	}
+}
+
+func TestLuaSets(t *testing.T) {
+	ctx := context.Background()
+	b := newSetBucket(t, nil)
+	script := `
+local sets = kvdb.sets
+kvdb.say(sets.add("l1", "c", "a", "b", "a"))
+kvdb.say(sets.add("l2", "b", "d"))
+kvdb.say(sets.rem("l2", "d", "z"))
+kvdb.say(tostring(sets.ismember("l1", "a")) .. " " .. tostring(sets.ismember("l2", "a")))
+kvdb.say(table.concat(sets.members("l1"), ","))
+kvdb.say(sets.card("l1"))
+kvdb.say(table.concat(sets.union("l1", "l2"), ","))
+kvdb.say(table.concat(sets.inter("l1", "l2"), ","))
+kvdb.say(table.concat(sets.diff("l1", "l2"), ","))
+`
+	if err := b.StoreScript(ctx, []byte("sets"), []byte(script)); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	if err := b.DoScript(ctx, w, r, []byte("sets")); err != nil {
+		t.Fatal(err)
+	}
+	want := "3\n2\n1\ntrue false\na,b,c\n3\na,b,c\nb\na,c\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+
+	// The writes of the script are committed.
+	got := collect(t, func(fn func(member []byte) error) error {
+		return b.SMembers(ctx, []byte("l2"), fn)
+	})
+	if got != "b" {
+		t.Errorf("SMembers = %q, want %q", got, "b")
+	}
+}
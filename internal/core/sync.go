@@ -0,0 +1,72 @@
+package core
+
+import (
+	"context"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+type syncKey struct{}
+
+// WithSync overrides BucketOptions.SyncWrites for the writes made with ctx.
+func WithSync(ctx context.Context, sync bool) context.Context {
+	return context.WithValue(ctx, syncKey{}, sync)
+}
+
+// update runs fn in a write transaction, and makes the commit durable when
+// requested, see WithSync. The keys used by fn are locked until committed,
+// fn is run again when one is used by another transaction, see keyLocker.
+// The cached values written are invalidated and the history of the keys
+// written is pruned once committed.
+func (b *Bucket) update(ctx context.Context, fn func(txn kv.Txn) error) error {
+	if readOnly(ctx) {
+		return kv.ErrReadOnlyTxn
+	}
+	locker := newKeyLocker()
+	defer locker.release()
+	for {
+		prune, err := b.tryUpdate(ctx, locker, fn)
+		if locker.retry() {
+			continue
+		}
+		locker.release()
+		if err != nil {
+			return err
+		}
+		prune(ctx)
+		return b.sync(ctx)
+	}
+}
+
+func (b *Bucket) tryUpdate(
+	ctx context.Context,
+	locker *keyLocker,
+	fn func(txn kv.Txn) error,
+) (func(ctx context.Context), error) {
+	txn, invalidate := b.trackWrites(ctx, locker.newTransaction(b.store))
+	defer invalidate()
+	defer txn.Discard()
+	txn, prune := b.trackHistory(txn)
+	if err := fn(txn); err != nil {
+		return nil, err
+	}
+	if locker.failed {
+		// fn ignored the error.
+		return nil, errLockBusy
+	}
+	if err := txn.Commit(); err != nil {
+		return nil, err
+	}
+	return prune, nil
+}
+
+func (b *Bucket) sync(ctx context.Context) error {
+	sync, ok := ctx.Value(syncKey{}).(bool)
+	if !ok {
+		sync = b.opts.SyncWrites
+	}
+	if s, ok := b.store.(kv.SyncStore); ok && sync {
+		return s.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+type syncStore struct {
+	kv.Store
+	syncs atomic.Int64
+}
+
+func (s *syncStore) Sync() error {
+	s.syncs.Add(1)
+	return nil
+}
+
+func TestSyncPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		syncWrites bool
+		ctx        func(context.Context) context.Context
+		want       int64
+	}{
+		{"default", false, nil, 0},
+		{"bucket", true, nil, 1},
+		{"request", false, func(ctx context.Context) context.Context {
+			return WithSync(ctx, true)
+		}, 1},
+		{"request opts out", true, func(ctx context.Context) context.Context {
+			return WithSync(ctx, false)
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := &syncStore{Store: memory.New()}
+			b, err := NewBucket(ctx, s, &BucketOptions{SyncWrites: tt.syncWrites})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.syncs.Store(0)
+			if tt.ctx != nil {
+				ctx = tt.ctx(ctx)
+			}
+			if err := b.Set(ctx, []byte("k"), []byte("v"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if got := s.syncs.Load(); got != tt.want {
+				t.Errorf("%d syncs, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+// Number of generations of the value cache, keys are spread over them.
+const _valueGens = 256
+
+var _values atomic.Pointer[valueCache]
+
+type ValueCacheOptions struct {
+	// Total size of the cached keys and values in bytes.
+	Size int64
+
+	// Larger values are not cached.
+	MaxValueSize int
+}
+
+// SetValueCache enables the cache of the values read by Bucket.Get, for
+// the buckets created with BucketOptions.CacheValues. It must be called
+// before serving requests, and not for a cluster.Store: a hit skips the
+// store, and the read index of its transactions.
+func SetValueCache(opts *ValueCacheOptions) error {
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		// 10 counters per item, assuming 1 KiB items.
+		NumCounters: max(opts.Size/100, 1000),
+		MaxCost:     opts.Size,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		return err
+	}
+	_values.Store(&valueCache{
+		cache:   cache,
+		maxSize: opts.MaxValueSize,
+		seed:    maphash.MakeSeed(),
+	})
+	return nil
+}
+
+func ValueCacheStats() *CacheStats {
+	c := _values.Load()
+	if c == nil {
+		return &CacheStats{}
+	}
+	m := c.cache.Metrics
+	return &CacheStats{
+		Hits:      m.Hits(),
+		Misses:    m.Misses(),
+		Evictions: m.KeysEvicted(),
+		Size:      int(c.cache.MaxCost()),
+	}
+}
+
+// PurgeCaches drops the cached buckets and values, which must be done when
+// the store was written by another process, e.g. by the previous leader of a
+// cluster.
+func PurgeCaches() {
+	_buckets.purge()
+	if c := _values.Load(); c != nil {
+		c.purge()
+	}
+}
+
+// valueCache caches values by key. A write bumps the generation of the key
+// once committed, so that a value read before is not added afterwards: the
+// additions hold mu for reading, and the invalidations for writing.
+//
+// Keys are prefixed by the epoch of the cache, purging it starts a new one
+// and lets the old entries be evicted.
+type valueCache struct {
+	cache   *ristretto.Cache
+	maxSize int
+	group   singleflight.Group
+	epoch   atomic.Uint64
+
+	mu   sync.RWMutex
+	gens [_valueGens]uint64
+	seed maphash.Seed
+}
+
+func (c *valueCache) key(uKey []byte) string {
+	return string(append(binary.BigEndian.AppendUint64(nil, c.epoch.Load()), uKey...))
+}
+
+func (c *valueCache) gen(key string) *uint64 {
+	return &c.gens[maphash.String(c.seed, key)%_valueGens]
+}
+
+// get returns the value of uKey, reading it with load on a miss. Concurrent
+// misses share a single read.
+func (c *valueCache) get(
+	ctx context.Context,
+	uKey []byte,
+	load func(ctx context.Context) ([]byte, time.Duration, error),
+) ([]byte, error) {
+	key := c.key(uKey)
+	if v, ok := c.cache.Get(key); ok {
+		return bytes.Clone(v.([]byte)), nil
+	}
+	v, err, _ := c.group.Do(key, func() (any, error) {
+		c.mu.RLock()
+		gen := *c.gen(key)
+		c.mu.RUnlock()
+
+		// The waiters should not fail because the first caller left.
+		val, ttl, err := load(context.WithoutCancel(ctx))
+		if err != nil || len(val) > c.maxSize {
+			return val, err
+		}
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		if *c.gen(key) == gen {
+			c.cache.SetWithTTL(key, val, int64(len(key)+len(val)), ttl)
+		}
+		return val, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(v.([]byte)), nil
+}
+
+func (c *valueCache) invalidate(uKeys [][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, uKey := range uKeys {
+		key := c.key(uKey)
+		*c.gen(key)++
+		c.cache.Del(key)
+	}
+}
+
+func (c *valueCache) purge() {
+	c.epoch.Add(1)
+}
+
+// valueCache returns the cache of the values of the bucket, if enabled.
+// Replicas do not cache, their buckets are written by the primary.
+func (b *Bucket) valueCache(ctx context.Context) *valueCache {
+	if !b.opts.CacheValues || readOnly(ctx) {
+		return nil
+	}
+	return _values.Load()
+}
+
+// writeTracker records the keys of the values written by a transaction or
+// a write batch, to invalidate their cached values once committed.
+type writeTracker struct {
+	c      *valueCache
+	prefix []byte
+	keys   [][]byte
+}
+
+func (t *writeTracker) record(key []byte) {
+	if bytes.HasPrefix(key, t.prefix) {
+		t.keys = append(t.keys, bytes.Clone(key))
+	}
+}
+
+func (t *writeTracker) invalidate() {
+	if len(t.keys) > 0 {
+		t.c.invalidate(t.keys)
+		t.keys = nil
+	}
+}
+
+// newWriteTracker tracks the writes of every bucket while the cache is
+// enabled, since a bucket may start caching while it is written.
+func (b *Bucket) newWriteTracker(ctx context.Context) *writeTracker {
+	c := _values.Load()
+	if c == nil || readOnly(ctx) {
+		return nil
+	}
+	return &writeTracker{
+		c:      c,
+		prefix: b.udataKey(nil, _markKeyValue),
+	}
+}
+
+// trackWrites wraps txn to record its writes if values are cached, the
+// returned function invalidates them and must be called once txn is
+// committed or discarded.
+func (b *Bucket) trackWrites(ctx context.Context, txn kv.Txn) (kv.Txn, func()) {
+	t := b.newWriteTracker(ctx)
+	if t == nil {
+		return txn, func() {}
+	}
+	return &trackedTxn{Txn: txn, t: t}, t.invalidate
+}
+
+type trackedTxn struct {
+	kv.Txn
+	t *writeTracker
+}
+
+func (txn *trackedTxn) Set(ctx context.Context, key, val []byte, opts *kv.SetOptions) error {
+	txn.t.record(key)
+	return txn.Txn.Set(ctx, key, val, opts)
+}
+
+func (txn *trackedTxn) Delete(ctx context.Context, key []byte) error {
+	txn.t.record(key)
+	return txn.Txn.Delete(ctx, key)
+}
+
+func (txn *trackedTxn) Incr(
+	ctx context.Context,
+	key []byte,
+	increment int64,
+	opts *kv.IncrOptions[int64],
+) (int64, error) {
+	txn.t.record(key)
+	return txn.Txn.Incr(ctx, key, increment, opts)
+}
+
+func (txn *trackedTxn) IncrFloat(
+	ctx context.Context,
+	key []byte,
+	increment float64,
+	opts *kv.IncrOptions[float64],
+) (float64, error) {
+	txn.t.record(key)
+	return txn.Txn.IncrFloat(ctx, key, increment, opts)
+}
+
+// trackBatch is like trackWrites for a write batch.
+func (b *Bucket) trackBatch(ctx context.Context, wb kv.WriteBatch) (kv.WriteBatch, func()) {
+	t := b.newWriteTracker(ctx)
+	if t == nil {
+		return wb, func() {}
+	}
+	return &trackedBatch{WriteBatch: wb, t: t}, t.invalidate
+}
+
+type trackedBatch struct {
+	kv.WriteBatch
+	t *writeTracker
+}
+
+func (wb *trackedBatch) Set(key, val []byte, opts *kv.SetOptions) error {
+	wb.t.record(key)
+	return wb.WriteBatch.Set(key, val, opts)
+}
+
+func (wb *trackedBatch) Delete(key []byte) error {
+	wb.t.record(key)
+	return wb.WriteBatch.Delete(key)
+}
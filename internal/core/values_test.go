@@ -0,0 +1,183 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+// newCachedBucket enables the value cache for the test, and returns a bucket
+// caching its values.
+func newCachedBucket(t *testing.T, s kv.Store) *Bucket {
+	t.Helper()
+	if err := SetValueCache(&ValueCacheOptions{Size: 1 << 20, MaxValueSize: 1 << 10}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _values.Store(nil) })
+	b, err := NewBucket(context.Background(), s, &BucketOptions{CacheValues: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// cachedGet reads key, and waits for the value to be cached.
+func cachedGet(t *testing.T, b *Bucket, key string) string {
+	t.Helper()
+	val, err := b.Get(context.Background(), []byte(key))
+	if err != nil {
+		t.Fatalf("Get(%s): %v", key, err)
+	}
+	_values.Load().cache.Wait()
+	return string(val)
+}
+
+func TestValueCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	s := memory.New()
+	b := newCachedBucket(t, s)
+	key := []byte("k")
+	if err := b.Set(ctx, key, []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	cachedGet(t, b, "k")
+
+	// A write bypassing the bucket is not seen, the value is cached.
+	err := kv.WithTxn(s, true, func(txn kv.Txn) error {
+		return txn.Set(ctx, b.udataKey(key, _markKeyValue), []byte("2"), nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedGet(t, b, "k"); got != "1" {
+		t.Fatalf("Get = %q, want the cached 1", got)
+	}
+
+	tests := []struct {
+		name  string
+		write func() error
+		want  string
+	}{
+		{"Set", func() error {
+			return b.Set(ctx, key, []byte("3"), 0)
+		}, "3"},
+		{"Incr", func() error {
+			_, err := b.Incr(ctx, key, 1, nil)
+			return err
+		}, "4"},
+		{"ApplyTxn", func() error {
+			return b.ApplyTxn(ctx, []*Operation{
+				{Type: OpTypeSet, Data: &OpSet{Key: key, Value: []byte("5")}},
+			})
+		}, "5"},
+		{"Lua", func() error {
+			if err := b.StoreScript(ctx, []byte("set"), []byte(`kvdb.set("k", "6")`)); err != nil {
+				return err
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			return b.DoScript(ctx, w, r, []byte("set"))
+		}, "6"},
+		{"Import", func() error {
+			_, err := importRecords(b, []*Record{
+				{Type: RecordTypeKV, Key: "k", Value: []byte("7")},
+			}, &ImportOptions{Overwrite: true})
+			return err
+		}, "7"},
+	}
+	for _, tt := range tests {
+		cachedGet(t, b, "k")
+		if err := tt.write(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := cachedGet(t, b, "k"); got != tt.want {
+			t.Errorf("Get after %s = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	cachedGet(t, b, "k")
+	if err := b.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(ctx, key); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("Get after Delete error = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestValueCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	b := newCachedBucket(t, memory.New())
+	if err := b.Set(ctx, []byte("k"), []byte("v"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	cachedGet(t, b, "k")
+	time.Sleep(2100 * time.Millisecond)
+	if val, err := b.Get(ctx, []byte("k")); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Errorf("Get after expiry = %q, %v, want ErrKeyNotFound", val, err)
+	}
+}
+
+// blockingStore counts the reads of a key, which wait for release.
+type blockingStore struct {
+	kv.Store
+	key     []byte
+	reads   atomic.Int64
+	release chan struct{}
+}
+
+func (s *blockingStore) NewTransaction(update bool) kv.Txn {
+	return &blockingTxn{Txn: s.Store.NewTransaction(update), s: s}
+}
+
+type blockingTxn struct {
+	kv.Txn
+	s *blockingStore
+}
+
+func (txn *blockingTxn) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if string(key) == string(txn.s.key) {
+		txn.s.reads.Add(1)
+		<-txn.s.release
+	}
+	return txn.Txn.Get(ctx, key)
+}
+
+func TestValueCacheCoalescing(t *testing.T) {
+	ctx := context.Background()
+	s := &blockingStore{Store: memory.New(), release: make(chan struct{})}
+	b := newCachedBucket(t, s)
+	if err := b.Set(ctx, []byte("k"), []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	s.key = b.udataKey([]byte("k"), _markKeyValue)
+
+	const readers = 8
+	var wg sync.WaitGroup
+	for range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if val, err := b.Get(ctx, []byte("k")); err != nil || string(val) != "v" {
+				t.Errorf("Get = %q, %v, want v", val, err)
+			}
+		}()
+	}
+	for s.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Let the other readers join the read in flight.
+	time.Sleep(20 * time.Millisecond)
+	close(s.release)
+	wg.Wait()
+	if n := s.reads.Load(); n != 1 {
+		t.Errorf("%d reads for %d concurrent misses, want 1", n, readers)
+	}
+}
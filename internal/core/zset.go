@@ -0,0 +1,569 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+)
+
+// A sorted set is stored as two indexes:
+//
+//	<bucket_name>:zmember:<len(key)><key><member> -> <score>
+//	<bucket_name>:zscore:<len(key)><key><sortable score><member> -> ""
+//
+// The first one answers ZSCORE, the second one keeps members ordered by
+// score for range scans.
+
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// ZRangeByScoreOptions selects members with Min <= score <= Max. Offset and
+// Limit paginate the result, a Limit <= 0 means no limit.
+type ZRangeByScoreOptions struct {
+	Min    float64
+	Max    float64
+	Offset int
+	Limit  int
+}
+
+// ZAdd sets the score of member and reports whether member was newly added.
+func (b *Bucket) ZAdd(ctx context.Context, key, member []byte, score float64) (bool, error) {
+	var added bool
+	err := b.update(ctx, func(txn kv.Txn) error {
+		var err error
+		added, err = b.zadd(ctx, txn, key, member, score)
+		return err
+	})
+	return added, err
+}
+
+func (b *Bucket) ZIncrBy(
+	ctx context.Context,
+	key, member []byte,
+	increment float64,
+) (float64, error) {
+	var score float64
+	err := b.update(ctx, func(txn kv.Txn) error {
+		var err error
+		score, err = b.zincrby(ctx, txn, key, member, increment)
+		return err
+	})
+	return score, err
+}
+
+// ZRange returns members ordered by score from rank start to stop
+// (inclusive). Negative ranks count from the end, -1 being the last member.
+func (b *Bucket) ZRange(ctx context.Context, key []byte, start, stop int64) ([]*ZMember, error) {
+	var ms []*ZMember
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		var err error
+		ms, err = b.zrange(ctx, txn, key, start, stop, false)
+		return err
+	})
+	return ms, err
+}
+
+// ZRevRange is like ZRange with members ordered from the highest score.
+func (b *Bucket) ZRevRange(
+	ctx context.Context,
+	key []byte,
+	start, stop int64,
+) ([]*ZMember, error) {
+	var ms []*ZMember
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		var err error
+		ms, err = b.zrange(ctx, txn, key, start, stop, true)
+		return err
+	})
+	return ms, err
+}
+
+func (b *Bucket) ZRangeByScore(
+	ctx context.Context,
+	key []byte,
+	opts *ZRangeByScoreOptions,
+) ([]*ZMember, error) {
+	var ms []*ZMember
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		var err error
+		ms, err = b.zrangebyscore(ctx, txn, key, opts, false)
+		return err
+	})
+	return ms, err
+}
+
+func (b *Bucket) ZRevRangeByScore(
+	ctx context.Context,
+	key []byte,
+	opts *ZRangeByScoreOptions,
+) ([]*ZMember, error) {
+	var ms []*ZMember
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		var err error
+		ms, err = b.zrangebyscore(ctx, txn, key, opts, true)
+		return err
+	})
+	return ms, err
+}
+
+// ZRank returns the 0-based position of member ordered by ascending score.
+func (b *Bucket) ZRank(ctx context.Context, key, member []byte) (int64, error) {
+	var rank int64
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		var err error
+		rank, err = b.zrank(ctx, txn, key, member)
+		return err
+	})
+	return rank, err
+}
+
+func (b *Bucket) ZScore(ctx context.Context, key, member []byte) (float64, error) {
+	var score float64
+	err := kv.WithTxn(b.store, false, func(txn kv.Txn) error {
+		var err error
+		score, err = b.zscore(ctx, txn, key, member)
+		return err
+	})
+	return score, err
+}
+
+// ZRem removes the given members and returns the number of members that existed.
+func (b *Bucket) ZRem(ctx context.Context, key []byte, members ...[]byte) (int, error) {
+	var n int
+	err := b.update(ctx, func(txn kv.Txn) error {
+		var err error
+		n, err = b.zrem(ctx, txn, key, members...)
+		return err
+	})
+	return n, err
+}
+
+func (b *Bucket) zadd(
+	ctx context.Context,
+	txn kv.Txn,
+	key, member []byte,
+	score float64,
+) (bool, error) {
+	if math.IsNaN(score) {
+		return false, kv.ErrInvalidNum
+	}
+	prev, err := b.zscore(ctx, txn, key, member)
+	added := errors.Is(err, kv.ErrKeyNotFound)
+	if err != nil && !added {
+		return false, err
+	}
+	if !added {
+		if prev == score {
+			return false, nil
+		}
+		if err := txn.Delete(ctx, b.zscoreKey(key, member, prev)); err != nil {
+			return false, err
+		}
+	}
+
+	// Both keys of the member expire at the same time.
+	opts := b.setOptions(0)
+	if opts.TTL > 0 {
+		opts.ExpiresAt = time.Now().Add(opts.TTL)
+	}
+	if err := txn.Set(
+		ctx,
+		b.compositeKey(_markZMember, key, member),
+		binary.BigEndian.AppendUint64(nil, math.Float64bits(score)),
+		opts,
+	); err != nil {
+		return false, err
+	}
+	if err := txn.Set(ctx, b.zscoreKey(key, member, score), nil, opts); err != nil {
+		return false, err
+	}
+	return added, nil
+}
+
+func (b *Bucket) zincrby(
+	ctx context.Context,
+	txn kv.Txn,
+	key, member []byte,
+	increment float64,
+) (float64, error) {
+	score, err := b.zscore(ctx, txn, key, member)
+	if err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+		return 0, err
+	}
+	score += increment
+	if _, err := b.zadd(ctx, txn, key, member, score); err != nil {
+		return 0, err
+	}
+	return score, nil
+}
+
+func (b *Bucket) zrange(
+	ctx context.Context,
+	txn kv.Txn,
+	key []byte,
+	start, stop int64,
+	reverse bool,
+) ([]*ZMember, error) {
+	switch {
+	case start < 0 && stop < 0:
+		// Count from the other end rather than counting the members.
+		ms, err := b.zrangeRanks(ctx, txn, key, -stop-1, -start-1, !reverse)
+		slices.Reverse(ms)
+		return ms, err
+	case stop < 0:
+		ms, err := b.zrangeRanks(ctx, txn, key, start, math.MaxInt64, reverse)
+		return ms[:max(int64(len(ms))+stop+1, 0)], err
+	case start < 0:
+		card, err := b.zcard(ctx, txn, key)
+		if err != nil {
+			return nil, err
+		}
+		start = max(card+start, 0)
+	}
+	return b.zrangeRanks(ctx, txn, key, start, stop, reverse)
+}
+
+// zrangeRanks returns members from rank start to stop, both non-negative.
+func (b *Bucket) zrangeRanks(
+	ctx context.Context,
+	txn kv.Txn,
+	key []byte,
+	start, stop int64,
+	reverse bool,
+) ([]*ZMember, error) {
+	ms := make([]*ZMember, 0)
+	if start > stop {
+		return ms, nil
+	}
+
+	prefix := b.compositeKey(_markZScore, key, nil)
+	var rank int64
+	err := txn.Iterate(ctx, &kv.IterOptions{
+		Prefix:   prefix,
+		Reverse:  reverse,
+		KeysOnly: true,
+	}, func(k, _ []byte) error {
+		if rank > stop {
+			return kv.ErrStopIteration
+		}
+		if rank >= start {
+			ms = append(ms, decodeZScoreKey(k[len(prefix):]))
+		}
+		rank++
+		return nil
+	})
+	return ms, err
+}
+
+func (b *Bucket) zrangebyscore(
+	ctx context.Context,
+	txn kv.Txn,
+	key []byte,
+	opts *ZRangeByScoreOptions,
+	reverse bool,
+) ([]*ZMember, error) {
+	ms := make([]*ZMember, 0)
+	if opts.Min > opts.Max {
+		return ms, nil
+	}
+
+	prefix := b.compositeKey(_markZScore, key, nil)
+	var seek []byte
+	if reverse {
+		// Reverse seeks include the seek key, which may be a member scored
+		// right above Max.
+		seek = kv.PrefixEnd(b.compositeKey(_markZScore, key, encodeScore(opts.Max)))
+	} else {
+		seek = b.compositeKey(_markZScore, key, encodeScore(opts.Min))
+	}
+
+	skipped := 0
+	err := txn.Iterate(ctx, &kv.IterOptions{
+		Prefix:   prefix,
+		Seek:     seek,
+		Reverse:  reverse,
+		KeysOnly: true,
+	}, func(k, _ []byte) error {
+		m := decodeZScoreKey(k[len(prefix):])
+		if reverse && m.Score > opts.Max {
+			return nil
+		}
+		if m.Score < opts.Min || m.Score > opts.Max {
+			return kv.ErrStopIteration
+		}
+		if skipped < opts.Offset {
+			skipped++
+			return nil
+		}
+		ms = append(ms, m)
+		if opts.Limit > 0 && len(ms) >= opts.Limit {
+			return kv.ErrStopIteration
+		}
+		return nil
+	})
+	return ms, err
+}
+
+// zrank scans the members up to member, so it is linear in the rank.
+func (b *Bucket) zrank(ctx context.Context, txn kv.Txn, key, member []byte) (int64, error) {
+	score, err := b.zscore(ctx, txn, key, member)
+	if err != nil {
+		return 0, err
+	}
+
+	target := b.zscoreKey(key, member, score)
+	prefix := b.compositeKey(_markZScore, key, nil)
+	var rank int64
+	err = txn.Iterate(ctx, &kv.IterOptions{
+		Prefix:   prefix,
+		KeysOnly: true,
+	}, func(k, _ []byte) error {
+		if string(k) == string(target) {
+			return kv.ErrStopIteration
+		}
+		rank++
+		return nil
+	})
+	return rank, err
+}
+
+func (b *Bucket) zscore(ctx context.Context, txn kv.Txn, key, member []byte) (float64, error) {
+	val, err := txn.Get(ctx, b.compositeKey(_markZMember, key, member))
+	if err != nil {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, kv.ErrInvalidNum
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(val)), nil
+}
+
+func (b *Bucket) zrem(
+	ctx context.Context,
+	txn kv.Txn,
+	key []byte,
+	members ...[]byte,
+) (int, error) {
+	var n int
+	for _, member := range members {
+		score, err := b.zscore(ctx, txn, key, member)
+		if err != nil {
+			if errors.Is(err, kv.ErrKeyNotFound) {
+				continue
+			}
+			return 0, err
+		}
+		if err := txn.Delete(ctx, b.compositeKey(_markZMember, key, member)); err != nil {
+			return 0, err
+		}
+		if err := txn.Delete(ctx, b.zscoreKey(key, member, score)); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (b *Bucket) zcard(ctx context.Context, txn kv.Txn, key []byte) (int64, error) {
+	var n int64
+	err := txn.Iterate(ctx, &kv.IterOptions{
+		Prefix:   b.compositeKey(_markZMember, key, nil),
+		KeysOnly: true,
+	}, func(_, _ []byte) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func (b *Bucket) zscoreKey(key, member []byte, score float64) []byte {
+	sub := append(encodeScore(score), member...)
+	return b.compositeKey(_markZScore, key, sub)
+}
+
+// encodeScore encodes f so that the byte order of the result matches the
+// numeric order of f.
+func encodeScore(f float64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) == 0 {
+		bits |= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return binary.BigEndian.AppendUint64(make([]byte, 0, 8), bits)
+}
+
+func decodeScore(b []byte) float64 {
+	bits := binary.BigEndian.Uint64(b)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+func decodeZScoreKey(sub []byte) *ZMember {
+	return &ZMember{
+		Member: string(sub[8:]),
+		Score:  decodeScore(sub[:8]),
+	}
+}
+
+func zmembersToLua(l *lua.LState, ms []*ZMember) *lua.LTable {
+	arr := l.NewTable()
+	for _, m := range ms {
+		tb := l.NewTable()
+		tb.RawSetString("member", lua.LString(m.Member))
+		tb.RawSetString("score", lua.LNumber(m.Score))
+		arr.Append(tb)
+	}
+	return arr
+}
+
+func mkLuaZSet(ctx context.Context, b *Bucket, txn kv.Txn, l *lua.LState) *lua.LTable {
+	rangeByRank := func(reverse bool) lua.LGFunction {
+		return func(l *lua.LState) int {
+			key := l.CheckString(1)
+			start := l.CheckInt64(2)
+			stop := l.CheckInt64(3)
+			ms, err := b.zrange(ctx, txn, bytesconv.StringToBytes(key), start, stop, reverse)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(zmembersToLua(l, ms))
+			return 1
+		}
+	}
+	rangeByScore := func(reverse bool) lua.LGFunction {
+		return func(l *lua.LState) int {
+			key := l.CheckString(1)
+			opts := &ZRangeByScoreOptions{
+				Min:    float64(l.CheckNumber(2)),
+				Max:    float64(l.CheckNumber(3)),
+				Offset: l.OptInt(4, 0),
+				Limit:  l.OptInt(5, 0),
+			}
+			ms, err := b.zrangebyscore(ctx, txn, bytesconv.StringToBytes(key), opts, reverse)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(zmembersToLua(l, ms))
+			return 1
+		}
+	}
+	fns := map[string]lua.LGFunction{
+		"add": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			score := l.CheckNumber(2)
+			member := l.CheckString(3)
+			added, err := b.zadd(
+				ctx,
+				txn,
+				bytesconv.StringToBytes(key),
+				bytesconv.StringToBytes(member),
+				float64(score),
+			)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(lua.LBool(added))
+			return 1
+		},
+		"incrby": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			increment := l.CheckNumber(2)
+			member := l.CheckString(3)
+			score, err := b.zincrby(
+				ctx,
+				txn,
+				bytesconv.StringToBytes(key),
+				bytesconv.StringToBytes(member),
+				float64(increment),
+			)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(lua.LNumber(score))
+			return 1
+		},
+		"range":           rangeByRank(false),
+		"revrange":        rangeByRank(true),
+		"rangebyscore":    rangeByScore(false),
+		"revrangebyscore": rangeByScore(true),
+		"rank": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			member := l.CheckString(2)
+			rank, err := b.zrank(
+				ctx,
+				txn,
+				bytesconv.StringToBytes(key),
+				bytesconv.StringToBytes(member),
+			)
+			if err != nil {
+				if errors.Is(err, kv.ErrKeyNotFound) {
+					l.Push(lua.LNil)
+					return 1
+				}
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(lua.LNumber(rank))
+			return 1
+		},
+		"score": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			member := l.CheckString(2)
+			score, err := b.zscore(
+				ctx,
+				txn,
+				bytesconv.StringToBytes(key),
+				bytesconv.StringToBytes(member),
+			)
+			if err != nil {
+				if errors.Is(err, kv.ErrKeyNotFound) {
+					l.Push(lua.LNil)
+					return 1
+				}
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(lua.LNumber(score))
+			return 1
+		},
+		"rem": func(l *lua.LState) int {
+			key := l.CheckString(1)
+			members := make([][]byte, 0, l.GetTop()-1)
+			for i := 2; i <= l.GetTop(); i++ {
+				members = append(members, bytesconv.StringToBytes(l.CheckString(i)))
+			}
+			n, err := b.zrem(ctx, txn, bytesconv.StringToBytes(key), members...)
+			if err != nil {
+				l.Error(lua.LString(err.Error()), 1)
+				return 0
+			}
+			l.Push(lua.LNumber(n))
+			return 1
+		},
+	}
+
+	mod := l.NewTable()
+	for name, f := range fns {
+		mod.RawSetString(name, l.NewFunction(f))
+	}
+	return mod
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+func TestZRange(t *testing.T) {
+	ctx := context.Background()
+	b, err := NewBucket(ctx, memory.New(), &BucketOptions{DefaultTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("z")
+	for i, m := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := b.ZAdd(ctx, key, []byte(m), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	members := func(ms []*ZMember) string {
+		var s string
+		for _, m := range ms {
+			s += m.Member
+		}
+		return s
+	}
+	for _, tt := range []struct {
+		start, stop int64
+		reverse     bool
+		want        string
+	}{
+		{0, -1, false, "abcde"},
+		{1, 2, false, "bc"},
+		{-2, -1, false, "de"},
+		{-3, 3, false, "cd"},
+		{1, -2, false, "bcd"},
+		{-10, 1, false, "ab"},
+		{3, -4, false, ""},
+		{-1, -2, false, ""},
+		{0, 1, true, "ed"},
+		{-2, -1, true, "ba"},
+		{1, -2, true, "dcb"},
+	} {
+		ms, err := b.ZRange(ctx, key, tt.start, tt.stop)
+		if tt.reverse {
+			ms, err = b.ZRevRange(ctx, key, tt.start, tt.stop)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := members(ms); got != tt.want {
+			t.Errorf("range %d %d reverse %v = %q, want %q",
+				tt.start, tt.stop, tt.reverse, got, tt.want)
+		}
+	}
+
+	// The key of the empty member scored right above 4 is the reverse seek
+	// of Max 4.
+	if _, err := b.ZAdd(ctx, key, []byte{}, 4.000000000000001); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := b.ZRevRangeByScore(ctx, key, &ZRangeByScoreOptions{Min: 1, Max: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := members(ms); got != "edcb" {
+		t.Errorf("revrangebyscore = %q, want %q", got, "edcb")
+	}
+}
+
+func TestConcurrentZSetWrites(t *testing.T) {
+	ctx := context.Background()
+	b := newHistoryBucket(t, &BucketOptions{})
+	key := []byte("z")
+	members := []string{"a", "b", "c", "d"}
+
+	run := func(write func(i int, m []byte) error) {
+		var wg sync.WaitGroup
+		for i := range 100 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := write(i, []byte(members[i%len(members)])); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	// The score index must hold exactly one entry per member, matching the
+	// member index.
+	check := func() []*ZMember {
+		t.Helper()
+		ms, err := b.ZRange(ctx, key, 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ms) != len(members) {
+			t.Fatalf("ZRange = %d members, want %d", len(ms), len(members))
+		}
+		for _, m := range ms {
+			score, err := b.ZScore(ctx, key, []byte(m.Member))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if score != m.Score {
+				t.Errorf("ZScore(%q) = %v, ZRange score %v", m.Member, score, m.Score)
+			}
+		}
+		return ms
+	}
+
+	run(func(i int, m []byte) error {
+		_, err := b.ZAdd(ctx, key, m, float64(i))
+		return err
+	})
+	before := make(map[string]float64)
+	for _, m := range check() {
+		before[m.Member] = m.Score
+	}
+
+	run(func(_ int, m []byte) error {
+		_, err := b.ZIncrBy(ctx, key, m, 1)
+		return err
+	})
+	for _, m := range check() {
+		if want := before[m.Member] + 25; m.Score != want {
+			t.Errorf("score of %q = %v, want %v", m.Member, m.Score, want)
+		}
+	}
+}
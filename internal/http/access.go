@@ -0,0 +1,63 @@
+package http
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jaevor/go-nanoid"
+	"github.com/samber/lo"
+	"github.com/tomasen/realip"
+
+	"github.com/maolonglong/kvdb/internal/core"
+)
+
+const (
+	_headerRequestID = "X-Request-ID"
+	// Longer request IDs of clients are replaced.
+	_maxRequestIDLen = 128
+)
+
+var requestIDGen = lo.Must(nanoid.Standard(21))
+
+// requestID returns the request ID sent by the client, or a new one if it
+// did not send a valid one.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(_headerRequestID)
+	if id == "" || len(id) > _maxRequestIDLen {
+		return requestIDGen()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return requestIDGen()
+		}
+	}
+	return id
+}
+
+// logRequest writes the access log of r, err is the error of its handler.
+func logRequest(r *http.Request, w *responseWriter, d time.Duration, err error) {
+	status := w.code()
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case err != nil:
+		level = slog.LevelWarn
+	}
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("route", routeTemplate(r)),
+		slog.String("bucket", mux.Vars(r)["bucket"]),
+		slog.Int("status", status),
+		slog.Int64("bytes", w.bytes),
+		slog.Duration("duration", d),
+		slog.String("client_ip", realip.FromRequest(r)),
+		slog.String("request_id", core.RequestID(r.Context())),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("err", err))
+	}
+	slog.LogAttrs(r.Context(), level, "http: Served request", attrs...)
+}
@@ -0,0 +1,121 @@
+package http_test
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logRecorder is a slog.Handler keeping the records logged.
+type logRecorder struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *logRecorder) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *logRecorder) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func (h *logRecorder) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *logRecorder) WithGroup(string) slog.Handler { return h }
+
+// find returns the attributes of the last record with msg.
+func (h *logRecorder) find(msg string) map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.records) - 1; i >= 0; i-- {
+		if r := h.records[i]; r.Message == msg {
+			attrs := make(map[string]string)
+			r.Attrs(func(a slog.Attr) bool {
+				attrs[a.Key] = a.Value.String()
+				return true
+			})
+			return attrs
+		}
+	}
+	return nil
+}
+
+func recordLogs(t *testing.T) *logRecorder {
+	h := &logRecorder{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return h
+}
+
+func TestRequestID(t *testing.T) {
+	logs := recordLogs(t)
+	s := newServer(t)
+	long := strings.Repeat("a", 128)
+	for _, tt := range []struct {
+		name string
+		id   string
+		keep bool
+	}{
+		{"valid", "req-1_a.b:c", true},
+		{"max length", long, true},
+		{"none", "", false},
+		{"too long", long + "a", false},
+		{"space", "req 1", false},
+		{"control", "req\x7f", false},
+		{"non ascii", "réq", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/"+s.bucket+"/k", nil)
+			if tt.id != "" {
+				r.Header.Set("X-Request-ID", tt.id)
+			}
+			w := httptest.NewRecorder()
+			s.h.ServeHTTP(w, r)
+
+			id := w.Header().Get("X-Request-ID")
+			if tt.keep && id != tt.id {
+				t.Errorf("X-Request-ID = %q, want %q", id, tt.id)
+			}
+			if !tt.keep && (id == tt.id || len(id) != 21) {
+				t.Errorf("X-Request-ID = %q, want a new ID", id)
+			}
+			attrs := logs.find("http: Served request")
+			if attrs["request_id"] != id {
+				t.Errorf("request_id = %q, want %q", attrs["request_id"], id)
+			}
+		})
+	}
+}
+
+func TestScriptErrorRequestID(t *testing.T) {
+	logs := recordLogs(t)
+	s := newServer(t)
+	s.expect(t, http.MethodPost, "/_scripts/fail", `error("boom")`, http.StatusOK, "")
+
+	r := httptest.NewRequest(http.MethodPost, "/"+s.bucket+"/scripts/fail", nil)
+	r.Header.Set("X-Request-ID", "req-1")
+	w := httptest.NewRecorder()
+	s.h.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("script = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	attrs := logs.find("core: Script failed")
+	if attrs == nil {
+		t.Fatal("the failure of the script is not logged")
+	}
+	if attrs["request_id"] != "req-1" || attrs["script"] != "fail" ||
+		!strings.Contains(attrs["err"], "boom") {
+		t.Errorf("script failure logged with %v", attrs)
+	}
+	if id := logs.find("http: Served request")["request_id"]; id != "req-1" {
+		t.Errorf("request_id = %q, want %q", id, "req-1")
+	}
+}
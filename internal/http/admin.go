@@ -0,0 +1,147 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/cast"
+
+	"github.com/maolonglong/kvdb/internal/cluster"
+	"github.com/maolonglong/kvdb/internal/core"
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/replica"
+)
+
+// Trailer of backup responses holding the version to pass as since to the
+// next incremental backup.
+const _trailerBackupVersion = "Kvdb-Backup-Version"
+
+// NewAdminHandler serves operator endpoints, which require token as a bearer
+// token. They are disabled when token is empty.
+func NewAdminHandler(store kv.Store, token string, opts *Options) http.Handler {
+	if opts == nil {
+		opts = &Options{}
+	}
+	monkey := func(fn handleFunc) http.Handler {
+		return handle(withAdminToken(token, withReplica(opts.Primary, fn)), store)
+	}
+
+	r := mux.NewRouter()
+	r.Handle("/admin/backup", monkey(backupStore)).Methods(http.MethodGet)
+	r.Handle("/admin/buckets", monkey(listBuckets)).Methods(http.MethodGet)
+	r.Handle("/admin/buckets/{bucket}", monkey(dropBucket)).Methods(http.MethodDelete)
+	r.Handle("/admin/replication", monkey(replicationStatus(opts.Replica))).
+		Methods(http.MethodGet)
+	r.Handle("/admin/stats", monkey(stats)).Methods(http.MethodGet)
+
+	c := opts.Cluster
+	r.Handle("/admin/cluster", monkey(withCluster(c, clusterStatus))).Methods(http.MethodGet)
+	r.Handle("/admin/cluster/members", monkey(withCluster(c, addMember))).
+		Methods(http.MethodPost)
+	r.Handle("/admin/cluster/members/{id}", monkey(withCluster(c, removeMember))).
+		Methods(http.MethodDelete)
+	r.Handle(cluster.PathVote, monkey(withCluster(c, raftVote))).Methods(http.MethodPost)
+	r.Handle(cluster.PathAppend, monkey(withCluster(c, raftAppend))).Methods(http.MethodPost)
+	r.Handle(cluster.PathSnapshot, monkey(withCluster(c, raftSnapshot))).
+		Methods(http.MethodPost)
+	return r
+}
+
+func withAdminToken(token string, next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+		got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("admin token required"))
+			return 0, nil
+		}
+		return next(w, r, d)
+	}
+}
+
+func listBuckets(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	return streamJSON(w, func(emit func(v any) error) error {
+		return core.ListBuckets(r.Context(), d.store, func(name string) error {
+			b, err := core.LoadBucket(r.Context(), d.store, name)
+			if err != nil {
+				if errors.Is(err, kv.ErrKeyNotFound) || errors.Is(err, core.ErrBucketExpired) {
+					// Left for the reaper.
+					return nil
+				}
+				return err
+			}
+			info, err := b.Info(r.Context())
+			if err != nil {
+				return err
+			}
+			return emit(info)
+		})
+	})
+}
+
+// dropBucket drops expired buckets too, and does not touch the bucket.
+func dropBucket(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	err := core.DropBucket(r.Context(), d.store, mux.Vars(r)["bucket"])
+	switch {
+	case errors.Is(err, kv.ErrKeyNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("bucket not found"))
+		return 0, nil
+	case errors.Is(err, kv.ErrReadOnlyTxn):
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("read-only replica, drop the bucket on the primary"))
+		return 0, nil
+	case err != nil:
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+}
+
+func stats(w http.ResponseWriter, _ *http.Request, _ *data) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"bucket_cache": core.BucketCacheStats(),
+		"value_cache":  core.ValueCacheStats(),
+	})
+	return 0, nil
+}
+
+func replicationStatus(rep *replica.Replica) handleFunc {
+	return func(w http.ResponseWriter, _ *http.Request, _ *data) (int, error) {
+		if rep == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("not a replica"))
+			return 0, nil
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(rep.Status())
+		return 0, nil
+	}
+}
+
+func backupStore(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	bs, ok := d.store.(kv.BackupStore)
+	if !ok {
+		// Sharded stores cannot be backed up, nor replicated.
+		w.WriteHeader(http.StatusNotImplemented)
+		_, _ = w.Write([]byte("store does not support backups"))
+		return 0, nil
+	}
+	since := cast.ToUint64(r.URL.Query().Get("since"))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", _trailerBackupVersion)
+	version, err := bs.Backup(w, since)
+	if err != nil {
+		// The status has already been sent, the missing trailer tells the
+		// client that the backup is incomplete.
+		return 0, err
+	}
+	w.Header().Set(_trailerBackupVersion, strconv.FormatUint(version, 10))
+	return 0, nil
+}
@@ -0,0 +1,24 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+)
+
+// withSecretKey only lets through requests carrying the bucket's SecretKey,
+// either as a bearer token or as the username of basic auth.
+func withSecretKey(next handleFunc) handleFunc {
+	return withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			key, _, _ = r.BasicAuth()
+		}
+		if !d.bucket.IsSecretKey(key) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kvdb"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("secret key required"))
+			return 0, nil
+		}
+		return next(w, r, d)
+	})
+}
@@ -15,14 +15,7 @@ func createBucket(w http.ResponseWriter, r *http.Request, d *data) (int, error)
 		return http.StatusBadRequest, err
 	}
 
-	opts := &core.BucketOptions{
-		SecretKey:  r.PostForm.Get("secret_key"),
-		ReadKey:    r.PostForm.Get("read_key"),
-		WriteKey:   r.PostForm.Get("write_key"),
-		SigningKey: r.PostForm.Get("signing_key"),
-		DefaultTTL: time.Duration(cast.ToInt64(r.PostForm.Get("default_ttl"))) * time.Second,
-	}
-	b, err := core.NewBucket(r.Context(), d.store, opts)
+	b, err := core.NewBucket(r.Context(), d.store, bucketOptions(r))
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
@@ -30,3 +23,43 @@ func createBucket(w http.ResponseWriter, r *http.Request, d *data) (int, error)
 	_, _ = w.Write(bytesconv.StringToBytes(b.Name()))
 	return 0, nil
 }
+
+var cloneBucket = withSecretKey(
+	func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+		if err := r.ParseForm(); err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		b, err := d.bucket.Clone(r.Context(), bucketOptions(r), r.PostForm.Get("prefix"))
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		_, _ = w.Write(bytesconv.StringToBytes(b.Name()))
+		return 0, nil
+	},
+)
+
+// bucketOptions reads the options of a new bucket from a parsed form.
+func bucketOptions(r *http.Request) *core.BucketOptions {
+	return &core.BucketOptions{
+		SecretKey:  r.PostForm.Get("secret_key"),
+		ReadKey:    r.PostForm.Get("read_key"),
+		WriteKey:   r.PostForm.Get("write_key"),
+		SigningKey: r.PostForm.Get("signing_key"),
+		DefaultTTL: time.Duration(cast.ToInt64(r.PostForm.Get("default_ttl"))) * time.Second,
+
+		TTL: time.Duration(cast.ToInt64(r.PostForm.Get("ttl"))) * time.Second,
+		InactivityTTL: time.Duration(
+			cast.ToInt64(r.PostForm.Get("inactivity_ttl")),
+		) * time.Second,
+
+		HistoryVersions: cast.ToInt(r.PostForm.Get("history_versions")),
+		HistoryDuration: time.Duration(
+			cast.ToInt64(r.PostForm.Get("history_duration")),
+		) * time.Second,
+
+		SyncWrites:  cast.ToBool(r.PostForm.Get("sync_writes")),
+		CacheValues: cast.ToBool(r.PostForm.Get("cache_values")),
+	}
+}
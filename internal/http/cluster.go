@@ -0,0 +1,137 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/maolonglong/kvdb/internal/cluster"
+	"github.com/maolonglong/kvdb/internal/raft"
+)
+
+// withLeader redirects to the leader of the cluster, only it serves data.
+func withLeader(c *cluster.Store, next handleFunc) handleFunc {
+	if c == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+		if c.IsLeader() {
+			return next(w, r, d)
+		}
+		m, ok := c.Leader()
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("no leader, retry later"))
+			return 0, nil
+		}
+		target := strings.TrimSuffix(m.ClientURL, "/") + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+		return 0, nil
+	}
+}
+
+// withCluster serves the admin endpoints of a cluster member, with a 404 on
+// other servers.
+func withCluster(
+	c *cluster.Store,
+	fn func(w http.ResponseWriter, r *http.Request, n *raft.Node) (int, error),
+) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, _ *data) (int, error) {
+		if c == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("not a cluster member"))
+			return 0, nil
+		}
+		return fn(w, r, c.Node())
+	}
+}
+
+func raftVote(w http.ResponseWriter, r *http.Request, n *raft.Node) (int, error) {
+	var req raft.VoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, err
+	}
+	resp, err := n.HandleRequestVote(&req)
+	return writeRaftResponse(w, resp, err)
+}
+
+func raftAppend(w http.ResponseWriter, r *http.Request, n *raft.Node) (int, error) {
+	var req raft.AppendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, err
+	}
+	resp, err := n.HandleAppendEntries(&req)
+	return writeRaftResponse(w, resp, err)
+}
+
+func raftSnapshot(w http.ResponseWriter, r *http.Request, n *raft.Node) (int, error) {
+	var req raft.SnapshotRequest
+	if err := json.Unmarshal([]byte(r.Header.Get(cluster.HeaderSnapshot)), &req); err != nil {
+		return http.StatusBadRequest, err
+	}
+	resp, err := n.HandleInstallSnapshot(&req, r.Body)
+	return writeRaftResponse(w, resp, err)
+}
+
+func writeRaftResponse(w http.ResponseWriter, resp any, err error) (int, error) {
+	if err != nil {
+		if errors.Is(err, raft.ErrStopped) {
+			return http.StatusServiceUnavailable, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return 0, json.NewEncoder(w).Encode(resp)
+}
+
+func clusterStatus(w http.ResponseWriter, _ *http.Request, n *raft.Node) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(n.Status())
+	return 0, nil
+}
+
+func addMember(w http.ResponseWriter, r *http.Request, n *raft.Node) (int, error) {
+	var m raft.Member
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m.ID == "" || m.PeerURL == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid member, id and peer_url are required"))
+		return 0, nil
+	}
+	return changeMembers(w, r, n, n.AddMember(r.Context(), m))
+}
+
+func removeMember(w http.ResponseWriter, r *http.Request, n *raft.Node) (int, error) {
+	return changeMembers(w, r, n, n.RemoveMember(r.Context(), mux.Vars(r)["id"]))
+}
+
+// changeMembers writes the result of a membership change, which followers
+// redirect to the admin endpoint of the leader.
+func changeMembers(w http.ResponseWriter, r *http.Request, n *raft.Node, err error) (int, error) {
+	switch {
+	case err == nil:
+		return clusterStatus(w, r, n)
+	case errors.Is(err, raft.ErrNotLeader):
+		m, ok := n.Leader()
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("no leader, retry later"))
+			return 0, nil
+		}
+		target := strings.TrimSuffix(m.PeerURL, "/") + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+		return 0, nil
+	case errors.Is(err, raft.ErrMemberExists),
+		errors.Is(err, raft.ErrConfigPending):
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(err.Error()))
+		return 0, nil
+	case errors.Is(err, raft.ErrMemberNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(err.Error()))
+		return 0, nil
+	}
+	return http.StatusInternalServerError, err
+}
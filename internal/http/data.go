@@ -1,11 +1,10 @@
 package http
 
 import (
-	"log"
+	"errors"
 	"net/http"
 	"strconv"
-
-	"github.com/tomasen/realip"
+	"time"
 
 	"github.com/maolonglong/kvdb/internal/core"
 	"github.com/maolonglong/kvdb/internal/kv"
@@ -16,23 +15,33 @@ type handleFunc func(w http.ResponseWriter, r *http.Request, d *data) (int, erro
 type data struct {
 	store  kv.Store
 	bucket *core.Bucket
+
+	// Set when serving a replica, see withReplica.
+	primary string
 }
 
 func handle(fn handleFunc, store kv.Store) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		rw.Header().Set(_headerRequestID, id)
+		r = r.WithContext(core.WithRequestID(r.Context(), id))
+
+		w := &responseWriter{ResponseWriter: rw}
 		status, err := fn(w, r, &data{
 			store: store,
 		})
-
-		if status >= 400 || err != nil {
-			clientIP := realip.FromRequest(r)
-			log.Printf("%s: %v %s %v", r.URL.Path, status, clientIP, err)
+		if status != 0 && errors.Is(err, kv.ErrNotLeader) {
+			// Leadership moved during the request, the client may retry.
+			status = http.StatusServiceUnavailable
 		}
 
 		if status != 0 {
 			txt := http.StatusText(status)
 			http.Error(w, strconv.Itoa(status)+" "+txt, status)
-			return
 		}
+		d := time.Since(start)
+		observeRequest(r, w.code(), d)
+		logRequest(r, w, d, err)
 	})
 }
@@ -0,0 +1,65 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/maolonglong/kvdb/internal/core"
+)
+
+const _contentTypeNDJSON = "application/x-ndjson"
+
+var exportBucket = withSecretKey(
+	func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+		w.Header().Set("Content-Type", _contentTypeNDJSON)
+		enc := json.NewEncoder(w)
+		n := 0
+		err := d.bucket.Export(r.Context(), func(rec *core.Record) error {
+			n++
+			return enc.Encode(rec)
+		})
+		if err != nil {
+			if n == 0 {
+				return http.StatusInternalServerError, err
+			}
+			// The status may have been sent, the client sees a truncated stream.
+			return 0, err
+		}
+		return 0, nil
+	},
+)
+
+var importBucket = withSecretKey(
+	func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+		query := r.URL.Query()
+		opts := &core.ImportOptions{
+			Overwrite:   query.Get("overwrite") == "true",
+			PreserveTTL: query.Get("preserve_ttl") == "true",
+		}
+
+		dec := json.NewDecoder(r.Body)
+		res, err := d.bucket.Import(r.Context(), func() (*core.Record, error) {
+			rec := &core.Record{}
+			if err := dec.Decode(rec); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil, err
+				}
+				return nil, errors.Join(core.ErrInvalidRecord, err)
+			}
+			return rec, nil
+		}, opts)
+		if err != nil {
+			if errors.Is(err, core.ErrInvalidRecord) {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(err.Error()))
+				return 0, nil
+			}
+			return http.StatusInternalServerError, err
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		return 0, json.NewEncoder(w).Encode(res)
+	},
+)
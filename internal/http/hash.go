@@ -0,0 +1,112 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+)
+
+var hashSetField = withBucket(func(_ http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+
+	val, err := io.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	key := bytesconv.StringToBytes(vars["key"])
+	field := bytesconv.StringToBytes(vars["field"])
+	if err := d.bucket.HSet(r.Context(), key, field, val); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+})
+
+var hashGetField = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	key := bytesconv.StringToBytes(vars["key"])
+	field := bytesconv.StringToBytes(vars["field"])
+	val, err := d.bucket.HGet(r.Context(), key, field)
+	if err != nil {
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("field not found"))
+			return 0, nil
+		}
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(val)
+	return 0, nil
+})
+
+var hashDeleteField = withBucket(
+	func(_ http.ResponseWriter, r *http.Request, d *data) (int, error) {
+		vars := mux.Vars(r)
+		key := bytesconv.StringToBytes(vars["key"])
+		field := bytesconv.StringToBytes(vars["field"])
+		if _, err := d.bucket.HDel(r.Context(), key, field); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return 0, nil
+	},
+)
+
+var hashIncrField = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	increment, err := parseIncrement(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return 0, nil
+	}
+
+	key := bytesconv.StringToBytes(vars["key"])
+	field := bytesconv.StringToBytes(vars["field"])
+	val, err := d.bucket.HIncrBy(r.Context(), key, field, increment)
+	if err != nil {
+		if errors.Is(err, kv.ErrInvalidNum) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf("field `%s` is not a number", field)))
+			return 0, nil
+		}
+		if errors.Is(err, kv.ErrOutOfRange) {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte("value out of range"))
+			return 0, nil
+		}
+		return http.StatusInternalServerError, err
+	}
+	_, _ = w.Write(bytesconv.StringToBytes(strconv.FormatInt(val, 10)))
+	return 0, nil
+})
+
+var hashGetAll = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	m, err := d.bucket.HGetAll(r.Context(), bytesconv.StringToBytes(vars["key"]))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	resp := make(map[string]string, len(m))
+	for k, v := range m {
+		resp[k] = bytesconv.BytesToString(v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+	return 0, nil
+})
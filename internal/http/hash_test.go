@@ -0,0 +1,36 @@
+package http_test
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	s := newServer(t)
+	for _, f := range []string{"c", "a", "b"} {
+		s.expect(t, http.MethodPost, "/_hash/h/"+f, f+f, http.StatusOK, "")
+	}
+	s.expect(t, http.MethodGet, "/_hash/h/a", "", http.StatusOK, "aa")
+	s.expect(t, http.MethodGet, "/_hash/h/z", "", http.StatusNotFound, "field not found")
+	// The fields are ordered.
+	s.expect(t, http.MethodGet, "/_hash/h", "", http.StatusOK,
+		`{"a":"aa","b":"bb","c":"cc"}`+"\n")
+
+	s.expect(t, http.MethodPatch, "/_hash/h/n", "+5", http.StatusOK, "5")
+	s.expect(t, http.MethodPatch, "/_hash/h/n", "-7", http.StatusOK, "-2")
+	s.expect(t, http.MethodPatch, "/_hash/h/n", "7", http.StatusBadRequest, "invalid body")
+	s.expect(t, http.MethodPatch, "/_hash/h/a", "+1", http.StatusBadRequest,
+		"field `a` is not a number")
+	s.expect(t, http.MethodPatch, "/_hash/h/n", strconv.FormatInt(math.MinInt64, 10),
+		http.StatusConflict, "value out of range")
+	s.expect(t, http.MethodGet, "/_hash/h/n", "", http.StatusOK, "-2")
+
+	for _, f := range []string{"a", "b", "c", "n", "z"} {
+		s.expect(t, http.MethodDelete, "/_hash/h/"+f, "", http.StatusOK, "")
+	}
+	// Deleting the last field deletes the hash.
+	s.expect(t, http.MethodGet, "/_hash/h", "", http.StatusOK, "{}\n")
+	s.expect(t, http.MethodGet, "/_hash/h/a", "", http.StatusNotFound, "field not found")
+}
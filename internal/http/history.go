@@ -0,0 +1,85 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/maolonglong/kvdb/internal/core"
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+)
+
+type version struct {
+	Version   uint64    `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Value     any       `json:"value,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	ExpiresAt int64     `json:"expires_at,omitempty"`
+}
+
+func getKeyHistory(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	key := bytesconv.StringToBytes(vars["key"])
+
+	code, err := streamJSON(w, func(emit func(v any) error) error {
+		return d.bucket.History(r.Context(), key, func(v *kv.Version) error {
+			ver := &version{
+				Version:   v.Version,
+				Timestamp: time.Unix(0, int64(v.Version)).UTC(),
+				Deleted:   v.Deleted,
+				ExpiresAt: int64(v.ExpiresAt),
+			}
+			if !v.Deleted {
+				ver.Value = documentValue(v.Value)
+			}
+			return emit(ver)
+		})
+	})
+	if errors.Is(err, core.ErrHistoryNotSupported) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("bucket does not keep history"))
+		return 0, nil
+	}
+	return code, err
+}
+
+func getKeyValueAt(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+
+	at, err := parseTime(r.URL.Query().Get("at"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid time"))
+		return 0, nil
+	}
+
+	val, err := d.bucket.GetAt(r.Context(), bytesconv.StringToBytes(vars["key"]), at)
+	if err != nil {
+		switch {
+		case errors.Is(err, kv.ErrKeyNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("key not found"))
+			return 0, nil
+		case errors.Is(err, core.ErrHistoryNotSupported):
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("bucket does not keep history"))
+			return 0, nil
+		}
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(val)
+	return 0, nil
+}
+
+// parseTime accepts Unix nanoseconds, as listed by getKeyHistory, or RFC 3339.
+func parseTime(s string) (time.Time, error) {
+	if ns, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ns), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
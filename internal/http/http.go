@@ -2,31 +2,88 @@ package http
 
 import (
 	"net/http"
+	"regexp"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 
+	"github.com/maolonglong/kvdb/internal/cluster"
+	"github.com/maolonglong/kvdb/internal/core"
 	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/replica"
 )
 
-func NewHandler(store kv.Store) http.Handler {
-	monkey := func(fn handleFunc) http.Handler {
-		return handle(fn, store)
+type Options struct {
+	// URL of the primary when serving a read-only replica, writes are
+	// redirected to it.
+	Primary string
+
+	// Replication of a replica, for the admin endpoints.
+	Replica *replica.Replica
+
+	// Store of a cluster member, requests are redirected to the leader.
+	Cluster *cluster.Store
+}
+
+func NewHandler(store kv.Store, opts *Options) http.Handler {
+	if opts == nil {
+		opts = &Options{}
+	}
+	// Routes are registered as reads or writes, which a replica redirects.
+	read := func(fn handleFunc) http.Handler {
+		return handle(withLeader(opts.Cluster, withReplica(opts.Primary, fn)), store)
+	}
+	write := func(fn handleFunc) http.Handler {
+		if opts.Primary != "" {
+			return handle(toPrimary(opts.Primary), store)
+		}
+		return handle(withLeader(opts.Cluster, fn), store)
 	}
 
 	r := mux.NewRouter()
 
-	r.Handle("/", monkey(createBucket)).Methods(http.MethodPost)
-	r.Handle("/{bucket}", monkey(executeTxn)).Methods(http.MethodPost)
-	r.Handle("/{bucket}/{key}", monkey(getKeyValue)).Methods(http.MethodGet)
-	r.Handle("/{bucket}/{key}", monkey(setKeyValue)).Methods(http.MethodPost)
-	r.Handle("/{bucket}/{key}", monkey(deleteKeyValue)).Methods(http.MethodDelete)
-	r.Handle("/{bucket}/{key}", monkey(incrKeyValue)).Methods(http.MethodPatch)
-	r.Handle("/{bucket}/_scripts/{name}", monkey(createScript)).Methods(http.MethodPost)
-	r.Handle("/{bucket}/scripts/{name}", monkey(doScript)).Methods(http.MethodGet, http.MethodPost)
+	r.Handle("/", write(createBucket)).Methods(http.MethodPost)
+	r.Handle("/{bucket}", write(executeTxn)).Methods(http.MethodPost)
+	r.Handle("/{bucket}/_index", read(listIndexes)).Methods(http.MethodGet)
+	r.Handle("/{bucket}/_query", read(runQuery)).Methods(http.MethodPost)
+	r.Handle("/{bucket}/_export", read(exportBucket)).Methods(http.MethodGet)
+	r.Handle("/{bucket}/_import", write(importBucket)).Methods(http.MethodPost)
+	r.Handle("/{bucket}/_clone", write(cloneBucket)).Methods(http.MethodPost)
+	r.Handle("/{bucket}/{key}", read(getKeyValue)).Methods(http.MethodGet)
+	r.Handle("/{bucket}/{key}", write(setKeyValue)).Methods(http.MethodPost)
+	r.Handle("/{bucket}/{key}", write(deleteKeyValue)).Methods(http.MethodDelete)
+	r.Handle("/{bucket}/{key}", write(patchJSONValue(core.PatchTypeJSONPatch))).
+		Methods(http.MethodPatch).
+		HeadersRegexp("Content-Type", "^"+regexp.QuoteMeta(_contentTypeJSONPatch))
+	r.Handle("/{bucket}/{key}", write(patchJSONValue(core.PatchTypeMergePatch))).
+		Methods(http.MethodPatch).
+		HeadersRegexp("Content-Type", "^"+regexp.QuoteMeta(_contentTypeMergePatch))
+	r.Handle("/{bucket}/{key}", write(incrKeyValue)).Methods(http.MethodPatch)
+	r.Handle("/{bucket}/_hash/{key}", read(hashGetAll)).Methods(http.MethodGet)
+	r.Handle("/{bucket}/_hash/{key}/{field}", read(hashGetField)).Methods(http.MethodGet)
+	r.Handle("/{bucket}/_hash/{key}/{field}", write(hashSetField)).Methods(http.MethodPost)
+	r.Handle("/{bucket}/_hash/{key}/{field}", write(hashDeleteField)).
+		Methods(http.MethodDelete)
+	r.Handle("/{bucket}/_hash/{key}/{field}", write(hashIncrField)).Methods(http.MethodPatch)
+	r.Handle("/{bucket}/_zset/{key}", read(zsetRange)).Methods(http.MethodGet)
+	r.Handle("/{bucket}/_zset/{key}/{member}", read(zsetGetMember)).Methods(http.MethodGet)
+	r.Handle("/{bucket}/_zset/{key}/{member}", write(zsetAdd)).Methods(http.MethodPost)
+	r.Handle("/{bucket}/_zset/{key}/{member}", write(zsetRem)).Methods(http.MethodDelete)
+	r.Handle("/{bucket}/_zset/{key}/{member}", write(zsetIncrBy)).Methods(http.MethodPatch)
+	r.Handle("/{bucket}/_set/{key}", read(setMembers)).Methods(http.MethodGet)
+	r.Handle("/{bucket}/_set/{key}/{member}", read(setIsMember)).Methods(http.MethodGet)
+	r.Handle("/{bucket}/_set/{key}/{member}", write(setAddMember)).Methods(http.MethodPost)
+	r.Handle("/{bucket}/_set/{key}/{member}", write(setRemMember)).Methods(http.MethodDelete)
+	r.Handle("/{bucket}/_sets/{op}", read(setAlgebra)).Methods(http.MethodGet)
+	r.Handle("/{bucket}/_index/{name}", read(queryIndex)).Methods(http.MethodGet)
+	r.Handle("/{bucket}/_index/{name}", write(createIndex)).Methods(http.MethodPost)
+	r.Handle("/{bucket}/_index/{name}", write(dropIndex)).Methods(http.MethodDelete)
+	r.Handle("/{bucket}/_scripts/{name}", write(createScript)).Methods(http.MethodPost)
+	r.Handle("/{bucket}/scripts/{name}", read(doScript)).Methods(http.MethodGet, http.MethodPost)
 
 	h := handlers.CORS(
-		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", _headerRequestID}),
+		handlers.ExposedHeaders([]string{_headerRequestID}),
 		handlers.AllowedMethods([]string{
 			http.MethodGet,
 			http.MethodHead,
@@ -41,3 +98,23 @@ func NewHandler(store kv.Store) http.Handler {
 	h = handlers.RecoveryHandler(handlers.PrintRecoveryStack(true))(h)
 	return h
 }
+
+// withReplica serves reads of a replica from a read-only context, see
+// core.WithReadOnly.
+func withReplica(primary string, next handleFunc) handleFunc {
+	if primary == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+		d.primary = primary
+		return next(w, r.WithContext(core.WithReadOnly(r.Context())), d)
+	}
+}
+
+// toPrimary redirects to the primary, the method and body are preserved.
+func toPrimary(primary string) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, _ *data) (int, error) {
+		http.Redirect(w, r, primary+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return 0, nil
+	}
+}
@@ -0,0 +1,50 @@
+package http_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/core"
+	kvdbhttp "github.com/maolonglong/kvdb/internal/http"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+)
+
+// server serves a bucket of a memory store.
+type server struct {
+	h      http.Handler
+	bucket string
+}
+
+func newServer(t *testing.T) *server {
+	t.Helper()
+	s := memory.New()
+	b, err := core.NewBucket(context.Background(), s, &core.BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &server{h: kvdbhttp.NewHandler(s, nil), bucket: b.Name()}
+}
+
+// do sends a request to path, relative to the bucket.
+func (s *server) do(method, path, body string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	w := httptest.NewRecorder()
+	s.h.ServeHTTP(w, httptest.NewRequest(method, "/"+s.bucket+path, r))
+	return w
+}
+
+// expect sends a request and checks its response.
+func (s *server) expect(t *testing.T, method, path, body string, code int, want string) {
+	t.Helper()
+	w := s.do(method, path, body)
+	if w.Code != code || w.Body.String() != want {
+		t.Errorf("%s %s = %d %q, want %d %q", method, path, w.Code, w.Body, code, want)
+	}
+}
@@ -0,0 +1,150 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/cast"
+
+	"github.com/maolonglong/kvdb/internal/core"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+	"github.com/maolonglong/kvdb/pkg/jsondoc"
+)
+
+var listIndexes = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	idxs := d.bucket.Indexes()
+	if idxs == nil {
+		idxs = []*core.Index{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(idxs)
+	return 0, nil
+})
+
+// createIndex defines the index {name} on the ?path= of the JSON documents
+// whose key starts with ?prefix=. Existing documents are indexed in the
+// background, the index can be queried once it is ready.
+var createIndex = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	if err := r.ParseForm(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	idx, err := d.bucket.CreateIndex(
+		r.Context(),
+		vars["name"],
+		r.Form.Get("prefix"),
+		r.Form.Get("path"),
+	)
+	if err != nil {
+		if errors.Is(err, jsondoc.ErrInvalidPath) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid path"))
+			return 0, nil
+		}
+		if errors.Is(err, core.ErrIndexExists) {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte("index already exists"))
+			return 0, nil
+		}
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(idx)
+	return 0, nil
+})
+
+var dropIndex = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	if err := d.bucket.DropIndex(r.Context(), vars["name"]); err != nil {
+		if errors.Is(err, core.ErrIndexNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("index not found"))
+			return 0, nil
+		}
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+})
+
+// queryIndex returns the documents whose indexed value matches ?eq=, or is
+// in the range given by ?gt=, ?gte=, ?lt= and ?lte=. Values are parsed as
+// JSON, falling back to a string.
+var queryIndex = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+
+	q := &core.IndexQuery{
+		Limit: cast.ToInt(query.Get("limit")),
+	}
+	bound := func(name string, exclusive bool) *core.IndexBound {
+		if !query.Has(name) {
+			return nil
+		}
+		return &core.IndexBound{
+			Value:     parseQueryValue(query.Get(name)),
+			Exclusive: exclusive,
+		}
+	}
+	if query.Has("eq") {
+		q.Lower = bound("eq", false)
+		q.Upper = q.Lower
+	} else {
+		if q.Lower = bound("gte", false); q.Lower == nil {
+			q.Lower = bound("gt", true)
+		}
+		if q.Upper = bound("lte", false); q.Upper == nil {
+			q.Upper = bound("lt", true)
+		}
+	}
+
+	status, err := streamJSON(w, func(emit func(v any) error) error {
+		return d.bucket.QueryIndex(r.Context(), vars["name"], q, func(key, val []byte) error {
+			return emit(&document{
+				Key:   bytesconv.BytesToString(key),
+				Value: documentValue(val),
+			})
+		})
+	})
+	switch {
+	case errors.Is(err, core.ErrIndexNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("index not found"))
+		return 0, nil
+	case errors.Is(err, core.ErrIndexNotReady):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("index is being built"))
+		return 0, nil
+	case errors.Is(err, jsondoc.ErrInvalidDocument):
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid bound"))
+		return 0, nil
+	}
+	return status, err
+})
+
+type document struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+// documentValue returns val as raw JSON if it is a JSON document, or as a
+// string otherwise.
+func documentValue(val []byte) any {
+	if json.Valid(val) {
+		return json.RawMessage(val)
+	}
+	return bytesconv.BytesToString(val)
+}
+
+func parseQueryValue(s string) any {
+	v, err := jsondoc.Decode(bytesconv.StringToBytes(s))
+	if err != nil || s == "" {
+		return s
+	}
+	return v
+}
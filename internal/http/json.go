@@ -0,0 +1,93 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/cast"
+
+	"github.com/maolonglong/kvdb/internal/core"
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+	"github.com/maolonglong/kvdb/pkg/jsondoc"
+)
+
+const (
+	_contentTypeJSONPatch  = "application/json-patch+json"
+	_contentTypeMergePatch = "application/merge-patch+json"
+)
+
+// getJSONPath handles GET /{bucket}/{key}?path=$.a.b.
+func getJSONPath(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+
+	path, err := jsondoc.ParsePath(r.URL.Query().Get("path"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid path"))
+		return 0, nil
+	}
+
+	v, err := d.bucket.GetJSON(r.Context(), bytesconv.StringToBytes(vars["key"]), path)
+	if err != nil {
+		if errors.Is(err, jsondoc.ErrPathNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("path not found"))
+			return 0, nil
+		}
+		return writeJSONError(w, err)
+	}
+	doc, err := jsondoc.Encode(v)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(doc)
+	return 0, nil
+}
+
+func patchJSONValue(typ core.PatchType) handleFunc {
+	return withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+		vars := mux.Vars(r)
+
+		patch, err := io.ReadAll(r.Body)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		key := bytesconv.StringToBytes(vars["key"])
+		ttl := time.Duration(cast.ToInt64(r.URL.Query().Get("ttl"))) * time.Second
+		doc, err := d.bucket.PatchJSON(r.Context(), key, typ, patch, ttl)
+		if err != nil {
+			return writeJSONError(w, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(doc)
+		return 0, nil
+	})
+}
+
+func writeJSONError(w http.ResponseWriter, err error) (int, error) {
+	var (
+		status int
+		msg    string
+	)
+	switch {
+	case errors.Is(err, kv.ErrKeyNotFound):
+		status, msg = http.StatusNotFound, "key not found"
+	case errors.Is(err, jsondoc.ErrInvalidDocument):
+		status, msg = http.StatusBadRequest, "value is not a JSON document"
+	case errors.Is(err, jsondoc.ErrInvalidPatch), errors.Is(err, jsondoc.ErrInvalidPath):
+		status, msg = http.StatusBadRequest, err.Error()
+	case errors.Is(err, jsondoc.ErrPathNotFound), errors.Is(err, jsondoc.ErrTestFailed):
+		status, msg = http.StatusConflict, err.Error()
+	default:
+		return http.StatusInternalServerError, err
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(msg))
+	return 0, nil
+}
@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
@@ -23,14 +25,24 @@ func withBucket(next handleFunc) handleFunc {
 		vars := mux.Vars(r)
 		bucket, err := core.LoadBucket(r.Context(), d.store, vars["bucket"])
 		if err != nil {
-			if errors.Is(err, kv.ErrKeyNotFound) {
+			if errors.Is(err, kv.ErrKeyNotFound) || errors.Is(err, core.ErrBucketExpired) {
 				w.WriteHeader(http.StatusNotFound)
 				_, _ = w.Write([]byte("bucket not found"))
 				return 0, nil
 			}
 			return http.StatusInternalServerError, err
 		}
+		if err := bucket.Touch(r.Context()); err != nil {
+			slog.WarnContext(r.Context(), "http: Failed to record bucket access",
+				"bucket", bucket.Name(),
+				"request_id", core.RequestID(r.Context()),
+				"err", err,
+			)
+		}
 		d.bucket = bucket
+		if sync := r.URL.Query().Get("sync"); sync != "" {
+			r = r.WithContext(core.WithSync(r.Context(), cast.ToBool(sync)))
+		}
 		return next(w, r, d)
 	}
 }
@@ -44,8 +56,11 @@ var setKeyValue = withBucket(func(_ http.ResponseWriter, r *http.Request, d *dat
 	}
 
 	ttl := time.Duration(cast.ToInt64(r.URL.Query().Get("ttl"))) * time.Second
-	// FIXME: handle error
-	_ = d.bucket.Set(r.Context(), bytesconv.StringToBytes(vars["key"]), val, ttl)
+	// The write must not be acknowledged if it could not be synced.
+	key := bytesconv.StringToBytes(vars["key"])
+	if err := d.bucket.Set(r.Context(), key, val, ttl); err != nil {
+		return http.StatusInternalServerError, err
+	}
 	return 0, nil
 })
 
@@ -60,6 +75,15 @@ var deleteKeyValue = withBucket(
 )
 
 var getKeyValue = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	switch query := r.URL.Query(); {
+	case query.Has("path"):
+		return getJSONPath(w, r, d)
+	case query.Get("history") == "true":
+		return getKeyHistory(w, r, d)
+	case query.Has("at"):
+		return getKeyValueAt(w, r, d)
+	}
+
 	vars := mux.Vars(r)
 	val, err := d.bucket.Get(r.Context(), bytesconv.StringToBytes(vars["key"]))
 	if err != nil {
@@ -86,29 +110,15 @@ var executeTxn = withBucket(func(w http.ResponseWriter, r *http.Request, d *data
 		return http.StatusBadRequest, err
 	}
 
-	var ops []*core.Operation
+	ops := make([]*core.Operation, 0, len(req.Txn))
 	for _, item := range req.Txn {
-		if item.Set != nil && item.Value != nil && item.TTL != nil && item.Delete == nil {
-			ops = append(ops, &core.Operation{
-				Data: &core.OpSet{
-					Key:   bytesconv.StringToBytes(*item.Set),
-					Value: bytesconv.StringToBytes(*item.Value),
-					TTL:   time.Duration(*item.TTL) * time.Second,
-				},
-				Type: core.OpTypeSet,
-			})
-		} else if item.Set == nil && item.Value == nil && item.TTL == nil && item.Delete != nil {
-			ops = append(ops, &core.Operation{
-				Data: &core.OpDelete{
-					Key: bytesconv.StringToBytes(*item.Delete),
-				},
-				Type: core.OpTypeDelete,
-			})
-		} else {
+		op := txnOperation(item)
+		if op == nil {
 			w.WriteHeader(http.StatusBadRequest)
 			_, _ = w.Write([]byte("invalid operation"))
 			return 0, nil
 		}
+		ops = append(ops, op)
 	}
 
 	if err := d.bucket.ApplyTxn(r.Context(), ops); err != nil {
@@ -117,43 +127,293 @@ var executeTxn = withBucket(func(w http.ResponseWriter, r *http.Request, d *data
 			_, _ = w.Write([]byte("txn too big"))
 			return 0, nil
 		}
+		if errors.Is(err, kv.ErrInvalidNum) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("value is not a number"))
+			return 0, nil
+		}
+		if errors.Is(err, kv.ErrOutOfRange) {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte("value out of range"))
+			return 0, nil
+		}
 		return http.StatusInternalServerError, err
 	}
 	return 0, nil
 })
 
-var incrKeyValue = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
-	vars := mux.Vars(r)
+var (
+	errInvalidBody = errors.New("invalid body")
+	errInvalidNum  = errors.New("invalid num")
+)
 
-	body, err := io.ReadAll(r.Body)
+func txnOperation(item *request.Txn) *core.Operation {
+	// An item is a single operation.
+	n := 0
+	for _, key := range []*string{
+		item.Set, item.Delete, item.Incr,
+		item.HSet, item.HDelete, item.HIncrBy,
+		item.SAdd, item.SRem,
+	} {
+		if key != nil {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil
+	}
+
+	switch {
+	case item.Set != nil && item.Value != nil && item.TTL != nil && item.Delete == nil:
+		return &core.Operation{
+			Data: &core.OpSet{
+				Key:   bytesconv.StringToBytes(*item.Set),
+				Value: bytesconv.StringToBytes(*item.Value),
+				TTL:   time.Duration(*item.TTL) * time.Second,
+			},
+			Type: core.OpTypeSet,
+		}
+	case item.Set == nil && item.Value == nil && item.TTL == nil && item.Delete != nil:
+		return &core.Operation{
+			Data: &core.OpDelete{
+				Key: bytesconv.StringToBytes(*item.Delete),
+			},
+			Type: core.OpTypeDelete,
+		}
+	case item.Incr != nil && item.Increment != nil:
+		return incrOperation(item)
+	case item.HSet != nil && item.Field != nil && item.Value != nil:
+		return &core.Operation{
+			Data: &core.OpHSet{
+				Key:   bytesconv.StringToBytes(*item.HSet),
+				Field: bytesconv.StringToBytes(*item.Field),
+				Value: bytesconv.StringToBytes(*item.Value),
+			},
+			Type: core.OpTypeHSet,
+		}
+	case item.HDelete != nil && item.Field != nil:
+		return &core.Operation{
+			Data: &core.OpHDelete{
+				Key:   bytesconv.StringToBytes(*item.HDelete),
+				Field: bytesconv.StringToBytes(*item.Field),
+			},
+			Type: core.OpTypeHDelete,
+		}
+	case item.HIncrBy != nil && item.Field != nil && item.Increment != nil:
+		increment, err := item.Increment.Int64()
+		if err != nil {
+			return nil
+		}
+		return &core.Operation{
+			Data: &core.OpHIncrBy{
+				Key:       bytesconv.StringToBytes(*item.HIncrBy),
+				Field:     bytesconv.StringToBytes(*item.Field),
+				Increment: increment,
+			},
+			Type: core.OpTypeHIncrBy,
+		}
+	case item.SAdd != nil && item.Member != nil:
+		return &core.Operation{
+			Data: &core.OpSAdd{
+				Key:    bytesconv.StringToBytes(*item.SAdd),
+				Member: bytesconv.StringToBytes(*item.Member),
+			},
+			Type: core.OpTypeSAdd,
+		}
+	case item.SRem != nil && item.Member != nil:
+		return &core.Operation{
+			Data: &core.OpSRem{
+				Key:    bytesconv.StringToBytes(*item.SRem),
+				Member: bytesconv.StringToBytes(*item.Member),
+			},
+			Type: core.OpTypeSRem,
+		}
+	default:
+		return nil
+	}
+}
+
+func incrOperation(item *request.Txn) *core.Operation {
+	var ttl time.Duration
+	if item.TTL != nil {
+		ttl = time.Duration(*item.TTL) * time.Second
+	}
+	query := make(url.Values)
+	for name, n := range map[string]*json.Number{
+		"default": item.Default,
+		"min":     item.Min,
+		"max":     item.Max,
+	} {
+		if n != nil {
+			query.Set(name, n.String())
+		}
+	}
+	if item.Clamp {
+		query.Set("clamp", "true")
+	}
+
+	increment, err := item.Increment.Int64()
+	if err == nil && !item.Float {
+		opts, err := incrOptions(query, ttl, func(s string) (int64, error) {
+			return strconv.ParseInt(s, 10, 64)
+		})
+		if err != nil {
+			return nil
+		}
+		return &core.Operation{
+			Data: &core.OpIncr{
+				Key:       bytesconv.StringToBytes(*item.Incr),
+				Increment: increment,
+				Options:   opts,
+			},
+			Type: core.OpTypeIncr,
+		}
+	}
+
+	fincrement, err := kv.ParseFloat(bytesconv.StringToBytes(item.Increment.String()))
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return nil
+	}
+	opts, err := incrOptions(query, ttl, func(s string) (float64, error) {
+		return kv.ParseFloat(bytesconv.StringToBytes(s))
+	})
+	if err != nil {
+		return nil
+	}
+	return &core.Operation{
+		Data: &core.OpIncrFloat{
+			Key:       bytesconv.StringToBytes(*item.Incr),
+			Increment: fincrement,
+			Options:   opts,
+		},
+		Type: core.OpTypeIncrFloat,
 	}
+}
 
+// parseIncrement parses a "+N" or "-N" request body.
+func parseIncrement(body []byte) (int64, error) {
 	if len(body) < 2 || (body[0] != '-' && body[0] != '+') {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte("invalid body"))
-		return 0, nil
+		return 0, errInvalidBody
+	}
+	increment, err := strconv.ParseInt(bytesconv.BytesToString(body), 10, 64)
+	if err != nil {
+		return 0, errInvalidNum
 	}
+	return increment, nil
+}
 
-	increment, err := strconv.ParseInt(bytesconv.BytesToString(body[1:]), 10, 64)
+// parseFloatIncrement is like parseIncrement for floating-point numbers.
+func parseFloatIncrement(body []byte) (float64, error) {
+	if len(body) < 2 || (body[0] != '-' && body[0] != '+') {
+		return 0, errInvalidBody
+	}
+	increment, err := kv.ParseFloat(body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte("invalid num"))
-		return 0, nil
+		return 0, errInvalidNum
+	}
+	return increment, nil
+}
+
+// incrKeyValue adds the "+N" or "-N" body to the value of a key. Non-integer
+// increments, or ?float=true, use floating-point arithmetic. The optional
+// ?default=, ?min=, ?max= and ?clamp= parameters bound the result.
+var incrKeyValue = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusInternalServerError, err
 	}
 
 	key := bytesconv.StringToBytes(vars["key"])
-	ttl := time.Duration(cast.ToInt64(r.URL.Query().Get("ttl"))) * time.Second
-	val, err := d.bucket.Incr(r.Context(), key, increment, ttl)
+	ttl := time.Duration(cast.ToInt64(query.Get("ttl"))) * time.Second
+
+	var val string
+	increment, err := parseIncrement(body)
+	if err == nil && !cast.ToBool(query.Get("float")) {
+		var opts *kv.IncrOptions[int64]
+		opts, err = incrOptions(query, ttl, func(s string) (int64, error) {
+			return strconv.ParseInt(s, 10, 64)
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return 0, nil
+		}
+		var num int64
+		num, err = d.bucket.Incr(r.Context(), key, increment, opts)
+		val = strconv.FormatInt(num, 10)
+	} else {
+		var fincrement float64
+		fincrement, err = parseFloatIncrement(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return 0, nil
+		}
+		var opts *kv.IncrOptions[float64]
+		opts, err = incrOptions(query, ttl, func(s string) (float64, error) {
+			return kv.ParseFloat(bytesconv.StringToBytes(s))
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return 0, nil
+		}
+		var num float64
+		num, err = d.bucket.IncrFloat(r.Context(), key, fincrement, opts)
+		val = kv.FormatFloat(num)
+	}
 	if err != nil {
 		if errors.Is(err, kv.ErrInvalidNum) {
 			w.WriteHeader(http.StatusBadRequest)
 			_, _ = w.Write([]byte(fmt.Sprintf("key `%s` is not a number", key)))
 			return 0, nil
 		}
+		if errors.Is(err, kv.ErrOutOfRange) {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte("value out of range"))
+			return 0, nil
+		}
 		return http.StatusInternalServerError, err
 	}
-	_, _ = w.Write(bytesconv.StringToBytes(strconv.FormatInt(val, 10)))
+	_, _ = w.Write(bytesconv.StringToBytes(val))
 	return 0, nil
 })
+
+func incrOptions[T int64 | float64](
+	query url.Values,
+	ttl time.Duration,
+	parse func(string) (T, error),
+) (*kv.IncrOptions[T], error) {
+	opts := &kv.IncrOptions[T]{
+		TTL:   ttl,
+		Clamp: cast.ToBool(query.Get("clamp")),
+	}
+	number := func(name string) (*T, error) {
+		if !query.Has(name) {
+			return nil, nil
+		}
+		n, err := parse(query.Get(name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s", name)
+		}
+		return &n, nil
+	}
+
+	def, err := number("default")
+	if err != nil {
+		return nil, err
+	}
+	if def != nil {
+		opts.Default = *def
+	}
+	if opts.Min, err = number("min"); err != nil {
+		return nil, err
+	}
+	if opts.Max, err = number("max"); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
@@ -0,0 +1,46 @@
+package http_test
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestExecuteTxn(t *testing.T) {
+	s := newServer(t)
+	for _, tt := range []struct {
+		name string
+		txn  string
+		code int
+		want string
+	}{
+		{"empty item", `[{}]`, http.StatusBadRequest, "invalid operation"},
+		{
+			"set and hset",
+			`[{"set": "k", "value": "v", "ttl": 0, "hset": "h", "field": "f"}]`,
+			http.StatusBadRequest, "invalid operation",
+		},
+		{
+			"sadd and srem",
+			`[{"sadd": "s", "srem": "s", "member": "m"}]`,
+			http.StatusBadRequest, "invalid operation",
+		},
+		{
+			"incr and hincrby",
+			`[{"incr": "n", "hincrby": "h", "field": "f", "increment": 1}]`,
+			http.StatusBadRequest, "invalid operation",
+		},
+		{
+			"operations",
+			`[{"set": "k", "value": "v", "ttl": 0}, {"hset": "h", "field": "f", "value": "v"}]`,
+			http.StatusOK, "",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s.expect(t, http.MethodPost, "", `{"txn": `+tt.txn+`}`, tt.code, tt.want)
+		})
+	}
+	// Only the valid transaction was applied.
+	s.expect(t, http.MethodGet, "/k", "", http.StatusOK, "v")
+	s.expect(t, http.MethodGet, "/_hash/h", "", http.StatusOK, `{"f":"v"}`+"\n")
+	s.expect(t, http.MethodGet, "/_set/s", "", http.StatusOK, "[]\n")
+}
@@ -0,0 +1,94 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/internal/metrics"
+)
+
+var (
+	_requests = metrics.NewCounterVec(
+		"kvdb_http_requests_total",
+		"HTTP requests by route and status.",
+		"method", "route", "status",
+	)
+	_requestDuration = metrics.NewHistogramVec(
+		"kvdb_http_request_duration_seconds",
+		"Latency of HTTP requests by route and status.",
+		metrics.DefBuckets,
+		"method", "route", "status",
+	)
+)
+
+// NewMetricsHandler serves the metrics of the process and of store in the
+// Prometheus text format. Like pprof, it relies on the listener being
+// private.
+func NewMetricsHandler(store kv.Store) http.Handler {
+	var cs []metrics.Collector
+	if c, ok := store.(metrics.Collector); ok {
+		cs = append(cs, c)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = metrics.Write(w, cs...)
+	})
+}
+
+// routeTemplate returns the path template of the route matching r.
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "unknown"
+}
+
+func observeRequest(r *http.Request, status int, d time.Duration) {
+	code := strconv.Itoa(status)
+	route := routeTemplate(r)
+	_requests.Inc(r.Method, route, code)
+	_requestDuration.Observe(d.Seconds(), r.Method, route, code)
+}
+
+// responseWriter records the status and the size of a response.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// code returns the status of the response, which is 200 if none was
+// written.
+func (w *responseWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Unwrap lets http.ResponseController reach the writer of the server.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,75 @@
+package http_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/core"
+	kvdbhttp "github.com/maolonglong/kvdb/internal/http"
+	"github.com/maolonglong/kvdb/internal/kv"
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+	"github.com/maolonglong/kvdb/internal/kv/shard"
+)
+
+func TestMetrics(t *testing.T) {
+	var shards []kv.Store
+	for range 2 {
+		s, err := badgerstore.New(badgerstore.DefaultOptions(t.TempDir()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = s.Close() })
+		shards = append(shards, s)
+	}
+	store, err := shard.New(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := core.NewBucket(context.Background(), store, &core.BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	kvdbhttp.NewHandler(store, nil).
+		ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+b.Name()+"/k", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("GET = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	srv := httptest.NewServer(kvdbhttp.NewMetricsHandler(store))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics = %s", resp.Status)
+	}
+
+	labels := `method="GET",route="/{bucket}/{key}",status="404"`
+	for _, want := range []string{
+		`kvdb_http_requests_total{` + labels + `} `,
+		`kvdb_http_request_duration_seconds_bucket{` + labels + `,le="+Inf"} `,
+		`kvdb_http_request_duration_seconds_count{` + labels + `} `,
+		"kvdb_lstate_pool_in_use ",
+		"kvdb_lstate_pool_idle ",
+		"kvdb_lstate_pool_size 50\n",
+		`kvdb_badger_lsm_size_bytes{shard="0"} `,
+		`kvdb_badger_vlog_size_bytes{shard="1"} `,
+		`kvdb_badger_gc_runs_total{shard="1"} `,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("no %q in the metrics", want)
+		}
+	}
+}
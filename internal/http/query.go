@@ -0,0 +1,37 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/maolonglong/kvdb/internal/core"
+)
+
+// runQuery runs a core.Query given as the JSON request body and returns
+// the matching documents as a JSON array.
+var runQuery = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	q, err := core.ParseQuery(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return 0, nil
+	}
+
+	status, err := streamJSON(w, func(emit func(v any) error) error {
+		return d.bucket.Query(r.Context(), q, func(res *core.QueryResult) error {
+			return emit(res)
+		})
+	})
+	if errors.Is(err, core.ErrQueryTooLarge) && status != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("too many matches to sort, set a smaller offset and limit"))
+		return 0, nil
+	}
+	return status, err
+})
@@ -37,6 +37,10 @@ var doScript = withBucket(func(w http.ResponseWriter, r *http.Request, d *data)
 			_, _ = w.Write([]byte("script not found"))
 			return 0, nil
 		}
+		if errors.Is(err, kv.ErrReadOnlyTxn) && d.primary != "" {
+			// The script writes, run it on the primary.
+			return toPrimary(d.primary)(w, r, d)
+		}
 		var luaErr *lua.ApiError
 		if errors.As(err, &luaErr) {
 			w.WriteHeader(http.StatusInternalServerError)
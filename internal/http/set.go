@@ -0,0 +1,104 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/cast"
+
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+)
+
+var setAddMember = withBucket(func(_ http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	key := bytesconv.StringToBytes(vars["key"])
+	member := bytesconv.StringToBytes(vars["member"])
+	if _, err := d.bucket.SAdd(r.Context(), key, member); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+})
+
+var setRemMember = withBucket(func(_ http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	key := bytesconv.StringToBytes(vars["key"])
+	member := bytesconv.StringToBytes(vars["member"])
+	if _, err := d.bucket.SRem(r.Context(), key, member); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+})
+
+var setIsMember = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	key := bytesconv.StringToBytes(vars["key"])
+	member := bytesconv.StringToBytes(vars["member"])
+	ok, err := d.bucket.SIsMember(r.Context(), key, member)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("member not found"))
+	}
+	return 0, nil
+})
+
+// setMembers streams the members of a set as a JSON array, or returns the
+// number of members with ?card=true.
+var setMembers = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	key := bytesconv.StringToBytes(vars["key"])
+
+	if cast.ToBool(r.URL.Query().Get("card")) {
+		n, err := d.bucket.SCard(r.Context(), key)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		_, _ = w.Write(bytesconv.StringToBytes(strconv.FormatInt(n, 10)))
+		return 0, nil
+	}
+
+	return streamMembers(w, func(fn func(member []byte) error) error {
+		return d.bucket.SMembers(r.Context(), key, fn)
+	})
+})
+
+// setAlgebra streams the union, intersection or difference of the sets given
+// with ?key=a&key=b.
+var setAlgebra = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+
+	var algebra func(context.Context, [][]byte, func([]byte) error) error
+	switch vars["op"] {
+	case "union":
+		algebra = d.bucket.SUnion
+	case "inter":
+		algebra = d.bucket.SInter
+	case "diff":
+		algebra = d.bucket.SDiff
+	default:
+		return http.StatusNotFound, nil
+	}
+
+	var keys [][]byte
+	for _, key := range r.URL.Query()["key"] {
+		keys = append(keys, bytesconv.StringToBytes(key))
+	}
+	return streamMembers(w, func(fn func(member []byte) error) error {
+		return algebra(r.Context(), keys, fn)
+	})
+})
+
+func streamMembers(
+	w http.ResponseWriter,
+	scan func(fn func(member []byte) error) error,
+) (int, error) {
+	return streamJSON(w, func(emit func(v any) error) error {
+		return scan(func(member []byte) error {
+			return emit(bytesconv.BytesToString(member))
+		})
+	})
+}
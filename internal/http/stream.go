@@ -0,0 +1,39 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// streamJSON writes the values emitted by scan as a JSON array, without
+// buffering the whole array.
+func streamJSON(w http.ResponseWriter, scan func(emit func(v any) error) error) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	n := 0
+	err := scan(func(v any) error {
+		sep := byte(',')
+		if n == 0 {
+			sep = '['
+		}
+		n++
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append([]byte{sep}, b...))
+		return err
+	})
+	if err != nil {
+		if n == 0 {
+			return http.StatusInternalServerError, err
+		}
+		// The status has already been sent, the client sees a truncated array.
+		return 0, err
+	}
+	if n == 0 {
+		_, _ = w.Write([]byte("[]\n"))
+	} else {
+		_, _ = w.Write([]byte("]\n"))
+	}
+	return 0, nil
+}
@@ -0,0 +1,165 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/cast"
+
+	"github.com/maolonglong/kvdb/internal/core"
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+)
+
+var zsetAdd = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	score, err := strconv.ParseFloat(bytesconv.BytesToString(body), 64)
+	if err != nil || math.IsNaN(score) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("invalid score"))
+		return 0, nil
+	}
+
+	key := bytesconv.StringToBytes(vars["key"])
+	member := bytesconv.StringToBytes(vars["member"])
+	if _, err := d.bucket.ZAdd(r.Context(), key, member, score); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+})
+
+var zsetIncrBy = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	increment, err := parseFloatIncrement(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return 0, nil
+	}
+
+	key := bytesconv.StringToBytes(vars["key"])
+	member := bytesconv.StringToBytes(vars["member"])
+	score, err := d.bucket.ZIncrBy(r.Context(), key, member, increment)
+	if err != nil {
+		if errors.Is(err, kv.ErrInvalidNum) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("score is not a number"))
+			return 0, nil
+		}
+		return http.StatusInternalServerError, err
+	}
+	_, _ = w.Write(bytesconv.StringToBytes(strconv.FormatFloat(score, 'g', -1, 64)))
+	return 0, nil
+})
+
+var zsetRem = withBucket(func(_ http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	key := bytesconv.StringToBytes(vars["key"])
+	member := bytesconv.StringToBytes(vars["member"])
+	if _, err := d.bucket.ZRem(r.Context(), key, member); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+})
+
+var zsetGetMember = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	key := bytesconv.StringToBytes(vars["key"])
+	member := bytesconv.StringToBytes(vars["member"])
+
+	score, err := d.bucket.ZScore(r.Context(), key, member)
+	if err == nil {
+		var rank int64
+		rank, err = d.bucket.ZRank(r.Context(), key, member)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"member": vars["member"],
+				"score":  score,
+				"rank":   rank,
+			})
+			return 0, nil
+		}
+	}
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("member not found"))
+		return 0, nil
+	}
+	return http.StatusInternalServerError, err
+})
+
+// zsetRange lists members by rank (?start=&stop=) or, when min or max is
+// given, by score (?min=&max=&offset=&limit=). ?rev=true orders the result
+// from the highest score.
+var zsetRange = withBucket(func(w http.ResponseWriter, r *http.Request, d *data) (int, error) {
+	vars := mux.Vars(r)
+	key := bytesconv.StringToBytes(vars["key"])
+	query := r.URL.Query()
+	reverse := cast.ToBool(query.Get("rev"))
+
+	var (
+		ms  []*core.ZMember
+		err error
+	)
+	if query.Has("min") || query.Has("max") {
+		opts := &core.ZRangeByScoreOptions{
+			Min:    math.Inf(-1),
+			Max:    math.Inf(1),
+			Offset: cast.ToInt(query.Get("offset")),
+			Limit:  cast.ToInt(query.Get("limit")),
+		}
+		var perr error
+		if query.Has("min") {
+			opts.Min, perr = strconv.ParseFloat(query.Get("min"), 64)
+		}
+		if perr == nil && query.Has("max") {
+			opts.Max, perr = strconv.ParseFloat(query.Get("max"), 64)
+		}
+		if perr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid score range"))
+			return 0, nil
+		}
+		if reverse {
+			ms, err = d.bucket.ZRevRangeByScore(r.Context(), key, opts)
+		} else {
+			ms, err = d.bucket.ZRangeByScore(r.Context(), key, opts)
+		}
+	} else {
+		start := cast.ToInt64(query.Get("start"))
+		stop := int64(-1)
+		if query.Has("stop") {
+			stop = cast.ToInt64(query.Get("stop"))
+		}
+		if reverse {
+			ms, err = d.bucket.ZRevRange(r.Context(), key, start, stop)
+		} else {
+			ms, err = d.bucket.ZRange(r.Context(), key, start, stop)
+		}
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ms)
+	return 0, nil
+})
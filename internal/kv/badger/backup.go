@@ -0,0 +1,100 @@
+package badger
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/dgraph-io/badger/v4/pb"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+var _ kv.BackupStore = (*Store)(nil)
+
+// Backup works like badger.DB.Backup, which cannot be used in managed mode.
+func (s *Store) Backup(w io.Writer, since uint64) (uint64, error) {
+	readTs := s.oracle.readTs()
+	if readTs == 0 {
+		// Nothing has been written, and streams need a read timestamp.
+		return 0, nil
+	}
+	stream := s.inner.NewStreamAt(readTs)
+	stream.LogPrefix = "Store.Backup"
+	stream.SinceTs = since
+	if _, err := stream.Backup(w, since); err != nil {
+		return 0, err
+	}
+	return readTs, nil
+}
+
+// Load works like badger.DB.Load, which requires that no transaction runs
+// concurrently. That protects the timestamps of badger's own oracle, unused
+// in managed mode. Reads may run concurrently: their timestamp comes from
+// s.oracle, which only moves past the loaded versions once Load returns, so
+// that a partial load is not visible. Only a load interrupted by a crash is,
+// until the next one completes it. Commits must not run concurrently, they
+// would move the read timestamp past versions still being loaded. Replicas
+// reject writes.
+func (s *Store) Load(r io.Reader) error {
+	if err := s.inner.Load(r, 256); err != nil {
+		return err
+	}
+	s.oracle.advance(s.inner.MaxVersion())
+	return nil
+}
+
+// Split writes a full backup of the store to ws, each key going to
+// ws[route(key)]. Every part can be loaded by Load.
+func (s *Store) Split(ws []io.Writer, route func(key []byte) int) error {
+	_, err := s.Backup(&splitter{ws: ws, route: route}, 0)
+	return err
+}
+
+// splitter parses a backup, KV lists prefixed by their little endian length,
+// and writes the KVs of each list to the writer of their key.
+type splitter struct {
+	ws    []io.Writer
+	route func(key []byte) int
+	buf   []byte
+}
+
+func (sp *splitter) Write(p []byte) (int, error) {
+	sp.buf = append(sp.buf, p...)
+	for len(sp.buf) >= 8 {
+		n := binary.LittleEndian.Uint64(sp.buf)
+		if uint64(len(sp.buf)-8) < n {
+			break
+		}
+		var list pb.KVList
+		if err := list.Unmarshal(sp.buf[8 : 8+n]); err != nil {
+			return 0, err
+		}
+		sp.buf = sp.buf[8+n:]
+		if err := sp.split(&list); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (sp *splitter) split(list *pb.KVList) error {
+	lists := make([]pb.KVList, len(sp.ws))
+	for _, kv := range list.Kv {
+		i := sp.route(kv.Key)
+		lists[i].Kv = append(lists[i].Kv, kv)
+	}
+	for i := range lists {
+		if len(lists[i].Kv) == 0 {
+			continue
+		}
+		b, err := lists[i].Marshal()
+		if err != nil {
+			return err
+		}
+		b = append(binary.LittleEndian.AppendUint64(nil, uint64(len(b))), b...)
+		if _, err := sp.ws[i].Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
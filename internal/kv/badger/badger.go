@@ -1,14 +1,16 @@
 package badger
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"log/slog"
+	"math"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	badger "github.com/dgraph-io/badger/v4"
-	bopt "github.com/dgraph-io/badger/v4/options"
 	"github.com/dgraph-io/ristretto/z"
 
 	"github.com/maolonglong/kvdb/internal/kv"
@@ -17,29 +19,46 @@ import (
 
 type Store struct {
 	inner  *badger.DB
+	oracle *oracle
+	opts   *Options
+	syncer *syncer
 	closer *z.Closer
+
+	// Value log GCs run, and those that rewrote a file.
+	gcRuns, gcRewrites atomic.Uint64
 }
 
-func New(path string) (kv.Store, error) {
-	db, err := badger.Open(
-		badger.DefaultOptions(path).
-			// FIXME: If multiple connections are written at the same time,
-			// it seems that there will always be conflicts.
-			WithDetectConflicts(false).
-			WithCompression(bopt.ZSTD).
-			WithSyncWrites(false).
-			WithBlockCacheSize(100 * (1 << 20)).
-			WithIndexCacheSize(100 * (1 << 20)).
-			WithZSTDCompressionLevel(3),
-	)
+// New opens the badger DB of opts in managed mode, timestamps are assigned by
+// the store so that versions can be read back, see kv.VersionedStore.
+func New(opts *Options) (kv.Store, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	bopts, err := opts.badgerOptions()
+	if err != nil {
+		return nil, err
+	}
+	db, err := badger.OpenManaged(bopts)
 	if err != nil {
+		if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+			return nil, ErrEncryptionKeyMismatch
+		}
 		return nil, err
 	}
 	store := &Store{
 		inner:  db,
+		oracle: newOracle(db.MaxVersion()),
+		opts:   opts,
+		syncer: newSyncer(),
 		closer: z.NewCloser(1),
 	}
+	db.SetDiscardTs(store.oracle.readTs())
 	go store.gc()
+	if opts.NumVersionsToKeep > 0 {
+		slog.Warn("badger: Bucket histories are truncated",
+			"num_versions_to_keep", opts.NumVersionsToKeep,
+		)
+	}
 	return store, nil
 }
 
@@ -48,23 +67,35 @@ func (s *Store) Close() error {
 	return s.inner.Close()
 }
 
-func (s *Store) NewTransaction(update bool) any {
-	return s.inner.NewTransaction(update)
+func (s *Store) NewTransaction(update bool) kv.Txn {
+	return &txn{
+		s:     s,
+		inner: s.inner.NewTransactionAt(s.oracle.readTs(), update),
+	}
+}
+
+// commit commits txn at a timestamp of the oracle.
+func (s *Store) commit(txn *badger.Txn) error {
+	ts := s.oracle.newCommitTs()
+	defer s.oracle.doneCommit(ts)
+	return convertErr(txn.CommitAt(ts, nil))
 }
 
-func (s *Store) Discard(_txn any) {
-	txn := _txn.(*badger.Txn)
-	txn.Discard()
+type txn struct {
+	s     *Store
+	inner *badger.Txn
 }
 
-func (s *Store) Commit(_txn any) error {
-	txn := _txn.(*badger.Txn)
-	return txn.Commit()
+func (txn *txn) Discard() {
+	txn.inner.Discard()
 }
 
-func (s *Store) Get(ctx context.Context, _txn any, key []byte) ([]byte, error) {
-	txn := _txn.(*badger.Txn)
-	item, err := txn.Get(key)
+func (txn *txn) Commit() error {
+	return txn.s.commit(txn.inner)
+}
+
+func (txn *txn) Get(ctx context.Context, key []byte) ([]byte, error) {
+	item, err := txn.inner.Get(key)
 	if err != nil {
 		if errors.Is(err, badger.ErrKeyNotFound) {
 			return nil, kv.ErrKeyNotFound
@@ -74,25 +105,40 @@ func (s *Store) Get(ctx context.Context, _txn any, key []byte) ([]byte, error) {
 	return item.ValueCopy(nil)
 }
 
-func (s *Store) Set(ctx context.Context, _txn any, key, val []byte, opts *kv.SetOptions) error {
-	txn := _txn.(*badger.Txn)
-
-	var ttl time.Duration
+func (txn *txn) Set(ctx context.Context, key, val []byte, opts *kv.SetOptions) error {
+	var (
+		expiresAt uint64
+		keep      bool
+	)
 	if opts != nil {
-		ttl = opts.TTL
+		expiresAt = kv.Expiry(opts.TTL, opts.ExpiresAt)
+		keep = opts.KeepVersions
 	}
 
-	return s.setEntry(txn, key, val, ttl)
+	return txn.setEntry(key, val, expiresAt, keep)
 }
 
-func (s *Store) Delete(ctx context.Context, _txn any, key []byte) error {
-	txn := _txn.(*badger.Txn)
-	return txn.Delete(key)
+func (txn *txn) Delete(ctx context.Context, key []byte) error {
+	return convertErr(txn.inner.Delete(key))
+}
+
+// TTL returns the remaining time to live of key, 0 if it does not expire.
+func (txn *txn) TTL(ctx context.Context, key []byte) (time.Duration, error) {
+	item, err := txn.inner.Get(key)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return 0, kv.ErrKeyNotFound
+		}
+		return 0, err
+	}
+	if item.ExpiresAt() == 0 {
+		return 0, nil
+	}
+	return max(time.Until(time.Unix(int64(item.ExpiresAt()), 0)), time.Nanosecond), nil
 }
 
-func (s *Store) Has(ctx context.Context, _txn any, key []byte) (bool, error) {
-	txn := _txn.(*badger.Txn)
-	item, err := txn.Get(key)
+func (txn *txn) Has(ctx context.Context, key []byte) (bool, error) {
+	item, err := txn.inner.Get(key)
 	if err != nil {
 		if errors.Is(err, badger.ErrKeyNotFound) {
 			return false, nil
@@ -102,25 +148,25 @@ func (s *Store) Has(ctx context.Context, _txn any, key []byte) (bool, error) {
 	return item != nil, nil
 }
 
-func (s *Store) Incr(
+func (txn *txn) Incr(
 	ctx context.Context,
-	_txn any,
 	key []byte,
 	increment int64,
-	opts *kv.SetOptions,
+	opts *kv.IncrOptions[int64],
 ) (int64, error) {
-	txn := _txn.(*badger.Txn)
-
 	var (
 		invalid bool
 		ttl     time.Duration
+		keep    bool
 		num     int64
 	)
 	if opts != nil {
 		ttl = opts.TTL
+		keep = opts.KeepVersions
+		num = opts.Default
 	}
 
-	prev, err := txn.Get(key)
+	prev, err := txn.inner.Get(key)
 	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
 		return 0, err
 	}
@@ -138,21 +184,164 @@ func (s *Store) Incr(
 		return 0, kv.ErrInvalidNum
 	}
 
-	num += increment
+	if num, err = kv.AddInt(num, increment); err != nil {
+		return 0, err
+	}
+	num, err = opts.Bound(num)
+	if err != nil {
+		return 0, err
+	}
 	val := strconv.FormatInt(num, 10)
-	if err := s.setEntry(txn, key, bytesconv.StringToBytes(val), ttl); err != nil {
+	if err := txn.setEntry(
+		key,
+		bytesconv.StringToBytes(val),
+		kv.Expiry(ttl, time.Time{}),
+		keep,
+	); err != nil {
 		return 0, err
 	}
 
 	return num, nil
 }
 
-func (s *Store) setEntry(txn *badger.Txn, key, val []byte, ttl time.Duration) error {
+func (txn *txn) IncrFloat(
+	ctx context.Context,
+	key []byte,
+	increment float64,
+	opts *kv.IncrOptions[float64],
+) (float64, error) {
+	var (
+		invalid bool
+		ttl     time.Duration
+		keep    bool
+		num     float64
+	)
+	if opts != nil {
+		ttl = opts.TTL
+		keep = opts.KeepVersions
+		num = opts.Default
+	}
+
+	prev, err := txn.inner.Get(key)
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, err
+	}
+	if prev != nil {
+		_ = prev.Value(func(val []byte) error {
+			num, err = kv.ParseFloat(val)
+			if err != nil {
+				invalid = true
+			}
+			return nil
+		})
+	}
+
+	if invalid {
+		return 0, kv.ErrInvalidNum
+	}
+
+	num, err = opts.Bound(num + increment)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsInf(num, 0) {
+		return 0, kv.ErrOutOfRange
+	}
+	val := kv.FormatFloat(num)
+	if err := txn.setEntry(
+		key,
+		bytesconv.StringToBytes(val),
+		kv.Expiry(ttl, time.Time{}),
+		keep,
+	); err != nil {
+		return 0, err
+	}
+
+	return num, nil
+}
+
+func (txn *txn) Iterate(
+	ctx context.Context,
+	opts *kv.IterOptions,
+	fn func(key, val []byte) error,
+) error {
+	iopts := badger.DefaultIteratorOptions
+	iopts.Reverse = opts.Reverse
+	iopts.PrefetchValues = !opts.KeysOnly
+
+	seek := opts.Seek
+	if opts.Reverse {
+		// Reverse iteration starts at the largest key <= seek, which may be
+		// the end of the prefix itself: the prefix is checked below rather
+		// than by the iterator, which would stop there. A nil end seeks to
+		// the last key.
+		end := kv.PrefixEnd(opts.Prefix)
+		if seek == nil || (end != nil && bytes.Compare(seek, end) > 0) {
+			seek = end
+		}
+	} else {
+		iopts.Prefix = opts.Prefix
+		if seek == nil {
+			seek = opts.Prefix
+		}
+	}
+	it := txn.inner.NewIterator(iopts)
+	defer it.Close()
+
+	for it.Seek(seek); it.Valid(); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		item := it.Item()
+		if opts.Reverse && !bytes.HasPrefix(item.Key(), opts.Prefix) {
+			if bytes.Compare(item.Key(), opts.Prefix) > 0 {
+				continue
+			}
+			return nil
+		}
+		key := item.KeyCopy(nil)
+		var val []byte
+		if !opts.KeysOnly {
+			var err error
+			val, err = item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+		}
+		if err := fn(key, val); err != nil {
+			if errors.Is(err, kv.ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (txn *txn) setEntry(key, val []byte, expiresAt uint64, keepVersions bool) error {
+	return convertErr(txn.inner.SetEntry(newEntry(key, val, expiresAt, keepVersions)))
+}
+
+// convertErr maps the badger errors callers may handle to their kv
+// counterparts.
+func convertErr(err error) error {
+	switch {
+	case errors.Is(err, badger.ErrTxnTooBig):
+		return kv.ErrTxnTooBig
+	case errors.Is(err, badger.ErrReadOnlyTxn):
+		return kv.ErrReadOnlyTxn
+	}
+	return err
+}
+
+// newEntry returns the entry of key, expiresAt is a Unix time, 0 for none.
+func newEntry(key, val []byte, expiresAt uint64, keepVersions bool) *badger.Entry {
 	ent := badger.NewEntry(key, val)
-	if ttl > 0 {
-		ent.ExpiresAt = uint64(time.Now().Add(ttl).Unix())
+	ent.ExpiresAt = expiresAt
+	if !keepVersions {
+		ent = ent.WithDiscard()
 	}
-	return txn.SetEntry(ent)
+	return ent
 }
 
 func (s *Store) gc() {
@@ -163,7 +352,7 @@ func (s *Store) gc() {
 		}
 	}()
 
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := time.NewTicker(time.Duration(s.opts.GCInterval))
 	defer ticker.Stop()
 	for {
 		select {
@@ -171,9 +360,14 @@ func (s *Store) gc() {
 			return
 		case <-ticker.C:
 		}
+		// Versions at or below the discard timestamp can be reclaimed by
+		// compactions.
+		s.inner.SetDiscardTs(s.oracle.readTs())
 	again:
-		err := s.inner.RunValueLogGC(0.7)
+		s.gcRuns.Add(1)
+		err := s.inner.RunValueLogGC(s.opts.GCDiscardRatio)
 		if err == nil {
+			s.gcRewrites.Add(1)
 			goto again
 		}
 	}
@@ -0,0 +1,60 @@
+package badger_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+	"github.com/maolonglong/kvdb/internal/kv/kvtest"
+)
+
+func TestStore(t *testing.T) {
+	kvtest.Run(t, func(t *testing.T) kv.Store {
+		s, err := badgerstore.New(badgerstore.DefaultOptions(t.TempDir()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+// A transaction started after a commit returned sees it, even while older
+// commits are still in flight.
+func TestReadAfterCommit(t *testing.T) {
+	s, err := badgerstore.New(badgerstore.DefaultOptions(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := []byte(fmt.Sprintf("%d/%d", i, j))
+				err := kv.WithTxn(s, true, func(txn kv.Txn) error {
+					return txn.Set(ctx, key, key, nil)
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				err = kv.WithTxn(s, false, func(txn kv.Txn) error {
+					_, err := txn.Get(ctx, key)
+					return err
+				})
+				if err != nil {
+					t.Errorf("Get(%s) after its commit: %v", key, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
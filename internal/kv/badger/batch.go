@@ -0,0 +1,67 @@
+package badger
+
+import (
+	"errors"
+
+	badger "github.com/dgraph-io/badger/v4"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+// writeBatch works like badger.WriteBatch. The latter commits every write at
+// a single timestamp in managed mode, which would hold back the read
+// timestamp of the whole DB until Flush, so each commit takes its own
+// timestamp from the oracle instead.
+type writeBatch struct {
+	s   *Store
+	txn *badger.Txn
+}
+
+func (s *Store) NewWriteBatch() kv.WriteBatch {
+	return &writeBatch{
+		s:   s,
+		txn: s.inner.NewTransactionAt(s.oracle.readTs(), true),
+	}
+}
+
+func (wb *writeBatch) Set(key, val []byte, opts *kv.SetOptions) error {
+	var (
+		expiresAt uint64
+		keep      bool
+	)
+	if opts != nil {
+		expiresAt = kv.Expiry(opts.TTL, opts.ExpiresAt)
+		keep = opts.KeepVersions
+	}
+	ent := newEntry(key, val, expiresAt, keep)
+	return wb.handle(func() error {
+		return wb.txn.SetEntry(ent)
+	})
+}
+
+func (wb *writeBatch) Delete(key []byte) error {
+	return wb.handle(func() error {
+		return wb.txn.Delete(key)
+	})
+}
+
+func (wb *writeBatch) Flush() error {
+	return wb.s.commit(wb.txn)
+}
+
+func (wb *writeBatch) Cancel() {
+	wb.txn.Discard()
+}
+
+// handle commits the pending writes and retries fn once the transaction is
+// full.
+func (wb *writeBatch) handle(fn func() error) error {
+	if err := fn(); !errors.Is(err, badger.ErrTxnTooBig) {
+		return err
+	}
+	if err := wb.s.commit(wb.txn); err != nil {
+		return err
+	}
+	wb.txn = wb.s.inner.NewTransactionAt(wb.s.oracle.readTs(), true)
+	return fn()
+}
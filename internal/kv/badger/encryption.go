@@ -0,0 +1,143 @@
+package badger
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+var ErrEncryptionKeyMismatch = errors.New(
+	"badger: encryption key does not match the data directory",
+)
+
+// ParseEncryptionKey parses a master key, hex encoded or raw, of 16, 24 or
+// 32 bytes for AES-128, AES-192 or AES-256. A raw key may be followed by a
+// newline, as written by editors.
+func ParseEncryptionKey(b []byte) ([]byte, error) {
+	if key, err := hex.DecodeString(string(bytes.TrimSpace(b))); err == nil &&
+		validKeySize(len(key)) {
+		return key, nil
+	}
+	if validKeySize(len(b)) {
+		return b, nil
+	}
+	key := bytes.TrimSuffix(bytes.TrimSuffix(b, []byte("\n")), []byte("\r"))
+	if validKeySize(len(key)) {
+		return key, nil
+	}
+	return nil, errors.New("badger: encryption key must be 16, 24 or 32 bytes")
+}
+
+// ReadEncryptionKey reads the master key in the file at path, see
+// ParseEncryptionKey.
+func ReadEncryptionKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseEncryptionKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, path)
+	}
+	return key, nil
+}
+
+func validKeySize(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+// Rekey encrypts the data directory opts.Dir under newKey instead of the key
+// of opts, an empty key meaning plain text. The directory must not be in
+// use.
+//
+// Between two keys, only the data keys are encrypted again, which is cheap.
+// Otherwise the data is rewritten with opts into a new directory replacing
+// opts.Dir, so that no plain text is left behind.
+func Rekey(opts *Options, newKey []byte) error {
+	oldKey, err := opts.encryptionKey()
+	if err != nil {
+		return err
+	}
+	// Opening the DB takes the directory lock and checks the old key.
+	src, err := New(opts)
+	if err != nil {
+		return err
+	}
+
+	if len(oldKey) > 0 && len(newKey) > 0 {
+		if err := src.Close(); err != nil {
+			return err
+		}
+		kopts := badger.KeyRegistryOptions{
+			Dir:                           opts.Dir,
+			ReadOnly:                      true,
+			EncryptionKey:                 oldKey,
+			EncryptionKeyRotationDuration: time.Duration(opts.EncryptionKeyRotation),
+		}
+		kr, err := badger.OpenKeyRegistry(kopts)
+		if err != nil {
+			return err
+		}
+		kopts.EncryptionKey = newKey
+		return badger.WriteKeyRegistry(kr, kopts)
+	}
+
+	dir := opts.Dir
+	tmp := dir + ".rekey"
+	dstOpts := *opts
+	dstOpts.Dir = tmp
+	dstOpts.EncryptionKey = newKey
+	dstOpts.EncryptionKeyFile = ""
+	err = rewrite(src.(*Store), &dstOpts)
+	if cerr := src.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return err
+	}
+	old := dir + ".old"
+	if err := os.Rename(dir, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		if rerr := os.Rename(old, dir); rerr != nil {
+			return fmt.Errorf(
+				"badger: %w, the data is in %s and rekeyed in %s, rename one of them to %s",
+				err, old, tmp, dir,
+			)
+		}
+		_ = os.RemoveAll(tmp)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// rewrite copies every version of src into a new DB with opts.
+func rewrite(src *Store, opts *Options) error {
+	if _, err := os.Stat(opts.Dir); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("badger: %s already exists", opts.Dir)
+	}
+	dst, err := New(opts)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := src.Backup(pw, 0)
+		pw.CloseWithError(err)
+	}()
+	if err := dst.(*Store).Load(pr); err != nil {
+		_ = pr.CloseWithError(err)
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
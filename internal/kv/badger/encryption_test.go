@@ -0,0 +1,118 @@
+package badger_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+)
+
+func TestParseEncryptionKey(t *testing.T) {
+	raw := []byte("ghijklmnopqrstuvwxyzGHIJKLMNOPQR")
+	for _, tt := range []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{"raw", raw, raw},
+		{"raw with newline", append(raw[:16:16], '\n'), raw[:16]},
+		{"raw with crlf", append(raw[:24:24], '\r', '\n'), raw[:24]},
+		{"raw ending with a newline", append(raw[:31:31], '\n'), append(raw[:31:31], '\n')},
+		{"hex", []byte(hex.EncodeToString(raw)), raw},
+		{"hex with spaces", []byte(" " + hex.EncodeToString(raw[:16]) + "\n"), raw[:16]},
+		{"short", raw[:15], nil},
+		{"short with newlines", append(raw[:13:13], '\n', '\n'), nil},
+		{"hex of a bad size", []byte(hex.EncodeToString(raw[:20])), nil},
+	} {
+		got, err := badgerstore.ParseEncryptionKey(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: ParseEncryptionKey = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: ParseEncryptionKey = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	keyA := bytes.Repeat([]byte{'a'}, 16)
+	keyB := bytes.Repeat([]byte{'b'}, 32)
+	ctx := context.Background()
+
+	open := func(key []byte) (kv.Store, error) {
+		opts := badgerstore.DefaultOptions(dir)
+		opts.EncryptionKey = key
+		return badgerstore.New(opts)
+	}
+	check := func(key []byte) {
+		t.Helper()
+		s, err := open(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		err = kv.WithTxn(s, false, func(txn kv.Txn) error {
+			val, err := txn.Get(ctx, []byte("k"))
+			if err == nil && string(val) != "v" {
+				t.Errorf("Get = %q, want v", val)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.WithTxn(s, true, func(txn kv.Txn) error {
+		return txn.Set(ctx, []byte("k"), []byte("v"), nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := [][]byte{nil, keyA, keyB, nil}
+	for i := 1; i < len(keys); i++ {
+		opts := badgerstore.DefaultOptions(dir)
+		opts.Compression = "none"
+		opts.EncryptionKey = keys[i-1]
+		if err := badgerstore.Rekey(opts, keys[i]); err != nil {
+			t.Fatalf("Rekey %d: %v", i, err)
+		}
+		check(keys[i])
+		if keys[i-1] != nil {
+			if _, err := open(keys[i-1]); !errors.Is(err, badgerstore.ErrEncryptionKeyMismatch) {
+				t.Errorf("open with the old key: error = %v, want ErrEncryptionKeyMismatch", err)
+			}
+		}
+	}
+	for _, suffix := range []string{".rekey", ".old"} {
+		if _, err := os.Stat(dir + suffix); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left behind: %v", dir+suffix, err)
+		}
+	}
+
+	// The old key is checked before anything is written.
+	opts := badgerstore.DefaultOptions(dir)
+	opts.EncryptionKey = keyA
+	if err := badgerstore.Rekey(opts, keyB); err == nil {
+		t.Error("Rekey of a plain text directory with an old key succeeded")
+	}
+	check(nil)
+}
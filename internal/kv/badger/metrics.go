@@ -0,0 +1,30 @@
+package badger
+
+import (
+	"github.com/dgraph-io/ristretto"
+
+	"github.com/maolonglong/kvdb/internal/metrics"
+)
+
+var _ metrics.Collector = (*Store)(nil)
+
+func (s *Store) Collect(e *metrics.Encoder) {
+	lsm, vlog := s.inner.Size()
+	e.Gauge("kvdb_badger_lsm_size_bytes", "Size of the LSM tree files.", float64(lsm))
+	e.Gauge("kvdb_badger_vlog_size_bytes", "Size of the value log files.", float64(vlog))
+	e.Counter("kvdb_badger_gc_runs_total", "Value log GCs run.", float64(s.gcRuns.Load()))
+	e.Counter(
+		"kvdb_badger_gc_rewrites_total",
+		"Value log GCs that rewrote a file.",
+		float64(s.gcRewrites.Load()),
+	)
+	collectCache(e, "badger_block", s.inner.BlockCacheMetrics())
+	collectCache(e, "badger_index", s.inner.IndexCacheMetrics())
+}
+
+// collectCache writes the metrics of a cache, m is nil if it is disabled.
+func collectCache(e *metrics.Encoder, name string, m *ristretto.Metrics) {
+	if m != nil {
+		metrics.Cache(e, name, m.Hits(), m.Misses())
+	}
+}
@@ -0,0 +1,236 @@
+package badger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	bopt "github.com/dgraph-io/badger/v4/options"
+	"github.com/dustin/go-humanize"
+)
+
+const _maxValueThreshold = 1 << 20
+
+// Options configures the badger store, see DefaultOptions.
+type Options struct {
+	// Directory of the LSM tree and the value log.
+	Dir string `toml:"dir" json:"dir"`
+
+	MemTableSize   Size `toml:"memtable_size"    json:"memtable_size"`
+	BlockCacheSize Size `toml:"block_cache_size" json:"block_cache_size"`
+	IndexCacheSize Size `toml:"index_cache_size" json:"index_cache_size"`
+
+	// One of none, snappy and zstd. The level only applies to zstd.
+	Compression      string `toml:"compression"       json:"compression"`
+	CompressionLevel int    `toml:"compression_level" json:"compression_level"`
+
+	SyncWrites bool `toml:"sync_writes" json:"sync_writes"`
+
+	// Values larger than this are stored in the value log.
+	ValueThreshold Size `toml:"value_threshold" json:"value_threshold"`
+
+	// The value log is garbage collected every GCInterval, rewriting the
+	// files with at least GCDiscardRatio of stale data.
+	GCInterval     Duration `toml:"gc_interval"      json:"gc_interval"`
+	GCDiscardRatio float64  `toml:"gc_discard_ratio" json:"gc_discard_ratio"`
+
+	// Master key encrypting the data keys, see ParseEncryptionKey. Data is
+	// stored in plain text without a key or key file.
+	EncryptionKey     []byte `toml:"-"                       json:"-"`
+	EncryptionKeyFile string `toml:"encryption_key_file"     json:"encryption_key_file"`
+	// Interval after which data is encrypted with a new data key.
+	EncryptionKeyRotation Duration `toml:"encryption_key_rotation" json:"encryption_key_rotation"`
+
+	// Maximum number of versions kept per key, 0 keeps them all. Buckets
+	// without history keep a single version regardless, while the history
+	// of the others is truncated to this many versions, whatever their
+	// HistoryVersions and HistoryDuration.
+	NumVersionsToKeep int `toml:"num_versions_to_keep" json:"num_versions_to_keep"`
+}
+
+func DefaultOptions(dir string) *Options {
+	return &Options{
+		Dir:              dir,
+		MemTableSize:     64 << 20,
+		BlockCacheSize:   100 << 20,
+		IndexCacheSize:   100 << 20,
+		Compression:      "zstd",
+		CompressionLevel: 3,
+		SyncWrites:       false,
+		ValueThreshold:   _maxValueThreshold,
+		GCInterval:       Duration(5 * time.Minute),
+		GCDiscardRatio:   0.7,
+
+		EncryptionKeyRotation: Duration(10 * 24 * time.Hour),
+	}
+}
+
+// Validate reports the first invalid option, before badger fails on it or
+// silently adjusts it.
+func (o *Options) Validate() error {
+	switch {
+	case o.Dir == "":
+		return errors.New("badger: dir is required")
+	case o.MemTableSize < 1<<20:
+		return fmt.Errorf("badger: memtable_size %v is less than 1 MiB", o.MemTableSize)
+	case o.BlockCacheSize < 0 || o.IndexCacheSize < 0:
+		return errors.New("badger: cache sizes must not be negative")
+	case (o.Compression != "none" || o.encrypted()) && o.BlockCacheSize == 0:
+		return errors.New("badger: block_cache_size is required with compression or encryption")
+	case o.ValueThreshold < 0 || o.ValueThreshold > _maxValueThreshold:
+		return fmt.Errorf("badger: value_threshold %v is out of [0, 1 MiB]", o.ValueThreshold)
+	case o.ValueThreshold > o.MemTableSize*15/100:
+		// A batch is at most 15% of a memtable, and must hold a value.
+		return fmt.Errorf(
+			"badger: value_threshold %v is more than 15%% of memtable_size %v",
+			o.ValueThreshold,
+			o.MemTableSize,
+		)
+	case o.GCInterval <= 0:
+		return errors.New("badger: gc_interval must be positive")
+	case o.GCDiscardRatio <= 0 || o.GCDiscardRatio >= 1:
+		return fmt.Errorf("badger: gc_discard_ratio %v is out of (0, 1)", o.GCDiscardRatio)
+	case len(o.EncryptionKey) > 0 && o.EncryptionKeyFile != "":
+		return errors.New("badger: both an encryption key and a key file are set")
+	case len(o.EncryptionKey) > 0 && !validKeySize(len(o.EncryptionKey)):
+		return errors.New("badger: encryption key must be 16, 24 or 32 bytes")
+	case o.encrypted() && o.EncryptionKeyRotation <= 0:
+		return errors.New("badger: encryption_key_rotation must be positive")
+	case o.NumVersionsToKeep < 0:
+		return errors.New("badger: num_versions_to_keep must not be negative")
+	}
+	if _, err := o.compression(); err != nil {
+		return err
+	}
+	if o.Compression == "zstd" && (o.CompressionLevel < 1 || o.CompressionLevel > 22) {
+		return fmt.Errorf("badger: compression_level %d is out of [1, 22]", o.CompressionLevel)
+	}
+	return nil
+}
+
+func (o *Options) compression() (bopt.CompressionType, error) {
+	switch o.Compression {
+	case "none":
+		return bopt.None, nil
+	case "snappy":
+		return bopt.Snappy, nil
+	case "zstd":
+		return bopt.ZSTD, nil
+	}
+	return 0, fmt.Errorf("badger: unknown compression %q", o.Compression)
+}
+
+func (o *Options) encrypted() bool {
+	return len(o.EncryptionKey) > 0 || o.EncryptionKeyFile != ""
+}
+
+// encryptionKey returns the master key, read from EncryptionKeyFile if set.
+func (o *Options) encryptionKey() ([]byte, error) {
+	if o.EncryptionKeyFile != "" {
+		return ReadEncryptionKey(o.EncryptionKeyFile)
+	}
+	return o.EncryptionKey, nil
+}
+
+func (o *Options) badgerOptions() (badger.Options, error) {
+	key, err := o.encryptionKey()
+	if err != nil {
+		return badger.Options{}, err
+	}
+	compression, _ := o.compression()
+	numVersions := o.NumVersionsToKeep
+	if numVersions == 0 {
+		// Superseded versions are dropped per key, see setEntry.
+		numVersions = math.MaxInt32
+	}
+	return badger.DefaultOptions(o.Dir).
+		WithNumVersionsToKeep(numVersions).
+		// Conflicting writes are serialized by core, which locks the keys
+		// of its write transactions. Detecting them here would also break
+		// the writes at older timestamps of DiscardVersionsBefore.
+		WithDetectConflicts(false).
+		WithMemTableSize(int64(o.MemTableSize)).
+		WithBlockCacheSize(int64(o.BlockCacheSize)).
+		WithIndexCacheSize(int64(o.IndexCacheSize)).
+		WithCompression(compression).
+		WithZSTDCompressionLevel(o.CompressionLevel).
+		WithSyncWrites(o.SyncWrites).
+		WithValueThreshold(int64(o.ValueThreshold)).
+		WithEncryptionKey(key).
+		WithEncryptionKeyRotationDuration(time.Duration(o.EncryptionKeyRotation)), nil
+}
+
+// Size is a number of bytes, written as 64MiB or 1GB in flags and files.
+type Size int64
+
+// String returns s in the largest unit dividing it, so that it parses back to
+// the same size.
+func (s Size) String() string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	n, i := int64(s), 0
+	for ; i < len(units)-1 && n != 0 && n%1024 == 0; i++ {
+		n /= 1024
+	}
+	return strconv.FormatInt(n, 10) + units[i]
+}
+
+func (s *Size) Set(v string) error {
+	n, err := humanize.ParseBytes(v)
+	if err != nil {
+		return err
+	}
+	if n > math.MaxInt64 {
+		return fmt.Errorf("size %s is too large", v)
+	}
+	*s = Size(n)
+	return nil
+}
+
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Size) UnmarshalText(text []byte) error {
+	return s.Set(string(text))
+}
+
+// UnmarshalJSON accepts a number of bytes as well as a string.
+func (s *Size) UnmarshalJSON(data []byte) error {
+	if n, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+		*s = Size(n)
+		return nil
+	}
+	var v string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return s.Set(v)
+}
+
+// Duration is a time.Duration written as 5m in flags and files.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(v string) error {
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
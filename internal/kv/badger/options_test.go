@@ -0,0 +1,137 @@
+package badger_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(o *badgerstore.Options)
+		wantErr string
+	}{
+		{"defaults", func(*badgerstore.Options) {}, ""},
+		{"no dir", func(o *badgerstore.Options) { o.Dir = "" }, "dir"},
+		{
+			"small memtable",
+			func(o *badgerstore.Options) { o.MemTableSize = 1 << 10 },
+			"memtable_size",
+		},
+		{"negative cache", func(o *badgerstore.Options) { o.IndexCacheSize = -1 }, "cache sizes"},
+		{
+			"compression without block cache",
+			func(o *badgerstore.Options) { o.BlockCacheSize = 0 },
+			"block_cache_size",
+		},
+		{
+			"no compression nor block cache",
+			func(o *badgerstore.Options) { o.Compression, o.BlockCacheSize = "none", 0 },
+			"",
+		},
+		{
+			"large value threshold",
+			func(o *badgerstore.Options) { o.ValueThreshold = 2 << 20 },
+			"value_threshold",
+		},
+		{
+			"value threshold over the batch size",
+			func(o *badgerstore.Options) { o.MemTableSize, o.ValueThreshold = 4<<20, 1<<20 },
+			"15%",
+		},
+		{"no gc interval", func(o *badgerstore.Options) { o.GCInterval = 0 }, "gc_interval"},
+		{"gc ratio", func(o *badgerstore.Options) { o.GCDiscardRatio = 1 }, "gc_discard_ratio"},
+		{
+			"key and key file",
+			func(o *badgerstore.Options) {
+				o.EncryptionKey = make([]byte, 16)
+				o.EncryptionKeyFile = "key"
+			},
+			"key file",
+		},
+		{
+			"key size",
+			func(o *badgerstore.Options) { o.EncryptionKey = make([]byte, 10) },
+			"16, 24 or 32",
+		},
+		{
+			"key rotation",
+			func(o *badgerstore.Options) {
+				o.EncryptionKey = make([]byte, 32)
+				o.EncryptionKeyRotation = 0
+			},
+			"encryption_key_rotation",
+		},
+		{
+			"negative versions",
+			func(o *badgerstore.Options) { o.NumVersionsToKeep = -1 },
+			"num_versions_to_keep",
+		},
+		{"compression", func(o *badgerstore.Options) { o.Compression = "lz4" }, "lz4"},
+		{
+			"zstd level",
+			func(o *badgerstore.Options) { o.CompressionLevel = 23 },
+			"compression_level",
+		},
+		{
+			"snappy ignores the level",
+			func(o *badgerstore.Options) { o.Compression, o.CompressionLevel = "snappy", 0 },
+			"",
+		},
+	}
+	for _, tt := range tests {
+		o := badgerstore.DefaultOptions("data")
+		tt.set(o)
+		err := o.Validate()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: Validate = %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: Validate = %v, want an error about %s", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want badgerstore.Size
+		str  string
+	}{
+		{"64MiB", 64 << 20, "64MiB"},
+		{"1GB", 1000 * 1000 * 1000, "1000000000B"},
+		{"1.5KiB", 1536, "1536B"},
+		{"2048", 2048, "2KiB"},
+		{"0", 0, "0B"},
+	} {
+		var s badgerstore.Size
+		if err := s.Set(tt.in); err != nil || s != tt.want {
+			t.Errorf("Set(%q) = %d, %v, want %d", tt.in, s, err, tt.want)
+			continue
+		}
+		if got := s.String(); got != tt.str {
+			t.Errorf("String(%d) = %q, want %q", s, got, tt.str)
+		}
+		var back badgerstore.Size
+		if err := back.Set(s.String()); err != nil || back != s {
+			t.Errorf("Set(String(%d)) = %d, %v", s, back, err)
+		}
+	}
+	for _, in := range []string{"", "abc", "-1MiB", "100EiB"} {
+		var s badgerstore.Size
+		if err := s.Set(in); err == nil {
+			t.Errorf("Set(%q) = %d, want an error", in, s)
+		}
+	}
+
+	var cfg struct{ A, B badgerstore.Size }
+	if err := json.Unmarshal([]byte(`{"A":1024,"B":"1MiB"}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.A != 1024 || cfg.B != 1<<20 {
+		t.Errorf("UnmarshalJSON = %d, %d", cfg.A, cfg.B)
+	}
+}
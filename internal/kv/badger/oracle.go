@@ -0,0 +1,79 @@
+package badger
+
+import (
+	"sync"
+	"time"
+)
+
+// oracle hands out the timestamps of the managed badger DB. Commit
+// timestamps are wall-clock Unix nanoseconds, so that a version tells when
+// it was written.
+type oracle struct {
+	mu     sync.Mutex
+	done   *sync.Cond
+	lastTs uint64
+	// Latest timestamp of a commit that returned.
+	lastDone uint64
+	pending  map[uint64]struct{}
+}
+
+func newOracle(maxVersion uint64) *oracle {
+	o := &oracle{
+		lastTs:   maxVersion,
+		lastDone: maxVersion,
+		pending:  make(map[uint64]struct{}),
+	}
+	o.done = sync.NewCond(&o.mu)
+	return o
+}
+
+// readTs returns the timestamp of the latest commit that returned, once every
+// commit up to it is done, so that a transaction sees the commits that
+// returned before it started. Commits started after it are not waited for,
+// but a new transaction, read-only ones included, waits for the older ones,
+// e.g. while they sync with Options.SyncWrites.
+func (o *oracle) readTs() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ts := o.lastDone
+	for o.pendingUpTo(ts) {
+		o.done.Wait()
+	}
+	return ts
+}
+
+func (o *oracle) pendingUpTo(ts uint64) bool {
+	for p := range o.pending {
+		if p <= ts {
+			return true
+		}
+	}
+	return false
+}
+
+// newCommitTs returns a timestamp greater than any previous one, doneCommit
+// must be called once the commit returns.
+func (o *oracle) newCommitTs() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ts := max(uint64(time.Now().UnixNano()), o.lastTs+1)
+	o.lastTs = ts
+	o.pending[ts] = struct{}{}
+	return ts
+}
+
+func (o *oracle) doneCommit(ts uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.pending, ts)
+	o.lastDone = max(o.lastDone, ts)
+	o.done.Broadcast()
+}
+
+// advance makes sure that later commits are newer than ts.
+func (o *oracle) advance(ts uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastTs = max(o.lastTs, ts)
+	o.lastDone = max(o.lastDone, ts)
+}
@@ -0,0 +1,54 @@
+package badger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOracleReadTs(t *testing.T) {
+	o := newOracle(0)
+	older := o.newCommitTs()
+	newer := o.newCommitTs()
+	// The newer commit returns first.
+	o.doneCommit(newer)
+
+	got := make(chan uint64)
+	go func() {
+		got <- o.readTs()
+	}()
+	select {
+	case ts := <-got:
+		t.Fatalf("readTs = %d while the commit at %d is in flight", ts, older)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	o.doneCommit(older)
+	if ts := <-got; ts < newer {
+		t.Errorf("readTs = %d, want >= %d", ts, newer)
+	}
+}
+
+func TestOracleReadTsSkipsNewerCommits(t *testing.T) {
+	o := newOracle(0)
+	done := o.newCommitTs()
+	o.doneCommit(done)
+	// A commit still in flight, e.g. syncing, does not block new reads.
+	inFlight := o.newCommitTs()
+
+	got := make(chan uint64)
+	go func() {
+		got <- o.readTs()
+	}()
+	select {
+	case ts := <-got:
+		if ts != done {
+			t.Errorf("readTs = %d, want %d", ts, done)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("readTs waits for the commit at %d", inFlight)
+	}
+	o.doneCommit(inFlight)
+	if ts := o.readTs(); ts != inFlight {
+		t.Errorf("readTs = %d, want %d", ts, inFlight)
+	}
+}
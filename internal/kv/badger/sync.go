@@ -0,0 +1,63 @@
+package badger
+
+import "sync"
+
+// syncer runs a sync for every group of concurrent callers, instead of one
+// per caller.
+type syncer struct {
+	mu sync.Mutex
+	// The running sync, and the one that callers arriving meanwhile wait
+	// for.
+	running, next *syncCall
+}
+
+type syncCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newSyncer() *syncer {
+	return &syncer{}
+}
+
+// sync returns once fn ran entirely after sync was called, with the error
+// of that run. A running fn may have missed the writes of the caller, so
+// the next one is waited for, and shared by everyone who arrived meanwhile.
+func (s *syncer) sync(fn func() error) error {
+	s.mu.Lock()
+	if s.running == nil {
+		c := &syncCall{done: make(chan struct{})}
+		s.running = c
+		s.mu.Unlock()
+		s.run(c, fn)
+		return c.err
+	}
+	if c := s.next; c != nil {
+		s.mu.Unlock()
+		<-c.done
+		return c.err
+	}
+	// The first caller waiting for the next sync runs it.
+	c := &syncCall{done: make(chan struct{})}
+	s.next = c
+	running := s.running
+	s.mu.Unlock()
+	<-running.done
+	s.run(c, fn)
+	return c.err
+}
+
+// run runs c, which must be running, and hands over to the next sync.
+func (s *syncer) run(c *syncCall, fn func() error) {
+	c.err = fn()
+	s.mu.Lock()
+	s.running, s.next = s.next, nil
+	s.mu.Unlock()
+	close(c.done)
+}
+
+// Sync flushes the value log, commits are not synced unless
+// Options.SyncWrites is set.
+func (s *Store) Sync() error {
+	return s.syncer.sync(s.inner.Sync)
+}
@@ -0,0 +1,134 @@
+package badger
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSyncerGroupCommit(t *testing.T) {
+	s := newSyncer()
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	release := make(chan error)
+	fn := func() error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return <-release
+	}
+	errFirst := errors.New("first sync")
+
+	first := make(chan error)
+	go func() {
+		first <- s.sync(fn)
+	}()
+	// Wait for the first sync to run, the callers arriving meanwhile share
+	// the next one.
+	for {
+		mu.Lock()
+		n := calls
+		mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	const waiters = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, waiters)
+	for range waiters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.sync(fn)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	release <- errFirst
+	if err := <-first; !errors.Is(err, errFirst) {
+		t.Fatalf("first sync error = %v, want %v", err, errFirst)
+	}
+	release <- nil
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("sync error = %v, want the error of the second sync", err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("%d syncs for %d callers, want 2", calls, waiters+1)
+	}
+
+	// The syncer is idle again.
+	go func() {
+		release <- nil
+	}()
+	if err := s.sync(fn); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("%d syncs, want 3", calls)
+	}
+}
+
+func TestSyncerErrorPerGeneration(t *testing.T) {
+	s := newSyncer()
+	errSecond := errors.New("second sync")
+	started := make(chan int)
+	release := make(chan struct{})
+	gen := 0
+	fn := func() error {
+		gen++
+		n := gen
+		started <- n
+		<-release
+		if n == 2 {
+			return errSecond
+		}
+		return nil
+	}
+
+	first := make(chan error)
+	go func() {
+		first <- s.sync(fn)
+	}()
+	<-started
+	// Both the caller running the second sync and the one waiting for it.
+	second := make(chan error, 2)
+	for range 2 {
+		go func() {
+			second <- s.sync(fn)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	release <- struct{}{}
+	if err := <-first; err != nil {
+		t.Fatalf("first sync error = %v", err)
+	}
+
+	// A third sync finishing before the callers of the second one return
+	// does not replace its error.
+	<-started
+	third := make(chan error)
+	go func() {
+		third <- s.sync(fn)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	if err := <-third; err != nil {
+		t.Fatalf("third sync error = %v", err)
+	}
+	for range 2 {
+		if err := <-second; !errors.Is(err, errSecond) {
+			t.Fatalf("second sync error = %v, want %v", err, errSecond)
+		}
+	}
+}
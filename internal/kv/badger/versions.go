@@ -0,0 +1,89 @@
+package badger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	badger "github.com/dgraph-io/badger/v4"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+var _ kv.VersionedStore = (*Store)(nil)
+
+func (s *Store) Versions(ctx context.Context, key []byte, fn func(v *kv.Version) error) error {
+	txn := s.inner.NewTransactionAt(s.oracle.readTs(), false)
+	defer txn.Discard()
+
+	iopts := badger.DefaultIteratorOptions
+	iopts.AllVersions = true
+	iopts.Prefix = key
+	it := txn.NewIterator(iopts)
+	defer it.Close()
+
+	for it.Seek(key); it.Valid(); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		item := it.Item()
+		if !bytes.Equal(item.Key(), key) {
+			break
+		}
+		v := &kv.Version{
+			Version:   item.Version(),
+			Deleted:   item.IsDeletedOrExpired() && item.ExpiresAt() == 0,
+			ExpiresAt: item.ExpiresAt(),
+		}
+		if !v.Deleted {
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			v.Value = val
+		}
+		if err := fn(v); err != nil {
+			if errors.Is(err, kv.ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+		// Older versions are logically gone, even if not compacted yet.
+		if item.DiscardEarlierVersions() || item.IsDeletedOrExpired() {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *Store) DiscardVersionsBefore(ctx context.Context, key []byte, ts uint64) error {
+	txn := s.inner.NewTransactionAt(ts, false)
+	defer txn.Discard()
+
+	item, err := txn.Get(key)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	}
+	if item.Version() != ts || item.DiscardEarlierVersions() {
+		return nil
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+
+	// Rewrite the version with the discard bit set, compactions then drop
+	// every older version once ts is below the discard timestamp.
+	ent := badger.NewEntry(key, val).WithDiscard()
+	ent.ExpiresAt = item.ExpiresAt()
+	ent.UserMeta = item.UserMeta()
+	wb := s.inner.NewManagedWriteBatch()
+	defer wb.Cancel()
+	if err := wb.SetEntryAt(ent, ts); err != nil {
+		return err
+	}
+	return wb.Flush()
+}
@@ -5,5 +5,15 @@ import "errors"
 var (
 	ErrKeyNotFound = errors.New("kv: key not found")
 	ErrTxnTooBig   = errors.New("kv: txn too big")
+	ErrReadOnlyTxn = errors.New("kv: read-only txn")
 	ErrInvalidNum  = errors.New("kv: invalid num")
+	ErrOutOfRange  = errors.New("kv: num out of range")
+
+	// ErrNotLeader is returned by the transactions of a replicated store on
+	// the members that do not lead it.
+	ErrNotLeader = errors.New("kv: not the leader")
+
+	// ErrStopIteration can be returned by an Iterate callback to stop
+	// the iteration early without reporting an error.
+	ErrStopIteration = errors.New("kv: stop iteration")
 )
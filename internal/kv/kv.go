@@ -1,42 +1,233 @@
 package kv
 
 import (
+	"bytes"
 	"context"
+	"io"
+	"math"
+	"strconv"
 	"time"
+
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
 )
 
 type Store interface {
-	NewTransaction(update bool) any
-	Discard(txn any)
-	Commit(txn any) error
+	// NewTransaction starts a transaction reading from a snapshot of the
+	// store. The writes of a read-only transaction fail with ErrReadOnlyTxn.
+	NewTransaction(update bool) Txn
+
+	NewWriteBatch() WriteBatch
+
+	Close() error
+}
+
+// Txn is a transaction of a Store. Discard must be called once it is no
+// longer used, it is a no-op after Commit.
+type Txn interface {
+	Get(ctx context.Context, key []byte) ([]byte, error)
+	Has(ctx context.Context, key []byte) (bool, error)
 
-	Get(ctx context.Context, txn any, key []byte) ([]byte, error)
-	Has(ctx context.Context, txn any, key []byte) (bool, error)
+	// TTL returns the remaining time to live of key, 0 if it does not expire.
+	TTL(ctx context.Context, key []byte) (time.Duration, error)
 
-	Set(ctx context.Context, txn any, key, val []byte, opts *SetOptions) error
-	Delete(ctx context.Context, txn any, key []byte) error
+	Set(ctx context.Context, key, val []byte, opts *SetOptions) error
+	Delete(ctx context.Context, key []byte) error
 	Incr(
 		ctx context.Context,
-		txn any,
 		key []byte,
 		increment int64,
-		opts *SetOptions,
+		opts *IncrOptions[int64],
 	) (int64, error)
+	IncrFloat(
+		ctx context.Context,
+		key []byte,
+		increment float64,
+		opts *IncrOptions[float64],
+	) (float64, error)
 
-	Close() error
+	// Iterate calls fn for every key matching opts in key order, including
+	// the writes of the transaction. The key and value passed to fn are
+	// copies and may be retained.
+	Iterate(ctx context.Context, opts *IterOptions, fn func(key, val []byte) error) error
+
+	Commit() error
+	Discard()
+}
+
+// WriteBatch applies writes in as many commits as needed, so that it is not
+// limited by the size of a transaction. It is not atomic, and Flush must be
+// called for the last writes to be committed.
+type WriteBatch interface {
+	Set(key, val []byte, opts *SetOptions) error
+	Delete(key []byte) error
+	Flush() error
+	Cancel()
 }
 
 type SetOptions struct {
 	TTL time.Duration
+
+	// Expiry of the key, overriding TTL. Keys written with the same
+	// ExpiresAt expire together, while a TTL is relative to each write.
+	ExpiresAt time.Time
+
+	// Keep the superseded versions of the key, see VersionedStore.
+	KeepVersions bool
+}
+
+type IncrOptions[T int64 | float64] struct {
+	TTL          time.Duration
+	KeepVersions bool
+
+	// Value of the key before the increment if it does not exist.
+	Default T
+
+	// Optional bounds of the result. Without Clamp, a result out of bounds
+	// fails with ErrOutOfRange and the key is left unchanged.
+	Min   *T
+	Max   *T
+	Clamp bool
+}
+
+// Bound applies the bounds of opts to num. A nil opts leaves num unchanged.
+func (opts *IncrOptions[T]) Bound(num T) (T, error) {
+	if opts == nil {
+		return num, nil
+	}
+	if opts.Min != nil && num < *opts.Min {
+		if !opts.Clamp {
+			return num, ErrOutOfRange
+		}
+		num = *opts.Min
+	}
+	if opts.Max != nil && num > *opts.Max {
+		if !opts.Clamp {
+			return num, ErrOutOfRange
+		}
+		num = *opts.Max
+	}
+	return num, nil
+}
+
+// AddInt returns num + increment, or ErrOutOfRange if it overflows.
+func AddInt(num, increment int64) (int64, error) {
+	if increment > 0 && num > math.MaxInt64-increment ||
+		increment < 0 && num < math.MinInt64-increment {
+		return 0, ErrOutOfRange
+	}
+	return num + increment, nil
+}
+
+// VersionedStore is implemented by stores that can keep the superseded
+// versions of keys written with SetOptions.KeepVersions. Deleting or
+// expiring a key may drop its history.
+type VersionedStore interface {
+	Store
+
+	// Versions calls fn for every retained version of key, newest first.
+	Versions(ctx context.Context, key []byte, fn func(v *Version) error) error
+
+	// DiscardVersionsBefore lets the store reclaim the versions of key older
+	// than the existing version ts.
+	DiscardVersionsBefore(ctx context.Context, key []byte, ts uint64) error
+}
+
+// SyncStore is implemented by stores that may acknowledge commits before
+// they are durable.
+type SyncStore interface {
+	Store
+
+	// Sync makes the commits that returned before it is called durable.
+	// Concurrent calls may share a single sync.
+	Sync() error
+}
+
+// BackupStore is implemented by stores that can dump their content.
+type BackupStore interface {
+	Store
+
+	// Backup writes the versions newer than since from a consistent
+	// snapshot, and returns the version of the snapshot, to be passed as
+	// since to the next incremental backup.
+	Backup(w io.Writer, since uint64) (uint64, error)
+
+	// Load writes the content of backups, in the order they were taken.
+	Load(r io.Reader) error
 }
 
-func WithTxn(store Store, update bool, fn func(txn any) error) error {
+type Version struct {
+	// Commit timestamp of the version in Unix nanoseconds.
+	Version uint64
+
+	Value   []byte
+	Deleted bool
+
+	// Unix time in seconds after which the version expires, 0 if never.
+	ExpiresAt uint64
+}
+
+type IterOptions struct {
+	// Only keys with this prefix are visited.
+	Prefix []byte
+
+	// Start from this key instead of the first (or last, when Reverse is set)
+	// key with Prefix.
+	Seek []byte
+
+	Reverse  bool
+	KeysOnly bool
+}
+
+// Expiry returns the Unix time at which a key written with ttl, or expiring
+// at a non-zero at, expires. 0 means that it does not.
+func Expiry(ttl time.Duration, at time.Time) uint64 {
+	if !at.IsZero() {
+		return uint64(at.Unix())
+	}
+	if ttl > 0 {
+		return uint64(time.Now().Add(ttl).Unix())
+	}
+	return 0
+}
+
+// PrefixEnd returns the smallest key greater than every key with prefix, nil
+// if there is none.
+func PrefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func WithTxn(store Store, update bool, fn func(txn Txn) error) error {
 	txn := store.NewTransaction(update)
-	defer store.Discard(txn)
+	defer txn.Discard()
 
 	if err := fn(txn); err != nil {
 		return err
 	}
 
-	return store.Commit(txn)
+	return txn.Commit()
+}
+
+// ParseFloat parses a value written by IncrFloat, NaN and infinities are
+// rejected.
+func ParseFloat(val []byte) (float64, error) {
+	f, err := strconv.ParseFloat(bytesconv.BytesToString(val), 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, ErrInvalidNum
+	}
+	return f, nil
+}
+
+// FormatFloat formats f the way IncrFloat stores it, without an exponent.
+func FormatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
 }
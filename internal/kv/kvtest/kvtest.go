@@ -0,0 +1,602 @@
+// Package kvtest implements a conformance test suite for kv.Store
+// implementations.
+//
+// A backend is certified by a single test:
+//
+//	func TestStore(t *testing.T) {
+//		kvtest.Run(t, func(t *testing.T) kv.Store {
+//			return mystore.New()
+//		})
+//	}
+package kvtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+// Run runs the suite, newStore must return an empty store, which is closed
+// by the suite.
+func Run(t *testing.T, newStore func(t *testing.T) kv.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s kv.Store)
+	}{
+		{"GetSetDelete", testGetSetDelete},
+		{"TTL", testTTL},
+		{"Incr", testIncr},
+		{"IncrFloat", testIncrFloat},
+		{"Isolation", testIsolation},
+		{"Discard", testDiscard},
+		{"ReadOnly", testReadOnly},
+		{"Iterate", testIterate},
+		{"IteratePending", testIteratePending},
+		{"WriteBatch", testWriteBatch},
+		{"Concurrency", testConcurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s := newStore(t)
+			t.Cleanup(func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("Close: %v", err)
+				}
+			})
+			tt.fn(t, s)
+		})
+	}
+}
+
+var ctx = context.Background()
+
+func update(t *testing.T, s kv.Store, fn func(txn kv.Txn) error) {
+	t.Helper()
+	if err := kv.WithTxn(s, true, fn); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+}
+
+func set(t *testing.T, s kv.Store, key, val string, opts *kv.SetOptions) {
+	t.Helper()
+	update(t, s, func(txn kv.Txn) error {
+		return txn.Set(ctx, []byte(key), []byte(val), opts)
+	})
+}
+
+func get(t *testing.T, s kv.Store, key string) (string, error) {
+	t.Helper()
+	var val []byte
+	err := kv.WithTxn(s, false, func(txn kv.Txn) error {
+		var err error
+		val, err = txn.Get(ctx, []byte(key))
+		return err
+	})
+	if err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	return string(val), err
+}
+
+func mustGet(t *testing.T, s kv.Store, key, want string) {
+	t.Helper()
+	got, err := get(t, s, key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	if got != want {
+		t.Fatalf("Get(%q) = %q, want %q", key, got, want)
+	}
+}
+
+func mustNotFound(t *testing.T, s kv.Store, key string) {
+	t.Helper()
+	if got, err := get(t, s, key); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Fatalf("Get(%q) = %q, %v, want ErrKeyNotFound", key, got, err)
+	}
+}
+
+func testGetSetDelete(t *testing.T, s kv.Store) {
+	mustNotFound(t, s, "a")
+
+	set(t, s, "a", "1", nil)
+	mustGet(t, s, "a", "1")
+	set(t, s, "a", "2", nil)
+	mustGet(t, s, "a", "2")
+	set(t, s, "empty", "", nil)
+	mustGet(t, s, "empty", "")
+
+	update(t, s, func(txn kv.Txn) error {
+		for key, want := range map[string]bool{"a": true, "empty": true, "b": false} {
+			ok, err := txn.Has(ctx, []byte(key))
+			if err != nil {
+				return err
+			}
+			if ok != want {
+				return fmt.Errorf("Has(%q) = %v, want %v", key, ok, want)
+			}
+		}
+		return txn.Delete(ctx, []byte("a"))
+	})
+	mustNotFound(t, s, "a")
+
+	// Deleting a missing key is not an error.
+	update(t, s, func(txn kv.Txn) error {
+		return txn.Delete(ctx, []byte("missing"))
+	})
+}
+
+func testTTL(t *testing.T, s kv.Store) {
+	set(t, s, "ttl", "v", &kv.SetOptions{TTL: time.Second})
+	set(t, s, "persistent", "v", nil)
+	// ExpiresAt overrides TTL.
+	set(t, s, "at", "v", &kv.SetOptions{
+		TTL:       time.Hour,
+		ExpiresAt: time.Now().Add(time.Second),
+	})
+
+	update(t, s, func(txn kv.Txn) error {
+		if ttl, err := txn.TTL(ctx, []byte("at")); err != nil || ttl <= 0 ||
+			ttl > 2*time.Second {
+			return fmt.Errorf("TTL(at) = %v, %v", ttl, err)
+		}
+		ttl, err := txn.TTL(ctx, []byte("ttl"))
+		if err != nil {
+			return err
+		}
+		if ttl <= 0 || ttl > 2*time.Second {
+			return fmt.Errorf("TTL(ttl) = %v", ttl)
+		}
+		if ttl, err = txn.TTL(ctx, []byte("persistent")); err != nil || ttl != 0 {
+			return fmt.Errorf("TTL(persistent) = %v, %v, want 0", ttl, err)
+		}
+		if _, err = txn.TTL(ctx, []byte("missing")); !errors.Is(err, kv.ErrKeyNotFound) {
+			return fmt.Errorf("TTL(missing) = %v, want ErrKeyNotFound", err)
+		}
+		return nil
+	})
+
+	// Expiry has a resolution of one second.
+	time.Sleep(2100 * time.Millisecond)
+	mustNotFound(t, s, "ttl")
+	mustNotFound(t, s, "at")
+	mustGet(t, s, "persistent", "v")
+
+	update(t, s, func(txn kv.Txn) error {
+		if ok, err := txn.Has(ctx, []byte("ttl")); err != nil || ok {
+			return fmt.Errorf("Has(ttl) = %v, %v, want false", ok, err)
+		}
+		// An expired value does not count for increments.
+		if n, err := txn.Incr(ctx, []byte("ttl"), 1, nil); err != nil || n != 1 {
+			return fmt.Errorf("Incr(ttl) = %v, %v, want 1", n, err)
+		}
+		return nil
+	})
+}
+
+func incr(s kv.Store, key string, n int64, opts *kv.IncrOptions[int64]) (int64, error) {
+	var num int64
+	err := kv.WithTxn(s, true, func(txn kv.Txn) error {
+		var err error
+		num, err = txn.Incr(ctx, []byte(key), n, opts)
+		return err
+	})
+	return num, err
+}
+
+func testIncr(t *testing.T, s kv.Store) {
+	zero, ten := int64(0), int64(10)
+	tests := []struct {
+		key     string
+		n       int64
+		opts    *kv.IncrOptions[int64]
+		want    int64
+		wantErr error
+	}{
+		{key: "c", n: 1, want: 1},
+		{key: "c", n: 41, want: 42},
+		{key: "c", n: -50, want: -8},
+		{key: "d", n: 1, opts: &kv.IncrOptions[int64]{Default: 100}, want: 101},
+		{key: "d", n: 1, opts: &kv.IncrOptions[int64]{Default: 100}, want: 102},
+		{key: "e", n: -1, opts: &kv.IncrOptions[int64]{Min: &zero}, wantErr: kv.ErrOutOfRange},
+		{key: "e", n: 11, opts: &kv.IncrOptions[int64]{Max: &ten}, wantErr: kv.ErrOutOfRange},
+		{key: "e", n: 11, opts: &kv.IncrOptions[int64]{Max: &ten, Clamp: true}, want: 10},
+		{key: "e", n: -20, opts: &kv.IncrOptions[int64]{Min: &zero, Clamp: true}, want: 0},
+		{key: "text", n: 1, wantErr: kv.ErrInvalidNum},
+		{key: "float", n: 1, wantErr: kv.ErrInvalidNum},
+	}
+	set(t, s, "text", "abc", nil)
+	set(t, s, "float", "1.5", nil)
+	for _, tt := range tests {
+		got, err := incr(s, tt.key, tt.n, tt.opts)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Incr(%q, %d) error = %v, want %v", tt.key, tt.n, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Incr(%q, %d) = %d, %v, want %d", tt.key, tt.n, got, err, tt.want)
+		}
+	}
+
+	// Rejected increments leave the value untouched.
+	mustGet(t, s, "c", "-8")
+	mustGet(t, s, "e", "0")
+	mustGet(t, s, "text", "abc")
+
+	if _, err := incr(s, "ttl", 1, &kv.IncrOptions[int64]{TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	update(t, s, func(txn kv.Txn) error {
+		if ttl, err := txn.TTL(ctx, []byte("ttl")); err != nil || ttl <= 0 {
+			return fmt.Errorf("TTL(ttl) = %v, %v", ttl, err)
+		}
+		return nil
+	})
+
+	if _, err := incr(s, "max", math.MaxInt64, nil); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, s, "max", "9223372036854775807")
+	// Overflows are rejected rather than wrapping around.
+	if _, err := incr(s, "max", 1, nil); !errors.Is(err, kv.ErrOutOfRange) {
+		t.Errorf("Incr(max, 1) error = %v, want ErrOutOfRange", err)
+	}
+	if _, err := incr(s, "min", math.MinInt64, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := incr(s, "min", -1, nil); !errors.Is(err, kv.ErrOutOfRange) {
+		t.Errorf("Incr(min, -1) error = %v, want ErrOutOfRange", err)
+	}
+	mustGet(t, s, "max", "9223372036854775807")
+	mustGet(t, s, "min", "-9223372036854775808")
+}
+
+func testIncrFloat(t *testing.T, s kv.Store) {
+	incr := func(key string, n float64, opts *kv.IncrOptions[float64]) (float64, error) {
+		var num float64
+		err := kv.WithTxn(s, true, func(txn kv.Txn) error {
+			var err error
+			num, err = txn.IncrFloat(ctx, []byte(key), n, opts)
+			return err
+		})
+		return num, err
+	}
+
+	if n, err := incr("f", 0.5, nil); err != nil || n != 0.5 {
+		t.Fatalf("IncrFloat = %v, %v, want 0.5", n, err)
+	}
+	if n, err := incr("f", 2, nil); err != nil || n != 2.5 {
+		t.Fatalf("IncrFloat = %v, %v, want 2.5", n, err)
+	}
+	mustGet(t, s, "f", "2.5")
+
+	set(t, s, "int", "3", nil)
+	if n, err := incr("int", 0.25, nil); err != nil || n != 3.25 {
+		t.Fatalf("IncrFloat(int) = %v, %v, want 3.25", n, err)
+	}
+
+	// Integral results are formatted as integers, so that Incr still works.
+	if n, err := incr("whole", 2.5, &kv.IncrOptions[float64]{Default: 0.5}); err != nil || n != 3 {
+		t.Fatalf("IncrFloat(whole) = %v, %v, want 3", n, err)
+	}
+	mustGet(t, s, "whole", "3")
+
+	set(t, s, "big", "1e308", nil)
+	if _, err := incr("big", 1e308, nil); !errors.Is(err, kv.ErrOutOfRange) {
+		t.Fatalf("IncrFloat(big) error = %v, want ErrOutOfRange", err)
+	}
+	set(t, s, "nan", "NaN", nil)
+	if _, err := incr("nan", 1, nil); !errors.Is(err, kv.ErrInvalidNum) {
+		t.Fatalf("IncrFloat(nan) error = %v, want ErrInvalidNum", err)
+	}
+}
+
+func testIsolation(t *testing.T, s kv.Store) {
+	set(t, s, "k", "old", nil)
+
+	reader := s.NewTransaction(false)
+	defer reader.Discard()
+	writer := s.NewTransaction(true)
+	defer writer.Discard()
+
+	if err := writer.Set(ctx, []byte("k"), []byte("new"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Set(ctx, []byte("added"), []byte("v"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction sees its own writes.
+	if val, err := writer.Get(ctx, []byte("k")); err != nil || string(val) != "new" {
+		t.Fatalf("Get(k) in writer = %q, %v, want new", val, err)
+	}
+	// Others do not see uncommitted writes.
+	mustGet(t, s, "k", "old")
+	mustNotFound(t, s, "added")
+
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, s, "k", "new")
+
+	// The reader keeps reading from its snapshot.
+	if val, err := reader.Get(ctx, []byte("k")); err != nil || string(val) != "old" {
+		t.Fatalf("Get(k) in reader = %q, %v, want old", val, err)
+	}
+	if ok, err := reader.Has(ctx, []byte("added")); err != nil || ok {
+		t.Fatalf("Has(added) in reader = %v, %v, want false", ok, err)
+	}
+	var keys []string
+	err := reader.Iterate(ctx, &kv.IterOptions{}, func(k, _ []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	if err != nil || !slices.Equal(keys, []string{"k"}) {
+		t.Fatalf("Iterate in reader = %q, %v, want [k]", keys, err)
+	}
+}
+
+func testDiscard(t *testing.T, s kv.Store) {
+	txn := s.NewTransaction(true)
+	if err := txn.Set(ctx, []byte("k"), []byte("v"), nil); err != nil {
+		t.Fatal(err)
+	}
+	txn.Discard()
+	mustNotFound(t, s, "k")
+
+	if err := txn.Commit(); err == nil {
+		t.Fatal("Commit after Discard succeeded")
+	}
+	// Discarding twice or after a commit is harmless.
+	txn.Discard()
+	txn = s.NewTransaction(true)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	txn.Discard()
+
+	// kv.WithTxn discards on errors.
+	errTest := errors.New("test")
+	err := kv.WithTxn(s, true, func(txn kv.Txn) error {
+		if err := txn.Set(ctx, []byte("k"), []byte("v"), nil); err != nil {
+			return err
+		}
+		return errTest
+	})
+	if !errors.Is(err, errTest) {
+		t.Fatalf("WithTxn error = %v, want %v", err, errTest)
+	}
+	mustNotFound(t, s, "k")
+}
+
+func testReadOnly(t *testing.T, s kv.Store) {
+	txn := s.NewTransaction(false)
+	defer txn.Discard()
+	if err := txn.Set(ctx, []byte("k"), []byte("v"), nil); !errors.Is(err, kv.ErrReadOnlyTxn) {
+		t.Errorf("Set in a read-only transaction: %v, want %v", err, kv.ErrReadOnlyTxn)
+	}
+	if err := txn.Delete(ctx, []byte("k")); !errors.Is(err, kv.ErrReadOnlyTxn) {
+		t.Errorf("Delete in a read-only transaction: %v, want %v", err, kv.ErrReadOnlyTxn)
+	}
+	if _, err := txn.Incr(ctx, []byte("k"), 1, nil); !errors.Is(err, kv.ErrReadOnlyTxn) {
+		t.Errorf("Incr in a read-only transaction: %v, want %v", err, kv.ErrReadOnlyTxn)
+	}
+}
+
+func iterate(t *testing.T, txn kv.Txn, opts *kv.IterOptions, limit int) []string {
+	t.Helper()
+	var got []string
+	err := txn.Iterate(ctx, opts, func(k, v []byte) error {
+		if opts.KeysOnly {
+			got = append(got, string(k))
+		} else {
+			got = append(got, string(k)+"="+string(v))
+		}
+		if len(got) == limit {
+			return kv.ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Iterate(%+v): %v", opts, err)
+	}
+	return got
+}
+
+// A key of prefix "b:" with more 0xff bytes than a reverse seek could append.
+var _ffs = "b:" + strings.Repeat("\xff", 64)
+
+func testIterate(t *testing.T, s kv.Store) {
+	update(t, s, func(txn kv.Txn) error {
+		for _, k := range []string{"a", "b:1", "b:2", "b:3", _ffs, "b;", "c"} {
+			if err := txn.Set(ctx, []byte(k), []byte("v"+k), nil); err != nil {
+				return err
+			}
+		}
+		return txn.Set(ctx, []byte("b:expired"), nil, &kv.SetOptions{TTL: time.Second})
+	})
+	update(t, s, func(txn kv.Txn) error {
+		return txn.Delete(ctx, []byte("b:2"))
+	})
+	time.Sleep(2100 * time.Millisecond)
+
+	txn := s.NewTransaction(false)
+	defer txn.Discard()
+	tests := []struct {
+		opts  *kv.IterOptions
+		limit int
+		want  []string
+	}{
+		{
+			opts: &kv.IterOptions{KeysOnly: true},
+			want: []string{"a", "b:1", "b:3", _ffs, "b;", "c"},
+		},
+		{
+			opts: &kv.IterOptions{Prefix: []byte("b:")},
+			want: []string{"b:1=vb:1", "b:3=vb:3", _ffs + "=v" + _ffs},
+		},
+		{
+			opts: &kv.IterOptions{Prefix: []byte("b:"), Reverse: true, KeysOnly: true},
+			want: []string{_ffs, "b:3", "b:1"},
+		},
+		{
+			opts: &kv.IterOptions{
+				Prefix:   []byte("b:"),
+				Seek:     []byte("c"),
+				Reverse:  true,
+				KeysOnly: true,
+			},
+			want: []string{_ffs, "b:3", "b:1"},
+		},
+		{
+			opts: &kv.IterOptions{Prefix: []byte("b:"), Seek: []byte("b:2"), KeysOnly: true},
+			want: []string{"b:3", _ffs},
+		},
+		{
+			opts: &kv.IterOptions{
+				Prefix:   []byte("b:"),
+				Seek:     []byte("b:2"),
+				Reverse:  true,
+				KeysOnly: true,
+			},
+			want: []string{"b:1"},
+		},
+		{
+			opts:  &kv.IterOptions{KeysOnly: true},
+			limit: 2,
+			want:  []string{"a", "b:1"},
+		},
+		{
+			opts: &kv.IterOptions{Prefix: []byte("x"), KeysOnly: true},
+		},
+	}
+	for _, tt := range tests {
+		got := iterate(t, txn, tt.opts, tt.limit)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Iterate(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err := txn.Iterate(canceled, &kv.IterOptions{}, func(_, _ []byte) error {
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Iterate with a canceled context error = %v", err)
+	}
+}
+
+func testIteratePending(t *testing.T, s kv.Store) {
+	update(t, s, func(txn kv.Txn) error {
+		for _, k := range []string{"a", "b", "d"} {
+			if err := txn.Set(ctx, []byte(k), []byte("old"), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	txn := s.NewTransaction(true)
+	defer txn.Discard()
+	for _, k := range []string{"b", "c", "e"} {
+		if err := txn.Set(ctx, []byte(k), []byte("new"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := txn.Delete(ctx, []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a=old", "b=new", "c=new", "e=new"}
+	if got := iterate(t, txn, &kv.IterOptions{}, 0); !slices.Equal(got, want) {
+		t.Errorf("Iterate = %q, want %q", got, want)
+	}
+	slices.Reverse(want)
+	got := iterate(t, txn, &kv.IterOptions{Reverse: true}, 0)
+	if !slices.Equal(got, want) {
+		t.Errorf("Iterate(Reverse) = %q, want %q", got, want)
+	}
+}
+
+func testWriteBatch(t *testing.T, s kv.Store) {
+	const n = 10000
+	set(t, s, "deleted", "v", nil)
+
+	wb := s.NewWriteBatch()
+	defer wb.Cancel()
+	for i := range n {
+		if err := wb.Set(fmt.Appendf(nil, "k%05d", i), make([]byte, 100), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wb.Delete([]byte("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	mustNotFound(t, s, "deleted")
+	txn := s.NewTransaction(false)
+	defer txn.Discard()
+	if got := len(iterate(t, txn, &kv.IterOptions{KeysOnly: true}, 0)); got != n {
+		t.Fatalf("got %d keys, want %d", got, n)
+	}
+}
+
+func testConcurrency(t *testing.T, s kv.Store) {
+	const (
+		workers = 8
+		rounds  = 100
+	)
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*2)
+	for w := range workers {
+		wg.Add(2)
+		key := fmt.Sprintf("counter%d", w)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				if _, err := incr(s, key, 1, nil); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				err := kv.WithTxn(s, false, func(txn kv.Txn) error {
+					return txn.Iterate(ctx, &kv.IterOptions{}, func(_, _ []byte) error {
+						return nil
+					})
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for w := range workers {
+		mustGet(t, s, fmt.Sprintf("counter%d", w), fmt.Sprint(rounds))
+	}
+}
@@ -0,0 +1,506 @@
+// Package memory implements a kv.Store keeping everything in memory, for
+// tests and throwaway instances.
+package memory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	"github.com/maolonglong/kvdb/pkg/bytesconv"
+)
+
+var (
+	ErrDiscarded = errors.New("memory: transaction has been discarded")
+	ErrEmptyKey  = errors.New("memory: empty key")
+)
+
+const _gcInterval = time.Minute
+
+var _ kv.Store = (*Store)(nil)
+
+type version struct {
+	ts        uint64
+	val       []byte
+	expiresAt uint64
+	deleted   bool
+}
+
+func (v *version) live(now int64) bool {
+	return !v.deleted && (v.expiresAt == 0 || v.expiresAt > uint64(now))
+}
+
+// Store keeps the versions of each key still visible to a transaction.
+// Transactions read from a snapshot taken when they start and, like the
+// badger store, do not detect conflicts: the last commit wins.
+type Store struct {
+	mu sync.RWMutex
+	ts uint64
+	// Sorted keys of items.
+	keys  []string
+	items map[string][]*version // Newest first.
+	// Read timestamp -> number of open transactions.
+	active map[uint64]int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func New() kv.Store {
+	s := &Store{
+		items:  make(map[string][]*version),
+		active: make(map[uint64]int),
+		done:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.gc()
+	return s
+}
+
+type txn struct {
+	s      *Store
+	readTs uint64
+	update bool
+	done   bool
+	writes map[string]*version
+}
+
+func (s *Store) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Store) NewTransaction(update bool) kv.Txn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active[s.ts]++
+	return &txn{
+		s:      s,
+		readTs: s.ts,
+		update: update,
+		writes: make(map[string]*version),
+	}
+}
+
+func (txn *txn) Discard() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+
+	s := txn.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release(txn.readTs)
+}
+
+func (txn *txn) Commit() error {
+	if txn.done {
+		return ErrDiscarded
+	}
+	txn.done = true
+
+	s := txn.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release(txn.readTs)
+	if len(txn.writes) == 0 {
+		return nil
+	}
+
+	s.ts++
+	for key, v := range txn.writes {
+		v.ts = s.ts
+		vs, ok := s.items[key]
+		if !ok {
+			i, _ := slices.BinarySearch(s.keys, key)
+			s.keys = slices.Insert(s.keys, i, key)
+		}
+		s.items[key] = append([]*version{v}, vs...)
+		s.prune(key)
+	}
+	return nil
+}
+
+func (txn *txn) Get(ctx context.Context, key []byte) ([]byte, error) {
+	v := txn.get(bytesconv.BytesToString(key))
+	if v == nil {
+		return nil, kv.ErrKeyNotFound
+	}
+	return bytes.Clone(v.val), nil
+}
+
+func (txn *txn) Has(ctx context.Context, key []byte) (bool, error) {
+	return txn.get(bytesconv.BytesToString(key)) != nil, nil
+}
+
+func (txn *txn) TTL(ctx context.Context, key []byte) (time.Duration, error) {
+	v := txn.get(bytesconv.BytesToString(key))
+	if v == nil {
+		return 0, kv.ErrKeyNotFound
+	}
+	if v.expiresAt == 0 {
+		return 0, nil
+	}
+	return max(time.Until(time.Unix(int64(v.expiresAt), 0)), time.Nanosecond), nil
+}
+
+func (txn *txn) Set(ctx context.Context, key, val []byte, opts *kv.SetOptions) error {
+	var expiresAt uint64
+	if opts != nil {
+		expiresAt = kv.Expiry(opts.TTL, opts.ExpiresAt)
+	}
+	return txn.set(key, bytes.Clone(val), expiresAt)
+}
+
+func (txn *txn) Delete(ctx context.Context, key []byte) error {
+	if err := txn.writable(key); err != nil {
+		return err
+	}
+	txn.writes[string(key)] = &version{deleted: true}
+	return nil
+}
+
+func (txn *txn) Incr(
+	ctx context.Context,
+	key []byte,
+	increment int64,
+	opts *kv.IncrOptions[int64],
+) (int64, error) {
+	var (
+		ttl time.Duration
+		num int64
+	)
+	if opts != nil {
+		ttl = opts.TTL
+		num = opts.Default
+	}
+
+	if prev := txn.get(bytesconv.BytesToString(key)); prev != nil {
+		var err error
+		num, err = strconv.ParseInt(bytesconv.BytesToString(prev.val), 10, 64)
+		if err != nil {
+			return 0, kv.ErrInvalidNum
+		}
+	}
+
+	num, err := kv.AddInt(num, increment)
+	if err != nil {
+		return 0, err
+	}
+	if num, err = opts.Bound(num); err != nil {
+		return 0, err
+	}
+	val := strconv.AppendInt(nil, num, 10)
+	if err := txn.set(key, val, kv.Expiry(ttl, time.Time{})); err != nil {
+		return 0, err
+	}
+	return num, nil
+}
+
+func (txn *txn) IncrFloat(
+	ctx context.Context,
+	key []byte,
+	increment float64,
+	opts *kv.IncrOptions[float64],
+) (float64, error) {
+	var (
+		ttl time.Duration
+		num float64
+	)
+	if opts != nil {
+		ttl = opts.TTL
+		num = opts.Default
+	}
+
+	if prev := txn.get(bytesconv.BytesToString(key)); prev != nil {
+		var err error
+		num, err = kv.ParseFloat(prev.val)
+		if err != nil {
+			return 0, kv.ErrInvalidNum
+		}
+	}
+
+	num, err := opts.Bound(num + increment)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsInf(num, 0) {
+		return 0, kv.ErrOutOfRange
+	}
+	if err := txn.set(key, []byte(kv.FormatFloat(num)), kv.Expiry(ttl, time.Time{})); err != nil {
+		return 0, err
+	}
+	return num, nil
+}
+
+// Iterate sees the writes of txn made before it is called, like badger
+// iterators.
+func (txn *txn) Iterate(
+	ctx context.Context,
+	opts *kv.IterOptions,
+	fn func(key, val []byte) error,
+) error {
+	prefix := bytesconv.BytesToString(opts.Prefix)
+
+	var pending []string
+	for k := range txn.writes {
+		if len(k) >= len(prefix) && k[:len(prefix)] == prefix {
+			pending = append(pending, k)
+		}
+	}
+	sort.Strings(pending)
+	if opts.Reverse {
+		slices.Reverse(pending)
+	}
+
+	// The first key is the smallest >= seek, or the largest <= seek in
+	// reverse. Later keys are strictly after the cursor. Without seek, a
+	// reverse iteration starts before the end of the prefix, or from the
+	// last key when the prefix has no end.
+	cursor := string(opts.Seek)
+	inclusive, unbounded := true, false
+	if opts.Seek == nil {
+		cursor = prefix
+		if opts.Reverse {
+			end := kv.PrefixEnd(opts.Prefix)
+			cursor, inclusive, unbounded = string(end), false, end == nil
+		}
+	}
+	for len(pending) > 0 && !unbounded && !after(pending[0], cursor, opts.Reverse, inclusive) {
+		pending = pending[1:]
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key, v := txn.s.next(txn.readTs, prefix, cursor, opts.Reverse, inclusive, unbounded)
+		if len(pending) > 0 && (v == nil || !after(pending[0], key, opts.Reverse, false)) {
+			if key == pending[0] {
+				// Shadowed by the pending write.
+				cursor, inclusive, unbounded = key, false, false
+				continue
+			}
+			key, v = pending[0], txn.writes[pending[0]]
+			pending = pending[1:]
+			if !v.live(time.Now().Unix()) {
+				cursor, inclusive, unbounded = key, false, false
+				continue
+			}
+		}
+		if v == nil {
+			return nil
+		}
+		cursor, inclusive, unbounded = key, false, false
+
+		var val []byte
+		if !opts.KeysOnly {
+			val = bytes.Clone(v.val)
+		}
+		if err := fn([]byte(key), val); err != nil {
+			if errors.Is(err, kv.ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// after reports whether a comes after b in the iteration order.
+func after(a, b string, reverse, orEqual bool) bool {
+	if a == b {
+		return orEqual
+	}
+	return (a > b) != reverse
+}
+
+// next returns the first live key with prefix after cursor at readTs. An
+// unbounded reverse iteration ignores cursor and starts from the last key.
+func (s *Store) next(
+	readTs uint64,
+	prefix, cursor string,
+	reverse, inclusive, unbounded bool,
+) (string, *version) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().Unix()
+	if !reverse {
+		i := sort.Search(len(s.keys), func(i int) bool {
+			return after(s.keys[i], cursor, false, inclusive)
+		})
+		for ; i < len(s.keys); i++ {
+			key := s.keys[i]
+			if len(key) < len(prefix) || key[:len(prefix)] != prefix {
+				if key > prefix {
+					return "", nil
+				}
+				continue
+			}
+			if v := s.visible(key, readTs); v != nil && v.live(now) {
+				return key, v
+			}
+		}
+		return "", nil
+	}
+
+	// Index of the first key after the cursor in forward order.
+	i := len(s.keys)
+	if !unbounded {
+		i = sort.Search(len(s.keys), func(i int) bool {
+			return after(s.keys[i], cursor, false, !inclusive)
+		})
+	}
+	for i--; i >= 0; i-- {
+		key := s.keys[i]
+		if len(key) < len(prefix) || key[:len(prefix)] != prefix {
+			if key < prefix {
+				return "", nil
+			}
+			continue
+		}
+		if v := s.visible(key, readTs); v != nil && v.live(now) {
+			return key, v
+		}
+	}
+	return "", nil
+}
+
+func (s *Store) NewWriteBatch() kv.WriteBatch {
+	return &writeBatch{txn: s.NewTransaction(true)}
+}
+
+// writeBatch is a single transaction, which is not limited in size here.
+type writeBatch struct {
+	txn kv.Txn
+}
+
+func (wb *writeBatch) Set(key, val []byte, opts *kv.SetOptions) error {
+	return wb.txn.Set(context.Background(), key, val, opts)
+}
+
+func (wb *writeBatch) Delete(key []byte) error {
+	return wb.txn.Delete(context.Background(), key)
+}
+
+func (wb *writeBatch) Flush() error {
+	return wb.txn.Commit()
+}
+
+func (wb *writeBatch) Cancel() {
+	wb.txn.Discard()
+}
+
+// get returns the live version of key seen by txn, or nil.
+func (txn *txn) get(key string) *version {
+	v, ok := txn.writes[key]
+	if !ok {
+		txn.s.mu.RLock()
+		v = txn.s.visible(key, txn.readTs)
+		txn.s.mu.RUnlock()
+	}
+	if v == nil || !v.live(time.Now().Unix()) {
+		return nil
+	}
+	return v
+}
+
+func (txn *txn) set(key, val []byte, expiresAt uint64) error {
+	if err := txn.writable(key); err != nil {
+		return err
+	}
+	v := &version{val: val, expiresAt: expiresAt}
+	txn.writes[string(key)] = v
+	return nil
+}
+
+func (txn *txn) writable(key []byte) error {
+	switch {
+	case txn.done:
+		return ErrDiscarded
+	case !txn.update:
+		return kv.ErrReadOnlyTxn
+	case len(key) == 0:
+		return ErrEmptyKey
+	}
+	return nil
+}
+
+// visible returns the version of key at readTs, s.mu must be held.
+func (s *Store) visible(key string, readTs uint64) *version {
+	for _, v := range s.items[key] {
+		if v.ts <= readTs {
+			return v
+		}
+	}
+	return nil
+}
+
+// release unregisters a transaction, s.mu must be held.
+func (s *Store) release(readTs uint64) {
+	if s.active[readTs]--; s.active[readTs] == 0 {
+		delete(s.active, readTs)
+	}
+}
+
+// prune drops the versions of key that no transaction can read anymore, and
+// the key itself once it is deleted or expired. s.mu must be held.
+func (s *Store) prune(key string) {
+	minTs := s.ts
+	for ts := range s.active {
+		minTs = min(minTs, ts)
+	}
+
+	vs := s.items[key]
+	for i, v := range vs {
+		if v.ts <= minTs {
+			vs = vs[:i+1]
+			break
+		}
+	}
+	if len(vs) == 1 && vs[0].ts <= minTs && !vs[0].live(time.Now().Unix()) {
+		delete(s.items, key)
+		if i, ok := slices.BinarySearch(s.keys, key); ok {
+			s.keys = slices.Delete(s.keys, i, i+1)
+		}
+		return
+	}
+	s.items[key] = vs
+}
+
+// gc removes expired keys, which are otherwise only pruned on writes.
+func (s *Store) gc() {
+	defer func() {
+		s.wg.Done()
+		if err := recover(); err != nil {
+			slog.Error("memory: gc goroutine panic", "err", err)
+		}
+	}()
+
+	ticker := time.NewTicker(_gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		keys := slices.Clone(s.keys)
+		for _, key := range keys {
+			s.prune(key)
+		}
+		s.mu.Unlock()
+	}
+}
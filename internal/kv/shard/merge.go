@@ -0,0 +1,100 @@
+package shard
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+type item struct {
+	key, val []byte
+}
+
+// cursor is the next item of the iteration of a shard, err is set once items
+// is closed.
+type cursor struct {
+	items chan item
+	cur   item
+	ok    bool
+	err   error
+}
+
+// merge calls fn for the keys of txns in key order, iterating each of them in
+// its own goroutine. The shards hold disjoint keys.
+func merge(
+	ctx context.Context,
+	txns []kv.Txn,
+	opts *kv.IterOptions,
+	fn func(key, val []byte) error,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	cursors := make([]*cursor, len(txns))
+	for i, t := range txns {
+		c := &cursor{items: make(chan item)}
+		cursors[i] = c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(c.items)
+			c.err = t.Iterate(ctx, opts, func(key, val []byte) error {
+				select {
+				case c.items <- item{key: key, val: val}:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+	}
+
+	next := func(c *cursor) error {
+		c.cur, c.ok = <-c.items
+		if !c.ok && c.err != nil {
+			return c.err
+		}
+		return nil
+	}
+	for _, c := range cursors {
+		if err := next(c); err != nil {
+			return err
+		}
+	}
+	for {
+		var first *cursor
+		for _, c := range cursors {
+			if !c.ok {
+				continue
+			}
+			if first == nil {
+				first = c
+				continue
+			}
+			cmp := bytes.Compare(c.cur.key, first.cur.key)
+			if opts.Reverse {
+				cmp = -cmp
+			}
+			if cmp < 0 {
+				first = c
+			}
+		}
+		if first == nil {
+			return nil
+		}
+		if err := fn(first.cur.key, first.cur.val); err != nil {
+			if errors.Is(err, kv.ErrStopIteration) {
+				return nil
+			}
+			return err
+		}
+		if err := next(first); err != nil {
+			return err
+		}
+	}
+}
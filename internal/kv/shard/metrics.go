@@ -0,0 +1,18 @@
+package shard
+
+import (
+	"strconv"
+
+	"github.com/maolonglong/kvdb/internal/metrics"
+)
+
+var _ metrics.Collector = (*Store)(nil)
+
+// Collect writes the metrics of the shards, labeled by their index.
+func (s *Store) Collect(e *metrics.Encoder) {
+	for i, shard := range s.shards {
+		if c, ok := shard.(metrics.Collector); ok {
+			c.Collect(e.With("shard", strconv.Itoa(i)))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+// Splitter is implemented by the stores that can be resharded, see Reshard.
+type Splitter interface {
+	// Split writes a backup of the store to ws, each key to ws[route(key)],
+	// to be loaded by kv.BackupStore.Load.
+	Split(ws []io.Writer, route func(key []byte) int) error
+}
+
+// Reshard copies the content of src to dst, which must be empty and not
+// used meanwhile. The shards of src must implement Splitter and those of dst
+// kv.BackupStore.
+func Reshard(src, dst *Store) error {
+	loaders := make([]kv.BackupStore, len(dst.shards))
+	for i, shard := range dst.shards {
+		bs, ok := shard.(kv.BackupStore)
+		if !ok {
+			return fmt.Errorf("%w: shard %d cannot load backups", ErrUnsupported, i)
+		}
+		loaders[i] = bs
+	}
+	for i, shard := range src.shards {
+		sp, ok := shard.(Splitter)
+		if !ok {
+			return fmt.Errorf("%w: shard %d cannot be split", ErrUnsupported, i)
+		}
+		if err := split(sp, loaders, dst.route); err != nil {
+			return fmt.Errorf("shard: shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// split streams the parts of sp to loaders through pipes.
+func split(sp Splitter, loaders []kv.BackupStore, route func(key []byte) int) error {
+	ws := make([]io.Writer, len(loaders))
+	pws := make([]*io.PipeWriter, len(loaders))
+	errs := make(chan error, len(loaders))
+	for i, bs := range loaders {
+		pr, pw := io.Pipe()
+		ws[i], pws[i] = pw, pw
+		go func() {
+			err := bs.Load(pr)
+			// Unblock the writer if the load stopped early.
+			pr.CloseWithError(err)
+			errs <- err
+		}()
+	}
+	err := sp.Split(ws, route)
+	for _, pw := range pws {
+		// A nil error closes the pipe, ending the load.
+		pw.CloseWithError(err)
+	}
+	loadErrs := make([]error, len(loaders))
+	for i := range loaders {
+		loadErrs[i] = <-errs
+	}
+	if err != nil {
+		return err
+	}
+	return errors.Join(loadErrs...)
+}
@@ -0,0 +1,423 @@
+// Package shard implements a kv.Store spreading buckets over several stores,
+// to scale writes and compactions beyond a single badger DB.
+//
+// A key is routed by the hash of its bucket name, the part before the first
+// ':', so that all the keys of a bucket live in the same shard. The writes of
+// a transaction must belong to a single shard, which keeps single bucket
+// transactions atomic. Transactions read from a snapshot of each shard, taken
+// when they first use it, there is no snapshot across shards.
+//
+// The store does not implement kv.BackupStore, the versions of the shards
+// are not comparable: sharded stores cannot be backed up or replicated, nor
+// replicate from a primary.
+package shard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+var (
+	ErrCrossShard  = errors.New("shard: transaction writes to several shards")
+	ErrNotSharded  = errors.New("shard: directory is not sharded")
+	ErrShardCount  = errors.New("shard: wrong number of shards")
+	ErrUnsupported = errors.New("shard: not supported by the shards")
+	errNoShards    = errors.New("shard: no shards")
+)
+
+const (
+	// File of a sharded directory recording the number of shards.
+	_manifestName   = "shards.json"
+	_shardDirFormat = "shard-%d"
+)
+
+var (
+	_ kv.Store          = (*Store)(nil)
+	_ kv.VersionedStore = (*Store)(nil)
+	_ kv.SyncStore      = (*Store)(nil)
+)
+
+type Store struct {
+	shards []kv.Store
+	// Sync state of each shard.
+	syncs []syncState
+}
+
+// syncState records whether a shard was written since its last sync.
+// Syncing is the number of running syncs, which cleared dirty.
+type syncState struct {
+	mu      sync.Mutex
+	dirty   bool
+	syncing int
+}
+
+// New routes the keys to shards, which the store owns. The order of shards
+// must not change once written.
+func New(shards []kv.Store) (*Store, error) {
+	if len(shards) == 0 {
+		return nil, errNoShards
+	}
+	return &Store{
+		shards: shards,
+		syncs:  make([]syncState, len(shards)),
+	}, nil
+}
+
+type manifest struct {
+	Shards int `json:"shards"`
+}
+
+// Open opens the shards in dir with open, one subdirectory each. n is the
+// number of shards, an empty dir is created with n of them; 0 opens the ones
+// dir has. ErrNotSharded is returned for a non-empty dir without shards, and
+// for an empty one if n is 0.
+func Open(dir string, n int, open func(dir string) (kv.Store, error)) (*Store, error) {
+	path := filepath.Join(dir, _manifestName)
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var m manifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("shard: %s: %w", path, err)
+		}
+		if n != 0 && n != m.Shards {
+			return nil, fmt.Errorf("%w: %s has %d, not %d", ErrShardCount, dir, m.Shards, n)
+		}
+		n = m.Shards
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	default:
+		entries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if n == 0 || len(entries) > 0 {
+			return nil, fmt.Errorf("%w: %s", ErrNotSharded, dir)
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		b, _ := json.Marshal(&manifest{Shards: n})
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			return nil, err
+		}
+	}
+
+	shards := make([]kv.Store, 0, n)
+	for i := range n {
+		s, err := open(filepath.Join(dir, fmt.Sprintf(_shardDirFormat, i)))
+		if err != nil {
+			for _, s := range shards {
+				s.Close()
+			}
+			return nil, fmt.Errorf("shard: shard %d: %w", i, err)
+		}
+		shards = append(shards, s)
+	}
+	return New(shards)
+}
+
+// Route returns the shard of key among n.
+func Route(key []byte, n int) int {
+	if i := bytes.IndexByte(key, ':'); i >= 0 {
+		key = key[:i]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+func (s *Store) route(key []byte) int {
+	return Route(key, len(s.shards))
+}
+
+// Shards returns the stores holding the shards.
+func (s *Store) Shards() []kv.Store {
+	return s.shards
+}
+
+func (s *Store) Close() error {
+	errs := make([]error, len(s.shards))
+	for i, shard := range s.shards {
+		errs[i] = shard.Close()
+	}
+	return errors.Join(errs...)
+}
+
+// NewTransaction starts a transaction on a shard when it is first used. With
+// a single shard, it is started right away, like those of the shard.
+func (s *Store) NewTransaction(update bool) kv.Txn {
+	txn := &txn{
+		s:       s,
+		update:  update,
+		txns:    make([]kv.Txn, len(s.shards)),
+		written: -1,
+	}
+	if len(s.shards) == 1 {
+		txn.get(0)
+	}
+	return txn
+}
+
+func (s *Store) Versions(ctx context.Context, key []byte, fn func(v *kv.Version) error) error {
+	vs, ok := s.shards[s.route(key)].(kv.VersionedStore)
+	if !ok {
+		return ErrUnsupported
+	}
+	return vs.Versions(ctx, key, fn)
+}
+
+func (s *Store) DiscardVersionsBefore(ctx context.Context, key []byte, ts uint64) error {
+	vs, ok := s.shards[s.route(key)].(kv.VersionedStore)
+	if !ok {
+		return ErrUnsupported
+	}
+	i := s.route(key)
+	s.written(i)
+	return vs.DiscardVersionsBefore(ctx, key, ts)
+}
+
+// written marks shard i as written, Sync syncs it.
+func (s *Store) written(i int) {
+	st := &s.syncs[i]
+	st.mu.Lock()
+	st.dirty = true
+	st.mu.Unlock()
+}
+
+// Sync syncs the shards written since their last sync concurrently. A shard
+// being synced is synced again: the running sync may have missed the
+// commits that returned before Sync was called.
+func (s *Store) Sync() error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.shards))
+	for i, shard := range s.shards {
+		ss, ok := shard.(kv.SyncStore)
+		if !ok {
+			continue
+		}
+		st := &s.syncs[i]
+		st.mu.Lock()
+		if !st.dirty && st.syncing == 0 {
+			st.mu.Unlock()
+			continue
+		}
+		st.dirty = false
+		st.syncing++
+		st.mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = ss.Sync()
+			st.mu.Lock()
+			st.syncing--
+			if errs[i] != nil {
+				// The commits may not be durable.
+				st.dirty = true
+			}
+			st.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// txn holds a transaction per shard, started on first use, written is the
+// shard of its writes.
+type txn struct {
+	s         *Store
+	update    bool
+	txns      []kv.Txn
+	written   int
+	discarded bool
+}
+
+func (txn *txn) get(i int) kv.Txn {
+	if txn.txns[i] == nil {
+		txn.txns[i] = txn.s.shards[i].NewTransaction(txn.update)
+		if txn.discarded {
+			// Let the transaction of the shard report it.
+			txn.txns[i].Discard()
+		}
+	}
+	return txn.txns[i]
+}
+
+func (txn *txn) shard(key []byte) kv.Txn {
+	return txn.get(txn.s.route(key))
+}
+
+// write returns the transaction of the shard of key, the first write picks
+// the shard of the transaction.
+func (txn *txn) write(key []byte) (kv.Txn, error) {
+	i := txn.s.route(key)
+	if txn.update {
+		if txn.written == -1 {
+			txn.written = i
+		} else if txn.written != i {
+			return nil, ErrCrossShard
+		}
+	}
+	return txn.get(i), nil
+}
+
+func (txn *txn) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return txn.shard(key).Get(ctx, key)
+}
+
+func (txn *txn) Has(ctx context.Context, key []byte) (bool, error) {
+	return txn.shard(key).Has(ctx, key)
+}
+
+func (txn *txn) TTL(ctx context.Context, key []byte) (time.Duration, error) {
+	return txn.shard(key).TTL(ctx, key)
+}
+
+func (txn *txn) Set(ctx context.Context, key, val []byte, opts *kv.SetOptions) error {
+	t, err := txn.write(key)
+	if err != nil {
+		return err
+	}
+	return t.Set(ctx, key, val, opts)
+}
+
+func (txn *txn) Delete(ctx context.Context, key []byte) error {
+	t, err := txn.write(key)
+	if err != nil {
+		return err
+	}
+	return t.Delete(ctx, key)
+}
+
+func (txn *txn) Incr(
+	ctx context.Context,
+	key []byte,
+	increment int64,
+	opts *kv.IncrOptions[int64],
+) (int64, error) {
+	t, err := txn.write(key)
+	if err != nil {
+		return 0, err
+	}
+	return t.Incr(ctx, key, increment, opts)
+}
+
+func (txn *txn) IncrFloat(
+	ctx context.Context,
+	key []byte,
+	increment float64,
+	opts *kv.IncrOptions[float64],
+) (float64, error) {
+	t, err := txn.write(key)
+	if err != nil {
+		return 0, err
+	}
+	return t.IncrFloat(ctx, key, increment, opts)
+}
+
+// Iterate visits a single shard when the prefix holds a bucket name, and
+// merges the iterations of all shards otherwise. fn must then not use the
+// transaction, the shards are iterated concurrently.
+func (txn *txn) Iterate(
+	ctx context.Context,
+	opts *kv.IterOptions,
+	fn func(key, val []byte) error,
+) error {
+	if bytes.IndexByte(opts.Prefix, ':') >= 0 {
+		return txn.shard(opts.Prefix).Iterate(ctx, opts, fn)
+	}
+	for i := range txn.txns {
+		txn.get(i)
+	}
+	return merge(ctx, txn.txns, opts, fn)
+}
+
+func (txn *txn) Commit() error {
+	committed := txn.written
+	if committed == -1 {
+		// Committing a transaction without writes still reports whether
+		// it was discarded.
+		committed = 0
+	}
+	var err error
+	for i := range txn.txns {
+		if i != committed {
+			if t := txn.txns[i]; t != nil {
+				t.Discard()
+			}
+			continue
+		}
+		if txn.written != -1 {
+			txn.s.written(i)
+		}
+		err = txn.get(i).Commit()
+	}
+	return err
+}
+
+func (txn *txn) Discard() {
+	txn.discarded = true
+	for _, t := range txn.txns {
+		if t != nil {
+			t.Discard()
+		}
+	}
+}
+
+// writeBatch holds a write batch per shard, created on first use.
+type writeBatch struct {
+	s   *Store
+	wbs []kv.WriteBatch
+}
+
+func (s *Store) NewWriteBatch() kv.WriteBatch {
+	return &writeBatch{
+		s:   s,
+		wbs: make([]kv.WriteBatch, len(s.shards)),
+	}
+}
+
+func (wb *writeBatch) shard(key []byte) kv.WriteBatch {
+	i := wb.s.route(key)
+	if wb.wbs[i] == nil {
+		wb.wbs[i] = wb.s.shards[i].NewWriteBatch()
+	}
+	return wb.wbs[i]
+}
+
+func (wb *writeBatch) Set(key, val []byte, opts *kv.SetOptions) error {
+	return wb.shard(key).Set(key, val, opts)
+}
+
+func (wb *writeBatch) Delete(key []byte) error {
+	return wb.shard(key).Delete(key)
+}
+
+func (wb *writeBatch) Flush() error {
+	var errs []error
+	for i, b := range wb.wbs {
+		if b != nil {
+			wb.s.written(i)
+			errs = append(errs, b.Flush())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (wb *writeBatch) Cancel() {
+	for _, b := range wb.wbs {
+		if b != nil {
+			b.Cancel()
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package shard_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+	"github.com/maolonglong/kvdb/internal/kv/kvtest"
+	"github.com/maolonglong/kvdb/internal/kv/memory"
+	"github.com/maolonglong/kvdb/internal/kv/shard"
+)
+
+var ctx = context.Background()
+
+// The conformance tests write keys of several buckets in a transaction, a
+// single shard accepts them.
+func TestStore(t *testing.T) {
+	kvtest.Run(t, func(t *testing.T) kv.Store {
+		s, err := shard.New([]kv.Store{memory.New()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func keys(t *testing.T, s kv.Store, opts *kv.IterOptions) []string {
+	t.Helper()
+	var got []string
+	err := kv.WithTxn(s, false, func(txn kv.Txn) error {
+		return txn.Iterate(ctx, opts, func(k, _ []byte) error {
+			got = append(got, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestRouting(t *testing.T) {
+	stores := []kv.Store{memory.New(), memory.New(), memory.New(), memory.New()}
+	s, err := shard.New(stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var want []string
+	for b := range 16 {
+		err := kv.WithTxn(s, true, func(txn kv.Txn) error {
+			for k := range 3 {
+				key := fmt.Sprintf("bucket%02d:%d", b, k)
+				want = append(want, key)
+				if err := txn.Set(ctx, []byte(key), nil, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The keys of a bucket are in its shard only.
+	for _, key := range want {
+		i := shard.Route([]byte(key), len(stores))
+		for j, store := range stores {
+			got := keys(t, store, &kv.IterOptions{Prefix: []byte(key)})
+			if (i == j) != (len(got) == 1) {
+				t.Errorf("shard %d has %q: %v, want it in shard %d", j, key, got, i)
+			}
+		}
+	}
+
+	if got := keys(t, s, &kv.IterOptions{}); !slices.Equal(got, want) {
+		t.Errorf("Iterate = %q, want %q", got, want)
+	}
+	if got := keys(t, s, &kv.IterOptions{Seek: []byte("bucket08;")}); !slices.Equal(
+		got,
+		want[27:],
+	) {
+		t.Errorf("Iterate(Seek) = %q, want %q", got, want[27:])
+	}
+	slices.Reverse(want)
+	if got := keys(t, s, &kv.IterOptions{Reverse: true}); !slices.Equal(got, want) {
+		t.Errorf("Iterate(Reverse) = %q, want %q", got, want)
+	}
+
+	// bucket00 and bucket01 are in different shards.
+	if shard.Route([]byte("bucket00"), 4) == shard.Route([]byte("bucket01"), 4) {
+		t.Fatal("bucket00 and bucket01 are in the same shard")
+	}
+	err = kv.WithTxn(s, true, func(txn kv.Txn) error {
+		if err := txn.Set(ctx, []byte("bucket00:k"), nil, nil); err != nil {
+			return err
+		}
+		return txn.Set(ctx, []byte("bucket01:k"), nil, nil)
+	})
+	if !errors.Is(err, shard.ErrCrossShard) {
+		t.Fatalf("write to two shards error = %v, want %v", err, shard.ErrCrossShard)
+	}
+}
+
+func TestMergedIteration(t *testing.T) {
+	stores := []kv.Store{memory.New(), memory.New(), memory.New(), memory.New()}
+	s, err := shard.New(stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	model := map[string]string{}
+	for b := range 8 {
+		err := kv.WithTxn(s, true, func(txn kv.Txn) error {
+			for k := range 3 {
+				key := fmt.Sprintf("bucket%d:%d", b, k)
+				model[key] = "old"
+				if err := txn.Set(ctx, []byte(key), []byte("old"), nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The pending writes of a shard are merged with the others.
+	txn := s.NewTransaction(true)
+	defer txn.Discard()
+	for _, key := range []string{"bucket3:1", "bucket3:5"} {
+		model[key] = "new"
+		if err := txn.Set(ctx, []byte(key), []byte("new"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delete(model, "bucket3:0")
+	if err := txn.Delete(ctx, []byte("bucket3:0")); err != nil {
+		t.Fatal(err)
+	}
+
+	sorted := make([]string, 0, len(model))
+	for k := range model {
+		sorted = append(sorted, k)
+	}
+	slices.Sort(sorted)
+	between := func(from, to string, reverse bool) []string {
+		var want []string
+		for _, k := range sorted {
+			if k >= from && k < to {
+				want = append(want, k+"="+model[k])
+			}
+		}
+		if reverse {
+			slices.Reverse(want)
+		}
+		return want
+	}
+	tests := []struct {
+		opts  *kv.IterOptions
+		limit int
+		want  []string
+	}{
+		{opts: &kv.IterOptions{}, want: between("", "~", false)},
+		{opts: &kv.IterOptions{Reverse: true}, want: between("", "~", true)},
+		{
+			opts: &kv.IterOptions{Seek: []byte("bucket3:1")},
+			want: between("bucket3:1", "~", false),
+		},
+		{
+			opts: &kv.IterOptions{Seek: []byte("bucket3:1"), Reverse: true},
+			want: between("", "bucket3:1\x00", true),
+		},
+		{
+			opts: &kv.IterOptions{
+				Prefix:  []byte("bucket"),
+				Seek:    []byte("bucket5"),
+				Reverse: true,
+			},
+			want: between("bucket", "bucket5", true),
+		},
+		{
+			opts:  &kv.IterOptions{Seek: []byte("bucket2;"), Reverse: true},
+			limit: 4,
+			want:  between("", "bucket2;", true)[:4],
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		err := txn.Iterate(ctx, tt.opts, func(k, v []byte) error {
+			got = append(got, string(k)+"="+string(v))
+			if len(got) == tt.limit {
+				return kv.ErrStopIteration
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Iterate(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
+// countingStore counts the transactions started and the syncs.
+type countingStore struct {
+	kv.Store
+	txns, syncs int
+}
+
+func (s *countingStore) NewTransaction(update bool) kv.Txn {
+	s.txns++
+	return s.Store.NewTransaction(update)
+}
+
+func (s *countingStore) Sync() error {
+	s.syncs++
+	return nil
+}
+
+func TestSyncWrittenShards(t *testing.T) {
+	stores := make([]*countingStore, 4)
+	shards := make([]kv.Store, len(stores))
+	for i := range stores {
+		stores[i] = &countingStore{Store: memory.New()}
+		shards[i] = stores[i]
+	}
+	s, err := shard.New(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	key := []byte("bucket00:k")
+	written := shard.Route(key, len(stores))
+	err = kv.WithTxn(s, true, func(txn kv.Txn) error {
+		return txn.Set(ctx, key, nil, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing was written since.
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for i, store := range stores {
+		want := 0
+		if i == written {
+			want = 1
+		}
+		if store.txns != want || store.syncs != want {
+			t.Errorf("shard %d: %d transactions and %d syncs, want %d",
+				i, store.txns, store.syncs, want)
+		}
+	}
+
+	// Iterating all the shards starts their transactions.
+	if got := keys(t, s, &kv.IterOptions{}); !slices.Equal(got, []string{string(key)}) {
+		t.Fatalf("Iterate = %q", got)
+	}
+	for i, store := range stores {
+		if store.txns == 0 {
+			t.Errorf("shard %d was not iterated", i)
+		}
+	}
+}
+
+func TestReshard(t *testing.T) {
+	open := func(dir string) (kv.Store, error) {
+		return badgerstore.New(badgerstore.DefaultOptions(dir))
+	}
+	src, err := shard.Open(t.TempDir(), 2, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	for b := range 8 {
+		err := kv.WithTxn(src, true, func(txn kv.Txn) error {
+			key := []byte(fmt.Sprintf("bucket%d:k", b))
+			if err := txn.Set(ctx, key, []byte("v1"), nil); err != nil {
+				return err
+			}
+			return txn.Set(ctx, []byte(fmt.Sprintf("bucket%d:ttl", b)), nil, &kv.SetOptions{
+				TTL: time.Hour,
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = kv.WithTxn(src, true, func(txn kv.Txn) error {
+			key := []byte(fmt.Sprintf("bucket%d:k", b))
+			return txn.Set(ctx, key, []byte("v2"), &kv.SetOptions{KeepVersions: true})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	dst, err := shard.Open(dir, 3, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shard.Reshard(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shard.Open(dir, 2, open); !errors.Is(err, shard.ErrShardCount) {
+		t.Fatalf("Open with 2 shards error = %v, want %v", err, shard.ErrShardCount)
+	}
+	if dst, err = shard.Open(dir, 0, open); err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	got, want := keys(t, dst, &kv.IterOptions{}), keys(t, src, &kv.IterOptions{})
+	if !slices.Equal(got, want) {
+		t.Fatalf("resharded keys = %q, want %q", got, want)
+	}
+	for b := range 8 {
+		key := []byte(fmt.Sprintf("bucket%d:k", b))
+		var vals []string
+		err := dst.Versions(ctx, key, func(v *kv.Version) error {
+			vals = append(vals, string(v.Value))
+			return nil
+		})
+		if err != nil || !slices.Equal(vals, []string{"v2", "v1"}) {
+			t.Errorf("versions of %s = %q, %v, want [v2 v1]", key, vals, err)
+		}
+		err = kv.WithTxn(dst, false, func(txn kv.Txn) error {
+			ttl, err := txn.TTL(ctx, []byte(fmt.Sprintf("bucket%d:ttl", b)))
+			if err == nil && (ttl <= 0 || ttl > time.Hour) {
+				err = fmt.Errorf("TTL = %v", ttl)
+			}
+			return err
+		})
+		if err != nil {
+			t.Errorf("bucket%d: %v", b, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Package metrics writes metrics in the Prometheus text exposition format.
+//
+// Counters and histograms updated by the code are registered when created,
+// like expvar variables. Values computed when scraped are written by
+// collectors, either registered or passed to Write.
+package metrics
+
+import (
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the upper bounds of histograms of durations in seconds.
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Collector writes its metrics to e when scraped.
+type Collector interface {
+	Collect(e *Encoder)
+}
+
+type CollectorFunc func(e *Encoder)
+
+func (fn CollectorFunc) Collect(e *Encoder) {
+	fn(e)
+}
+
+var _registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// Register adds c to the collectors written by Write.
+func Register(c Collector) {
+	_registry.mu.Lock()
+	defer _registry.mu.Unlock()
+	_registry.collectors = append(_registry.collectors, c)
+}
+
+// Write writes the registered metrics and those of cs to w.
+func Write(w io.Writer, cs ...Collector) error {
+	e := NewEncoder()
+	_registry.mu.Lock()
+	registered := _registry.collectors
+	_registry.mu.Unlock()
+	for _, c := range registered {
+		c.Collect(e)
+	}
+	for _, c := range cs {
+		c.Collect(e)
+	}
+	_, err := e.WriteTo(w)
+	return err
+}
+
+// Encoder groups the samples of metrics by name, so that collectors may
+// write to the same metric.
+type Encoder struct {
+	families map[string]*family
+	// Name and value pairs added to every sample.
+	labels []string
+}
+
+type family struct {
+	typ, help string
+	lines     []string
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{families: make(map[string]*family)}
+}
+
+// With returns an encoder adding labels, name and value pairs, to the
+// samples written to e.
+func (e *Encoder) With(labels ...string) *Encoder {
+	return &Encoder{
+		families: e.families,
+		labels:   append(e.labels[:len(e.labels):len(e.labels)], labels...),
+	}
+}
+
+// Counter writes a sample of a counter, labels are name and value pairs.
+func (e *Encoder) Counter(name, help string, v float64, labels ...string) {
+	e.sample(name, "counter", help, "", v, labels)
+}
+
+// Gauge writes a sample of a gauge, labels are name and value pairs.
+func (e *Encoder) Gauge(name, help string, v float64, labels ...string) {
+	e.sample(name, "gauge", help, "", v, labels)
+}
+
+// histogram writes a histogram, counts holds the number of observations
+// of each bucket followed by the larger ones.
+func (e *Encoder) histogram(
+	name, help string,
+	buckets []float64,
+	counts []uint64,
+	sum float64,
+	labels []string,
+) {
+	var n uint64
+	for i, c := range counts {
+		n += c
+		le := math.Inf(1)
+		if i < len(buckets) {
+			le = buckets[i]
+		}
+		e.sample(name, "histogram", help, "_bucket", float64(n),
+			append(labels[:len(labels):len(labels)], "le", formatFloat(le)))
+	}
+	e.sample(name, "histogram", help, "_sum", sum, labels)
+	e.sample(name, "histogram", help, "_count", float64(n), labels)
+}
+
+func (e *Encoder) sample(name, typ, help, suffix string, v float64, labels []string) {
+	f, ok := e.families[name]
+	if !ok {
+		f = &family{typ: typ, help: help}
+		e.families[name] = f
+	}
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteString(suffix)
+	writeLabels(&sb, e.labels, labels)
+	sb.WriteByte(' ')
+	sb.WriteString(formatFloat(v))
+	sb.WriteByte('\n')
+	f.lines = append(f.lines, sb.String())
+}
+
+// WriteTo writes the metrics sorted by name.
+func (e *Encoder) WriteTo(w io.Writer) (int64, error) {
+	names := make([]string, 0, len(e.families))
+	for name := range e.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		f := e.families[name]
+		sb.WriteString("# HELP " + name + " " + escape(f.help, false) + "\n")
+		sb.WriteString("# TYPE " + name + " " + f.typ + "\n")
+		for _, line := range f.lines {
+			sb.WriteString(line)
+		}
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func writeLabels(sb *strings.Builder, pairs ...[]string) {
+	first := true
+	for _, labels := range pairs {
+		for i := 0; i+1 < len(labels); i += 2 {
+			if first {
+				sb.WriteByte('{')
+				first = false
+			} else {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(labels[i])
+			sb.WriteString(`="`)
+			sb.WriteString(escape(labels[i+1], true))
+			sb.WriteByte('"')
+		}
+	}
+	if !first {
+		sb.WriteByte('}')
+	}
+}
+
+var (
+	_helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	_labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escape(s string, label bool) string {
+	if label {
+		return _labelEscaper.Replace(s)
+	}
+	return _helpEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Cache writes the hits and misses of the cache named cache, and its hit
+// ratio.
+func Cache(e *Encoder, cache string, hits, misses uint64) {
+	e.Counter("kvdb_cache_hits_total", "Cache hits.", float64(hits), "cache", cache)
+	e.Counter("kvdb_cache_misses_total", "Cache misses.", float64(misses), "cache", cache)
+	var ratio float64
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	e.Gauge("kvdb_cache_hit_ratio", "Ratio of cache lookups that hit.", ratio, "cache", cache)
+}
@@ -0,0 +1,62 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maolonglong/kvdb/internal/metrics"
+)
+
+func TestEncoder(t *testing.T) {
+	e := metrics.NewEncoder()
+	e.Gauge("b_size", "Size.", 3)
+	e.With("shard", "1").Gauge("b_size", "Size.", 4, "name", "a\"b\\c\nd")
+	e.Counter("a_total", "Total\nruns.", 1.5)
+
+	var sb strings.Builder
+	if _, err := e.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP a_total Total\nruns.
+# TYPE a_total counter
+a_total 1.5
+# HELP b_size Size.
+# TYPE b_size gauge
+b_size 3
+b_size{shard="1",name="a\"b\\c\nd"} 4
+`
+	if got := sb.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestVecs(t *testing.T) {
+	c := metrics.NewCounterVec("test_requests_total", "Requests.", "route", "status")
+	c.Inc("/b", "200")
+	c.Inc("/a", "404")
+	c.Add(2, "/b", "200")
+
+	h := metrics.NewHistogramVec("test_duration_seconds", "Duration.", []float64{.1, 1}, "route")
+	h.Observe(.1, "/a")
+	h.Observe(.5, "/a")
+	h.Observe(2, "/a")
+
+	var sb strings.Builder
+	if err := metrics.Write(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`test_requests_total{route="/a",status="404"} 1`,
+		`test_requests_total{route="/b",status="200"} 3`,
+		`test_duration_seconds_bucket{route="/a",le="0.1"} 1`,
+		`test_duration_seconds_bucket{route="/a",le="1"} 2`,
+		`test_duration_seconds_bucket{route="/a",le="+Inf"} 3`,
+		`test_duration_seconds_sum{route="/a"} 2.6`,
+		`test_duration_seconds_count{route="/a"} 3`,
+		`# TYPE test_duration_seconds histogram`,
+	} {
+		if !strings.Contains(sb.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, sb.String())
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// vec holds the values of a metric by label values.
+type vec[T any] struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*labeled[T]
+}
+
+type labeled[T any] struct {
+	labels []string // Name and value pairs.
+	v      T
+}
+
+func newVec[T any](name, help string, labels []string) *vec[T] {
+	return &vec[T]{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*labeled[T]),
+	}
+}
+
+// with calls fn with the value of the label values, under the lock of v.
+func (v *vec[T]) with(values []string, fn func(t *T)) {
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	l, ok := v.values[key]
+	if !ok {
+		l = &labeled[T]{labels: make([]string, 0, 2*len(v.labels))}
+		for i, name := range v.labels {
+			var value string
+			if i < len(values) {
+				value = values[i]
+			}
+			l.labels = append(l.labels, name, value)
+		}
+		v.values[key] = l
+	}
+	fn(&l.v)
+}
+
+// each calls fn for the values sorted by label values, under the lock of v.
+func (v *vec[T]) each(fn func(labels []string, t *T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		l := v.values[key]
+		fn(l.labels, &l.v)
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	v *vec[float64]
+}
+
+// NewCounterVec registers a counter with the label names labels.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{v: newVec[float64](name, help, labels)}
+	Register(c)
+	return c
+}
+
+// Add adds delta to the counter of the label values, in the order of the
+// label names.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	c.v.with(values, func(n *float64) {
+		*n += delta
+	})
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Collect(e *Encoder) {
+	c.v.each(func(labels []string, n *float64) {
+		e.Counter(c.v.name, c.v.help, *n, labels...)
+	})
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	v       *vec[histogram]
+	buckets []float64
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a histogram with the label names labels,
+// buckets are the sorted upper bounds of its buckets.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		v:       newVec[histogram](name, help, labels),
+		buckets: buckets,
+	}
+	Register(h)
+	return h
+}
+
+// Observe adds x to the histogram of the label values, in the order of the
+// label names.
+func (h *HistogramVec) Observe(x float64, values ...string) {
+	i := sort.SearchFloat64s(h.buckets, x)
+	h.v.with(values, func(hist *histogram) {
+		if hist.counts == nil {
+			hist.counts = make([]uint64, len(h.buckets)+1)
+		}
+		hist.counts[i]++
+		hist.sum += x
+	})
+}
+
+func (h *HistogramVec) Collect(e *Encoder) {
+	h.v.each(func(labels []string, hist *histogram) {
+		e.histogram(h.v.name, h.v.help, h.buckets, hist.counts, hist.sum, labels)
+	})
+}
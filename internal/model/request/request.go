@@ -1,5 +1,7 @@
 package request
 
+import "encoding/json"
+
 type ExecuteTransactionRequest struct {
 	Txn []*Txn `json:"txn"`
 }
@@ -10,4 +12,21 @@ type Txn struct {
 	TTL   *int    `json:"ttl"`
 
 	Delete *string `json:"delete"`
+
+	Incr      *string      `json:"incr"`
+	Increment *json.Number `json:"increment"`
+	Float     bool         `json:"float"`
+	Default   *json.Number `json:"default"`
+	Min       *json.Number `json:"min"`
+	Max       *json.Number `json:"max"`
+	Clamp     bool         `json:"clamp"`
+
+	HSet    *string `json:"hset"`
+	HDelete *string `json:"hdel"`
+	HIncrBy *string `json:"hincrby"`
+	Field   *string `json:"field"`
+
+	SAdd   *string `json:"sadd"`
+	SRem   *string `json:"srem"`
+	Member *string `json:"member"`
 }
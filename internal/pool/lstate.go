@@ -2,11 +2,32 @@ package pool
 
 import (
 	"sync"
+	"time"
 
 	luajson "github.com/alicebob/gopher-json"
 	lua "github.com/yuin/gopher-lua"
+
+	"github.com/maolonglong/kvdb/internal/metrics"
+)
+
+var _lstateWait = metrics.NewHistogramVec(
+	"kvdb_lstate_pool_wait_seconds",
+	"Time waited for a Lua state of the pool.",
+	metrics.DefBuckets,
 )
 
+func init() {
+	metrics.Register(metrics.CollectorFunc(func(e *metrics.Encoder) {
+		pl := defaultLStatePool
+		e.Gauge("kvdb_lstate_pool_in_use", "Lua states in use.", float64(len(pl.limit)))
+		pl.m.Lock()
+		idle := len(pl.pool)
+		pl.m.Unlock()
+		e.Gauge("kvdb_lstate_pool_idle", "Lua states created and not in use.", float64(idle))
+		e.Gauge("kvdb_lstate_pool_size", "Maximum number of Lua states.", float64(cap(pl.limit)))
+	}))
+}
+
 var defaultLStatePool = newLStatePool(50, func() *lua.LState {
 	lstate := lua.NewState(lua.Options{
 		CallStackSize:       10,
@@ -62,7 +83,9 @@ func newLStatePool(size int, factory func() *lua.LState) *lstatePool {
 }
 
 func (pl *lstatePool) Get() *lua.LState {
+	start := time.Now()
 	pl.limit <- struct{}{}
+	_lstateWait.Observe(time.Since(start).Seconds())
 	pl.m.Lock()
 	defer pl.m.Unlock()
 	n := len(pl.pool)
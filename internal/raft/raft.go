@@ -0,0 +1,861 @@
+// Package raft implements the Raft consensus algorithm, replicating a log of
+// entries applied in the same order by the state machine of every member.
+//
+// Besides leader election and log replication, it supports log compaction
+// with snapshots of the state machine, linearizable reads with ReadIndex, and
+// membership changes of one member at a time.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader        = errors.New("raft: not the leader")
+	ErrLeadershipLost   = errors.New("raft: leadership lost, the entry may or may not be applied")
+	ErrStopped          = errors.New("raft: node stopped")
+	ErrConfigPending    = errors.New("raft: a membership change is in progress")
+	ErrMemberExists     = errors.New("raft: member already exists")
+	ErrMemberNotFound   = errors.New("raft: member not found")
+	ErrAlreadyBootstrap = errors.New("raft: node already has a log")
+)
+
+type EntryType uint8
+
+const (
+	_ EntryType = iota
+	EntryNormal
+	// Appended by a new leader, to commit the entries of previous terms.
+	EntryNoop
+	// Holds the JSON encoded members from then on.
+	EntryConfig
+)
+
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+type Member struct {
+	ID string `json:"id"`
+
+	// URL of the peer RPCs, see Transport.
+	PeerURL string `json:"peer_url"`
+
+	// URL that clients are redirected to when it leads.
+	ClientURL string `json:"client_url"`
+}
+
+// StateMachine applies the committed entries. It must record the index of
+// the last entry applied along with its effects, as Applied reports it after
+// a restart.
+type StateMachine interface {
+	Applied() (uint64, error)
+
+	// Apply is called for every committed entry in order, Data is only set
+	// for EntryNormal.
+	Apply(e *Entry) error
+
+	// Snapshot returns a consistent snapshot of the state.
+	Snapshot() (Snapshot, error)
+
+	// Restore replaces the state with a snapshot taken at index.
+	Restore(r io.Reader, index uint64) error
+
+	// Sync makes the applied entries durable, it is called before the log
+	// is compacted.
+	Sync() error
+}
+
+type Snapshot interface {
+	// Index of the last entry applied to the snapshot.
+	Index() uint64
+	WriteTo(w io.Writer) (int64, error)
+	Close()
+}
+
+type Options struct {
+	// Leaders send heartbeats at this interval, followers start an election
+	// after a random timeout between ElectionTimeout and twice it.
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+
+	// Maximum number of entries per AppendEntries RPC.
+	MaxAppendEntries int
+
+	// Once the log holds more than SnapshotThreshold applied entries on
+	// top of the last TrailingLogs, which are kept for lagging followers,
+	// it is compacted.
+	SnapshotThreshold uint64
+	TrailingLogs      uint64
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		HeartbeatInterval: 100 * time.Millisecond,
+		ElectionTimeout:   time.Second,
+		MaxAppendEntries:  256,
+		SnapshotThreshold: 8192,
+		TrailingLogs:      1024,
+	}
+}
+
+type Role string
+
+const (
+	RoleFollower  Role = "follower"
+	RoleCandidate Role = "candidate"
+	RoleLeader    Role = "leader"
+)
+
+type Status struct {
+	ID        string   `json:"id"`
+	Role      Role     `json:"role"`
+	Term      uint64   `json:"term"`
+	Leader    string   `json:"leader,omitempty"`
+	Members   []Member `json:"members"`
+	LastIndex uint64   `json:"last_index"`
+	Commit    uint64   `json:"commit"`
+	Applied   uint64   `json:"applied"`
+	// Last entry removed from the log.
+	Compacted uint64 `json:"compacted"`
+}
+
+// Node is a member of a cluster, or a node waiting to be added to one.
+type Node struct {
+	id        string
+	opts      *Options
+	sm        StateMachine
+	storage   Storage
+	transport Transport
+
+	mu   sync.Mutex
+	role Role
+	hs   HardState
+	// Last compacted entry and the ones following it.
+	meta    SnapshotMeta
+	log     []*Entry
+	persist uint64 // Last entry persisted, the leader persists asynchronously.
+
+	// Members from the last config entry of the log, committed or not.
+	members     []Member
+	configIndex uint64
+
+	leader      string
+	lastContact time.Time
+	electionAt  time.Time
+
+	commit  uint64
+	applied uint64
+	// Closed and replaced whenever commit, applied or the role change, or
+	// peers acknowledge a heartbeat round.
+	changed chan struct{}
+
+	// Leader state.
+	peers map[string]*peer
+	round uint64
+	// Entry index -> proposal waiting for it to be applied.
+	waiters map[uint64]*waiter
+
+	applyMu  sync.Mutex
+	applyC   chan struct{}
+	persistC chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+// New starts a node from the state in storage. Call Bootstrap on a single
+// node to create a cluster, the other nodes are added with AddMember.
+func New(
+	id string,
+	sm StateMachine,
+	storage Storage,
+	transport Transport,
+	opts *Options,
+) (*Node, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	hs, meta, entries, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := sm.Applied()
+	if err != nil {
+		return nil, err
+	}
+	if applied < meta.Index {
+		return nil, fmt.Errorf(
+			"raft: state machine applied %d but the log is compacted up to %d",
+			applied, meta.Index,
+		)
+	}
+	n := &Node{
+		id:        id,
+		opts:      opts,
+		sm:        sm,
+		storage:   storage,
+		transport: transport,
+		role:      RoleFollower,
+		hs:        *hs,
+		meta:      *meta,
+		log:       entries,
+		commit:    applied,
+		applied:   applied,
+		changed:   make(chan struct{}),
+		waiters:   make(map[uint64]*waiter),
+		applyC:    make(chan struct{}, 1),
+		persistC:  make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	n.persist = n.lastIndex()
+	if applied > n.persist {
+		return nil, fmt.Errorf("raft: state machine applied %d beyond the log", applied)
+	}
+	n.reloadConfig()
+	n.resetElectionTimer()
+
+	n.wg.Add(3)
+	go n.tick()
+	go n.applyLoop()
+	go n.persistLoop()
+	return n, nil
+}
+
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Bootstrap creates a cluster of members, n must be one of them. It fails
+// with ErrAlreadyBootstrap if n has a log.
+func (n *Node) Bootstrap(members []Member) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.lastIndex() > 0 || n.hs.Term > 0 {
+		return ErrAlreadyBootstrap
+	}
+	data, err := encodeMembers(members)
+	if err != nil {
+		return err
+	}
+	e := &Entry{Index: 1, Term: 1, Type: EntryConfig, Data: data}
+	if err := n.storage.Append([]*Entry{e}); err != nil {
+		return err
+	}
+	n.hs.Term = 1
+	if err := n.storage.SetHardState(&n.hs); err != nil {
+		return err
+	}
+	n.log = append(n.log, e)
+	n.persist = 1
+	n.reloadConfig()
+	// No need to wait for a timeout, there is no leader to hear from.
+	n.electionAt = time.Now()
+	return nil
+}
+
+// Stop stops the node, it does not close its storage.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	select {
+	case <-n.done:
+		n.mu.Unlock()
+		return
+	default:
+	}
+	close(n.done)
+	n.stepDown(n.hs.Term)
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+func (n *Node) Status() *Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return &Status{
+		ID:        n.id,
+		Role:      n.role,
+		Term:      n.hs.Term,
+		Leader:    n.leader,
+		Members:   slices.Clone(n.members),
+		LastIndex: n.lastIndex(),
+		Commit:    n.commit,
+		Applied:   n.applied,
+		Compacted: n.meta.Index,
+	}
+}
+
+// Leader returns the current leader, if known.
+func (n *Node) Leader() (*Member, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.leader == "" {
+		return nil, false
+	}
+	m, ok := n.member(n.leader)
+	return m, ok
+}
+
+// Leading returns the term of the node if it is the leader.
+func (n *Node) Leading() (uint64, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.hs.Term, n.role == RoleLeader
+}
+
+// Propose appends data to the log and returns once the entry is applied by
+// the state machine of the leader.
+func (n *Node) Propose(ctx context.Context, data []byte) error {
+	return n.propose(ctx, EntryNormal, data, nil)
+}
+
+// AddMember adds m to the cluster, it then receives the log from the leader.
+func (n *Node) AddMember(ctx context.Context, m Member) error {
+	return n.changeMembers(ctx, func(members []Member) ([]Member, error) {
+		for _, o := range members {
+			if o.ID == m.ID {
+				return nil, ErrMemberExists
+			}
+		}
+		return append(members, m), nil
+	})
+}
+
+// RemoveMember removes the member id from the cluster. A leader removing
+// itself steps down once the change is committed.
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members []Member) ([]Member, error) {
+		i := slices.IndexFunc(members, func(m Member) bool { return m.ID == id })
+		if i < 0 {
+			return nil, ErrMemberNotFound
+		}
+		return slices.Delete(members, i, i+1), nil
+	})
+}
+
+func (n *Node) changeMembers(
+	ctx context.Context,
+	change func(members []Member) ([]Member, error),
+) error {
+	return n.propose(ctx, EntryConfig, nil, func() ([]byte, error) {
+		// Only one change at a time, so that the majorities of the old
+		// and the new members overlap.
+		if n.configIndex > n.commit {
+			return nil, ErrConfigPending
+		}
+		members, err := change(slices.Clone(n.members))
+		if err != nil {
+			return nil, err
+		}
+		return encodeMembers(members)
+	})
+}
+
+// propose appends an entry of type typ with data, or with the result of
+// build if not nil, which is called with n.mu held.
+func (n *Node) propose(
+	ctx context.Context,
+	typ EntryType,
+	data []byte,
+	build func() ([]byte, error),
+) error {
+	n.mu.Lock()
+	if n.role != RoleLeader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	if build != nil {
+		// The members of the previous terms may not be committed yet, a
+		// change is only safe once an entry of the current term is.
+		term := n.hs.Term
+		err := n.wait(ctx, func() (bool, error) {
+			return n.termOf(n.commit) == term, nil
+		}, term)
+		if err == nil {
+			data, err = build()
+		}
+		if err != nil {
+			n.mu.Unlock()
+			return err
+		}
+	}
+	e := n.appendEntry(typ, data)
+	w := &waiter{term: e.Term, ch: make(chan error, 1)}
+	n.waiters[e.Index] = w
+	n.mu.Unlock()
+
+	select {
+	case err := <-w.ch:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, e.Index)
+		n.mu.Unlock()
+		return ctx.Err()
+	case <-n.done:
+		return ErrStopped
+	}
+}
+
+// ReadIndex returns once the state machine of the leader reflects every
+// entry committed before it was called, so that reads which follow are
+// linearizable. It fails with ErrNotLeader on other nodes.
+func (n *Node) ReadIndex(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != RoleLeader {
+		return ErrNotLeader
+	}
+	term := n.hs.Term
+	// The commit index of the leader is only known to be up to date once
+	// it committed an entry of its term.
+	err := n.wait(ctx, func() (bool, error) {
+		return n.termOf(n.commit) == term, nil
+	}, term)
+	if err != nil {
+		return err
+	}
+	index := n.commit
+
+	// Confirm that n is still the leader with a heartbeat round.
+	n.round++
+	round := n.round
+	for _, p := range n.peers {
+		p.trigger()
+	}
+	err = n.wait(ctx, func() (bool, error) {
+		return n.quorum(func(p *peer) bool { return p.round >= round }), nil
+	}, term)
+	if err != nil {
+		return err
+	}
+	return n.wait(ctx, func() (bool, error) {
+		return n.applied >= index, nil
+	}, term)
+}
+
+// wait waits with n.mu held until cond is true, failing if n is no longer
+// the leader of term.
+func (n *Node) wait(ctx context.Context, cond func() (bool, error), term uint64) error {
+	for {
+		if n.role != RoleLeader || n.hs.Term != term {
+			return ErrLeadershipLost
+		}
+		if ok, err := cond(); ok || err != nil {
+			return err
+		}
+		changed := n.changed
+		n.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			n.mu.Lock()
+			return ctx.Err()
+		case <-n.done:
+			n.mu.Lock()
+			return ErrStopped
+		}
+		n.mu.Lock()
+	}
+}
+
+func (n *Node) notify() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// tick starts elections, which only members do.
+func (n *Node) tick() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.opts.HeartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		_, member := n.member(n.id)
+		if n.role != RoleLeader && member && time.Now().After(n.electionAt) {
+			n.campaign()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) resetElectionTimer() {
+	timeout := n.opts.ElectionTimeout
+	timeout += rand.N(timeout)
+	n.electionAt = time.Now().Add(timeout)
+}
+
+// setTerm moves to a newer term, with no vote yet.
+func (n *Node) setTerm(term uint64) {
+	if term <= n.hs.Term {
+		return
+	}
+	n.hs = HardState{Term: term}
+	n.saveHardState()
+}
+
+func (n *Node) saveHardState() {
+	if err := n.storage.SetHardState(&n.hs); err != nil {
+		// Answering RPCs without the state persisted could break the
+		// safety of the algorithm.
+		panic(fmt.Errorf("raft: persist hard state: %w", err))
+	}
+}
+
+// stepDown turns n into a follower of term.
+func (n *Node) stepDown(term uint64) {
+	n.setTerm(term)
+	if n.role == RoleLeader {
+		for _, p := range n.peers {
+			p.stop()
+		}
+		n.peers = nil
+		for index, w := range n.waiters {
+			w.ch <- ErrLeadershipLost
+			delete(n.waiters, index)
+		}
+		// The entries not persisted yet were not acknowledged, they are
+		// dropped as if n had crashed.
+		n.log = n.log[:n.persist-n.meta.Index]
+		n.reloadConfig()
+	}
+	if n.role != RoleFollower {
+		n.role = RoleFollower
+		n.leader = ""
+		n.resetElectionTimer()
+		n.notify()
+	}
+}
+
+func (n *Node) campaign() {
+	n.setTerm(n.hs.Term + 1)
+	n.role = RoleCandidate
+	n.leader = ""
+	n.hs.Vote = n.id
+	n.saveHardState()
+	n.resetElectionTimer()
+	n.notify()
+
+	req := &VoteRequest{
+		Term:      n.hs.Term,
+		Candidate: n.id,
+		LastIndex: n.lastIndex(),
+		LastTerm:  n.termOf(n.lastIndex()),
+	}
+	slog.Info("raft: Starting an election", "id", n.id, "term", req.Term)
+	votes := 1
+	if votes > len(n.members)/2 {
+		n.becomeLeader()
+		return
+	}
+	for _, m := range n.members {
+		if m.ID == n.id {
+			continue
+		}
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), n.opts.ElectionTimeout)
+			defer cancel()
+			resp, err := n.transport.RequestVote(ctx, &m, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.hs.Term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.role != RoleCandidate || n.hs.Term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes > len(n.members)/2 {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+func (n *Node) becomeLeader() {
+	slog.Info("raft: Elected leader", "id", n.id, "term", n.hs.Term)
+	n.role = RoleLeader
+	n.leader = n.id
+	n.peers = make(map[string]*peer)
+	n.appendEntry(EntryNoop, nil)
+	n.syncPeers()
+	n.notify()
+}
+
+// appendEntry appends an entry of the current term, which is persisted in
+// the background.
+func (n *Node) appendEntry(typ EntryType, data []byte) *Entry {
+	e := &Entry{
+		Index: n.lastIndex() + 1,
+		Term:  n.hs.Term,
+		Type:  typ,
+		Data:  data,
+	}
+	n.log = append(n.log, e)
+	if typ == EntryConfig {
+		n.reloadConfig()
+		n.syncPeers()
+	}
+	select {
+	case n.persistC <- struct{}{}:
+	default:
+	}
+	return e
+}
+
+// persistLoop persists the entries appended by the leader, in batches.
+func (n *Node) persistLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-n.persistC:
+		}
+		n.mu.Lock()
+		if n.role == RoleLeader && n.persist < n.lastIndex() {
+			if err := n.storage.Append(n.entries(n.persist+1, n.lastIndex()+1)); err != nil {
+				panic(fmt.Errorf("raft: persist log: %w", err))
+			}
+			n.persist = n.lastIndex()
+			n.maybeCommit()
+			for _, p := range n.peers {
+				p.trigger()
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// maybeCommit commits the entries of the current term replicated on a
+// majority.
+func (n *Node) maybeCommit() {
+	for index := n.lastIndex(); index > n.commit; index-- {
+		if n.termOf(index) != n.hs.Term {
+			// Entries of previous terms are committed by the ones of the
+			// current term following them.
+			break
+		}
+		if n.quorum(func(p *peer) bool { return p.match >= index }) {
+			n.setCommit(index)
+			break
+		}
+	}
+}
+
+// quorum tells whether a majority of the members satisfies ok, n being
+// counted with the entries it persisted and the current heartbeat round.
+func (n *Node) quorum(ok func(p *peer) bool) bool {
+	count := 0
+	for _, m := range n.members {
+		p, found := n.peers[m.ID]
+		if m.ID == n.id {
+			p, found = &peer{match: n.persist, round: n.round}, true
+		}
+		if found && ok(p) {
+			count++
+		}
+	}
+	return count > len(n.members)/2
+}
+
+func (n *Node) setCommit(index uint64) {
+	if index <= n.commit {
+		return
+	}
+	n.commit = index
+	n.notify()
+	select {
+	case n.applyC <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-n.applyC:
+		}
+		if err := n.applyCommitted(); err != nil {
+			slog.Error("raft: Failed to apply entries, retrying", "id", n.id, "err", err)
+			select {
+			case <-n.done:
+				return
+			case <-time.After(time.Second):
+			}
+			select {
+			case n.applyC <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (n *Node) applyCommitted() error {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	entries := n.entries(n.applied+1, n.commit+1)
+	n.mu.Unlock()
+	for _, e := range entries {
+		apply := e
+		if e.Type != EntryNormal {
+			apply = &Entry{Index: e.Index, Term: e.Term, Type: e.Type}
+		}
+		if err := n.sm.Apply(apply); err != nil {
+			return err
+		}
+		n.mu.Lock()
+		n.applied = e.Index
+		if w, ok := n.waiters[e.Index]; ok {
+			if w.term == e.Term {
+				w.ch <- nil
+			} else {
+				w.ch <- ErrLeadershipLost
+			}
+			delete(n.waiters, e.Index)
+		}
+		// A leader removed from the cluster steps down once the change is
+		// applied.
+		if _, ok := n.member(n.id); !ok && n.role == RoleLeader && n.configIndex <= e.Index {
+			n.stepDown(n.hs.Term)
+		}
+		n.notify()
+		n.mu.Unlock()
+	}
+	return n.maybeCompact()
+}
+
+// maybeCompact compacts the log once it holds more than SnapshotThreshold
+// applied entries, it is called with n.applyMu held.
+func (n *Node) maybeCompact() error {
+	n.mu.Lock()
+	if n.applied-n.meta.Index <= n.opts.SnapshotThreshold+n.opts.TrailingLogs {
+		n.mu.Unlock()
+		return nil
+	}
+	index := n.applied - n.opts.TrailingLogs
+	n.mu.Unlock()
+
+	// The compacted entries can no longer be replayed after a crash.
+	if err := n.sm.Sync(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.compact(&SnapshotMeta{
+		Index:   index,
+		Term:    n.termOf(index),
+		Members: n.membersAt(index),
+	})
+}
+
+func (n *Node) compact(meta *SnapshotMeta) error {
+	if err := n.storage.Compact(meta); err != nil {
+		return err
+	}
+	if meta.Index < n.lastIndex() && n.termOf(meta.Index) == meta.Term {
+		n.log = slices.Clone(n.log[meta.Index-n.meta.Index:])
+	} else {
+		n.log = nil
+	}
+	n.meta = *meta
+	n.persist = min(max(n.persist, meta.Index), n.lastIndex())
+	n.reloadConfig()
+	return nil
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.meta.Index + uint64(len(n.log))
+}
+
+// termOf returns the term of the entry at index, 0 if it is compacted or
+// beyond the log.
+func (n *Node) termOf(index uint64) uint64 {
+	if index == n.meta.Index {
+		return n.meta.Term
+	}
+	if index < n.meta.Index || index > n.lastIndex() {
+		return 0
+	}
+	return n.log[index-n.meta.Index-1].Term
+}
+
+// entries returns the entries from lo to hi excluded, which must not be
+// compacted.
+func (n *Node) entries(lo, hi uint64) []*Entry {
+	if lo >= hi {
+		return nil
+	}
+	return slices.Clone(n.log[lo-n.meta.Index-1 : hi-n.meta.Index-1])
+}
+
+func (n *Node) member(id string) (*Member, bool) {
+	for _, m := range n.members {
+		if m.ID == id {
+			return &m, true
+		}
+	}
+	return nil, false
+}
+
+// reloadConfig sets the members from the last config entry of the log.
+func (n *Node) reloadConfig() {
+	n.configIndex = 0
+	n.members = n.meta.Members
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if e := n.log[i]; e.Type == EntryConfig {
+			members, err := decodeMembers(e.Data)
+			if err != nil {
+				panic(fmt.Errorf("raft: entry %d: %w", e.Index, err))
+			}
+			n.members, n.configIndex = members, e.Index
+			return
+		}
+	}
+}
+
+// membersAt returns the members as of the entry at index.
+func (n *Node) membersAt(index uint64) []Member {
+	for i := int(index - n.meta.Index - 1); i >= 0; i-- {
+		if e := n.log[i]; e.Type == EntryConfig {
+			members, err := decodeMembers(e.Data)
+			if err != nil {
+				panic(fmt.Errorf("raft: entry %d: %w", e.Index, err))
+			}
+			return members
+		}
+	}
+	return n.meta.Members
+}
@@ -0,0 +1,428 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// machine records the data of the applied entries.
+type machine struct {
+	mu      sync.Mutex
+	applied uint64
+	data    []string
+}
+
+func (m *machine) Applied() (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.applied, nil
+}
+
+func (m *machine) Apply(e *Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e.Type == EntryNormal {
+		m.data = append(m.data, string(e.Data))
+	}
+	m.applied = e.Index
+	return nil
+}
+
+func (m *machine) Snapshot() (Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &snapshot{index: m.applied, data: slices.Clone(m.data)}, nil
+}
+
+func (m *machine) Restore(r io.Reader, index uint64) error {
+	var data []string
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applied, m.data = index, data
+	return nil
+}
+
+func (m *machine) Sync() error {
+	return nil
+}
+
+func (m *machine) snapshot() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.data)
+}
+
+type snapshot struct {
+	index uint64
+	data  []string
+}
+
+func (s *snapshot) Index() uint64 {
+	return s.index
+}
+
+func (s *snapshot) WriteTo(w io.Writer) (int64, error) {
+	return 0, json.NewEncoder(w).Encode(s.data)
+}
+
+func (s *snapshot) Close() {}
+
+type cluster struct {
+	t         *testing.T
+	transport *MemoryTransport
+	opts      *Options
+	nodes     map[string]*Node
+	machines  map[string]*machine
+	storages  map[string]*MemoryStorage
+}
+
+func newCluster(t *testing.T, n int, opts *Options) *cluster {
+	if opts == nil {
+		opts = &Options{
+			HeartbeatInterval: 10 * time.Millisecond,
+			ElectionTimeout:   50 * time.Millisecond,
+			MaxAppendEntries:  16,
+			SnapshotThreshold: 1 << 20,
+			TrailingLogs:      16,
+		}
+	}
+	c := &cluster{
+		t:         t,
+		transport: NewMemoryTransport(),
+		opts:      opts,
+		nodes:     make(map[string]*Node),
+		machines:  make(map[string]*machine),
+		storages:  make(map[string]*MemoryStorage),
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Stop()
+		}
+	})
+	var members []Member
+	for i := range n {
+		id := fmt.Sprintf("n%d", i+1)
+		members = append(members, Member{ID: id})
+		c.start(id)
+	}
+	if n > 0 {
+		if err := c.nodes["n1"].Bootstrap(members); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// start starts the node id, with the state it had if it ran before.
+func (c *cluster) start(id string) *Node {
+	c.t.Helper()
+	if _, ok := c.storages[id]; !ok {
+		c.storages[id] = NewMemoryStorage()
+		c.machines[id] = &machine{}
+	}
+	node, err := New(id, c.machines[id], c.storages[id], c.transport, c.opts)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = node
+	c.transport.Register(node)
+	return node
+}
+
+func (c *cluster) stop(id string) {
+	c.nodes[id].Stop()
+	delete(c.nodes, id)
+}
+
+// leader waits for a leader among the connected nodes.
+func (c *cluster) leader(except ...string) *Node {
+	c.t.Helper()
+	var leader *Node
+	c.eventually(func() error {
+		for id, node := range c.nodes {
+			if slices.Contains(except, id) {
+				continue
+			}
+			if node.Status().Role == RoleLeader {
+				leader = node
+				return nil
+			}
+		}
+		return errors.New("no leader")
+	})
+	return leader
+}
+
+func (c *cluster) propose(node *Node, data string) {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := node.Propose(ctx, []byte(data)); err != nil {
+		c.t.Fatalf("Propose(%q) on %s: %v", data, node.ID(), err)
+	}
+}
+
+// converge waits for the machines of the running nodes to hold want.
+func (c *cluster) converge(want ...string) {
+	c.t.Helper()
+	c.eventually(func() error {
+		for id := range c.nodes {
+			if got := c.machines[id].snapshot(); !slices.Equal(got, want) {
+				return fmt.Errorf("%s applied %q, want %q", id, got, want)
+			}
+		}
+		return nil
+	})
+}
+
+func (c *cluster) eventually(fn func() error) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := newCluster(t, 3, nil)
+	leader := c.leader()
+	for i := range 50 {
+		c.propose(leader, fmt.Sprint(i))
+	}
+	var want []string
+	for i := range 50 {
+		want = append(want, fmt.Sprint(i))
+	}
+	c.converge(want...)
+
+	for id, node := range c.nodes {
+		if node == leader {
+			continue
+		}
+		err := node.Propose(context.Background(), []byte("x"))
+		if !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("Propose on follower %s = %v, want ErrNotLeader", id, err)
+		}
+		if err := node.ReadIndex(context.Background()); !errors.Is(err, ErrNotLeader) {
+			t.Fatalf("ReadIndex on follower %s = %v, want ErrNotLeader", id, err)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	c := newCluster(t, 3, nil)
+	old := c.leader()
+	c.propose(old, "a")
+	c.converge("a")
+
+	c.transport.Disconnect(old.ID())
+	leader := c.leader(old.ID())
+	c.propose(leader, "b")
+
+	// The old leader cannot commit without a majority, nor serve reads.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := old.Propose(ctx, []byte("lost")); err == nil {
+		t.Fatal("Propose on a partitioned leader succeeded")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := old.ReadIndex(ctx); err == nil {
+		t.Fatal("ReadIndex on a partitioned leader succeeded")
+	}
+
+	c.transport.Reconnect(old.ID())
+	c.propose(leader, "c")
+	c.converge("a", "b", "c")
+}
+
+func TestRestart(t *testing.T) {
+	c := newCluster(t, 3, nil)
+	leader := c.leader()
+	c.propose(leader, "a")
+	c.converge("a")
+
+	// A follower restarted with its state catches up.
+	var follower string
+	for id, node := range c.nodes {
+		if node != leader {
+			follower = id
+		}
+	}
+	c.stop(follower)
+	c.propose(leader, "b")
+	c.start(follower)
+	c.propose(leader, "c")
+	c.converge("a", "b", "c")
+
+	// So does the cluster after all the nodes restarted.
+	for id := range c.nodes {
+		c.stop(id)
+	}
+	for _, id := range []string{"n1", "n2", "n3"} {
+		c.start(id)
+	}
+	c.propose(c.leader(), "d")
+	c.converge("a", "b", "c", "d")
+}
+
+func TestReadIndex(t *testing.T) {
+	c := newCluster(t, 3, nil)
+	leader := c.leader()
+	c.propose(leader, "a")
+	if err := leader.ReadIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.machines[leader.ID()].snapshot(); !slices.Equal(got, []string{"a"}) {
+		t.Fatalf("leader applied %q after ReadIndex, want [a]", got)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	c := newCluster(t, 1, nil)
+	leader := c.leader()
+	c.propose(leader, "a")
+
+	ctx := context.Background()
+	for _, id := range []string{"n2", "n3"} {
+		c.start(id)
+		if err := leader.AddMember(ctx, Member{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.AddMember(ctx, Member{ID: "n2"}); !errors.Is(err, ErrMemberExists) {
+		t.Fatalf("AddMember(n2) = %v, want ErrMemberExists", err)
+	}
+	c.propose(leader, "b")
+	c.converge("a", "b")
+
+	// The leader removing itself steps down, the others elect a new one.
+	if err := leader.RemoveMember(ctx, leader.ID()); err != nil {
+		t.Fatal(err)
+	}
+	removed := leader.ID()
+	leader = c.leader(removed)
+	c.propose(leader, "c")
+	c.stop(removed)
+	c.converge("a", "b", "c")
+	if members := leader.Status().Members; len(members) != 2 {
+		t.Fatalf("members = %v, want 2 of them", members)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c := newCluster(t, 3, &Options{
+		HeartbeatInterval: 10 * time.Millisecond,
+		ElectionTimeout:   50 * time.Millisecond,
+		MaxAppendEntries:  16,
+		SnapshotThreshold: 8,
+		TrailingLogs:      4,
+	})
+	leader := c.leader()
+	var lagging string
+	for id, node := range c.nodes {
+		if node != leader {
+			lagging = id
+		}
+	}
+	c.stop(lagging)
+
+	var want []string
+	for i := range 40 {
+		c.propose(leader, fmt.Sprint(i))
+		want = append(want, fmt.Sprint(i))
+	}
+	if st := leader.Status(); st.Compacted == 0 {
+		t.Fatalf("log not compacted: %+v", st)
+	}
+
+	// The entries the restarted node misses are compacted, it gets a
+	// snapshot.
+	c.start(lagging)
+	c.converge(want...)
+
+	// A new member too.
+	c.start("n4")
+	if err := leader.AddMember(context.Background(), Member{ID: "n4"}); err != nil {
+		t.Fatal(err)
+	}
+	c.propose(leader, "last")
+	c.converge(append(want, "last")...)
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := func(lo, hi, term uint64) []*Entry {
+		var es []*Entry
+		for i := lo; i < hi; i++ {
+			es = append(es, &Entry{Index: i, Term: term, Type: EntryNormal, Data: []byte{byte(i)}})
+		}
+		return es
+	}
+	if _, _, _, err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetHardState(&HardState{Term: 2, Vote: "n1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(entries(1, 11, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// Entries 6 to 10 are replaced.
+	if err := s.Append(entries(6, 8, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(&SnapshotMeta{Index: 3, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(entries(8, 9, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	hs, meta, got, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *hs != (HardState{Term: 2, Vote: "n1"}) || meta.Index != 3 {
+		t.Fatalf("Load = %+v, %+v", hs, meta)
+	}
+	want := append(entries(4, 6, 1), entries(6, 9, 2)...)
+	if len(got) != len(want) {
+		t.Fatalf("Load returned %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Index != want[i].Index || got[i].Term != want[i].Term ||
+			string(got[i].Data) != string(want[i].Data) {
+			t.Fatalf("entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// peer is the state of a member kept by the leader, and its replicator.
+type peer struct {
+	member Member
+	next   uint64
+	match  uint64
+	// Last heartbeat round acknowledged.
+	round uint64
+
+	triggerC chan struct{}
+	stopC    chan struct{}
+}
+
+func (p *peer) trigger() {
+	select {
+	case p.triggerC <- struct{}{}:
+	default:
+	}
+}
+
+func (p *peer) stop() {
+	close(p.stopC)
+}
+
+// syncPeers starts a replicator for each new member, and stops the ones of
+// removed members.
+func (n *Node) syncPeers() {
+	if n.role != RoleLeader {
+		return
+	}
+	ids := make(map[string]bool)
+	for _, m := range n.members {
+		ids[m.ID] = true
+		if _, ok := n.peers[m.ID]; ok || m.ID == n.id {
+			continue
+		}
+		p := &peer{
+			member:   m,
+			next:     n.lastIndex() + 1,
+			triggerC: make(chan struct{}, 1),
+			stopC:    make(chan struct{}),
+		}
+		n.peers[m.ID] = p
+		n.wg.Add(1)
+		go n.replicate(p, n.hs.Term)
+	}
+	for id, p := range n.peers {
+		if !ids[id] {
+			p.stop()
+			delete(n.peers, id)
+		}
+	}
+}
+
+// replicate sends the log to p while n is the leader of term, and
+// heartbeats when there is nothing to send.
+func (n *Node) replicate(p *peer, term uint64) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.opts.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		more, err := n.sendAppend(p, term)
+		if more {
+			continue
+		}
+		trigger := p.triggerC
+		if err != nil {
+			// Retry with the next heartbeat.
+			trigger = nil
+		}
+		select {
+		case <-p.stopC:
+			return
+		case <-n.done:
+			return
+		case <-trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendAppend sends an AppendEntries RPC, or the snapshot if the entries p
+// needs are compacted. It returns whether there are more entries to send.
+func (n *Node) sendAppend(p *peer, term uint64) (bool, error) {
+	n.mu.Lock()
+	select {
+	case <-p.stopC:
+		n.mu.Unlock()
+		return false, nil
+	default:
+	}
+	if p.next <= n.meta.Index {
+		n.mu.Unlock()
+		return n.sendSnapshot(p, term)
+	}
+	req := &AppendRequest{
+		Term:      term,
+		Leader:    n.id,
+		PrevIndex: p.next - 1,
+		PrevTerm:  n.termOf(p.next - 1),
+		Entries:   n.entries(p.next, min(n.lastIndex()+1, p.next+uint64(n.opts.MaxAppendEntries))),
+		Commit:    n.commit,
+		Round:     n.round,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.opts.ElectionTimeout)
+	defer cancel()
+	resp, err := n.transport.AppendEntries(ctx, &p.member, req)
+	if err != nil {
+		return false, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.hs.Term {
+		n.stepDown(resp.Term)
+		return false, nil
+	}
+	if n.role != RoleLeader || n.hs.Term != term {
+		return false, nil
+	}
+	if req.Round > p.round {
+		p.round = req.Round
+		n.notify()
+	}
+	if !resp.Success {
+		p.next = max(min(resp.LastIndex+1, p.next-1), 1)
+		return true, nil
+	}
+	if match := req.PrevIndex + uint64(len(req.Entries)); match > p.match {
+		p.match = match
+		n.maybeCommit()
+	}
+	p.next = max(p.next, p.match+1)
+	return p.next <= n.lastIndex(), nil
+}
+
+func (n *Node) sendSnapshot(p *peer, term uint64) (bool, error) {
+	snap, err := n.sm.Snapshot()
+	if err != nil {
+		slog.Error("raft: Failed to take a snapshot", "id", n.id, "err", err)
+		return false, err
+	}
+	defer snap.Close()
+
+	n.mu.Lock()
+	index := snap.Index()
+	if index < n.meta.Index || index > n.lastIndex() {
+		// Cannot happen, the log is compacted up to applied entries.
+		n.mu.Unlock()
+		return false, nil
+	}
+	req := &SnapshotRequest{
+		Term:   term,
+		Leader: n.id,
+		Meta: SnapshotMeta{
+			Index:   index,
+			Term:    n.termOf(index),
+			Members: n.membersAt(index),
+		},
+	}
+	n.mu.Unlock()
+
+	slog.Info("raft: Sending a snapshot", "id", n.id, "to", p.member.ID, "index", index)
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := snap.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	// Streaming the whole state may take longer than a heartbeat.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp, err := n.transport.InstallSnapshot(ctx, &p.member, req, pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		slog.Warn("raft: Failed to send a snapshot", "id", n.id, "to", p.member.ID, "err", err)
+		return false, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.hs.Term {
+		n.stepDown(resp.Term)
+		return false, nil
+	}
+	if n.role != RoleLeader || n.hs.Term != term {
+		return false, nil
+	}
+	p.match = max(p.match, index)
+	p.next = p.match + 1
+	n.maybeCommit()
+	return p.next <= n.lastIndex(), nil
+}
+
+func (n *Node) HandleRequestVote(req *VoteRequest) (*VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped() {
+		return nil, ErrStopped
+	}
+	resp := &VoteResponse{Term: n.hs.Term}
+	if req.Term < n.hs.Term {
+		return resp, nil
+	}
+	// A node removed from the cluster, or partitioned away, must not
+	// disrupt a leader that the others still hear from.
+	if n.role == RoleLeader ||
+		(n.leader != "" && time.Since(n.lastContact) < n.opts.ElectionTimeout) {
+		return resp, nil
+	}
+	if req.Term > n.hs.Term {
+		n.stepDown(req.Term)
+		resp.Term = req.Term
+	}
+
+	lastTerm := n.termOf(n.lastIndex())
+	upToDate := req.LastTerm > lastTerm ||
+		(req.LastTerm == lastTerm && req.LastIndex >= n.lastIndex())
+	if (n.hs.Vote == "" || n.hs.Vote == req.Candidate) && upToDate {
+		n.hs.Vote = req.Candidate
+		n.saveHardState()
+		n.resetElectionTimer()
+		resp.Granted = true
+	}
+	return resp, nil
+}
+
+func (n *Node) HandleAppendEntries(req *AppendRequest) (*AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped() {
+		return nil, ErrStopped
+	}
+	resp := &AppendResponse{Term: n.hs.Term}
+	if req.Term < n.hs.Term {
+		return resp, nil
+	}
+	n.follow(req.Term, req.Leader)
+	resp.Term = n.hs.Term
+
+	if req.PrevIndex > n.lastIndex() {
+		resp.LastIndex = n.lastIndex()
+		return resp, nil
+	}
+	entries := req.Entries
+	if req.PrevIndex < n.meta.Index {
+		// The entries up to the compacted one are committed, so they match.
+		skip := min(n.meta.Index-req.PrevIndex, uint64(len(entries)))
+		entries = entries[skip:]
+	} else if n.termOf(req.PrevIndex) != req.PrevTerm {
+		resp.LastIndex = req.PrevIndex - 1
+		return resp, nil
+	}
+
+	// Skip the entries n already has, the log is truncated from the first
+	// conflicting one.
+	for len(entries) > 0 {
+		e := entries[0]
+		if e.Index > n.lastIndex() || n.termOf(e.Index) != e.Term {
+			break
+		}
+		entries = entries[1:]
+	}
+	if len(entries) > 0 {
+		if entries[0].Index <= n.commit {
+			panic("raft: truncating committed entries")
+		}
+		if err := n.storage.Append(entries); err != nil {
+			panic(fmt.Errorf("raft: persist log: %w", err))
+		}
+		n.log = append(n.log[:entries[0].Index-n.meta.Index-1], entries...)
+		n.persist = n.lastIndex()
+		n.reloadConfig()
+	}
+
+	last := req.PrevIndex + uint64(len(req.Entries))
+	n.setCommit(min(req.Commit, last))
+	resp.Success = true
+	resp.LastIndex = last
+	return resp, nil
+}
+
+func (n *Node) HandleInstallSnapshot(
+	req *SnapshotRequest,
+	data io.Reader,
+) (*SnapshotResponse, error) {
+	n.mu.Lock()
+	if n.stopped() {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if req.Term < n.hs.Term {
+		defer n.mu.Unlock()
+		return &SnapshotResponse{Term: n.hs.Term}, nil
+	}
+	n.follow(req.Term, req.Leader)
+	n.mu.Unlock()
+
+	// Hold off the applier while the state is replaced.
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if req.Meta.Index <= n.applied {
+		defer n.mu.Unlock()
+		return &SnapshotResponse{Term: n.hs.Term}, nil
+	}
+	n.mu.Unlock()
+
+	slog.Info("raft: Restoring a snapshot", "id", n.id, "index", req.Meta.Index)
+	if err := n.sm.Restore(data, req.Meta.Index); err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.compact(&req.Meta); err != nil {
+		return nil, err
+	}
+	n.applied = req.Meta.Index
+	n.setCommit(req.Meta.Index)
+	n.lastContact = time.Now()
+	n.resetElectionTimer()
+	return &SnapshotResponse{Term: n.hs.Term}, nil
+}
+
+// follow makes n a follower of leader, which leads term.
+func (n *Node) follow(term uint64, leader string) {
+	if term > n.hs.Term || n.role != RoleFollower {
+		n.stepDown(term)
+	}
+	if n.leader != leader {
+		n.leader = leader
+		n.notify()
+	}
+	n.lastContact = time.Now()
+	n.resetElectionTimer()
+}
+
+func (n *Node) stopped() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func encodeMembers(members []Member) ([]byte, error) {
+	return json.Marshal(members)
+}
+
+func decodeMembers(data []byte) ([]Member, error) {
+	var members []Member
+	err := json.Unmarshal(data, &members)
+	return members, err
+}
@@ -0,0 +1,351 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+var ErrCorruptLog = errors.New("raft: corrupt log")
+
+// HardState is the state a node must persist before answering an RPC.
+type HardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+}
+
+// SnapshotMeta describes the last entry removed from the log, which the state
+// machine has applied, and the members at that entry.
+type SnapshotMeta struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Members []Member `json:"members"`
+}
+
+// Storage persists the state of a node. A node calls it from a single
+// goroutine at a time.
+type Storage interface {
+	// Load returns the persisted state, entries are the ones following
+	// meta.Index.
+	Load() (*HardState, *SnapshotMeta, []*Entry, error)
+
+	SetHardState(hs *HardState) error
+
+	// Append persists entries after removing the ones at or after the
+	// index of the first of them.
+	Append(entries []*Entry) error
+
+	// Compact removes the entries up to meta.Index, all of them if the log
+	// does not reach it.
+	Compact(meta *SnapshotMeta) error
+
+	Close() error
+}
+
+// MemoryStorage keeps the state in memory, for tests. It survives the node
+// using it, so that a restart can be simulated by passing it to a new node.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	hs      HardState
+	meta    SnapshotMeta
+	entries []*Entry
+}
+
+var _ Storage = (*MemoryStorage)(nil)
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (s *MemoryStorage) Load() (*HardState, *SnapshotMeta, []*Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hs, meta := s.hs, s.meta
+	return &hs, &meta, slices.Clone(s.entries), nil
+}
+
+func (s *MemoryStorage) SetHardState(hs *HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hs = *hs
+	return nil
+}
+
+func (s *MemoryStorage) Append(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := int(entries[0].Index - s.meta.Index - 1)
+	s.entries = append(s.entries[:min(n, len(s.entries))], entries...)
+	return nil
+}
+
+func (s *MemoryStorage) Compact(meta *SnapshotMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := int(meta.Index - s.meta.Index)
+	s.entries = slices.Clone(s.entries[min(n, len(s.entries)):])
+	s.meta = *meta
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// FileStorage keeps the state in a directory: the hard state and the
+// snapshot meta in a JSON file replaced atomically, and the entries in an
+// append-only file of checksummed records.
+type FileStorage struct {
+	dir  string
+	log  *os.File
+	meta SnapshotMeta
+	hs   HardState
+	// Offset of each entry in the log file, and its end.
+	offsets []int64
+	end     int64
+}
+
+var _ Storage = (*FileStorage)(nil)
+
+type fileState struct {
+	HardState
+	Meta SnapshotMeta `json:"meta"`
+}
+
+// Record header: the length and the CRC-32 of the payload.
+const _recordHeaderLen = 8
+
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &FileStorage{dir: dir}
+	b, err := os.ReadFile(filepath.Join(dir, "state.json"))
+	if err == nil {
+		var st fileState
+		if err := json.Unmarshal(b, &st); err != nil {
+			return nil, fmt.Errorf("raft: %s: %w", dir, err)
+		}
+		s.hs, s.meta = st.HardState, st.Meta
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	s.log, err = os.OpenFile(filepath.Join(dir, "log"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStorage) Load() (*HardState, *SnapshotMeta, []*Entry, error) {
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, nil, err
+	}
+	r := bufio.NewReader(s.log)
+	var (
+		entries []*Entry
+		off     int64
+	)
+	s.offsets = s.offsets[:0]
+	for {
+		e, n, err := readRecord(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, ErrCorruptLog) {
+				// A torn write at the end of the log, the entry was never
+				// acknowledged.
+				break
+			}
+			return nil, nil, nil, err
+		}
+		// The log may still hold entries removed by a compaction, see
+		// Compact.
+		if e.Index > s.meta.Index {
+			if want := s.meta.Index + uint64(len(entries)) + 1; e.Index != want {
+				return nil, nil, nil, fmt.Errorf(
+					"%w: entry %d, want %d",
+					ErrCorruptLog,
+					e.Index,
+					want,
+				)
+			}
+			entries = append(entries, e)
+			s.offsets = append(s.offsets, off)
+		}
+		off += n
+	}
+	if err := s.log.Truncate(off); err != nil {
+		return nil, nil, nil, err
+	}
+	s.end = off
+	hs, meta := s.hs, s.meta
+	return &hs, &meta, entries, nil
+}
+
+func (s *FileStorage) SetHardState(hs *HardState) error {
+	s.hs = *hs
+	return s.saveState()
+}
+
+func (s *FileStorage) Append(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if n := int(entries[0].Index - s.meta.Index - 1); n < len(s.offsets) {
+		if err := s.log.Truncate(s.offsets[n]); err != nil {
+			return err
+		}
+		s.end = s.offsets[n]
+		s.offsets = s.offsets[:n]
+	}
+	var buf []byte
+	off := s.end
+	for _, e := range entries {
+		s.offsets = append(s.offsets, off+int64(len(buf)))
+		buf = appendRecord(buf, e)
+	}
+	if _, err := s.log.WriteAt(buf, off); err != nil {
+		return err
+	}
+	s.end += int64(len(buf))
+	return s.log.Sync()
+}
+
+// Compact saves meta first, the entries it covers are then skipped by Load
+// if the log is not rewritten.
+func (s *FileStorage) Compact(meta *SnapshotMeta) error {
+	n := min(int(meta.Index-s.meta.Index), len(s.offsets))
+	start := s.end
+	if n < len(s.offsets) {
+		start = s.offsets[n]
+	}
+	s.meta = *meta
+	if err := s.saveState(); err != nil {
+		return err
+	}
+
+	tmp, err := os.Create(filepath.Join(s.dir, "log.tmp"))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, io.NewSectionReader(s.log, start, s.end-start)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, "log")); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := s.log.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	s.log = tmp
+	offsets := make([]int64, 0, len(s.offsets)-n)
+	for _, off := range s.offsets[n:] {
+		offsets = append(offsets, off-start)
+	}
+	s.offsets = offsets
+	s.end -= start
+	return syncDir(s.dir)
+}
+
+func (s *FileStorage) Close() error {
+	return s.log.Close()
+}
+
+func (s *FileStorage) saveState() error {
+	b, err := json.Marshal(&fileState{HardState: s.hs, Meta: s.meta})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, "state.json")
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// appendRecord appends e to buf: the header, then the index, the term and the
+// type of e followed by its data.
+func appendRecord(buf []byte, e *Entry) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, _recordHeaderLen)...)
+	buf = binary.BigEndian.AppendUint64(buf, e.Index)
+	buf = binary.BigEndian.AppendUint64(buf, e.Term)
+	buf = append(buf, byte(e.Type))
+	buf = append(buf, e.Data...)
+	payload := buf[start+_recordHeaderLen:]
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(payload))
+	return buf
+}
+
+func readRecord(r io.Reader) (*Entry, int64, error) {
+	var header [_recordHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, ErrCorruptLog
+		}
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n < 17 {
+		return nil, 0, ErrCorruptLog
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return nil, 0, ErrCorruptLog
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, ErrCorruptLog
+	}
+	return &Entry{
+		Index: binary.BigEndian.Uint64(payload),
+		Term:  binary.BigEndian.Uint64(payload[8:]),
+		Type:  EntryType(payload[16]),
+		Data:  payload[17:],
+	}, int64(_recordHeaderLen + n), nil
+}
@@ -0,0 +1,156 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrUnreachable = errors.New("raft: peer unreachable")
+
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type AppendRequest struct {
+	Term      uint64   `json:"term"`
+	Leader    string   `json:"leader"`
+	PrevIndex uint64   `json:"prev_index"`
+	PrevTerm  uint64   `json:"prev_term"`
+	Entries   []*Entry `json:"entries,omitempty"`
+	Commit    uint64   `json:"commit"`
+
+	// Heartbeat round of the leader, see Node.ReadIndex.
+	Round uint64 `json:"round"`
+}
+
+type AppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+
+	// Last index of the log matching the leader's on success, a hint of
+	// where they diverge otherwise.
+	LastIndex uint64 `json:"last_index"`
+}
+
+type SnapshotRequest struct {
+	Term   uint64       `json:"term"`
+	Leader string       `json:"leader"`
+	Meta   SnapshotMeta `json:"meta"`
+}
+
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Transport sends the RPCs of a node to its peers, which serve them with the
+// Handle methods of their Node.
+type Transport interface {
+	RequestVote(ctx context.Context, to *Member, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(ctx context.Context, to *Member, req *AppendRequest) (*AppendResponse, error)
+
+	// InstallSnapshot streams the state of the state machine to a peer
+	// lagging behind the compacted log.
+	InstallSnapshot(
+		ctx context.Context,
+		to *Member,
+		req *SnapshotRequest,
+		data io.Reader,
+	) (*SnapshotResponse, error)
+}
+
+// MemoryTransport connects the nodes of a process, for tests. Nodes can be
+// disconnected to simulate failures and partitions.
+type MemoryTransport struct {
+	mu           sync.RWMutex
+	nodes        map[string]*Node
+	disconnected map[string]bool
+}
+
+var _ Transport = (*MemoryTransport)(nil)
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		nodes:        make(map[string]*Node),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// Register makes n reachable at its ID.
+func (t *MemoryTransport) Register(n *Node) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes[n.ID()] = n
+}
+
+// Disconnect drops the RPCs from and to id until it is reconnected.
+func (t *MemoryTransport) Disconnect(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.disconnected[id] = true
+}
+
+func (t *MemoryTransport) Reconnect(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.disconnected, id)
+}
+
+func (t *MemoryTransport) node(from, to string) (*Node, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n, ok := t.nodes[to]
+	if !ok || t.disconnected[from] || t.disconnected[to] {
+		return nil, ErrUnreachable
+	}
+	return n, nil
+}
+
+// The requests do not say which node sent them, the candidate or the leader
+// does.
+
+func (t *MemoryTransport) RequestVote(
+	_ context.Context,
+	to *Member,
+	req *VoteRequest,
+) (*VoteResponse, error) {
+	n, err := t.node(req.Candidate, to.ID)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleRequestVote(req)
+}
+
+func (t *MemoryTransport) AppendEntries(
+	_ context.Context,
+	to *Member,
+	req *AppendRequest,
+) (*AppendResponse, error) {
+	n, err := t.node(req.Leader, to.ID)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleAppendEntries(req)
+}
+
+func (t *MemoryTransport) InstallSnapshot(
+	_ context.Context,
+	to *Member,
+	req *SnapshotRequest,
+	data io.Reader,
+) (*SnapshotResponse, error) {
+	n, err := t.node(req.Leader, to.ID)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleInstallSnapshot(req, data)
+}
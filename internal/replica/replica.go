@@ -0,0 +1,230 @@
+// Package replica keeps a read-only copy of a primary kvdb-server. The
+// replica loads a snapshot from the backup endpoint of the primary's admin
+// listener, then polls it for the versions committed since.
+//
+// Replication is asynchronous: the replica may lag behind the primary, see
+// Status. A replica lagging behind by more than the value log GC interval of
+// the primary may miss deletions compacted meanwhile, and must be rebuilt
+// from an empty data directory.
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/kv"
+)
+
+// Trailer of the primary's backup responses, see the admin handler.
+const _trailerBackupVersion = "Kvdb-Backup-Version"
+
+var ErrNotEmpty = errors.New(
+	"replica: store is not empty but has no replication state, start from an empty data directory",
+)
+
+type Options struct {
+	// Admin address of the primary, and its admin token.
+	Primary string
+	Token   string
+
+	// File recording the replicated version, so that a restart resumes
+	// from it.
+	StatePath string
+
+	// Interval between polls of the primary.
+	Interval time.Duration
+}
+
+type Status struct {
+	Primary string `json:"primary"`
+
+	// Version of the primary that the replica has caught up with.
+	Version uint64 `json:"version"`
+
+	// Start of the last successful poll, the replica has every write the
+	// primary committed before.
+	SyncedAt time.Time `json:"synced_at"`
+
+	// Time since SyncedAt, nil before the first poll succeeded.
+	LagSeconds *float64 `json:"lag_seconds"`
+
+	// Error of the last poll, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+type Replica struct {
+	store  kv.BackupStore
+	opts   *Options
+	client *http.Client
+
+	mu       sync.Mutex
+	version  uint64
+	syncedAt time.Time
+	err      error
+}
+
+type state struct {
+	Version uint64 `json:"version"`
+}
+
+// New resumes the replication recorded at opts.StatePath. Without it, store
+// must be empty, deletions would not be replicated otherwise.
+func New(store kv.BackupStore, opts *Options) (*Replica, error) {
+	r := &Replica{
+		store:  store,
+		opts:   opts,
+		client: &http.Client{},
+	}
+	b, err := os.ReadFile(opts.StatePath)
+	if err == nil {
+		var st state
+		if err := json.Unmarshal(b, &st); err != nil {
+			return nil, fmt.Errorf("replica: %s: %w", opts.StatePath, err)
+		}
+		r.version = st.Version
+		return r, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	empty := true
+	err = kv.WithTxn(store, false, func(txn kv.Txn) error {
+		return txn.Iterate(context.Background(), &kv.IterOptions{
+			KeysOnly: true,
+		}, func(_, _ []byte) error {
+			empty = false
+			return kv.ErrStopIteration
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		return nil, ErrNotEmpty
+	}
+	return r, nil
+}
+
+// Run polls the primary every opts.Interval until ctx is done.
+func (r *Replica) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+	for {
+		err := r.poll(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("replica: Failed to poll the primary", "err", err)
+		}
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Replica) Status() *Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := &Status{
+		Primary:  r.opts.Primary,
+		Version:  r.version,
+		SyncedAt: r.syncedAt,
+	}
+	if !r.syncedAt.IsZero() {
+		lag := time.Since(r.syncedAt).Seconds()
+		st.LagSeconds = &lag
+	}
+	if r.err != nil {
+		st.Error = r.err.Error()
+	}
+	return st
+}
+
+// poll loads the versions committed on the primary since the last poll.
+func (r *Replica) poll(ctx context.Context) error {
+	start := time.Now()
+	r.mu.Lock()
+	since := r.version
+	r.mu.Unlock()
+
+	u := r.opts.Primary + "/admin/backup?" + url.Values{
+		"since": {strconv.FormatUint(since, 10)},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.opts.Token)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("replica: unexpected status %s: %s", resp.Status, msg)
+	}
+
+	// The versions are only visible once all of them are loaded.
+	if err := r.store.Load(resp.Body); err != nil {
+		return err
+	}
+	// Drain the body, the trailer is only available after it.
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	v := resp.Trailer.Get(_trailerBackupVersion)
+	if v == "" {
+		return errors.New("replica: incomplete stream")
+	}
+	version, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return err
+	}
+	// An empty primary has no version yet.
+	version = max(version, since)
+
+	if version != since {
+		// The state must not get ahead of the data after a crash.
+		if s, ok := r.store.(kv.SyncStore); ok {
+			if err := s.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := r.saveState(version); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.version = version
+	r.syncedAt = start
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Replica) saveState(version uint64) error {
+	b, err := json.Marshal(&state{Version: version})
+	if err != nil {
+		return err
+	}
+	tmp := r.opts.StatePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.opts.StatePath)
+}
@@ -0,0 +1,218 @@
+package replica_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maolonglong/kvdb/internal/core"
+	kvdbhttp "github.com/maolonglong/kvdb/internal/http"
+	"github.com/maolonglong/kvdb/internal/kv"
+	badgerstore "github.com/maolonglong/kvdb/internal/kv/badger"
+	"github.com/maolonglong/kvdb/internal/replica"
+)
+
+const token = "secret"
+
+func openStore(t *testing.T, dir string) kv.BackupStore {
+	t.Helper()
+	s, err := badgerstore.New(badgerstore.DefaultOptions(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(kv.BackupStore)
+}
+
+// newPrimary returns a store served by an admin listener.
+func newPrimary(t *testing.T) (kv.Store, string) {
+	t.Helper()
+	s := openStore(t, t.TempDir())
+	t.Cleanup(func() { s.Close() })
+	srv := httptest.NewServer(kvdbhttp.NewAdminHandler(s, token, nil))
+	t.Cleanup(srv.Close)
+	return s, srv.URL
+}
+
+// startReplica runs the replication until the returned function is called.
+func startReplica(t *testing.T, store kv.BackupStore, primary, state string) func() {
+	t.Helper()
+	r, err := replica.New(store, &replica.Options{
+		Primary:   primary,
+		Token:     token,
+		StatePath: state,
+		Interval:  10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(ctx)
+	}()
+	stop := func() {
+		cancel()
+		<-done
+		if st := r.Status(); st.Error != "" && !strings.Contains(st.Error, "context canceled") {
+			t.Errorf("replication error: %s", st.Error)
+		}
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// waitValue waits until the replica has the value of key, nil waits for a
+// deletion.
+func waitValue(t *testing.T, store kv.Store, bucket, key string, want []byte) {
+	t.Helper()
+	ctx := core.WithReadOnly(context.Background())
+	var (
+		got []byte
+		err error
+	)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		var b *core.Bucket
+		if b, err = core.LoadBucket(ctx, store, bucket); err == nil {
+			got, err = b.Get(ctx, []byte(key))
+		}
+		if want == nil && errors.Is(err, kv.ErrKeyNotFound) && b != nil {
+			return
+		}
+		if err == nil && string(got) == string(want) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("replica %s/%s = %q, %v, want %q", bucket, key, got, err, want)
+}
+
+func TestReplicate(t *testing.T) {
+	ctx := context.Background()
+	primary, url := newPrimary(t)
+	b, err := core.NewBucket(ctx, primary, &core.BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set(ctx, []byte("a"), []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	store := openStore(t, t.TempDir())
+	t.Cleanup(func() { store.Close() })
+	startReplica(t, store, url, filepath.Join(t.TempDir(), "replica.json"))
+
+	// The snapshot.
+	waitValue(t, store, b.Name(), "a", []byte("1"))
+	// The incremental polls.
+	if err := b.Set(ctx, []byte("b"), []byte("2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	waitValue(t, store, b.Name(), "b", []byte("2"))
+	if err := b.Set(ctx, []byte("a"), []byte("3"), 0); err != nil {
+		t.Fatal(err)
+	}
+	waitValue(t, store, b.Name(), "a", []byte("3"))
+	if err := b.Delete(ctx, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	waitValue(t, store, b.Name(), "a", nil)
+	waitValue(t, store, b.Name(), "b", []byte("2"))
+}
+
+func TestRestart(t *testing.T) {
+	ctx := context.Background()
+	primary, url := newPrimary(t)
+	b, err := core.NewBucket(ctx, primary, &core.BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set(ctx, []byte("a"), []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	state := filepath.Join(t.TempDir(), "replica.json")
+	store := openStore(t, dir)
+	stop := startReplica(t, store, url, state)
+	waitValue(t, store, b.Name(), "a", []byte("1"))
+	stop()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Delete(ctx, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set(ctx, []byte("b"), []byte("2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	store = openStore(t, dir)
+	t.Cleanup(func() { store.Close() })
+	// Without its state, the replica cannot tell what it missed.
+	_, err = replica.New(store, &replica.Options{
+		StatePath: filepath.Join(t.TempDir(), "replica.json"),
+	})
+	if !errors.Is(err, replica.ErrNotEmpty) {
+		t.Fatalf("New without state error = %v, want ErrNotEmpty", err)
+	}
+	startReplica(t, store, url, state)
+	waitValue(t, store, b.Name(), "b", []byte("2"))
+	waitValue(t, store, b.Name(), "a", nil)
+}
+
+func TestScriptRedirect(t *testing.T) {
+	ctx := context.Background()
+	primary, url := newPrimary(t)
+	b, err := core.NewBucket(ctx, primary, &core.BucketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set(ctx, []byte("a"), []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	scripts := map[string]string{
+		"read":  `kvdb.print(kvdb.get("a"))`,
+		"write": `kvdb.set("a", "2") kvdb.print("done")`,
+	}
+	for name, script := range scripts {
+		if err := b.StoreScript(ctx, []byte(name), []byte(script)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := openStore(t, t.TempDir())
+	t.Cleanup(func() { store.Close() })
+	startReplica(t, store, url, filepath.Join(t.TempDir(), "replica.json"))
+	waitValue(t, store, b.Name(), "a", []byte("1"))
+
+	const primaryURL = "http://primary.example"
+	h := kvdbhttp.NewHandler(store, &kvdbhttp.Options{Primary: primaryURL})
+	do := func(script string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		path := "/" + b.Name() + "/scripts/" + script
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		return w
+	}
+
+	w := do("read")
+	if w.Code != http.StatusOK || w.Body.String() != "1" {
+		t.Errorf("read script = %d %q, want 200 %q", w.Code, w.Body, "1")
+	}
+	w = do("write")
+	want := primaryURL + "/" + b.Name() + "/scripts/write"
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != want {
+		t.Errorf("write script = %d to %q, want %d to %q",
+			w.Code, w.Header().Get("Location"), http.StatusTemporaryRedirect, want)
+	}
+	if strings.Contains(w.Body.String(), "done") {
+		t.Errorf("write script output %q sent by the replica", w.Body)
+	}
+	// The write was not applied to the replica.
+	waitValue(t, store, b.Name(), "a", []byte("1"))
+}
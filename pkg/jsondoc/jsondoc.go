@@ -0,0 +1,201 @@
+// Package jsondoc manipulates JSON documents decoded into generic Go values
+// (map[string]any, []any, string, json.Number, bool and nil).
+package jsondoc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidDocument = errors.New("jsondoc: invalid document")
+	ErrInvalidPath     = errors.New("jsondoc: invalid path")
+	ErrInvalidPatch    = errors.New("jsondoc: invalid patch")
+	ErrPathNotFound    = errors.New("jsondoc: path not found")
+	ErrTestFailed      = errors.New("jsondoc: test operation failed")
+)
+
+// Decode decodes data keeping numbers as json.Number, so that they are
+// written back unchanged. An empty data decodes to nil.
+func Decode(data []byte) (any, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+	if dec.More() {
+		return nil, ErrInvalidDocument
+	}
+	return v, nil
+}
+
+func Encode(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Path is a parsed JSONPath made of object member names (string) and array
+// indexes (int).
+type Path []any
+
+// ParsePath parses the subset of JSONPath made of the root `$`, `.name`,
+// `['name']` and `[index]` segments. Negative indexes count from the end of
+// the array.
+func ParsePath(s string) (Path, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("%w: %q must start with $", ErrInvalidPath, s)
+	}
+	s = s[1:]
+
+	var p Path
+	for len(s) > 0 {
+		switch s[0] {
+		case '.':
+			s = s[1:]
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("%w: empty member name", ErrInvalidPath)
+			}
+			p = append(p, s[:end])
+			s = s[end:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: missing ]", ErrInvalidPath)
+			}
+			seg := s[1:end]
+			s = s[end+1:]
+			if len(seg) >= 2 && (seg[0] == '\'' || seg[0] == '"') && seg[len(seg)-1] == seg[0] {
+				p = append(p, seg[1:len(seg)-1])
+				continue
+			}
+			i, err := strconv.Atoi(seg)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid index %q", ErrInvalidPath, seg)
+			}
+			p = append(p, i)
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidPath, s[0])
+		}
+	}
+	return p, nil
+}
+
+// Get returns the value at p in doc.
+func (p Path) Get(doc any) (any, error) {
+	cur := doc
+	for _, seg := range p {
+		switch seg := seg.(type) {
+		case string:
+			obj, ok := cur.(map[string]any)
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			if cur, ok = obj[seg]; !ok {
+				return nil, ErrPathNotFound
+			}
+		case int:
+			arr, ok := cur.([]any)
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			if seg < 0 {
+				seg += len(arr)
+			}
+			if seg < 0 || seg >= len(arr) {
+				return nil, ErrPathNotFound
+			}
+			cur = arr[seg]
+		}
+	}
+	return cur, nil
+}
+
+func (p Path) String() string {
+	var sb strings.Builder
+	sb.WriteByte('$')
+	for _, seg := range p {
+		switch seg := seg.(type) {
+		case string:
+			sb.WriteByte('.')
+			sb.WriteString(seg)
+		case int:
+			sb.WriteByte('[')
+			sb.WriteString(strconv.Itoa(seg))
+			sb.WriteByte(']')
+		}
+	}
+	return sb.String()
+}
+
+// Equal reports whether a and b are the same JSON value, numbers are
+// compared by value.
+func Equal(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, av := range a {
+			bv, ok := b[k]
+			if !ok || !Equal(av, bv) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !Equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		af, err1 := a.Float64()
+		bf, err2 := b.Float64()
+		return err1 == nil && err2 == nil && af == bf
+	default:
+		return a == b
+	}
+}
+
+func deepCopy(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case []any:
+		arr := make([]any, len(v))
+		for i, e := range v {
+			arr[i] = deepCopy(e)
+		}
+		return arr
+	default:
+		return v
+	}
+}
@@ -0,0 +1,94 @@
+package jsondoc_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/maolonglong/kvdb/pkg/jsondoc"
+)
+
+func TestPath(t *testing.T) {
+	doc, err := jsondoc.Decode([]byte(`{"a":{"b c":[1,{"d":true}]},"e":null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path    string
+		want    string
+		wantErr error
+	}{
+		{path: "$", want: `{"a":{"b c":[1,{"d":true}]},"e":null}`},
+		{path: "$.a['b c'][0]", want: `1`},
+		{path: `$.a["b c"][1].d`, want: `true`},
+		{path: "$.a['b c'][-1]", want: `{"d":true}`},
+		{path: "$.e", want: `null`},
+		{path: "$.a['b c'][2]", wantErr: jsondoc.ErrPathNotFound},
+		{path: "$.a['b c'][-3]", wantErr: jsondoc.ErrPathNotFound},
+		{path: "$.missing", wantErr: jsondoc.ErrPathNotFound},
+		{path: "$.e.f", wantErr: jsondoc.ErrPathNotFound},
+		{path: "a", wantErr: jsondoc.ErrInvalidPath},
+		{path: "$.", wantErr: jsondoc.ErrInvalidPath},
+		{path: "$[0", wantErr: jsondoc.ErrInvalidPath},
+		{path: "$[x]", wantErr: jsondoc.ErrInvalidPath},
+		{path: "$a", wantErr: jsondoc.ErrInvalidPath},
+	}
+	for _, tt := range tests {
+		p, err := jsondoc.ParsePath(tt.path)
+		var v any
+		if err == nil {
+			v, err = p.Get(doc)
+		}
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: error = %v, want %v", tt.path, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		got, err := jsondoc.Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	p, err := jsondoc.ParsePath("$.a['b']['c'][2]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.String(); got != "$.a.b.c[2]" {
+		t.Errorf("String = %s", got)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{`1`, `1.0`, true},
+		{`1`, `"1"`, false},
+		{`{"a":[1,{"b":null}]}`, `{"a":[1e0,{"b":null}]}`, true},
+		{`{"a":1}`, `{"a":1,"b":2}`, false},
+		{`[1,2]`, `[2,1]`, false},
+		{`null`, `false`, false},
+	}
+	for _, tt := range tests {
+		a, err := jsondoc.Decode([]byte(tt.a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := jsondoc.Decode([]byte(tt.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := jsondoc.Equal(a, b); got != tt.want {
+			t.Errorf("Equal(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package jsondoc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type patchOp struct {
+	Op   string  `json:"op"`
+	Path *string `json:"path"`
+	From *string `json:"from"`
+	// A null value is decoded as "null", so an empty Value is a missing one.
+	Value json.RawMessage `json:"value"`
+}
+
+// Patch applies a JSON Patch (RFC 6902) to doc. Either all operations are
+// applied or an error is returned.
+func Patch(doc, patch []byte) ([]byte, error) {
+	v, err := Decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []*patchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	for i, op := range ops {
+		v, err = applyOp(v, op)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return Encode(v)
+}
+
+// MergePatch applies a JSON Merge Patch (RFC 7386) to doc.
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	v, err := Decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	return Encode(mergePatch(v, p))
+}
+
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+func applyOp(doc any, op *patchOp) (any, error) {
+	if op.Path == nil {
+		return nil, fmt.Errorf("%w: missing path", ErrInvalidPatch)
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	value := func() (any, error) {
+		if len(op.Value) == 0 {
+			return nil, fmt.Errorf("%w: missing value", ErrInvalidPatch)
+		}
+		return Decode(op.Value)
+	}
+	from := func() ([]string, error) {
+		if op.From == nil {
+			return nil, fmt.Errorf("%w: missing from", ErrInvalidPatch)
+		}
+		return parsePointer(*op.From)
+	}
+
+	switch op.Op {
+	case "add":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, v)
+	case "remove":
+		doc, _, err := pointerRemove(doc, path)
+		return doc, err
+	case "replace":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pointerGet(doc, path); err != nil {
+			return nil, err
+		}
+		if doc, _, err = pointerRemove(doc, path); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, v)
+	case "move":
+		fromPath, err := from()
+		if err != nil {
+			return nil, err
+		}
+		if isPrefix(fromPath, path) && len(fromPath) < len(path) {
+			return nil, fmt.Errorf("%w: cannot move a value into itself", ErrInvalidPatch)
+		}
+		doc, v, err := pointerRemove(doc, fromPath)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, v)
+	case "copy":
+		fromPath, err := from()
+		if err != nil {
+			return nil, err
+		}
+		v, err := pointerGet(doc, fromPath)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, deepCopy(v))
+	case "test":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		cur, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !Equal(cur, v) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown op %q", ErrInvalidPatch, op.Op)
+	}
+}
+
+// parsePointer parses a JSON Pointer (RFC 6901).
+func parsePointer(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if s[0] != '/' {
+		return nil, fmt.Errorf("%w: pointer %q must start with /", ErrInvalidPath, s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses an array index token, end allows the index one past the
+// last element ("-" or len(arr)).
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if token == "-" && end {
+		return n, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, ErrPathNotFound
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > n || (i == n && !end) {
+		return 0, ErrPathNotFound
+	}
+	return i, nil
+}
+
+func pointerGet(doc any, path []string) (any, error) {
+	cur := doc
+	for _, token := range path {
+		switch c := cur.(type) {
+		case map[string]any:
+			v, ok := c[token]
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			cur = v
+		case []any:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			cur = c[i]
+		default:
+			return nil, ErrPathNotFound
+		}
+	}
+	return cur, nil
+}
+
+// update calls fn with the parent container of the last token of path and
+// stores the container returned by fn back into doc.
+func update(doc any, path []string, fn func(parent any, token string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	switch c := doc.(type) {
+	case map[string]any:
+		child, ok := c[path[0]]
+		if !ok {
+			return nil, ErrPathNotFound
+		}
+		v, err := update(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[path[0]] = v
+		return c, nil
+	case []any:
+		i, err := arrayIndex(path[0], len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		v, err := update(c[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = v
+		return c, nil
+	default:
+		return nil, ErrPathNotFound
+	}
+}
+
+func pointerAdd(doc any, path []string, val any) (any, error) {
+	if len(path) == 0 {
+		return val, nil
+	}
+	return update(doc, path, func(parent any, token string) (any, error) {
+		switch c := parent.(type) {
+		case map[string]any:
+			c[token] = val
+			return c, nil
+		case []any:
+			i, err := arrayIndex(token, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = val
+			return c, nil
+		default:
+			return nil, ErrPathNotFound
+		}
+	})
+}
+
+func pointerRemove(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	var removed any
+	doc, err := update(doc, path, func(parent any, token string) (any, error) {
+		switch c := parent.(type) {
+		case map[string]any:
+			v, ok := c[token]
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			removed = v
+			delete(c, token)
+			return c, nil
+		case []any:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = c[i]
+			return append(c[:i], c[i+1:]...), nil
+		default:
+			return nil, ErrPathNotFound
+		}
+	})
+	return doc, removed, err
+}
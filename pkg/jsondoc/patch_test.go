@@ -0,0 +1,185 @@
+package jsondoc_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/maolonglong/kvdb/pkg/jsondoc"
+)
+
+func TestPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		patch   string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "add member",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"add","path":"/b","value":2}]`,
+			want:  `{"a":1,"b":2}`,
+		},
+		{
+			name:  "add null",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"add","path":"/b","value":null}]`,
+			want:  `{"a":1,"b":null}`,
+		},
+		{
+			name:  "replace with null",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"replace","path":"/a","value":null}]`,
+			want:  `{"a":null}`,
+		},
+		{
+			name:  "test null",
+			doc:   `{"a":null}`,
+			patch: `[{"op":"test","path":"/a","value":null}]`,
+			want:  `{"a":null}`,
+		},
+		{
+			name:    "missing value",
+			doc:     `{"a":1}`,
+			patch:   `[{"op":"add","path":"/b"}]`,
+			wantErr: jsondoc.ErrInvalidPatch,
+		},
+		{
+			name:  "add to array",
+			doc:   `{"a":[1,3]}`,
+			patch: `[{"op":"add","path":"/a/1","value":2},{"op":"add","path":"/a/-","value":4}]`,
+			want:  `{"a":[1,2,3,4]}`,
+		},
+		{
+			name:  "replace root",
+			doc:   `{"a":1}`,
+			patch: `[{"op":"replace","path":"","value":[1]}]`,
+			want:  `[1]`,
+		},
+		{
+			name:  "remove",
+			doc:   `{"a":[1,2],"b":1}`,
+			patch: `[{"op":"remove","path":"/a/0"},{"op":"remove","path":"/b"}]`,
+			want:  `{"a":[2]}`,
+		},
+		{
+			name:    "remove missing",
+			doc:     `{"a":1}`,
+			patch:   `[{"op":"remove","path":"/b"}]`,
+			wantErr: jsondoc.ErrPathNotFound,
+		},
+		{
+			name:  "move",
+			doc:   `{"a":{"b":1}}`,
+			patch: `[{"op":"move","from":"/a/b","path":"/c"}]`,
+			want:  `{"a":{},"c":1}`,
+		},
+		{
+			name:    "move into itself",
+			doc:     `{"a":{"b":1}}`,
+			patch:   `[{"op":"move","from":"/a","path":"/a/b"}]`,
+			wantErr: jsondoc.ErrInvalidPatch,
+		},
+		{
+			name:  "copy",
+			doc:   `{"a":{"b":1}}`,
+			patch: `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b","value":2}]`,
+			want:  `{"a":{"b":1},"c":{"b":2}}`,
+		},
+		{
+			name:  "escaped pointer",
+			doc:   `{"a/b":1,"c~d":2}`,
+			patch: `[{"op":"remove","path":"/a~1b"},{"op":"remove","path":"/c~0d"}]`,
+			want:  `{}`,
+		},
+		{
+			name:  "test numbers by value",
+			doc:   `{"a":1.0}`,
+			patch: `[{"op":"test","path":"/a","value":1}]`,
+			want:  `{"a":1.0}`,
+		},
+		{
+			name:    "test failed",
+			doc:     `{"a":1}`,
+			patch:   `[{"op":"test","path":"/a","value":2}]`,
+			wantErr: jsondoc.ErrTestFailed,
+		},
+		{
+			name:    "atomic",
+			doc:     `{"a":1}`,
+			patch:   `[{"op":"add","path":"/b","value":2},{"op":"remove","path":"/c"}]`,
+			wantErr: jsondoc.ErrPathNotFound,
+		},
+		{
+			name:    "unknown op",
+			doc:     `{}`,
+			patch:   `[{"op":"nop","path":""}]`,
+			wantErr: jsondoc.ErrInvalidPatch,
+		},
+		{
+			name:    "missing path",
+			doc:     `{}`,
+			patch:   `[{"op":"remove"}]`,
+			wantErr: jsondoc.ErrInvalidPatch,
+		},
+		{
+			name:    "invalid pointer",
+			doc:     `{}`,
+			patch:   `[{"op":"remove","path":"a"}]`,
+			wantErr: jsondoc.ErrInvalidPath,
+		},
+		{
+			name:    "bad array index",
+			doc:     `[1]`,
+			patch:   `[{"op":"add","path":"/01","value":1}]`,
+			wantErr: jsondoc.ErrPathNotFound,
+		},
+		{
+			name:    "not a patch",
+			doc:     `{}`,
+			patch:   `{}`,
+			wantErr: jsondoc.ErrInvalidPatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jsondoc.Patch([]byte(tt.doc), []byte(tt.patch))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Patch error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Patch = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":1}`, `{"b":2}`, `{"a":1,"b":2}`},
+		{`{"a":1,"b":2}`, `{"a":null}`, `{"b":2}`},
+		{`{"a":{"b":1,"c":2}}`, `{"a":{"b":null,"d":3}}`, `{"a":{"c":2,"d":3}}`},
+		{`{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{`{"a":1}`, `[1]`, `[1]`},
+		{`[1]`, `{"a":1}`, `{"a":1}`},
+		{``, `{"a":1}`, `{"a":1}`},
+	}
+	for _, tt := range tests {
+		got, err := jsondoc.MergePatch([]byte(tt.doc), []byte(tt.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("MergePatch(%s, %s) = %s, want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+}